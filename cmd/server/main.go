@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,6 +16,7 @@ import (
 	"vertex2api-golang/internal/config"
 	"vertex2api-golang/internal/handlers"
 	"vertex2api-golang/internal/health"
+	"vertex2api-golang/internal/keys"
 	"vertex2api-golang/internal/models"
 )
 
@@ -26,69 +30,100 @@ func main() {
 		log.Println("Loaded .env file")
 	}
 
+	// Optional JSON config file; environment variables take precedence
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := config.LoadConfigFile(path); err != nil {
+			log.Fatalf("Failed to load CONFIG_FILE: %v", err)
+		}
+		log.Printf("Loaded config file %s", path)
+	}
+
 	// Load configuration
 	cfg := config.Load()
 
-	// Validate configuration
-	if len(cfg.VertexExpressAPIKeys) == 0 {
-		log.Fatal("VERTEX_EXPRESS_API_KEY is required")
+	// Load keys from KEY_SOURCE and validate configuration
+	keyCount := keys.GetManager().KeyCount()
+	if cfg.EchoMode {
+		log.Printf("ECHO_MODE enabled: chat completions are answered locally without calling Vertex")
+	} else if keyCount == 0 {
+		log.Fatalf("No Express API keys loaded (KEY_SOURCE=%s); set VERTEX_EXPRESS_API_KEY or KEY_FILE", cfg.KeySource)
+	}
+	if cfg.PinnedKeyIndex >= keyCount || cfg.PinnedKeyIndex < -1 {
+		log.Fatalf("PINNED_KEY_INDEX=%d is out of range (keys=%d)", cfg.PinnedKeyIndex, keyCount)
+	}
+	if cfg.ExposeKeyIndex && !cfg.DebugMode {
+		log.Printf("EXPOSE_KEY_INDEX is ignored unless DEBUG_MODE is also enabled")
+	}
+	if cfg.PinnedKeyIndex >= 0 {
+		log.Printf("Key rotation disabled: pinned to key_index=%d", cfg.PinnedKeyIndex)
 	}
 
 	log.Printf("Configuration loaded: port=%s, keys=%d, roundrobin=%v, location=%s",
-		cfg.AppPort, len(cfg.VertexExpressAPIKeys), cfg.RoundRobin, cfg.GCPLocation)
+		cfg.AppPort, keyCount, cfg.RoundRobin, cfg.GCPLocation)
 
 	// Initialize models
 	models.Initialize()
 
 	// Initialize handlers (must be after config is loaded)
 	handlers.InitClient()
+	health.SetStreamGauge(handlers.StreamGauge)
 
-	// Setup routes
-	mux := http.NewServeMux()
-
-	// Health check (no auth)
-	mux.HandleFunc("/health", health.Handler())
+	// Probe benched keys in the background so requests only use healthy keys
+	proberCtx, stopProber := context.WithCancel(context.Background())
+	defer stopProber()
+	keys.GetManager().StartProber(proberCtx)
+	keys.GetManager().StartKeyRefresh(proberCtx)
+	health.StartDeepProbe(proberCtx)
+	handlers.StartFileSweeper(proberCtx)
 
-	// OpenAI compatible endpoints
-	mux.HandleFunc("/v1/models", handlers.ModelsHandler)
-	mux.HandleFunc("/v1/chat/completions", handlers.ChatCompletionsHandler)
-
-	// Gemini native endpoints
-	mux.HandleFunc("/gemini/v1beta/models", handlers.GeminiModelsHandler)
-	mux.HandleFunc("/gemini/v1beta/", handlers.GeminiHandler)
-
-	// Root redirect to health
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			http.Redirect(w, r, "/health", http.StatusFound)
-			return
-		}
-		http.NotFound(w, r)
-	})
+	// Setup routes
+	mux, adminMux := newRoutes(cfg.AdminPort != "")
 
 	// Apply middleware
-	handler := loggingMiddleware(corsMiddleware(auth.Middleware(mux)))
+	wrap := func(h http.Handler) http.Handler {
+		return loggingMiddleware(corsMiddleware(auth.Middleware(handlers.DecompressRequest(handlers.RequireJSON(handlers.RequestTimeout(h))))))
+	}
 
-	// Create server
+	// Create servers
 	server := &http.Server{
 		Addr:         ":" + cfg.AppPort,
-		Handler:      handler,
+		Handler:      wrap(mux),
 		ReadTimeout:  120 * time.Second,
 		WriteTimeout: 120 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	var adminServer *http.Server
+	if cfg.AdminPort != "" {
+		adminServer = &http.Server{
+			Addr:         ":" + cfg.AdminPort,
+			Handler:      wrap(adminMux),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		}
+	}
 
-	// Start server in goroutine
+	// Start servers in goroutines
 	go func() {
 		log.Printf("Server listening on port %s", cfg.AppPort)
-		log.Printf("OpenAI endpoints: /v1/chat/completions, /v1/models")
+		log.Printf("OpenAI endpoints: /v1/chat/completions, /v1/responses, /v1/embeddings, /v1/models")
 		log.Printf("Gemini endpoints: /gemini/v1beta/models/{model}:generateContent")
-		log.Printf("Health endpoint: /health")
+		if adminServer == nil {
+			log.Printf("Health endpoint: /health")
+		}
 
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
+	if adminServer != nil {
+		go func() {
+			log.Printf("Admin server listening on port %s: /health, /admin/*, /debug/*", cfg.AdminPort)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Admin server error: %v", err)
+			}
+		}()
+	}
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
@@ -96,31 +131,151 @@ func main() {
 	<-quit
 
 	log.Println("Shutting down server...")
+	health.SetShuttingDown()
+
+	// Keep serving while load balancers see the failing health check and
+	// stop routing here; closing the listener first would refuse requests
+	// still being sent our way
+	if delay := time.Duration(config.Get().ShutdownReadinessDelaySec) * time.Second; delay > 0 {
+		log.Printf("Waiting %v for load balancers to stop routing traffic...", delay)
+		time.Sleep(delay)
+	}
+
+	// Stop accepting new requests; Shutdown waits for in-flight connections
+	// (including streams) and gets a little extra time beyond the stream grace
+	// period so terminated streams can write their final event
+	grace := time.Duration(cfg.ShutdownGraceSeconds) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace+10*time.Second)
+	defer cancel()
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- server.Shutdown(shutdownCtx)
+	}()
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), grace)
+	defer drainCancel()
+	if active := handlers.ActiveStreams(); active > 0 {
+		log.Printf("Draining %d active streams (grace period %v)...", active, grace)
+	}
+	drained := handlers.DrainStreams(drainCtx)
+	log.Printf("Drained %d streams", drained)
+
+	if err := <-shutdownDone; err != nil {
+		log.Printf("Server shutdown error: %v", err)
+	}
+	if adminServer != nil {
+		// Health stays reachable while the API drains, then goes down too
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Admin server shutdown error: %v", err)
+		}
+	}
+	handlers.CloseAuditLog()
+	log.Println("Server stopped")
+}
+
+// newRoutes registers the endpoints. With separateAdmin (ADMIN_PORT set),
+// health, admin and debug endpoints go on their own mux for a second
+// listener so the public port serves only the API; otherwise both muxes
+// are the same.
+func newRoutes(separateAdmin bool) (mux, adminMux *http.ServeMux) {
+	mux = http.NewServeMux()
+	adminMux = mux
+	if separateAdmin {
+		adminMux = http.NewServeMux()
+	}
+
+	// Health check (no auth)
+	adminMux.HandleFunc("/health", health.Handler())
+
+	// OpenAI compatible endpoints
+	mux.HandleFunc("/v1/models", handlers.ModelsHandler)
+	mux.HandleFunc("/v1/chat/completions", handlers.ChatCompletionsHandler)
+	mux.HandleFunc("/v1/embeddings", handlers.EmbeddingsHandler)
+	mux.HandleFunc("/v1/responses", handlers.ResponsesHandler)
+	mux.HandleFunc("/v1/streams/", handlers.StreamCancelHandler)
+	mux.HandleFunc("/v1/files/", handlers.FileHandler)
+
+	// Gemini native endpoints
+	mux.HandleFunc("/gemini/v1beta/models", handlers.GeminiModelsHandler)
+	mux.HandleFunc("/gemini/v1beta/", handlers.GeminiHandler)
+
+	// Admin endpoints (require API_KEY)
+	adminMux.HandleFunc("/admin/config", handlers.ConfigHandler)
+	adminMux.HandleFunc("/admin/config/reload", handlers.ConfigReloadHandler)
+
+	// Translation preview (DEBUG_MODE only)
+	adminMux.HandleFunc("/debug/translate", handlers.DebugTranslateHandler)
+
+	// Root redirect to health
+	adminMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/health", http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	return mux, adminMux
 }
 
-// loggingMiddleware logs incoming requests
+// loggingMiddleware logs incoming requests, sampled by LOG_SAMPLE_RATE
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		// Create response wrapper to capture status code
+		// Create response wrapper to capture status code and response size
 		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		var body *countingReader
+		if r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
 
 		next.ServeHTTP(rw, r)
 
+		var requestBytes int64
+		if body != nil {
+			requestBytes = body.n
+		}
+		health.RecordSizes(requestBytes, rw.bytesWritten)
+		if limit := config.Get().SizeWarnBytes; limit > 0 && (requestBytes > limit || rw.bytesWritten > limit) {
+			log.Printf("Large request: %s %s request_bytes=%d response_bytes=%d (SIZE_WARN_BYTES=%d)",
+				r.Method, r.URL.Path, requestBytes, rw.bytesWritten, limit)
+		}
+
+		// Errors are always logged; successful requests are sampled
+		if rw.statusCode < http.StatusBadRequest && !sampleLog(config.Get().LogSampleRate) {
+			return
+		}
+
 		// Log request
-		log.Printf("%s %s %d %v",
+		log.Printf("%s %s %d %v req=%dB resp=%dB",
 			r.Method,
 			r.URL.Path,
 			rw.statusCode,
 			time.Since(start),
+			requestBytes,
+			rw.bytesWritten,
 		)
 	})
 }
 
+// sampleLog reports whether a request should be logged at the given rate
+func sampleLog(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return rand.Float64() < rate
+}
+
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int64 // body bytes written, including streamed events
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -128,6 +283,24 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
+// countingReader counts request body bytes as handlers read them
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
 // Flush implements http.Flusher for streaming support
 func (rw *responseWriter) Flush() {
 	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
@@ -135,6 +308,11 @@ func (rw *responseWriter) Flush() {
 	}
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // corsMiddleware handles CORS headers
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -145,7 +323,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization, X-Goog-Api-Key, Last-Event-ID, X-Vertex-Labels, X-Request-Timeout, X-Gen-Temperature, X-Gen-Max-Tokens, X-Gen-Thinking-Budget, X-Force-Buffer")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
@@ -156,7 +334,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 		// Special handling for SSE
 		if strings.Contains(r.URL.Path, "chat/completions") {
-			w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Type, x-ratelimit-limit-requests, x-ratelimit-remaining-requests, x-ratelimit-reset-requests")
 		}
 
 		next.ServeHTTP(w, r)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/health"
+)
+
+func TestAdminPortRoutes(t *testing.T) {
+	tests := []struct {
+		name          string
+		separateAdmin bool
+		path          string
+		wantAPI       int // status on the public port
+		wantAdmin     int // status on the admin port
+	}{
+		{"health on the admin port", true, "/health", http.StatusNotFound, http.StatusOK},
+		{"API on the public port", true, "/v1/models", http.StatusOK, http.StatusNotFound},
+		{"root redirect on the admin port", true, "/", http.StatusNotFound, http.StatusFound},
+		{"single port serves health", false, "/health", http.StatusOK, http.StatusOK},
+		{"single port serves the API", false, "/v1/models", http.StatusOK, http.StatusOK},
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, adminMux := newRoutes(tt.separateAdmin)
+			api := httptest.NewServer(mux)
+			defer api.Close()
+			admin := httptest.NewServer(adminMux)
+			defer admin.Close()
+
+			for _, port := range []struct {
+				name string
+				url  string
+				want int
+			}{
+				{"public", api.URL, tt.wantAPI},
+				{"admin", admin.URL, tt.wantAdmin},
+			} {
+				resp, err := client.Get(port.url + tt.path)
+				if err != nil {
+					t.Fatalf("GET %s on the %s port: %v", tt.path, port.name, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != port.want {
+					t.Errorf("GET %s on the %s port = %d, want %d", tt.path, port.name, resp.StatusCode, port.want)
+				}
+			}
+		})
+	}
+}
+
+// healthSizes reads the size histograms from /health
+func healthSizes(t *testing.T) health.SizeStats {
+	t.Helper()
+	w := httptest.NewRecorder()
+	health.Handler()(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var resp health.HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Sizes == nil {
+		return health.SizeStats{}
+	}
+	return *resp.Sizes
+}
+
+func TestLoggingMiddlewareSizes(t *testing.T) {
+	prev := config.Get()
+	next := *prev
+	next.SizeWarnBytes = 2048
+	next.LogSampleRate = 1
+	config.Override(&next)
+	defer config.Override(prev)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	before := healthSizes(t)
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// Streamed in flushed pieces, as SSE responses are
+		for range 3 {
+			w.Write(bytes.Repeat([]byte("x"), 1000))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(strings.Repeat("y", 100))))
+
+	after := healthSizes(t)
+	if after.Request.Count != before.Request.Count+1 || after.Request.Sum-before.Request.Sum != 100 {
+		t.Errorf("request histogram = %+v (before %+v), want one 100-byte request", after.Request, before.Request)
+	}
+	if after.Response.Sum-before.Response.Sum != 3000 || after.Response.Max < 3000 {
+		t.Errorf("response histogram = %+v (before %+v), want one 3000-byte response", after.Response, before.Response)
+	}
+	if !strings.Contains(logs.String(), "Large request: POST /v1/chat/completions request_bytes=100 response_bytes=3000") {
+		t.Errorf("no size warning above SIZE_WARN_BYTES:\n%s", logs.String())
+	}
+}
+
+func TestResponseWriterCountsBytes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := &responseWriter{ResponseWriter: rec, statusCode: http.StatusOK}
+	rw.WriteHeader(http.StatusAccepted)
+	for _, event := range []string{"data: one\n\n", "data: two\n\n"} {
+		io.WriteString(rw, event)
+		rw.Flush()
+	}
+	fmt.Fprintf(rw, "data: %s\n\n", "[DONE]")
+
+	if want := int64(rec.Body.Len()); rw.bytesWritten != want || want == 0 {
+		t.Errorf("bytesWritten = %d, want %d", rw.bytesWritten, want)
+	}
+	if !rec.Flushed {
+		t.Error("Flush did not reach the underlying writer")
+	}
+	if rw.statusCode != http.StatusAccepted || rec.Code != http.StatusAccepted {
+		t.Errorf("status = %d (recorded %d), want 202", rw.statusCode, rec.Code)
+	}
+
+	// The request log line carries the count
+	prev := config.Get()
+	next := *prev
+	next.LogSampleRate = 1
+	config.Override(&next)
+	defer config.Override(prev)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if !strings.Contains(logs.String(), "GET /v1/models 200") || !strings.Contains(logs.String(), "resp=5B") {
+		t.Errorf("request log line has no response size:\n%s", logs.String())
+	}
+}
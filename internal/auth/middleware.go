@@ -28,7 +28,7 @@ func Middleware(next http.Handler) http.Handler {
 		}
 
 		// Extract API key from various sources
-		apiKey := extractAPIKey(r)
+		apiKey := ExtractAPIKey(r)
 
 		if apiKey == "" || apiKey != cfg.APIKey {
 			sendAuthError(w, "Invalid API key")
@@ -39,9 +39,9 @@ func Middleware(next http.Handler) http.Handler {
 	})
 }
 
-// extractAPIKey extracts API key from request
+// ExtractAPIKey extracts API key from request
 // Supports: Authorization Bearer, x-goog-api-key header, URL query param
-func extractAPIKey(r *http.Request) string {
+func ExtractAPIKey(r *http.Request) string {
 	// Check Authorization header (Bearer token)
 	authHeader := r.Header.Get("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
@@ -4,19 +4,48 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // Config holds all application configuration
 type Config struct {
 	// Server
-	AppPort string
+	AppPort              string
+	AdminPort            string // Separate listener for health, admin and debug endpoints, "" = same port
+	ShutdownGraceSeconds int    // Time active streams get to finish on shutdown (alias SHUTDOWN_TIMEOUT_SECONDS)
+	RequestTimeoutSec    int    // Deadline for non-streaming requests, 0 = none
+	StreamTimeoutSec     int    // Deadline for streaming requests, 0 = none
+	MaxClientTimeoutSec  int    // Cap for X-Request-Timeout when no server deadline applies
+	MaxStreamDurationSec int    // End streams cleanly after this long, 0 = unlimited
+	// finish_reason of streams ended by MAX_STREAM_DURATION
+	MaxStreamFinishReason string
+	// Time /health reports shutting_down while still serving, before the listener closes
+	ShutdownReadinessDelaySec int
 
 	// Authentication
 	APIKey string
 
 	// Vertex Express Keys
 	VertexExpressAPIKeys []string
+	KeyProjects          map[string]string // API key -> project ID from "key:project" entries
 	RoundRobin           bool
+	PinnedKeyIndex       int    // Always use this key index (-1 = rotate)
+	SelectionStrategy    string // "" (ROUNDROBIN decides) or "adaptive"
+	KeySource            string // "env", "file", "secretmanager" or "vault"
+	KeyFile              string // Key file for KEY_SOURCE=file
+	KeyRefreshSeconds    int    // Re-read the key source at this interval, 0 = never
+	KeyDailyRequestLimit int    // Upstream requests per key per UTC day, 0 = unlimited
+	KeyDailyTokenLimit   int    // Tokens per key per UTC day, 0 = unlimited
+
+	// Deep health check (real upstream call)
+	DeepHealthIntervalSeconds int // 0 disables the deep probe
+	DeepHealthModel           string
+
+	// Key health probing
+	KeyProbeIntervalSeconds int    // 0 disables the background prober
+	KeyProbeMethod          string // "discovery" or "count_tokens"
+	KeyProbeModel           string // Model used by the count_tokens probe
+	KeyCooldownSeconds      int    // Skip a throttled key this long instead of benching it, 0 = bench
 
 	// GCP Settings
 	GCPProjectID string
@@ -25,77 +54,284 @@ type Config struct {
 	// Retry Settings
 	RetryMax        int
 	RetryIntervalMS int
+	RetryDeadlineMS int  // Total retry time budget, 0 = unlimited
+	RetryOnEmpty    bool // Retry 200 responses with no content that were not blocked
 
 	// Models
 	ModelsConfigURL string
+	ModelMap        map[string]string // Client model name -> upstream model name
+	OAIModelPrefix  string            // Prefix for model IDs sent to the OpenAI-compatible endpoint
+	ModelFallbacks  map[string]string // Model -> fallback model on availability errors
+	// Model prefix -> maximum thinking budget
+	ThinkingBudgetLimits map[string]string
+	// Model prefix -> input token limit, used by AUTO_TRIM_CONTEXT
+	ContextWindowLimits map[string]string
+	// Model prefix -> Vertex location, overriding GCP_LOCATION per model
+	ModelLocations map[string]string
+	// Model prefix -> "|"-separated OpenAI parameters the model rejects
+	UnsupportedParams map[string]string
+	// Vertex API version used by every URL builder
+	VertexAPIVersion string
+	// Model prefix -> Vertex API version, overriding VERTEX_API_VERSION
+	ModelAPIVersions map[string]string
+	// Models clients may use: names or "prefix*" patterns, empty = all
+	AllowedModels []string
+	DeniedModels  []string
 
 	// Proxy & TLS
 	ProxyURL    string
 	SSLCertFile string
+	// Trust X-Forwarded-Proto from a reverse proxy when building URLs
+	TrustProxyHeaders bool
 
 	// Features
-	SafetyScore bool
+	SafetyScore     bool
+	AnnotationsMode string            // "citations", "all" (adds safety ratings) or "off"
+	SafetySettings  map[string]string // "family:CATEGORY" -> threshold overrides
+	JSONModeEnforce bool              // Validate json_object responses and retry once if invalid
+	// Normalize malformed message sequences before forwarding (default strict)
+	RepairConversation bool
+	// Trim oldest messages over the context window: "off", "drop_oldest" or "placeholder"
+	AutoTrimContext string
+	// EventSource reconnect interval sent at stream start, 0 = none
+	SSERetryMS int
+	// Synthesize approximate usage when upstream omits it
+	EstimateUsage bool
+	// Reasoning output shape: "flat" (reasoning_content) or "object" (reasoning.content)
+	ReasoningShape string
+
+	// Tool schema sanitizing: "lenient", "strict" or "off"
+	SchemaSanitizeMode string
+	// Maximum number of tools per request (Vertex function declaration limit)
+	MaxTools int
+	// Maximum size of media fetched from URLs in content parts
+	MediaFetchMaxBytes int64
+
+	// Gemini passthrough
+	AllowedGeminiActions []string
+
+	// Cost guardrail: max output tokens when the client sets none (0 = model default)
+	DefaultMaxOutputTokens int
+
+	// Default Vertex labels for billing attribution
+	VertexLabels map[string]string
+
+	// Rate limiting
+	RateLimitRPM     int // Requests per minute per client, 0 = unlimited
+	RateLimitUserRPM int // Requests per minute per OpenAI "user" of a client, 0 = unlimited
+
+	// Request validation
+	StrictContentType bool // Reject POST bodies without a Content-Type header
+	MaxDecompressedMB int  // Cap on gzip-decoded request bodies
+
+	// Response shaping
+	IDPrefix            string // Prefix for generated completion IDs
+	ReturnAllCandidates bool   // Return every upstream candidate even when the client did not ask for n>1
+	BillReasoningTokens bool   // Count reasoning tokens in completion_tokens and total_tokens
+
+	// Streaming
+	CoalesceEmptyChunks  bool // Drop stream chunks that carry no delta information
+	StreamCoalesceMS     int  // Merge content deltas for this long before writing, 0 = off
+	MaxConcurrentStreams int  // Streaming requests in flight at once, 0 = unlimited
+	ForceNonStreaming    bool // Answer stream=true requests with a single buffered response
+
+	// Generated images
+	ImageResponseMode   string // "inline" (data URLs) or "url" (/v1/files/{id})
+	ImageFileTTLSeconds int    // How long stored image files can be fetched
+	ImageFileMaxBytes   int64  // Total size of stored image files; the oldest are evicted beyond it
+
+	// Logging
+	LogSampleRate float64 // Fraction of successful requests to log (errors are always logged)
+	LogBodies     bool    // Log request bodies (may contain prompts and secrets)
+	LogBodyMax    int     // Truncate logged bodies to this many bytes
+	SizeWarnBytes int64   // Log a warning when a request or response body exceeds this size, 0 = off
+	AuditMode     string  // "off" or "hashed" (SHA-256 of prompt/response; raw text only with AuditStoreContent)
+	AuditFile     string  // Write audit records to this file instead of the log, gzip-compressed if it ends in ".gz"
+	// Let store=true requests add their prompt and response to audit records
+	AuditStoreContent bool
+
+	// Debugging
+	DebugMode           bool // Enables debug-only response extensions
+	EchoMode            bool // Answer chat completions locally by echoing the last user message
+	IncludeRawResponse  bool // Always attach the upstream OpenAI-compatible response as _raw (requires DebugMode)
+	ExposeKeyIndex      bool // Set X-Key-Index on responses (requires DebugMode)
+	StreamUsageEstimate bool // Add a running usage_estimate to stream chunks (requires DebugMode)
+
+	// Variable name -> value and source, see Effective
+	settings map[string]Setting
 }
 
-var cfg *Config
+// cfg holds the active configuration; Reload replaces it atomically
+var cfg atomic.Pointer[Config]
 
 // Load parses environment variables and returns Config
 func Load() *Config {
-	if cfg != nil {
-		return cfg
+	if c := cfg.Load(); c != nil {
+		return c
 	}
+	cfg.CompareAndSwap(nil, parse())
+	return cfg.Load()
+}
+
+// parse builds a Config from the current environment
+func parse() *Config {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = make(map[string]Setting)
+	defer func() { settings = nil }()
 
-	cfg = &Config{
-		AppPort:              getEnv("APP_PORT", "8080"),
-		APIKey:               getEnv("API_KEY", ""),
-		VertexExpressAPIKeys: parseKeys(getEnv("VERTEX_EXPRESS_API_KEY", "")),
-		RoundRobin:           getEnvBool("ROUNDROBIN", false),
-		GCPProjectID:         getEnv("GCP_PROJECT_ID", ""),
-		GCPLocation:          getEnv("GCP_LOCATION", "global"),
-		RetryMax:             getEnvInt("RETRY_MAX", 3),
-		RetryIntervalMS:      getEnvInt("RETRY_INTERVAL_MS", 1000),
-		ModelsConfigURL:      getEnv("MODELS_CONFIG_URL", ""),
-		ProxyURL:             getEnv("PROXY_URL", ""),
-		SSLCertFile:          getEnv("SSL_CERT_FILE", ""),
-		SafetyScore:          getEnvBool("SAFETY_SCORE", false),
+	apiKeys, keyProjects := ParseKeyProjects(getEnv("VERTEX_EXPRESS_API_KEY", ""))
+
+	c := &Config{
+		AppPort:                   getEnv("APP_PORT", "8080"),
+		AdminPort:                 getEnv("ADMIN_PORT", ""),
+		ShutdownGraceSeconds:      getEnvInt("SHUTDOWN_GRACE_SECONDS", getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30)),
+		ShutdownReadinessDelaySec: getEnvInt("SHUTDOWN_READINESS_DELAY_SECONDS", 5),
+		RequestTimeoutSec:         getEnvInt("REQUEST_TIMEOUT", 0),
+		StreamTimeoutSec:          getEnvInt("STREAM_REQUEST_TIMEOUT", 0),
+		MaxClientTimeoutSec:       getEnvInt("MAX_CLIENT_TIMEOUT", 600),
+		MaxStreamDurationSec:      getEnvInt("MAX_STREAM_DURATION", 0),
+		MaxStreamFinishReason:     getEnv("MAX_STREAM_FINISH_REASON", "length"),
+		APIKey:                    getEnv("API_KEY", ""),
+		VertexExpressAPIKeys:      apiKeys,
+		KeyProjects:               keyProjects,
+		RoundRobin:                getEnvBool("ROUNDROBIN", false),
+		PinnedKeyIndex:            getEnvInt("PINNED_KEY_INDEX", -1),
+		SelectionStrategy:         strings.ToLower(getEnv("SELECTION_STRATEGY", "")),
+		KeySource:                 strings.ToLower(getEnv("KEY_SOURCE", "env")),
+		KeyFile:                   getEnv("KEY_FILE", ""),
+		KeyRefreshSeconds:         getEnvInt("KEY_REFRESH_SECONDS", 0),
+		KeyDailyRequestLimit:      getEnvInt("KEY_DAILY_REQUEST_LIMIT", 0),
+		KeyDailyTokenLimit:        getEnvInt("KEY_DAILY_TOKEN_LIMIT", 0),
+		DeepHealthIntervalSeconds: getEnvInt("DEEP_HEALTH_INTERVAL_SECONDS", 0),
+		DeepHealthModel:           getEnv("DEEP_HEALTH_MODEL", "gemini-2.5-flash"),
+		KeyProbeIntervalSeconds:   getEnvInt("KEY_PROBE_INTERVAL_SECONDS", 30),
+		KeyProbeMethod:            getEnv("KEY_PROBE_METHOD", "discovery"),
+		KeyProbeModel:             getEnv("KEY_PROBE_MODEL", "gemini-2.5-flash"),
+		KeyCooldownSeconds:        getEnvInt("KEY_COOLDOWN_SECONDS", 0),
+		GCPProjectID:              getEnv("GCP_PROJECT_ID", ""),
+		GCPLocation:               getEnv("GCP_LOCATION", "global"),
+		RetryMax:                  getEnvInt("RETRY_MAX", 3),
+		RetryIntervalMS:           getEnvInt("RETRY_INTERVAL_MS", 1000),
+		RetryDeadlineMS:           getEnvInt("RETRY_DEADLINE_MS", 0),
+		RetryOnEmpty:              getEnvBool("RETRY_ON_EMPTY", false),
+		ModelsConfigURL:           getEnv("MODELS_CONFIG_URL", ""),
+		ModelMap:                  parseMap(getEnv("MODEL_MAP", "")),
+		OAIModelPrefix:            getEnv("OAI_MODEL_PREFIX", "google/"),
+		ModelFallbacks:            parseMap(getEnv("MODEL_FALLBACKS", "")),
+		ThinkingBudgetLimits:      parseMap(getEnv("THINKING_BUDGET_LIMITS", "")),
+		ContextWindowLimits:       parseMap(getEnv("CONTEXT_WINDOW_LIMITS", "")),
+		ModelLocations:            parseMap(getEnv("MODEL_LOCATIONS", "")),
+		UnsupportedParams:         parseMap(getEnv("UNSUPPORTED_PARAMS", "")),
+		VertexAPIVersion:          getEnv("VERTEX_API_VERSION", "v1beta1"),
+		ModelAPIVersions:          parseMap(getEnv("MODEL_API_VERSIONS", "")),
+		AllowedModels:             parseKeys(getEnv("ALLOWED_MODELS", "")),
+		DeniedModels:              parseKeys(getEnv("DENIED_MODELS", "")),
+		ProxyURL:                  getEnv("PROXY_URL", ""),
+		TrustProxyHeaders:         getEnvBool("TRUST_PROXY_HEADERS", false),
+		SSLCertFile:               getEnv("SSL_CERT_FILE", ""),
+		SafetyScore:               getEnvBool("SAFETY_SCORE", false),
+		AnnotationsMode:           strings.ToLower(getEnv("ANNOTATIONS_MODE", "citations")),
+		SafetySettings:            parseMap(getEnv("SAFETY_SETTINGS", "")),
+		JSONModeEnforce:           getEnvBool("JSON_MODE_ENFORCE", false),
+		RepairConversation:        getEnvBool("REPAIR_CONVERSATION", false),
+		AutoTrimContext:           strings.ToLower(getEnv("AUTO_TRIM_CONTEXT", "off")),
+		SSERetryMS:                getEnvInt("SSE_RETRY_MS", 3000),
+		EstimateUsage:             getEnvBool("ESTIMATE_USAGE", false),
+		ReasoningShape:            strings.ToLower(getEnv("REASONING_SHAPE", "flat")),
+		SchemaSanitizeMode:        strings.ToLower(getEnv("SCHEMA_SANITIZE_MODE", "lenient")),
+		MaxTools:                  getEnvInt("MAX_TOOLS", 128),
+		MediaFetchMaxBytes:        int64(getEnvInt("MEDIA_FETCH_MAX_BYTES", 20<<20)),
+		StrictContentType:         getEnvBool("STRICT_CONTENT_TYPE", false),
+		DefaultMaxOutputTokens:    getEnvInt("DEFAULT_MAX_OUTPUT_TOKENS", 0),
+		VertexLabels:              parseMap(getEnv("VERTEX_LABELS", "")),
+		RateLimitRPM:              getEnvInt("RATE_LIMIT_RPM", 0),
+		RateLimitUserRPM:          getEnvInt("RATE_LIMIT_USER_RPM", 0),
+		MaxDecompressedMB:         getEnvInt("MAX_DECOMPRESSED_MB", 32),
+		AllowedGeminiActions:      parseKeys(getEnv("ALLOWED_GEMINI_ACTIONS", "generateContent,streamGenerateContent,countTokens,embedContent,batchEmbedContents")),
+		IDPrefix:                  getEnv("ID_PREFIX", "chatcmpl-"),
+		ReturnAllCandidates:       getEnvBool("RETURN_ALL_CANDIDATES", false),
+		BillReasoningTokens:       getEnvBool("BILL_REASONING_TOKENS", true),
+		CoalesceEmptyChunks:       getEnvBool("COALESCE_EMPTY_CHUNKS", false),
+		StreamCoalesceMS:          getEnvInt("STREAM_COALESCE_MS", 0),
+		ForceNonStreaming:         getEnvBool("FORCE_NON_STREAMING", false),
+		MaxConcurrentStreams:      getEnvInt("MAX_CONCURRENT_STREAMS", 0),
+		ImageResponseMode:         strings.ToLower(getEnv("IMAGE_RESPONSE_MODE", "inline")),
+		ImageFileTTLSeconds:       getEnvInt("IMAGE_FILE_TTL_SECONDS", 600),
+		ImageFileMaxBytes:         int64(getEnvInt("IMAGE_FILE_MAX_BYTES", 256<<20)),
+		LogSampleRate:             getEnvFloat("LOG_SAMPLE_RATE", 1.0),
+		LogBodies:                 getEnvBool("LOG_BODIES", false),
+		LogBodyMax:                getEnvInt("LOG_BODY_MAX_BYTES", 1024),
+		SizeWarnBytes:             int64(getEnvInt("SIZE_WARN_BYTES", 10<<20)),
+		AuditMode:                 strings.ToLower(getEnv("AUDIT_MODE", "off")),
+		AuditFile:                 getEnv("AUDIT_FILE", ""),
+		AuditStoreContent:         getEnvBool("AUDIT_STORE_CONTENT", false),
+		DebugMode:                 getEnvBool("DEBUG_MODE", false),
+		IncludeRawResponse:        getEnvBool("INCLUDE_RAW_RESPONSE", false),
+		ExposeKeyIndex:            getEnvBool("EXPOSE_KEY_INDEX", false),
+		StreamUsageEstimate:       getEnvBool("STREAM_USAGE_ESTIMATE", false),
+		EchoMode:                  getEnvBool("ECHO_MODE", false),
 	}
+	c.settings = settings
+	return c
+}
 
-	return cfg
+// Override replaces the active configuration, for tests
+func Override(c *Config) {
+	cfg.Store(c)
 }
 
-// Get returns the current config (must call Load first)
+// Get returns the current config. Read it per request rather than caching it
+// so that values changed by Reload take effect.
 func Get() *Config {
-	if cfg == nil {
-		return Load()
+	if c := cfg.Load(); c != nil {
+		return c
 	}
-	return cfg
+	return Load()
 }
 
-func getEnv(key, defaultVal string) string {
+// lookupEnv returns an environment variable, falling back to CONFIG_FILE
+func lookupEnv(key string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
 	}
-	return defaultVal
+	return fileValue(key)
 }
 
-func getEnvBool(key string, defaultVal bool) bool {
-	val := os.Getenv(key)
+func getEnv(key, defaultVal string) string {
+	val := lookupEnv(key)
 	if val == "" {
-		return defaultVal
+		val = defaultVal
 	}
-	val = strings.ToLower(val)
-	return val == "true" || val == "1" || val == "yes"
+	recordSetting(key, val)
+	return val
+}
+
+func getEnvBool(key string, defaultVal bool) bool {
+	result := defaultVal
+	if val := strings.ToLower(lookupEnv(key)); val != "" {
+		result = val == "true" || val == "1" || val == "yes"
+	}
+	recordSetting(key, strconv.FormatBool(result))
+	return result
 }
 
 func getEnvInt(key string, defaultVal int) int {
-	val := os.Getenv(key)
-	if val == "" {
-		return defaultVal
+	result := defaultVal
+	if i, err := strconv.Atoi(lookupEnv(key)); err == nil {
+		result = i
 	}
-	if i, err := strconv.Atoi(val); err == nil {
-		return i
+	recordSetting(key, strconv.Itoa(result))
+	return result
+}
+
+func getEnvFloat(key string, defaultVal float64) float64 {
+	result := defaultVal
+	if f, err := strconv.ParseFloat(lookupEnv(key), 64); err == nil {
+		result = f
 	}
-	return defaultVal
+	recordSetting(key, strconv.FormatFloat(result, 'f', -1, 64))
+	return result
 }
 
 func parseKeys(s string) []string {
@@ -112,3 +348,40 @@ func parseKeys(s string) []string {
 	}
 	return result
 }
+
+// ParseKeyProjects parses comma-separated keys where each entry is either
+// "key" or "key:projectID", returning the keys and the per-key projects
+func ParseKeyProjects(s string) ([]string, map[string]string) {
+	entries := parseKeys(s)
+	keys := make([]string, 0, len(entries))
+	projects := make(map[string]string)
+	for _, entry := range entries {
+		key, project, found := strings.Cut(entry, ":")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		keys = append(keys, key)
+		if project = strings.TrimSpace(project); found && project != "" {
+			projects[key] = project
+		}
+	}
+	return keys, projects
+}
+
+// parseMap parses "a=b,c=d" into a map, skipping malformed entries
+func parseMap(s string) map[string]string {
+	result := make(map[string]string)
+	for _, entry := range parseKeys(s) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		from := strings.TrimSpace(parts[0])
+		to := strings.TrimSpace(parts[1])
+		if from != "" && to != "" {
+			result[from] = to
+		}
+	}
+	return result
+}
@@ -4,16 +4,30 @@ import (
 	"bufio"
 	"os"
 	"strings"
+	"sync"
+)
+
+var (
+	// envFile is the .env file loaded at startup, re-read by Reload
+	envFile string
+	// envFileKeys are the variables that were set from envFile rather than
+	// the real environment; only these are updated on reload
+	envFileKeys = make(map[string]bool)
+	envFileMu   sync.Mutex
 )
 
 // LoadEnvFile loads environment variables from .env file
 func LoadEnvFile(filename string) error {
+	envFileMu.Lock()
+	defer envFileMu.Unlock()
+
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	seen := make(map[string]bool)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -43,11 +57,27 @@ func LoadEnvFile(filename string) error {
 			}
 		}
 
-		// Only set if not already set in environment
-		if os.Getenv(key) == "" {
+		// Only set if not already set in environment (or set by this file before)
+		if os.Getenv(key) == "" || envFileKeys[key] {
 			os.Setenv(key, value)
+			envFileKeys[key] = true
+		}
+		seen[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Variables removed from the file since the last load fall back to defaults
+	if filename == envFile {
+		for key := range envFileKeys {
+			if !seen[key] {
+				os.Unsetenv(key)
+				delete(envFileKeys, key)
+			}
 		}
 	}
 
-	return scanner.Err()
+	envFile = filename
+	return nil
 }
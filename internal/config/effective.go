@@ -0,0 +1,102 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Effective configuration reporting.
+//
+// parse records, for every variable it reads, the value in effect and where
+// it came from: "env" (process environment), "dotenv" (.env file),
+// "config_file" (CONFIG_FILE) or "default". Effective returns that view with
+// secrets masked, for GET /admin/config.
+
+// Setting is one configuration variable as currently in effect
+type Setting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// restartOnlyVars are the variables behind the fields keepRestartOnly preserves
+var restartOnlyVars = []string{
+	"APP_PORT", "ADMIN_PORT", "SHUTDOWN_GRACE_SECONDS", "SHUTDOWN_TIMEOUT_SECONDS",
+	"VERTEX_EXPRESS_API_KEY", "ROUNDROBIN", "PINNED_KEY_INDEX",
+	"KEY_SOURCE", "KEY_FILE", "KEY_REFRESH_SECONDS",
+	"GCP_PROJECT_ID", "GCP_LOCATION", "PROXY_URL", "SSL_CERT_FILE",
+	"MODELS_CONFIG_URL",
+	"DEEP_HEALTH_INTERVAL_SECONDS", "DEEP_HEALTH_MODEL",
+	"KEY_PROBE_INTERVAL_SECONDS", "KEY_PROBE_METHOD",
+}
+
+var (
+	// settings collects the variables read by the parse in progress
+	settings   map[string]Setting
+	settingsMu sync.Mutex
+)
+
+// recordSetting notes a variable read by parse
+func recordSetting(key, value string) {
+	if settings == nil {
+		return
+	}
+
+	source := "default"
+	if os.Getenv(key) != "" {
+		source = "env"
+		envFileMu.Lock()
+		if envFileKeys[key] {
+			source = "dotenv"
+		}
+		envFileMu.Unlock()
+	} else if fileValue(key) != "" {
+		source = "config_file"
+	}
+	settings[key] = Setting{Value: value, Source: source}
+}
+
+// Effective returns the variables behind c with API keys and proxy
+// credentials masked. hideProjects also hides GCP project IDs.
+func (c *Config) Effective(hideProjects bool) map[string]Setting {
+	result := make(map[string]Setting, len(c.settings))
+	for key, s := range c.settings {
+		switch key {
+		case "API_KEY":
+			s.Value = maskSecret(s.Value)
+		case "VERTEX_EXPRESS_API_KEY":
+			entries := parseKeys(s.Value)
+			for i, entry := range entries {
+				key, project, found := strings.Cut(entry, ":")
+				entries[i] = maskSecret(strings.TrimSpace(key))
+				if found && !hideProjects {
+					entries[i] += ":" + strings.TrimSpace(project)
+				}
+			}
+			s.Value = strings.Join(entries, ",")
+		case "PROXY_URL":
+			if u, err := url.Parse(s.Value); err == nil && u.User != nil {
+				u.User = url.User("redacted")
+				s.Value = u.String()
+			}
+		case "GCP_PROJECT_ID":
+			if hideProjects && s.Value != "" {
+				s.Value = "[hidden]"
+			}
+		}
+		result[key] = s
+	}
+	return result
+}
+
+// maskSecret keeps the last four characters of long secrets
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 8 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Optional JSON or YAML configuration file (CONFIG_FILE).
+//
+// The file is a single object keyed by environment variable name; files named
+// *.yaml or *.yml are read as YAML, anything else as JSON. Its values
+// underlie the environment: a variable set in the environment (or .env) always
+// wins. Scalars are used as-is, arrays become comma-separated lists and
+// objects become "key=value" lists, matching the env formats:
+//
+//	{
+//	  "RETRY_MAX": 3,
+//	  "ROUNDROBIN": true,
+//	  "ALLOWED_GEMINI_ACTIONS": ["generateContent", "countTokens"],
+//	  "MODEL_MAP": {"gpt-4o": "gemini-2.5-pro"}
+//	}
+//
+// or, in YAML:
+//
+//	RETRY_MAX: 3
+//	ROUNDROBIN: true
+//	ALLOWED_GEMINI_ACTIONS: [generateContent, countTokens]
+//	MODEL_MAP:
+//	  gpt-4o: gemini-2.5-pro
+
+var (
+	configFile       string
+	configFileValues map[string]string
+	configFileMu     sync.RWMutex
+)
+
+// LoadConfigFile reads a JSON or YAML configuration file; Reload re-reads it
+func LoadConfigFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]any
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".yaml" || ext == ".yml" {
+		raw, err = parseYAMLConfig(data)
+	} else {
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", filename, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := configFileString(value)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %s: %w", filename, key, err)
+		}
+		values[key] = s
+	}
+
+	configFileMu.Lock()
+	configFile = filename
+	configFileValues = values
+	configFileMu.Unlock()
+	return nil
+}
+
+// fileValue returns the CONFIG_FILE value for an environment variable
+func fileValue(key string) string {
+	configFileMu.RLock()
+	defer configFileMu.RUnlock()
+	return configFileValues[key]
+}
+
+// configFileString converts a decoded JSON or YAML value to its environment
+// variable form
+func configFileString(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(v))
+		for _, k := range keys {
+			pairs = append(pairs, k+"="+fmt.Sprint(v[k]))
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// loadTestConfigFile writes a config file and loads it, restoring the
+// previous file values when the test ends
+func loadTestConfigFile(t *testing.T, name, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	configFileMu.RLock()
+	prevFile, prevValues := configFile, configFileValues
+	configFileMu.RUnlock()
+	t.Cleanup(func() {
+		configFileMu.Lock()
+		configFile, configFileValues = prevFile, prevValues
+		configFileMu.Unlock()
+	})
+
+	if err := LoadConfigFile(path); err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+}
+
+func TestLoadConfigFileFormats(t *testing.T) {
+	want := map[string]string{
+		"RETRY_MAX":              "5",
+		"ROUNDROBIN":             "true",
+		"ALLOWED_GEMINI_ACTIONS": "generateContent,countTokens",
+		"MODEL_MAP":              "gpt-4o=gemini-2.5-pro,o3=gemini-3-pro-preview",
+		"ID_PREFIX":              "chatcmpl-x # not a comment",
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			content: `{
+				"RETRY_MAX": 5,
+				"ROUNDROBIN": true,
+				"ALLOWED_GEMINI_ACTIONS": ["generateContent", "countTokens"],
+				"MODEL_MAP": {"o3": "gemini-3-pro-preview", "gpt-4o": "gemini-2.5-pro"},
+				"ID_PREFIX": "chatcmpl-x # not a comment"
+			}`,
+		},
+		{
+			name: "yaml flow",
+			file: "config.yaml",
+			content: `---
+# proxy settings
+RETRY_MAX: 5
+ROUNDROBIN: true   # rotate keys
+ALLOWED_GEMINI_ACTIONS: [generateContent, "countTokens"]
+MODEL_MAP: {o3: gemini-3-pro-preview, gpt-4o: gemini-2.5-pro}
+ID_PREFIX: "chatcmpl-x # not a comment"
+`,
+		},
+		{
+			name: "yaml block",
+			file: "config.yml",
+			content: `RETRY_MAX: '5'
+ROUNDROBIN: true
+ALLOWED_GEMINI_ACTIONS:
+  - generateContent
+  - countTokens
+
+MODEL_MAP:
+  # aliases
+  o3: gemini-3-pro-preview
+  gpt-4o: gemini-2.5-pro
+ID_PREFIX: 'chatcmpl-x # not a comment'
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfigFile(t, tt.file, tt.content)
+			for key, value := range want {
+				if got := fileValue(key); got != value {
+					t.Errorf("%s = %q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileRejectsInvalidYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"indented first line", "  RETRY_MAX: 3\n"},
+		{"missing colon", "RETRY_MAX 3\n"},
+		{"unterminated sequence", "ALLOWED_GEMINI_ACTIONS: [a, b\n"},
+		{"mixed block", "MODEL_MAP:\n  - a\n  b: c\n"},
+		{"anchor", "RETRY_MAX: &n 3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := LoadConfigFile(path); err == nil {
+				t.Errorf("LoadConfigFile(%q) succeeded, want an error", tt.content)
+			}
+		})
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"config.json", `{"RETRY_MAX": 5, "MODEL_MAP": {"a": "b"}}`},
+		{"config.yaml", "RETRY_MAX: 5\nMODEL_MAP:\n  a: b\n"},
+	}
+
+	tests := []struct {
+		name       string
+		env        string
+		wantRetry  int
+		wantSource string
+	}{
+		{"env wins over file", "7", 7, "env"},
+		{"file wins over default", "", 5, "config_file"},
+	}
+
+	for _, f := range files {
+		for _, tt := range tests {
+			t.Run(f.name+"/"+tt.name, func(t *testing.T) {
+				loadTestConfigFile(t, f.name, f.content)
+				t.Setenv("RETRY_MAX", tt.env)
+				t.Setenv("MODEL_MAP", "")
+				t.Setenv("RETRY_INTERVAL_MS", "")
+
+				c := parse()
+				if c.RetryMax != tt.wantRetry {
+					t.Errorf("RetryMax = %d, want %d", c.RetryMax, tt.wantRetry)
+				}
+				if got := c.settings["RETRY_MAX"].Source; got != tt.wantSource {
+					t.Errorf("RETRY_MAX source = %q, want %q", got, tt.wantSource)
+				}
+				if want := map[string]string{"a": "b"}; !reflect.DeepEqual(c.ModelMap, want) {
+					t.Errorf("ModelMap = %v, want %v", c.ModelMap, want)
+				}
+				// Not in the file or the environment: the default applies
+				if c.RetryIntervalMS != 1000 || c.settings["RETRY_INTERVAL_MS"].Source != "default" {
+					t.Errorf("RetryIntervalMS = %d (%s), want the default 1000",
+						c.RetryIntervalMS, c.settings["RETRY_INTERVAL_MS"].Source)
+				}
+			})
+		}
+	}
+}
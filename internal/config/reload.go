@@ -0,0 +1,78 @@
+package config
+
+// Runtime configuration reload.
+//
+// Reload re-reads the .env file and CONFIG_FILE loaded at startup and the
+// process environment and atomically swaps the active Config. Request paths
+// call Get() for every request, so most settings take effect immediately. Settings consumed once
+// at startup are restart-only and keep their current values:
+//
+//	APP_PORT, SHUTDOWN_GRACE_SECONDS
+//	VERTEX_EXPRESS_API_KEY, ROUNDROBIN, PINNED_KEY_INDEX
+//	KEY_SOURCE, KEY_FILE, KEY_REFRESH_SECONDS (the key file itself is re-read)
+//	GCP_PROJECT_ID, GCP_LOCATION, PROXY_URL, SSL_CERT_FILE
+//	MODELS_CONFIG_URL
+//	DEEP_HEALTH_INTERVAL_SECONDS, DEEP_HEALTH_MODEL
+//	KEY_PROBE_INTERVAL_SECONDS, KEY_PROBE_METHOD
+//
+// Everything else (retry settings, timeouts, thinking budget limits, model
+// map/prefix/fallbacks, safety and JSON mode, rate limits, labels, logging,
+// debug switches, ...) is hot-reloadable.
+
+// Reload re-reads the configuration and makes it active, returning the new
+// Config. Restart-only fields are carried over from the current Config.
+func Reload() (*Config, error) {
+	envFileMu.Lock()
+	filename := envFile
+	envFileMu.Unlock()
+
+	if filename != "" {
+		if err := LoadEnvFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	configFileMu.RLock()
+	filename = configFile
+	configFileMu.RUnlock()
+
+	if filename != "" {
+		if err := LoadConfigFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	old := Get()
+	next := parse()
+	next.keepRestartOnly(old)
+	cfg.Store(next)
+	return next, nil
+}
+
+// keepRestartOnly copies the fields that cannot change at runtime from old
+func (c *Config) keepRestartOnly(old *Config) {
+	c.AppPort = old.AppPort
+	c.AdminPort = old.AdminPort
+	c.ShutdownGraceSeconds = old.ShutdownGraceSeconds
+	c.VertexExpressAPIKeys = old.VertexExpressAPIKeys
+	c.KeyProjects = old.KeyProjects
+	c.RoundRobin = old.RoundRobin
+	c.PinnedKeyIndex = old.PinnedKeyIndex
+	c.KeySource = old.KeySource
+	c.KeyFile = old.KeyFile
+	c.KeyRefreshSeconds = old.KeyRefreshSeconds
+	c.GCPProjectID = old.GCPProjectID
+	c.GCPLocation = old.GCPLocation
+	c.ProxyURL = old.ProxyURL
+	c.SSLCertFile = old.SSLCertFile
+	c.ModelsConfigURL = old.ModelsConfigURL
+	c.DeepHealthIntervalSeconds = old.DeepHealthIntervalSeconds
+	c.DeepHealthModel = old.DeepHealthModel
+	c.KeyProbeIntervalSeconds = old.KeyProbeIntervalSeconds
+	c.KeyProbeMethod = old.KeyProbeMethod
+	for _, key := range restartOnlyVars {
+		if s, ok := old.settings[key]; ok {
+			c.settings[key] = s
+		}
+	}
+}
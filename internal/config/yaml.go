@@ -0,0 +1,242 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// YAML configuration files.
+//
+// The module has no dependencies, so CONFIG_FILE YAML support covers the
+// subset a flat configuration needs: a top-level mapping whose values are
+// scalars, flow ([a, b] / {k: v}) or block sequences of scalars, or block
+// mappings of scalars. Comments, blank lines and a leading "---" are ignored.
+// Anchors, multi-line strings and deeper nesting are rejected.
+
+// parseYAMLConfig parses a YAML configuration file into the same shape
+// json.Unmarshal produces for the JSON form
+func parseYAMLConfig(data []byte) (map[string]any, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	result := make(map[string]any)
+
+	for i := 0; i < len(lines); i++ {
+		line := stripYAMLComment(lines[i])
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: unexpected indentation", i+1)
+		}
+
+		key, rest, ok := splitYAMLPair(line)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"KEY: value\"", i+1)
+		}
+		if rest != "" {
+			value, err := parseYAMLValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			result[key] = value
+			continue
+		}
+
+		// A block sequence or mapping follows on indented lines
+		var block []string
+		for i+1 < len(lines) {
+			next := stripYAMLComment(lines[i+1])
+			if strings.TrimSpace(next) != "" && next[0] != ' ' && next[0] != '\t' {
+				break
+			}
+			i++
+			if strings.TrimSpace(next) != "" {
+				block = append(block, strings.TrimSpace(next))
+			}
+		}
+		value, err := parseYAMLBlock(block)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// parseYAMLBlock parses the trimmed lines of a block sequence or mapping; no
+// lines is a null value
+func parseYAMLBlock(block []string) (any, error) {
+	if len(block) == 0 {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(block[0], "-") {
+		items := make([]any, 0, len(block))
+		for _, line := range block {
+			item, ok := strings.CutPrefix(line, "-")
+			if !ok {
+				return nil, fmt.Errorf("mixed sequence and mapping entries")
+			}
+			value, err := parseYAMLScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	}
+
+	m := make(map[string]any, len(block))
+	for _, line := range block {
+		key, rest, ok := splitYAMLPair(line)
+		if !ok {
+			return nil, fmt.Errorf("expected \"key: value\", got %q", line)
+		}
+		value, err := parseYAMLScalar(rest)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// parseYAMLValue parses an inline value: a flow sequence, a flow mapping or
+// a scalar
+func parseYAMLValue(s string) (any, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		inner, ok := strings.CutSuffix(s[1:], "]")
+		if !ok {
+			return nil, fmt.Errorf("unterminated sequence %q", s)
+		}
+		items := make([]any, 0)
+		for _, part := range splitYAMLFlow(inner) {
+			value, err := parseYAMLScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+
+	case strings.HasPrefix(s, "{"):
+		inner, ok := strings.CutSuffix(s[1:], "}")
+		if !ok {
+			return nil, fmt.Errorf("unterminated mapping %q", s)
+		}
+		m := make(map[string]any)
+		for _, part := range splitYAMLFlow(inner) {
+			key, rest, ok := splitYAMLPair(part)
+			if !ok {
+				return nil, fmt.Errorf("expected \"key: value\", got %q", part)
+			}
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+	return parseYAMLScalar(s)
+}
+
+// parseYAMLScalar parses a plain, single-quoted or double-quoted scalar.
+// Plain scalars stay strings: the env parsers interpret them.
+func parseYAMLScalar(s string) (any, error) {
+	switch {
+	case s == "" || s == "~" || s == "null":
+		return nil, nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		inner, ok := strings.CutSuffix(s[1:], "'")
+		if !ok {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(inner, "''", "'"), nil
+	case strings.ContainsAny(s[:1], "[{&*!|>"):
+		return nil, fmt.Errorf("unsupported YAML value %q", s)
+	}
+	return s, nil
+}
+
+// splitYAMLPair splits "key: value" at the first ": " (or a trailing ":")
+// outside quotes
+func splitYAMLPair(s string) (key, value string, ok bool) {
+	idx := -1
+	for i, quote := 0, byte(0); i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' ' || s[i+1] == '\t'):
+			idx = i
+		}
+		if idx >= 0 {
+			break
+		}
+	}
+	if idx <= 0 {
+		return "", "", false
+	}
+	key = strings.TrimSpace(s[:idx])
+	if unquoted, err := parseYAMLScalar(key); err == nil {
+		if k, isString := unquoted.(string); isString {
+			key = k
+		}
+	}
+	return key, strings.TrimSpace(s[idx+1:]), true
+}
+
+// splitYAMLFlow splits the inside of a flow collection at commas outside quotes
+func splitYAMLFlow(s string) []string {
+	var parts []string
+	start := 0
+	for i, quote := 0, byte(0); i <= len(s); i++ {
+		if i < len(s) {
+			c := s[i]
+			if quote != 0 {
+				if c == quote {
+					quote = 0
+				}
+				continue
+			}
+			if c == '"' || c == '\'' {
+				quote = c
+				continue
+			}
+			if c != ',' {
+				continue
+			}
+		}
+		if part := strings.TrimSpace(s[start:i]); part != "" {
+			parts = append(parts, part)
+		}
+		start = i + 1
+	}
+	return parts
+}
+
+// stripYAMLComment removes a "#" comment that starts a line or follows
+// whitespace outside quotes, and trailing whitespace
+func stripYAMLComment(line string) string {
+	for i, quote := 0, byte(0); i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
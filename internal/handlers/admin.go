@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"vertex2api-golang/internal/config"
+)
+
+// configReloadResponse reports the outcome of a configuration reload
+type configReloadResponse struct {
+	Status string `json:"status"`
+}
+
+// ConfigReloadHandler handles POST /admin/config/reload. Admin endpoints are
+// only served when API_KEY is set, so the auth middleware protects them.
+func ConfigReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if config.Get().APIKey == "" {
+		sendError(w, http.StatusForbidden, "permission_denied", "Admin endpoints require API_KEY to be set")
+		return
+	}
+
+	if _, err := config.Reload(); err != nil {
+		log.Printf("ConfigReload failed: %v", err)
+		sendError(w, http.StatusInternalServerError, "server_error", "Failed to reload configuration: "+err.Error())
+		return
+	}
+	log.Printf("ConfigReload: configuration reloaded")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configReloadResponse{Status: "reloaded"})
+}
+
+// configResponse is the effective configuration keyed by variable name
+type configResponse struct {
+	Settings map[string]config.Setting `json:"settings"`
+}
+
+// ConfigHandler handles GET /admin/config, returning the configuration in
+// effect with secrets masked. ?hide_projects=true also hides project IDs.
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	cfg := config.Get()
+	if cfg.APIKey == "" {
+		sendError(w, http.StatusForbidden, "permission_denied", "Admin endpoints require API_KEY to be set")
+		return
+	}
+
+	hideProjects := strings.EqualFold(r.URL.Query().Get("hide_projects"), "true")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configResponse{Settings: cfg.Effective(hideProjects)})
+}
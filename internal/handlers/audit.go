@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/translate"
+)
+
+// Privacy-preserving audit records.
+//
+// With AUDIT_MODE=hashed every completed chat request logs one "Audit:" line
+// with the model, the hashed user, token counts and SHA-256 digests of the
+// prompt and the response. Identical prompts produce identical digests, so
+// duplicate or abusive traffic can be spotted without storing any content.
+// Content is only ever recorded when the operator sets AUDIT_STORE_CONTENT;
+// then requests sent with store=true have their prompt and response logged
+// in full as well. Otherwise store is ignored.
+//
+// AUDIT_FILE sends audit records to their own file, appended one per line
+// with a UTC timestamp, instead of the process log. A name ending in ".gz"
+// writes the file gzip-compressed; every run appends a new gzip member, which
+// gzip -d and zcat read as one stream. Records are flushed as they are
+// written, and CloseAuditLog finishes the member at shutdown.
+
+// auditRecord accumulates what is needed for one audit line. A nil record
+// means auditing is disabled; all methods are no-ops on nil.
+type auditRecord struct {
+	user             string
+	metadata         string
+	promptHash       string
+	prompt           []byte // kept only for store=true requests under AUDIT_STORE_CONTENT
+	response         strings.Builder
+	promptTokens     int
+	completionTokens int
+}
+
+// newAuditRecord starts an audit record for a request, or returns nil when
+// AUDIT_MODE is not "hashed"
+func newAuditRecord(ctx context.Context, user string, prompt []byte, store bool) *auditRecord {
+	cfg := config.Get()
+	if cfg.AuditMode != "hashed" {
+		return nil
+	}
+	a := &auditRecord{
+		user:       user,
+		metadata:   metadataTag(requestMetadata(ctx)),
+		promptHash: sha256Hex(prompt),
+	}
+	if store && cfg.AuditStoreContent {
+		a.prompt = prompt
+	}
+	return a
+}
+
+// addResponse appends generated text to the response digest input
+func (a *auditRecord) addResponse(text string) {
+	if a == nil {
+		return
+	}
+	a.response.WriteString(text)
+}
+
+// setUsage records token counts reported by upstream
+func (a *auditRecord) setUsage(promptTokens, completionTokens int) {
+	if a == nil {
+		return
+	}
+	a.promptTokens, a.completionTokens = promptTokens, completionTokens
+}
+
+// setStreamUsage records token counts from a stream chunk's usage, if any
+func (a *auditRecord) setStreamUsage(usage *translate.Usage) {
+	if usage == nil {
+		return
+	}
+	a.setUsage(usage.PromptTokens, usage.CompletionTokens)
+}
+
+// reset discards response data from a failed attempt before a retry
+func (a *auditRecord) reset() {
+	if a == nil {
+		return
+	}
+	a.response.Reset()
+	a.promptTokens, a.completionTokens = 0, 0
+}
+
+// write logs the audit line for the model that served the request
+func (a *auditRecord) write(model string) {
+	if a == nil {
+		return
+	}
+	response := a.response.String()
+	writeAudit("Audit: model=%s, user=%s, metadata=%s, prompt_sha256=%s, response_sha256=%s, prompt_tokens=%d, completion_tokens=%d",
+		model, a.user, a.metadata, a.promptHash, sha256Hex([]byte(response)), a.promptTokens, a.completionTokens)
+	if a.prompt != nil {
+		writeAudit("Audit body: model=%s, user=%s, prompt=%s, response=%q", model, a.user, a.prompt, response)
+	}
+}
+
+// auditFile is the open AUDIT_FILE; gz is nil for an uncompressed file
+type auditFile struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+var (
+	auditOut   *auditFile
+	auditOutMu sync.Mutex
+)
+
+// writeAudit writes one audit record to AUDIT_FILE, or to the log when no
+// file is configured or it cannot be written
+func writeAudit(format string, args ...any) {
+	path := config.Get().AuditFile
+	if path == "" {
+		log.Printf(format, args...)
+		return
+	}
+	line := time.Now().UTC().Format(time.RFC3339) + " " + fmt.Sprintf(format, args...) + "\n"
+
+	auditOutMu.Lock()
+	defer auditOutMu.Unlock()
+	if err := writeAuditLocked(path, line); err != nil {
+		log.Printf("Audit file error: path=%s, error=%v", path, err)
+		log.Printf(format, args...)
+	}
+}
+
+// writeAuditLocked appends a line to the audit file, (re)opening it when
+// AUDIT_FILE has changed. auditOutMu must be held.
+func writeAuditLocked(path, line string) error {
+	if auditOut != nil && auditOut.path != path {
+		closeAuditLocked()
+	}
+	if auditOut == nil {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		auditOut = &auditFile{path: path, file: file}
+		if strings.HasSuffix(path, ".gz") {
+			auditOut.gz = gzip.NewWriter(file)
+		}
+	}
+
+	if auditOut.gz == nil {
+		_, err := auditOut.file.WriteString(line)
+		return err
+	}
+	if _, err := auditOut.gz.Write([]byte(line)); err != nil {
+		return err
+	}
+	// Flush keeps the compression window, so records still compress well
+	return auditOut.gz.Flush()
+}
+
+// CloseAuditLog finishes and closes AUDIT_FILE, if open
+func CloseAuditLog() {
+	auditOutMu.Lock()
+	defer auditOutMu.Unlock()
+	closeAuditLocked()
+}
+
+func closeAuditLocked() {
+	if auditOut == nil {
+		return
+	}
+	if auditOut.gz != nil {
+		auditOut.gz.Close()
+	}
+	auditOut.file.Close()
+	auditOut = nil
+}
+
+// sha256Hex returns the hex-encoded SHA-256 digest of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
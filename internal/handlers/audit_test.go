@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestAuditHashedMode(t *testing.T) {
+	const prompt = "my secret prompt that must not be stored"
+	messages := `[{"role":"user","content":"` + prompt + `"}]`
+	body := `{"model":"gemini-2.5-flash","store":true,"messages":` + messages + `}`
+	wantHash := "prompt_sha256=" + sha256Hex([]byte(messages))
+	jsonUpstream(t, http.StatusOK, completionBody)
+
+	t.Run("log", func(t *testing.T) {
+		useConfig(t, func(c *config.Config) {
+			c.AuditMode = "hashed"
+			c.AuditFile = ""
+		})
+		logs := captureLog(t)
+		w := httptest.NewRecorder()
+		ChatCompletionsHandler(w, newChatRequest(body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		out := logs.String()
+		if !strings.Contains(out, "Audit: model=gemini-2.5-flash") || !strings.Contains(out, wantHash) {
+			t.Errorf("log has no audit record with %s:\n%s", wantHash, out)
+		}
+		if !strings.Contains(out, "completion_tokens=") {
+			t.Errorf("audit record has no token counts:\n%s", out)
+		}
+		// store=true alone does not record content
+		if strings.Contains(out, prompt) {
+			t.Errorf("hashed audit mode logged the raw prompt:\n%s", out)
+		}
+	})
+
+	t.Run("gzip file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log.gz")
+		useConfig(t, func(c *config.Config) {
+			c.AuditMode = "hashed"
+			c.AuditFile = path
+		})
+		t.Cleanup(CloseAuditLog)
+		for range 2 {
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+		}
+		CloseAuditLog()
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := string(data)
+		if n := strings.Count(out, wantHash); n != 2 {
+			t.Errorf("audit file has %d records with %s, want 2:\n%s", n, wantHash, out)
+		}
+		if strings.Contains(out, prompt) {
+			t.Errorf("audit file contains the raw prompt:\n%s", out)
+		}
+	})
+}
+
+func TestMetadataLoggedNotForwarded(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.AuditMode = "hashed"
+		c.AuditFile = ""
+		c.AuditStoreContent = true
+	})
+	var sent map[string]json.RawMessage
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &sent)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionBody)
+	})
+	const metadata = `{"run":"nightly","trace":"abc-123"}`
+
+	for _, store := range []bool{false, true} {
+		t.Run(fmt.Sprintf("store=%v", store), func(t *testing.T) {
+			sent = nil
+			logs := captureLog(t)
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(fmt.Sprintf(`{"model":"gemini-2.5-flash","metadata":%s,"store":%v,"messages":[{"role":"user","content":"stored prompt"}]}`, metadata, store)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			for _, field := range []string{"metadata", "store"} {
+				if _, ok := sent[field]; ok {
+					t.Errorf("%s was forwarded upstream", field)
+				}
+			}
+			out := logs.String()
+			if n := strings.Count(out, "metadata="+metadata); n != 2 {
+				t.Errorf("metadata on %d log lines, want the request and audit lines:\n%s", n, out)
+			}
+			if logged := strings.Contains(out, "Audit body:") && strings.Contains(out, "stored prompt"); logged != store {
+				t.Errorf("content logged = %v, want %v with store=%v:\n%s", logged, store, store, out)
+			}
+		})
+	}
+
+	t.Run("over the limits", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","metadata":{"k":"`+strings.Repeat("v", maxMetadataValueLen+1)+`"},"messages":[{"role":"user","content":"hi"}]}`))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// best_of (legacy completions sampling).
+//
+// best_of=k asks Vertex for k candidates (n, which Vertex maps to
+// candidateCount) and returns one of them as choice 0. The pick is a
+// heuristic: the candidate with the highest average token logprob when the
+// response carries logprobs (the client asked for them), otherwise the first.
+// Usage is left as Vertex reports it, which counts every candidate generated.
+
+// maxBestOf is the largest candidateCount Vertex accepts
+const maxBestOf = 8
+
+// validateBestOf checks best_of against the rest of the request
+func validateBestOf(bestOf, n *int, stream bool) error {
+	if bestOf == nil {
+		return nil
+	}
+	if *bestOf < 1 || *bestOf > maxBestOf {
+		return fmt.Errorf("best_of must be between 1 and %d", maxBestOf)
+	}
+	if *bestOf == 1 {
+		return nil
+	}
+	if stream {
+		return fmt.Errorf("best_of cannot be used with stream")
+	}
+	if n != nil && *n > 1 {
+		return fmt.Errorf("best_of cannot be combined with n greater than 1")
+	}
+	return nil
+}
+
+// bestChoiceOnly keeps the best choice of a non-streaming response as choice
+// 0. Unparseable responses are returned unchanged.
+func bestChoiceOnly(payload []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(fields["choices"], &choices); err != nil || len(choices) <= 1 {
+		return payload
+	}
+
+	best := 0
+	if bestScore, ok := averageLogprob(choices[0]["logprobs"]); ok {
+		for i := 1; i < len(choices); i++ {
+			if score, ok := averageLogprob(choices[i]["logprobs"]); ok && score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+	}
+
+	chosen := choices[best]
+	chosen["index"] = json.RawMessage("0")
+	choicesJSON, err := json.Marshal([]map[string]json.RawMessage{chosen})
+	if err != nil {
+		return payload
+	}
+	fields["choices"] = choicesJSON
+	result, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return result
+}
+
+// averageLogprob is the mean token logprob of a choice's logprobs.content
+func averageLogprob(raw json.RawMessage) (float64, bool) {
+	var logprobs struct {
+		Content []struct {
+			Logprob float64 `json:"logprob"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(raw, &logprobs); err != nil || len(logprobs.Content) == 0 {
+		return 0, false
+	}
+	sum := 0.0
+	for _, token := range logprobs.Content {
+		sum += token.Logprob
+	}
+	return sum / float64(len(logprobs.Content)), true
+}
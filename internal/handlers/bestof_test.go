@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBestOf(t *testing.T) {
+	choice := func(index int, content string, logprobs ...float64) string {
+		tokens := make([]map[string]any, len(logprobs))
+		for i, lp := range logprobs {
+			tokens[i] = map[string]any{"token": "t", "logprob": lp}
+		}
+		data, _ := json.Marshal(map[string]any{
+			"index":         index,
+			"message":       map[string]string{"role": "assistant", "content": content},
+			"logprobs":      map[string]any{"content": tokens},
+			"finish_reason": "stop",
+		})
+		return string(data)
+	}
+	upstream := `{"id":"c1","object":"chat.completion","created":1,"model":"gemini-2.5-flash","choices":[` +
+		choice(0, "weak", -2.0, -1.0) + "," +
+		choice(1, "better", -0.5, -1.0) + "," +
+		choice(2, "best", -0.1, -0.3, -0.2) +
+		`],"usage":{"prompt_tokens":5,"completion_tokens":7,"total_tokens":12}}`
+	var sent map[string]json.RawMessage
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &sent)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, upstream)
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","best_of":3,"logprobs":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if string(sent["n"]) != "3" {
+		t.Errorf("upstream n = %s, want 3", sent["n"])
+	}
+	if _, ok := sent["best_of"]; ok {
+		t.Error("best_of was forwarded upstream")
+	}
+
+	var resp struct {
+		Choices []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Index != 0 || resp.Choices[0].Message.Content != "best" {
+		t.Errorf("choices = %+v, want only the highest average logprob candidate as choice 0", resp.Choices)
+	}
+	// Usage covers every generated candidate
+	if resp.Usage.CompletionTokens != 7 || resp.Usage.TotalTokens != 12 {
+		t.Errorf("usage = %+v, want the upstream total for all candidates", resp.Usage)
+	}
+
+	t.Run("with stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","best_of":2,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", w.Code)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Reasoning token billing (BILL_REASONING_TOKENS=false).
+//
+// Reported usage follows OpenAI: completion_tokens includes the
+// completion_tokens_details.reasoning_tokens. Operators who do not bill
+// thinking have those tokens taken out of completion_tokens and
+// total_tokens; reasoning_tokens stays in the details so clients can still
+// see what was spent. Key budgets and the audit log keep the real totals.
+
+// unbillReasoning removes reasoning tokens from the usage of a response or
+// stream chunk. Payloads without usage or reasoning tokens are unchanged.
+func unbillReasoning(payload []byte) []byte {
+	// Most stream chunks carry no usage; skip parsing them
+	if !bytes.Contains(payload, []byte(`"reasoning_tokens"`)) {
+		return payload
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	var usage map[string]json.RawMessage
+	if err := json.Unmarshal(fields["usage"], &usage); err != nil || usage == nil {
+		return payload
+	}
+	var counts struct {
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+		Details          struct {
+			ReasoningTokens int `json:"reasoning_tokens"`
+		} `json:"completion_tokens_details"`
+	}
+	if err := json.Unmarshal(fields["usage"], &counts); err != nil || counts.Details.ReasoningTokens <= 0 {
+		return payload
+	}
+
+	reasoning := counts.Details.ReasoningTokens
+	usage["completion_tokens"], _ = json.Marshal(max(counts.CompletionTokens-reasoning, 0))
+	usage["total_tokens"], _ = json.Marshal(max(counts.TotalTokens-reasoning, 0))
+
+	usageJSON, err := json.Marshal(usage)
+	if err != nil {
+		return payload
+	}
+	fields["usage"] = usageJSON
+	result, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return result
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Explicit stream cancellation.
+//
+// A disconnect only reaches us once the TCP connection is noticed as gone,
+// and proxies in between may keep it open. Clients can instead cancel a
+// stream in-band with POST /v1/streams/{id}/cancel, where {id} is the
+// X-Stream-ID response header (or any SSE event id of the stream). The
+// upstream generation is cancelled immediately and the stream ends with a
+// "cancelled" error event followed by [DONE]. Only the credential that
+// started a stream can cancel it; other callers get 404.
+
+// streamCancelResponse reports the outcome of a cancel request
+type streamCancelResponse struct {
+	ID        string `json:"id"`
+	Cancelled bool   `json:"cancelled"`
+}
+
+// StreamCancelHandler handles POST /v1/streams/{id}/cancel
+func StreamCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/streams/"), "/cancel")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		sendError(w, http.StatusNotFound, "not_found", "Not found")
+		return
+	}
+	// Accept an event id ("{stream}-{seq}") as well as the bare stream id
+	id, _, _ = strings.Cut(id, "-")
+
+	rs, ok := findReplayStream(r, id)
+	if !ok {
+		sendError(w, http.StatusNotFound, "not_found", "Unknown or expired stream")
+		return
+	}
+
+	cancelled := rs.abort()
+	log.Printf("StreamCancel: stream=%s, cancelled=%v", id, cancelled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(streamCancelResponse{ID: id, Cancelled: cancelled})
+}
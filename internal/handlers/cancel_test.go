@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestStreamCancel(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+	cancelled := make(chan struct{})
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hi"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	w := &flushSignal{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+		close(finished)
+	}()
+	<-w.flushed
+	id := w.Header().Get("X-Stream-ID")
+	if id == "" {
+		t.Fatal("stream has no X-Stream-ID")
+	}
+
+	cancelRequest := func(credential string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/streams/"+id+"/cancel", nil)
+		r.Header.Set("Authorization", "Bearer "+credential)
+		rec := httptest.NewRecorder()
+		StreamCancelHandler(rec, r)
+		return rec
+	}
+	if rec := cancelRequest("someone-else"); rec.Code != http.StatusNotFound {
+		t.Errorf("cancel by another client: status = %d, want 404", rec.Code)
+	}
+	rec := cancelRequest("client-key")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"cancelled":true`) {
+		t.Fatalf("cancel: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream request was not cancelled promptly")
+	}
+	<-finished
+	data := sseData(w.Body.String())
+	if len(data) < 2 || data[len(data)-1] != "[DONE]" || !strings.Contains(data[len(data)-2], `"cancelled"`) {
+		t.Errorf("stream does not end with a cancelled event and [DONE]:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Stream delta coalescing (STREAM_COALESCE_MS).
+//
+// Upstream often streams a token or two per chunk. With a coalescing window,
+// consecutive content deltas (or consecutive reasoning deltas) are merged and
+// written as one event when the window closes, cutting the number of writes
+// and flushes for slow clients. Any other event, such as a tool call, finish
+// reason, usage, error or [DONE], first flushes what is pending, so ordering
+// is preserved and the end of the stream is never delayed.
+
+// sseCoalescer serializes all writes of one stream. The window timer flushes
+// from its own goroutine, so every write goes through the coalescer's lock.
+type sseCoalescer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	write   func(data string) // writes and flushes one event
+	pending *streamChunk      // merged deltas not yet written
+	timer   *time.Timer
+	stopped bool
+}
+
+// newSSECoalescer returns a coalescer writing events with write; a window of
+// zero or less writes every delta immediately
+func newSSECoalescer(window time.Duration, write func(data string)) *sseCoalescer {
+	return &sseCoalescer{window: window, write: write}
+}
+
+// delta sends a content or reasoning delta, merging it with pending deltas
+// of the same kind when a window is configured
+func (c *sseCoalescer) delta(chunk streamChunk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.window <= 0 || c.stopped || !coalescable(chunk) {
+		c.flushLocked()
+		c.writeChunkLocked(chunk)
+		return
+	}
+
+	if c.pending != nil && !sameDeltaKind(*c.pending, chunk) {
+		c.flushLocked()
+	}
+	if c.pending == nil {
+		merged := chunk
+		merged.Choices = []streamChoice{chunk.Choices[0]}
+		c.pending = &merged
+		c.timer = time.AfterFunc(c.window, c.flush)
+		return
+	}
+	d := &c.pending.Choices[0].Delta
+	d.Content += chunk.Choices[0].Delta.Content
+	d.ReasoningContent += chunk.Choices[0].Delta.ReasoningContent
+}
+
+// send writes an event after any pending deltas
+func (c *sseCoalescer) send(data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+	c.write(data)
+}
+
+// do runs a raw write (e.g. an SSE comment) after any pending deltas
+func (c *sseCoalescer) do(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+	f()
+}
+
+// flush writes pending deltas now
+func (c *sseCoalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+// stop flushes pending deltas and makes later deltas write immediately
+func (c *sseCoalescer) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+	c.stopped = true
+}
+
+func (c *sseCoalescer) flushLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.pending == nil {
+		return
+	}
+	chunk := *c.pending
+	c.pending = nil
+	c.writeChunkLocked(chunk)
+}
+
+func (c *sseCoalescer) writeChunkLocked(chunk streamChunk) {
+	if data, err := json.Marshal(chunk); err == nil {
+		c.write(string(data))
+	}
+}
+
+// coalescable reports whether a chunk is a plain content or reasoning delta
+// that can be merged with its neighbours
+func coalescable(chunk streamChunk) bool {
+	if len(chunk.Choices) != 1 || chunk.Usage != nil || chunk.Choices[0].FinishReason != nil {
+		return false
+	}
+	d := chunk.Choices[0].Delta
+	return (d.Content == "") != (d.ReasoningContent == "")
+}
+
+// sameDeltaKind reports whether two coalescable chunks can be merged without
+// reordering content and reasoning
+func sameDeltaKind(a, b streamChunk) bool {
+	da, db := a.Choices[0].Delta, b.Choices[0].Delta
+	return a.ID == b.ID && a.Choices[0].Index == b.Choices[0].Index &&
+		(da.Content == "") == (db.Content == "") &&
+		(db.Role == "" || db.Role == da.Role)
+}
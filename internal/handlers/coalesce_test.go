@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSSECoalescer(t *testing.T) {
+	var written []string
+	// The window never closes on its own; flush stands in for the timer firing
+	c := newSSECoalescer(time.Hour, func(data string) { written = append(written, data) })
+	delta := func(content, reasoning string) streamChunk {
+		return streamChunk{ID: "c1", Choices: []streamChoice{{Delta: streamDelta{Content: content, ReasoningContent: reasoning}}}}
+	}
+	deltas := func() []string {
+		var out []string
+		for _, data := range written {
+			var chunk streamChunk
+			if json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+				out = append(out, data)
+				continue
+			}
+			d := chunk.Choices[0].Delta
+			switch {
+			case d.ReasoningContent != "":
+				out = append(out, "reasoning:"+d.ReasoningContent)
+			case chunk.Choices[0].FinishReason != nil:
+				out = append(out, "finish:"+*chunk.Choices[0].FinishReason)
+			default:
+				out = append(out, "content:"+d.Content)
+			}
+		}
+		return out
+	}
+
+	c.delta(delta("", "thin"))
+	c.delta(delta("", "king"))
+	// Switching kinds writes the pending reasoning first
+	c.delta(delta("Hel", ""))
+	c.delta(delta("lo", ""))
+	if got, want := deltas(), []string{"reasoning:thinking"}; !slices.Equal(got, want) {
+		t.Fatalf("before the window closes: %q, want %q", got, want)
+	}
+
+	c.flush()
+	c.delta(delta(" wor", ""))
+	c.delta(delta("ld", ""))
+	// The finish chunk and [DONE] go out at once, after what is pending
+	stop := "stop"
+	c.delta(streamChunk{ID: "c1", Choices: []streamChoice{{FinishReason: &stop}}})
+	c.send("[DONE]")
+
+	want := []string{"reasoning:thinking", "content:Hello", "content: world", "finish:stop", "[DONE]"}
+	if got := deltas(); !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	t.Run("window closes", func(t *testing.T) {
+		flushed := make(chan string, 2)
+		c := newSSECoalescer(10*time.Millisecond, func(data string) { flushed <- data })
+		defer c.stop()
+		c.delta(delta("a", ""))
+		c.delta(delta("b", ""))
+		select {
+		case data := <-flushed:
+			var chunk streamChunk
+			json.Unmarshal([]byte(data), &chunk)
+			if chunk.Choices[0].Delta.Content != "ab" {
+				t.Errorf("flushed %s, want the merged delta", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("pending deltas not written when the window closed")
+		}
+	})
+}
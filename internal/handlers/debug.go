@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/translate"
+	"vertex2api-golang/internal/vertex"
+)
+
+// debugTranslateRequest is the body of POST /debug/translate. Nothing is sent
+// to Vertex: the request is translated, and the given Gemini response (or,
+// with stream set, the Gemini stream chunks) is translated back.
+type debugTranslateRequest struct {
+	Request  *translate.ChatCompletionRequest `json:"request"`
+	Response *vertex.GeminiResponse           `json:"response"`
+	Stream   bool                             `json:"stream"`
+	Chunks   []*vertex.GeminiResponse         `json:"chunks"`
+}
+
+// debugTranslateResponse shows both directions of a non-streaming translation
+type debugTranslateResponse struct {
+	GeminiModel    string                            `json:"gemini_model,omitempty"`
+	GeminiRequest  *vertex.GeminiRequest             `json:"gemini_request,omitempty"`
+	OpenAIResponse *translate.ChatCompletionResponse `json:"openai_response,omitempty"`
+}
+
+// DebugTranslateHandler handles POST /debug/translate, previewing how the
+// native translation maps requests, responses and streams. Only served with
+// DEBUG_MODE enabled.
+func DebugTranslateHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.Get().DebugMode {
+		sendError(w, http.StatusNotFound, "not_found", "Not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	var req debugTranslateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Invalid JSON: "+err.Error())
+		return
+	}
+
+	model := "debug"
+	if req.Request != nil && req.Request.Model != "" {
+		model = req.Request.Model
+	}
+	requestID := translate.NewCompletionID()
+
+	// include_reasoning=false drops reasoning as on the live paths
+	withReasoning := req.Request == nil || req.Request.ReasoningEnabled()
+
+	// ESTIMATE_USAGE sizes the prompt from the request, when one is given
+	var estimate *translate.RunningUsage
+	if config.Get().EstimateUsage {
+		promptTokens := 0
+		if req.Request != nil {
+			promptTokens = translate.EstimatePromptTokens(req.Request.Messages)
+		}
+		estimate = translate.NewRunningUsage(promptTokens)
+	}
+
+	if req.Stream {
+		writeDebugStream(w, requestID, model, req.Chunks, withReasoning, estimate)
+		return
+	}
+
+	var resp debugTranslateResponse
+	if req.Request != nil {
+		if err := translate.ValidateTools(req.Request.Tools); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		geminiReq, geminiModel, err := translate.ToGeminiRequest(r.Context(), req.Request)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, translateErrorType(err), err.Error())
+			return
+		}
+		resp.GeminiRequest, resp.GeminiModel = geminiReq, geminiModel
+		overrides, err := translate.ParseGenerationOverrides(r.Header, resp.GeminiModel)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		overrides.ApplyGemini(resp.GeminiRequest)
+	}
+	if req.Response != nil {
+		resp.OpenAIResponse = translate.FromGeminiResponse(req.Response, model, requestID)
+		if !withReasoning {
+			translate.DropReasoning(resp.OpenAIResponse)
+		}
+		if estimate != nil {
+			translate.FillEstimatedUsage(resp.OpenAIResponse, estimate.Usage().PromptTokens)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeDebugStream replays Gemini stream chunks through StreamState and
+// SSEWriter exactly as a live native stream would be translated. A non-nil
+// estimate stands in for usage the chunks do not report.
+func writeDebugStream(w http.ResponseWriter, requestID, model string, chunks []*vertex.GeminiResponse, withReasoning bool, estimate *translate.RunningUsage) {
+	state := translate.NewStreamState()
+	sse := translate.NewSSEWriter(w, requestID, model)
+
+	isFirst := true
+	for _, chunk := range chunks {
+		if chunk == nil {
+			continue
+		}
+		content, reasoning, toolCalls, finishReason := state.ProcessChunk(chunk)
+		if !withReasoning {
+			reasoning = ""
+		}
+		sse.SetSystemFingerprint(state.SystemFingerprint())
+		if estimate != nil {
+			estimate.Add(content)
+			estimate.Add(reasoning)
+		}
+		var usage *translate.Usage
+		if finishReason != "" {
+			usage = state.Usage()
+			if usage == nil && estimate != nil {
+				usage = estimate.Usage()
+			}
+		}
+		if content == "" && reasoning == "" && len(toolCalls) == 0 && finishReason == "" && !isFirst {
+			continue
+		}
+		if err := sse.WriteChunk(content, reasoning, toolCalls, finishReason, isFirst, usage); err != nil {
+			return
+		}
+		isFirst = false
+	}
+
+	sse.WriteAnnotations(state.Annotations())
+	sse.WriteDone()
+}
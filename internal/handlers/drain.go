@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Active SSE stream tracking for graceful shutdown.
+//
+// Every streaming response (chat completions, Gemini streamGenerateContent,
+// streaming /v1/responses and resumed streams) registers itself with
+// beginStream while it runs. On shutdown DrainStreams stops new streams from
+// registering and waits for the active ones to finish within the grace
+// period; streams still running when it expires are cancelled and end with a
+// termination event.
+
+// streamTerminateTimeout bounds how long cancelled streams get to write their
+// termination event
+const streamTerminateTimeout = 5 * time.Second
+
+var (
+	// streamsMu guards activeStreams, draining and streamsIdle, so a stream
+	// cannot register after DrainStreams has taken its count
+	streamsMu     sync.Mutex
+	activeStreams int
+	draining      bool
+	streamsIdle   = make(chan struct{}) // closed once draining and no stream is active
+
+	drainCtx, drain = context.WithCancel(context.Background())
+)
+
+// beginStream registers a streaming response so shutdown can drain it. Once
+// draining has begun it answers 503 instead and reports false. The returned
+// context is also cancelled if the drain grace period runs out, and done must
+// be called when the stream has ended.
+func beginStream(ctx context.Context, w http.ResponseWriter) (streamCtx context.Context, done func(), ok bool) {
+	streamsMu.Lock()
+	if draining {
+		streamsMu.Unlock()
+		w.Header().Set("Retry-After", "1")
+		sendError(w, http.StatusServiceUnavailable, "service_unavailable", "Server is shutting down")
+		return ctx, nil, false
+	}
+	activeStreams++
+	streamsMu.Unlock()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(drainCtx, cancel)
+	return streamCtx, func() {
+		stop()
+		cancel()
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		activeStreams--
+		if draining && activeStreams == 0 {
+			close(streamsIdle)
+		}
+	}, true
+}
+
+// ActiveStreams returns the number of SSE streams currently in progress
+func ActiveStreams() int {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	return activeStreams
+}
+
+// streamsTerminated reports whether streams were force-terminated by a drain
+func streamsTerminated() bool {
+	return drainCtx.Err() != nil
+}
+
+// DrainStreams refuses new streams, waits for active ones to finish until ctx
+// is done, then terminates the remaining ones. It returns the number of
+// streams that were active when draining started. It must be called once.
+func DrainStreams(ctx context.Context) int {
+	streamsMu.Lock()
+	draining = true
+	count := activeStreams
+	if count == 0 {
+		close(streamsIdle)
+	}
+	streamsMu.Unlock()
+
+	select {
+	case <-streamsIdle:
+		return count
+	case <-ctx.Done():
+	}
+
+	// Grace period exhausted: cancel upstream reads so streams close cleanly
+	drain()
+	select {
+	case <-streamsIdle:
+	case <-time.After(streamTerminateTimeout):
+	}
+	return count
+}
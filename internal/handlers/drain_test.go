@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetDrain undoes DrainStreams so later tests can stream again
+func resetDrain(t *testing.T) {
+	t.Cleanup(func() {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		draining = false
+		streamsIdle = make(chan struct{})
+		drainCtx, drain = context.WithCancel(context.Background())
+	})
+}
+
+// waitForStreams waits until n streams are registered
+func waitForStreams(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for ActiveStreams() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("ActiveStreams = %d, want %d", ActiveStreams(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDrainStreamsRefusesNewStreams(t *testing.T) {
+	resetDrain(t)
+
+	_, done, ok := beginStream(context.Background(), httptest.NewRecorder())
+	if !ok {
+		t.Fatal("beginStream refused a stream before draining")
+	}
+
+	drained := make(chan int, 1)
+	go func() { drained <- DrainStreams(context.Background()) }()
+
+	// Once draining has begun, new streams are refused
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		_, late, ok := beginStream(context.Background(), w)
+		if !ok {
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("refused stream status = %d, want 503", w.Code)
+			}
+			break
+		}
+		late()
+		if time.Now().After(deadline) {
+			t.Fatal("beginStream still accepts streams while draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("DrainStreams returned while a stream was active")
+	case <-time.After(20 * time.Millisecond):
+	}
+	done()
+	if n := <-drained; n != 1 {
+		t.Errorf("DrainStreams = %d, want 1", n)
+	}
+}
+
+func TestDrainStreamsTerminatesGeminiStream(t *testing.T) {
+	resetDrain(t)
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"candidates\":[]}\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	w := &flushSignal{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		GeminiHandler(w, geminiRequest("models/gemini-2.5-flash:streamGenerateContent", `{"contents":[]}`))
+		close(finished)
+	}()
+	<-w.flushed
+	waitForStreams(t, 1)
+
+	// No grace period: the passthrough stream is cancelled and told why
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n := DrainStreams(ctx); n != 1 {
+		t.Errorf("DrainStreams = %d, want 1", n)
+	}
+	<-finished
+	if !strings.HasSuffix(w.Body.String(), geminiShutdownEvent) {
+		t.Errorf("stream does not end with the shutdown event:\n%s", w.Body)
+	}
+}
+
+// flushSignal reports the first flush of a streaming response
+type flushSignal struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+	once    sync.Once
+}
+
+func (f *flushSignal) Flush() {
+	f.ResponseRecorder.Flush()
+	f.once.Do(func() { close(f.flushed) })
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/translate"
+)
+
+// Echo mode (ECHO_MODE).
+//
+// For load tests and client integration work without Vertex quota, the
+// upstream HTTP client is replaced by a transport that answers locally with a
+// deterministic completion echoing the last user message, wrapped in a
+// thinking tag block. Everything else (request shaping, reasoning
+// extraction, SSE framing, replay) runs unchanged, so the output matches what
+// clients see from a real model. Streams are cut into small deltas that split
+// the thinking tags, like real upstream chunks do.
+
+const (
+	echoReasoning = "Echoing the last user message."
+	// echoChunkSize is the size of each streamed content delta
+	echoChunkSize = 8
+)
+
+var echoClient = &http.Client{Transport: echoTransport{}}
+
+// upstreamClient returns the client for Vertex requests
+func upstreamClient() *http.Client {
+	if config.Get().EchoMode {
+		return echoClient
+	}
+	return httpClient
+}
+
+// echoTransport answers OpenAI-compatible chat requests without a network call
+type echoTransport struct{}
+
+func (echoTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var req struct {
+		Model    string            `json:"model"`
+		Stream   bool              `json:"stream"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(body, &req)
+	}
+
+	text := lastUserText(req.Messages)
+	content := fmt.Sprintf("<%s>%s</%s>%s", ThinkingTagMarker, echoReasoning, ThinkingTagMarker, text)
+	usage := translate.EstimateUsage(translate.EstimateTokens(req.Messages), translate.EstimateTextTokens(content))
+	usage.Estimated = false
+	id, created := "chatcmpl-echo", time.Now().Unix()
+
+	var payload bytes.Buffer
+	contentType := "application/json"
+	if req.Stream {
+		contentType = "text/event-stream"
+		writeEvent := func(v any) {
+			data, _ := json.Marshal(v)
+			fmt.Fprintf(&payload, "data: %s\n\n", data)
+		}
+		chunk := func(delta map[string]string, finish *string, usage *translate.Usage) map[string]any {
+			c := map[string]any{
+				"id": id, "object": translate.ObjectChatCompletionChunk, "created": created, "model": req.Model,
+				"choices": []map[string]any{{"index": 0, "delta": delta, "finish_reason": finish}},
+			}
+			if usage != nil {
+				c["usage"] = usage
+			}
+			return c
+		}
+		writeEvent(chunk(map[string]string{"role": "assistant"}, nil, nil))
+		for rest := content; rest != ""; {
+			n := min(echoChunkSize, len(rest))
+			writeEvent(chunk(map[string]string{"content": rest[:n]}, nil, nil))
+			rest = rest[n:]
+		}
+		stop := "stop"
+		writeEvent(chunk(map[string]string{}, &stop, usage))
+		payload.WriteString("data: [DONE]\n\n")
+	} else {
+		json.NewEncoder(&payload).Encode(map[string]any{
+			"id": id, "object": translate.ObjectChatCompletion, "created": created, "model": req.Model,
+			"choices": []map[string]any{{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": content},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(&payload),
+		ContentLength: int64(payload.Len()),
+		Request:       r,
+	}, nil
+}
+
+// lastUserText returns the text of the last user message
+func lastUserText(messages []json.RawMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		var msg struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		}
+		if json.Unmarshal(messages[i], &msg) != nil || msg.Role != "user" {
+			continue
+		}
+
+		var text string
+		if json.Unmarshal(msg.Content, &text) == nil {
+			return text
+		}
+		var parts []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		json.Unmarshal(msg.Content, &parts)
+		texts := make([]string, 0, len(parts))
+		for _, p := range parts {
+			if p.Type == "text" {
+				texts = append(texts, p.Text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
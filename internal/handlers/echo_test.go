@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestEchoMode(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.EchoMode = true
+		c.StreamCoalesceMS = 0
+	})
+	// Echo mode never reaches the network
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected upstream request to %s", r.URL.Path)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	})
+	const messages = `"messages":[{"role":"user","content":"first"},{"role":"assistant","content":"ok"},{"role":"user","content":"echo this back"}]`
+
+	t.Run("non-streaming", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","include_reasoning":true,`+messages+`}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Choices []struct {
+				Message struct {
+					Content          string `json:"content"`
+					ReasoningContent string `json:"reasoning_content"`
+				} `json:"message"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage struct {
+				TotalTokens int `json:"total_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		choice := resp.Choices[0]
+		if choice.Message.Content != "echo this back" || choice.Message.ReasoningContent != echoReasoning {
+			t.Errorf("content %q, reasoning %q; want the last user message and the canned reasoning", choice.Message.Content, choice.Message.ReasoningContent)
+		}
+		if choice.FinishReason != "stop" || resp.Usage.TotalTokens == 0 {
+			t.Errorf("finish_reason %q, usage %d; want stop and a token count", choice.FinishReason, resp.Usage.TotalTokens)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","stream":true,"include_reasoning":true,`+messages+`}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		data := sseData(w.Body.String())
+		if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+			t.Fatalf("stream does not end with [DONE]:\n%s", w.Body.String())
+		}
+		var content, reasoning strings.Builder
+		var finish string
+		for _, payload := range data[:len(data)-1] {
+			for _, choice := range decodeChunk(t, payload).Choices {
+				content.WriteString(choice.Delta.Content)
+				reasoning.WriteString(choice.Delta.ReasoningContent)
+				if choice.FinishReason != nil {
+					finish = *choice.FinishReason
+				}
+			}
+		}
+		if content.String() != "echo this back" || reasoning.String() != echoReasoning {
+			t.Errorf("content %q, reasoning %q; want the last user message and the canned reasoning", content.String(), reasoning.String())
+		}
+		if strings.Contains(w.Body.String(), ThinkingTagMarker) {
+			t.Error("thinking tags leaked into the stream")
+		}
+		if finish != "stop" {
+			t.Errorf("finish_reason = %q, want stop", finish)
+		}
+	})
+}
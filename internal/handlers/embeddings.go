@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"vertex2api-golang/internal/keys"
+	"vertex2api-golang/internal/models"
+)
+
+// OpenAI-compatible embeddings (/v1/embeddings).
+//
+// Inputs are sent to the Vertex publisher model's :predict method, one
+// instance per input. With encoding_format "base64" each vector is returned
+// as float32 values packed little-endian and base64-encoded, as OpenAI does,
+// which is roughly a third of the size of the JSON float array.
+
+// embeddingsRequest is the subset of the OpenAI request that Vertex supports
+type embeddingsRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format"`
+	Dimensions     *int            `json:"dimensions"`
+	User           string          `json:"user"`
+}
+
+type vertexPredictResponse struct {
+	Predictions []struct {
+		Embeddings struct {
+			Values     []float64 `json:"values"`
+			Statistics struct {
+				TokenCount float64 `json:"token_count"`
+			} `json:"statistics"`
+		} `json:"embeddings"`
+	} `json:"predictions"`
+}
+
+type embeddingData struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"` // []float64, or string for base64
+}
+
+type embeddingsResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// EmbeddingsHandler handles /v1/embeddings
+func EmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	if !checkCapacity(w) {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	var req embeddingsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Invalid JSON: "+err.Error())
+		return
+	}
+	if !checkRateLimit(w, r, req.User) {
+		return
+	}
+	if req.Model == "" {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Model is required")
+		return
+	}
+	if req.EncodingFormat == "" {
+		req.EncodingFormat = "float"
+	}
+	if req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		sendError(w, http.StatusBadRequest, "invalid_request", "encoding_format must be \"float\" or \"base64\"")
+		return
+	}
+
+	inputs, err := parseEmbeddingInput(req.Input)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if !models.IsModelAllowed(req.Model) {
+		sendError(w, http.StatusForbidden, "permission_denied", "Model not allowed on this proxy: "+req.Model)
+		return
+	}
+	actualModel, _ := models.ResolveModel(req.Model)
+
+	instances := make([]map[string]string, len(inputs))
+	for i, input := range inputs {
+		instances[i] = map[string]string{"content": input}
+	}
+	predict := map[string]any{"instances": instances}
+	if req.Dimensions != nil {
+		predict["parameters"] = map[string]int{"outputDimensionality": *req.Dimensions}
+	}
+	predictBody, err := json.Marshal(predict)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "server_error", "Failed to encode request")
+		return
+	}
+
+	ctx := r.Context()
+	auth, err := keyManager.PickAuth(ctx)
+	if err != nil {
+		if errors.Is(err, keys.ErrBudgetExhausted) {
+			sendBudgetExhausted(w)
+			return
+		}
+		// Discovery errors can carry the key in a probe URL, so they stay in the log
+		log.Printf("Embeddings auth failed: model=%s, error=%v", actualModel, err)
+		sendError(w, http.StatusInternalServerError, "server_error", "Failed to get auth")
+		return
+	}
+
+	url := fmt.Sprintf(
+		"https://aiplatform.googleapis.com/%s/projects/%s/locations/%s/publishers/google/models/%s:predict?key=%s",
+		models.ResolveAPIVersion(actualModel),
+		auth.ProjectID,
+		models.ResolveLocation(actualModel, auth.Location),
+		actualModel,
+		auth.APIKey,
+	)
+
+	setKeyIndexHeader(w, auth.KeyIndex)
+	start := time.Now()
+	respBody, err := doNonStreamingRequest(ctx, url, predictBody)
+	keyManager.RecordResult(auth.KeyIndex, time.Since(start), err)
+	if err != nil {
+		keyManager.Penalize(auth.KeyIndex, err)
+		log.Printf("Embeddings failed: model=%s, key_index=%d, error=%v", actualModel, auth.KeyIndex, err)
+		if sendTimeoutError(w, ctx) {
+			return
+		}
+		if upErr, ok := asUpstreamError(err); ok {
+			sendUpstreamError(w, upErr)
+			return
+		}
+		// Transport errors quote the request URL, key included
+		sendError(w, http.StatusBadGateway, "upstream_error", "Upstream request failed")
+		return
+	}
+
+	var predicted vertexPredictResponse
+	if err := json.Unmarshal(respBody, &predicted); err != nil {
+		sendError(w, http.StatusBadGateway, "upstream_error", "Invalid upstream response: "+err.Error())
+		return
+	}
+
+	resp := embeddingsResponse{Object: "list", Model: req.Model, Data: make([]embeddingData, 0, len(predicted.Predictions))}
+	for i, p := range predicted.Predictions {
+		var embedding any = p.Embeddings.Values
+		if req.EncodingFormat == "base64" {
+			embedding = encodeEmbeddingBase64(p.Embeddings.Values)
+		}
+		resp.Data = append(resp.Data, embeddingData{Object: "embedding", Index: i, Embedding: embedding})
+		resp.Usage.PromptTokens += int(p.Embeddings.Statistics.TokenCount)
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	keyManager.RecordTokens(auth.KeyIndex, resp.Usage.TotalTokens)
+
+	log.Printf("Embeddings success: model=%s, inputs=%d, encoding=%s, key_index=%d", actualModel, len(inputs), req.EncodingFormat, auth.KeyIndex)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseEmbeddingInput accepts a string or an array of strings; token arrays
+// have no Vertex equivalent
+func parseEmbeddingInput(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of strings")
+	}
+	if len(many) == 0 {
+		return nil, fmt.Errorf("input must not be empty")
+	}
+	return many, nil
+}
+
+// encodeEmbeddingBase64 packs a vector as little-endian float32 values
+func encodeEmbeddingBase64(values []float64) string {
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddingsEncodingFormat(t *testing.T) {
+	values := []float64{0.1, -2.5, 3.14159, 1e-7, 0}
+	predictions, _ := json.Marshal(map[string]any{"predictions": []any{
+		map[string]any{"embeddings": map[string]any{"values": values, "statistics": map[string]any{"token_count": 2}}},
+	}})
+	jsonUpstream(t, http.StatusOK, string(predictions))
+
+	embed := func(t *testing.T, format string) json.RawMessage {
+		t.Helper()
+		body := `{"model":"text-embedding-005","input":"hello"` + format + `}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer client-key")
+		w := httptest.NewRecorder()
+		EmbeddingsHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Data []struct {
+				Embedding json.RawMessage `json:"embedding"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Data) != 1 {
+			t.Fatalf("response %s: %v", w.Body.String(), err)
+		}
+		return resp.Data[0].Embedding
+	}
+
+	t.Run("float", func(t *testing.T) {
+		var got []float64
+		if err := json.Unmarshal(embed(t, ""), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, values) {
+			t.Errorf("embedding = %v, want %v", got, values)
+		}
+	})
+
+	t.Run("base64", func(t *testing.T) {
+		var encoded string
+		if err := json.Unmarshal(embed(t, `,"encoding_format":"base64"`), &encoded); err != nil {
+			t.Fatal(err)
+		}
+		packed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed) != 4*len(values) {
+			t.Fatalf("decoded %d bytes, want %d", len(packed), 4*len(values))
+		}
+		for i, v := range values {
+			got := math.Float32frombits(binary.LittleEndian.Uint32(packed[4*i:]))
+			if got != float32(v) {
+				t.Errorf("value %d = %v, want %v", i, got, float32(v))
+			}
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(`{"model":"text-embedding-005","input":"hello","encoding_format":"binary"}`))
+		w := httptest.NewRecorder()
+		EmbeddingsHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", w.Code)
+		}
+	})
+}
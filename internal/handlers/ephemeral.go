@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+)
+
+// Ephemeral reasoning (the "ephemeral_reasoning": true request extension).
+//
+// Chat frontends that show thinking live but do not keep it set this flag.
+// Streams still emit reasoning_content deltas as they arrive, but those
+// events carry no SSE id and are not recorded for Last-Event-ID replay, so a
+// reconnecting client gets the answer without the thinking. Non-streaming
+// responses, which are what clients persist, omit reasoning entirely. The
+// audit log never includes reasoning either way.
+
+// isReasoningOnlyChunk reports whether a stream payload carries reasoning and
+// nothing else a client would need to keep
+func isReasoningOnlyChunk(data string) bool {
+	var chunk streamChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil || len(chunk.Choices) != 1 || chunk.Usage != nil {
+		return false
+	}
+	choice := chunk.Choices[0]
+	return choice.Delta.ReasoningContent != "" && choice.Delta.Content == "" && choice.FinishReason == nil
+}
+
+// stripReasoning removes reasoning_content from every choice of a
+// non-streaming response. Unparseable responses are returned unchanged.
+func stripReasoning(respBody []byte) []byte {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return respBody
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(resp["choices"], &choices); err != nil {
+		return respBody
+	}
+
+	changed := false
+	for _, choice := range choices {
+		var message map[string]json.RawMessage
+		if err := json.Unmarshal(choice["message"], &message); err != nil {
+			continue
+		}
+		if _, ok := message["reasoning_content"]; !ok {
+			continue
+		}
+		delete(message, "reasoning_content")
+		if messageBytes, err := json.Marshal(message); err == nil {
+			choice["message"] = messageBytes
+			changed = true
+		}
+	}
+	if !changed {
+		return respBody
+	}
+
+	choicesBytes, err := json.Marshal(choices)
+	if err != nil {
+		return respBody
+	}
+	resp["choices"] = choicesBytes
+	if out, err := json.Marshal(resp); err == nil {
+		return out
+	}
+	return respBody
+}
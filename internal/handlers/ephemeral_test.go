@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestEphemeralReasoning(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+	const thought = "<" + ThinkingTagMarker + ">pondering</" + ThinkingTagMarker + ">answer"
+	const body = `{"model":"gemini-2.5-flash","stream":true,"include_reasoning":true,"ephemeral_reasoning":true,"messages":[{"role":"user","content":"hi"}]}`
+	var sent map[string]json.RawMessage
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{thought[:20], thought[20:]} {
+			encoded, _ := json.Marshal(delta)
+			io.WriteString(w, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":`+string(encoded)+`}}]}`+"\n\n")
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := sent["ephemeral_reasoning"]; ok {
+		t.Error("ephemeral_reasoning was forwarded upstream")
+	}
+
+	// Reasoning is streamed live, without an id to resume from
+	var reasoning, content strings.Builder
+	for _, event := range strings.Split(w.Body.String(), "\n\n") {
+		_, payload, ok := strings.Cut(event, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		for _, choice := range decodeChunk(t, payload).Choices {
+			if choice.Delta.ReasoningContent != "" && strings.HasPrefix(event, "id: ") {
+				t.Errorf("reasoning event has an id: %q", event)
+			}
+			reasoning.WriteString(choice.Delta.ReasoningContent)
+			content.WriteString(choice.Delta.Content)
+		}
+	}
+	if reasoning.String() != "pondering" || content.String() != "answer" {
+		t.Errorf("streamed reasoning %q, content %q; want pondering, answer", reasoning.String(), content.String())
+	}
+
+	// A reconnecting client gets the answer without the thinking
+	resume := newChatRequest(body)
+	resume.Header.Set("Last-Event-ID", w.Header().Get("X-Stream-ID")+"-0")
+	replay := httptest.NewRecorder()
+	ChatCompletionsHandler(replay, resume)
+	if !strings.Contains(replay.Body.String(), "answer") || strings.Contains(replay.Body.String(), "pondering") {
+		t.Errorf("replay should carry the answer but not the reasoning:\n%s", replay.Body.String())
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vertex2api-golang/internal/auth"
+	"vertex2api-golang/internal/config"
+)
+
+// Generated images as files (IMAGE_RESPONSE_MODE=url).
+//
+// Image models return pictures as base64 data URLs, which can make a response
+// several megabytes of JSON. In url mode each such data URL is decoded into a
+// short-lived in-memory store and replaced by a /v1/files/{id} URL that
+// FileHandler serves until IMAGE_FILE_TTL_SECONDS have passed.
+//
+// A file is only served to the client that generated it: the same API key,
+// however it is sent, or the same address when none is. The store holds at most
+// IMAGE_FILE_MAX_BYTES: the oldest files are evicted to make room, and an
+// image larger than the whole store stays inline. Expired files are swept
+// every minute.
+
+// dataImagePattern matches base64 image data URLs in raw JSON text; "/" may
+// appear escaped as "\/"
+var dataImagePattern = regexp.MustCompile(`data:(image\\?/[A-Za-z0-9.+-]+);base64,([A-Za-z0-9+=]|\\?/)+`)
+
+type storedFile struct {
+	owner    string
+	mimeType string
+	data     []byte
+	expires  time.Time
+}
+
+// fileSweepInterval is how often expired files are dropped between requests
+const fileSweepInterval = time.Minute
+
+var (
+	fileStore      = make(map[string]*storedFile)
+	fileStoreBytes int64
+	fileStoreMu    sync.Mutex
+)
+
+// putFile stores data for owner until the TTL expires and returns its ID. It
+// reports false when data is larger than the whole store.
+func putFile(owner, mimeType string, data []byte) (string, bool) {
+	limit := config.Get().ImageFileMaxBytes
+	size := int64(len(data))
+	if limit > 0 && size > limit {
+		return "", false
+	}
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := "file-" + hex.EncodeToString(idBytes)
+	now := time.Now()
+
+	fileStoreMu.Lock()
+	defer fileStoreMu.Unlock()
+	sweepFilesLocked(now)
+	for limit > 0 && fileStoreBytes+size > limit {
+		evictOldestFileLocked()
+	}
+	fileStore[id] = &storedFile{
+		owner:    owner,
+		mimeType: mimeType,
+		data:     data,
+		expires:  now.Add(time.Duration(config.Get().ImageFileTTLSeconds) * time.Second),
+	}
+	fileStoreBytes += size
+	return id, true
+}
+
+// getFile returns a stored file of owner that has not expired
+func getFile(id, owner string) (*storedFile, bool) {
+	fileStoreMu.Lock()
+	defer fileStoreMu.Unlock()
+	f, ok := fileStore[id]
+	if !ok || f.owner != owner {
+		return nil, false
+	}
+	if time.Now().After(f.expires) {
+		deleteFileLocked(id)
+		return nil, false
+	}
+	return f, true
+}
+
+// StartFileSweeper drops expired files every minute until ctx is cancelled,
+// so their memory is released even when no new files are stored
+func StartFileSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(fileSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				fileStoreMu.Lock()
+				sweepFilesLocked(now)
+				fileStoreMu.Unlock()
+			}
+		}
+	}()
+}
+
+// sweepFilesLocked drops the files expired at now. fileStoreMu must be held.
+func sweepFilesLocked(now time.Time) {
+	for id, f := range fileStore {
+		if now.After(f.expires) {
+			deleteFileLocked(id)
+		}
+	}
+}
+
+// evictOldestFileLocked drops the file that expires first, which is the
+// oldest. fileStoreMu must be held.
+func evictOldestFileLocked() {
+	oldest := ""
+	for id, f := range fileStore {
+		if oldest == "" || f.expires.Before(fileStore[oldest].expires) {
+			oldest = id
+		}
+	}
+	deleteFileLocked(oldest)
+}
+
+// deleteFileLocked removes a file. fileStoreMu must be held.
+func deleteFileLocked(id string) {
+	if f, ok := fileStore[id]; ok {
+		fileStoreBytes -= int64(len(f.data))
+		delete(fileStore, id)
+	}
+}
+
+// fileBaseURL returns the URL prefix for stored files when IMAGE_RESPONSE_MODE
+// is "url", or "" when images stay inline
+func fileBaseURL(r *http.Request) string {
+	if config.Get().ImageResponseMode != "url" {
+		return ""
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// Only a trusted reverse proxy may say how the client connected
+	if proto := r.Header.Get("X-Forwarded-Proto"); config.Get().TrustProxyHeaders && (proto == "http" || proto == "https") {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + "/v1/files/"
+}
+
+// fileOwner identifies who may fetch a stored file. It uses the same key
+// extraction as authentication, so the ?key= form used by <img> tags and
+// plain links matches a key sent in a header when the file was created.
+func fileOwner(r *http.Request) string {
+	if key := auth.ExtractAPIKey(r); key != "" {
+		return hashUser(key)
+	}
+	return clientCredential(r)
+}
+
+// externalizeImages replaces base64 image data URLs in a JSON payload with
+// URLs of files stored for owner. Data that does not decode or does not fit
+// the store is left inline.
+func externalizeImages(payload []byte, baseURL, owner string) []byte {
+	if baseURL == "" || !strings.Contains(string(payload), "data:image") {
+		return payload
+	}
+	return dataImagePattern.ReplaceAllFunc(payload, func(match []byte) []byte {
+		unescaped := strings.ReplaceAll(string(match), `\/`, "/")
+		header, encoded, _ := strings.Cut(strings.TrimPrefix(unescaped, "data:"), ",")
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return match
+		}
+		id, ok := putFile(owner, strings.TrimSuffix(header, ";base64"), data)
+		if !ok {
+			return match
+		}
+		return []byte(baseURL + id)
+	})
+}
+
+// FileHandler serves stored files at /v1/files/{id}
+func FileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/files/")
+	f, ok := getFile(id, fileOwner(r))
+	if !ok {
+		sendError(w, http.StatusNotFound, "not_found", "File not found or expired")
+		return
+	}
+
+	w.Header().Set("Content-Type", f.mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(time.Until(f.expires).Seconds())))
+	w.Write(f.data)
+}
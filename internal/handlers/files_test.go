@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// resetFileStore empties the file store for a test
+func resetFileStore(t *testing.T) {
+	t.Helper()
+	empty := func() {
+		fileStoreMu.Lock()
+		fileStore = make(map[string]*storedFile)
+		fileStoreBytes = 0
+		fileStoreMu.Unlock()
+	}
+	empty()
+	t.Cleanup(empty)
+}
+
+func TestFileStoreExpiry(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.ImageFileTTLSeconds = 60 })
+	resetFileStore(t)
+
+	id, ok := putFile("alice", "image/png", []byte("png"))
+	if !ok {
+		t.Fatal("putFile refused a small file")
+	}
+	if _, ok := getFile(id, "alice"); !ok {
+		t.Fatal("getFile missed a fresh file")
+	}
+
+	// Expire it, then let the sweeper's pass drop it
+	fileStoreMu.Lock()
+	fileStore[id].expires = time.Now().Add(-time.Second)
+	sweepFilesLocked(time.Now())
+	remaining, bytes := len(fileStore), fileStoreBytes
+	fileStoreMu.Unlock()
+	if remaining != 0 || bytes != 0 {
+		t.Errorf("after sweep: files = %d, bytes = %d, want 0 and 0", remaining, bytes)
+	}
+	if _, ok := getFile(id, "alice"); ok {
+		t.Error("getFile served an expired file")
+	}
+}
+
+func TestFileStoreByteCap(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.ImageFileTTLSeconds = 60
+		c.ImageFileMaxBytes = 10
+	})
+	resetFileStore(t)
+
+	tests := []struct {
+		name      string
+		size      int
+		wantStore bool
+	}{
+		{"first", 4, true},
+		{"second", 4, true},
+		{"evicts the first", 4, true},
+		{"larger than the store", 11, false},
+	}
+
+	var ids []string
+	for _, tt := range tests {
+		// Distinct expiry times keep eviction order deterministic
+		time.Sleep(time.Millisecond)
+		id, ok := putFile("alice", "image/png", make([]byte, tt.size))
+		if ok != tt.wantStore {
+			t.Fatalf("%s: putFile stored = %v, want %v", tt.name, ok, tt.wantStore)
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+
+	if _, ok := getFile(ids[0], "alice"); ok {
+		t.Error("the oldest file survived eviction")
+	}
+	for _, id := range ids[1:] {
+		if _, ok := getFile(id, "alice"); !ok {
+			t.Errorf("file %s was evicted, want it kept", id)
+		}
+	}
+	fileStoreMu.Lock()
+	bytes := fileStoreBytes
+	fileStoreMu.Unlock()
+	if bytes != 8 {
+		t.Errorf("stored bytes = %d, want 8", bytes)
+	}
+}
+
+func TestFileHandlerScopesToClient(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.ImageFileTTLSeconds = 60 })
+	resetFileStore(t)
+
+	owner := httptest.NewRequest(http.MethodGet, "/", nil)
+	owner.Header.Set("Authorization", "Bearer alice")
+	id, _ := putFile(fileOwner(owner), "image/png", []byte("png"))
+
+	tests := []struct {
+		name   string
+		header string // header=value
+		query  string
+		want   int
+	}{
+		{"owner", "Authorization=Bearer alice", "", http.StatusOK},
+		{"owner key as a query parameter", "", "?key=alice", http.StatusOK},
+		{"owner key as x-goog-api-key", "x-goog-api-key=alice", "", http.StatusOK},
+		{"other client", "Authorization=Bearer bob", "", http.StatusNotFound},
+		{"other key as a query parameter", "", "?key=bob", http.StatusNotFound},
+		{"no credential", "", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/files/"+id+tt.query, nil)
+			if name, value, ok := strings.Cut(tt.header, "="); ok {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			FileHandler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileBaseURLForwardedProto(t *testing.T) {
+	tests := []struct {
+		name  string
+		trust bool
+		proto string
+		want  string
+	}{
+		{"untrusted header ignored", false, "https", "http://proxy.test/v1/files/"},
+		{"trusted header", true, "https", "https://proxy.test/v1/files/"},
+		{"trusted but invalid", true, "javascript", "http://proxy.test/v1/files/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.ImageResponseMode = "url"
+				c.TrustProxyHeaders = tt.trust
+			})
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.test/v1/chat/completions", nil)
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+			if got := fileBaseURL(r); got != tt.want {
+				t.Errorf("fileBaseURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
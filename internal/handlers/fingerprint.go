@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// addSystemFingerprint inserts system_fingerprint into a completion or chunk
+// that lacks one. It runs on every stream chunk, so the field is spliced in
+// after the opening brace instead of re-encoding the payload. Payloads
+// without choices (errors, [DONE]) are unchanged.
+//
+// The OpenAI-compatible endpoint reports the model but not the Gemini model
+// version, so the fingerprint passed in comes from the model name (see
+// translate.SystemFingerprint): it changes with the model, API version or
+// location, but not when Google updates the model behind the same name.
+func addSystemFingerprint(payload []byte, fingerprint string) []byte {
+	body := bytes.TrimLeft(payload, " \t\r\n")
+	if fingerprint == "" || len(body) == 0 || body[0] != '{' ||
+		!bytes.Contains(body, []byte(`"choices"`)) || bytes.Contains(body, []byte(`"system_fingerprint"`)) {
+		return payload
+	}
+
+	field, _ := json.Marshal(fingerprint)
+	rest := bytes.TrimLeft(body[1:], " \t\r\n")
+	result := make([]byte, 0, len(body)+len(field)+24)
+	result = append(result, `{"system_fingerprint":`...)
+	result = append(result, field...)
+	if len(rest) > 0 && rest[0] != '}' {
+		result = append(result, ',')
+	}
+	return append(result, rest...)
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAddSystemFingerprint(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     string
+		fingerprint string
+		want        string
+	}{
+		{
+			name:        "completion",
+			payload:     `{"id":"c1","choices":[]}`,
+			fingerprint: "fp_1",
+			want:        `{"system_fingerprint":"fp_1","id":"c1","choices":[]}`,
+		},
+		{
+			name:        "leading whitespace",
+			payload:     ` { "choices":[]}`,
+			fingerprint: "fp_1",
+			want:        `{"system_fingerprint":"fp_1","choices":[]}`,
+		},
+		{
+			name:        "already set upstream",
+			payload:     `{"choices":[],"system_fingerprint":"fp_up"}`,
+			fingerprint: "fp_1",
+			want:        `{"choices":[],"system_fingerprint":"fp_up"}`,
+		},
+		{
+			name:        "field name quoted in content",
+			payload:     `{"choices":[{"delta":{"content":"\"system_fingerprint\""}}]}`,
+			fingerprint: "fp_1",
+			want:        `{"system_fingerprint":"fp_1","choices":[{"delta":{"content":"\"system_fingerprint\""}}]}`,
+		},
+		{name: "no fingerprint", payload: `{"choices":[]}`, want: `{"choices":[]}`},
+		{name: "error", payload: `{"error":{"message":"x"}}`, fingerprint: "fp_1", want: `{"error":{"message":"x"}}`},
+		{name: "done", payload: `[DONE]`, fingerprint: "fp_1", want: `[DONE]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(addSystemFingerprint([]byte(tt.payload), tt.fingerprint))
+			if got != tt.want {
+				t.Errorf("addSystemFingerprint = %s, want %s", got, tt.want)
+			}
+			if got != tt.payload && !json.Valid([]byte(got)) {
+				t.Errorf("result is not valid JSON: %s", got)
+			}
+		})
+	}
+}
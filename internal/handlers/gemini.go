@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,11 +12,16 @@ import (
 	"regexp"
 	"strings"
 
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/keys"
 	"vertex2api-golang/internal/models"
+	"vertex2api-golang/internal/translate"
 )
 
-// modelActionPattern parses Gemini API path format: models/{model}:{action}
-var modelActionPattern = regexp.MustCompile(`^models/([^:]+):(.+)$`)
+// modelActionPattern parses Gemini API path format: models/{model}:{action},
+// also accepting the fully-qualified Vertex form
+// publishers/google/models/{model}:{action}
+var modelActionPattern = regexp.MustCompile(`^(?:publishers/google/)?models/([^:/]+):(.+)$`)
 
 // geminiModel represents a model in the Gemini API format
 type geminiModel struct {
@@ -38,7 +44,7 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 	matches := modelActionPattern.FindStringSubmatch(path)
 
 	if len(matches) != 3 {
-		sendError(w, http.StatusBadRequest, "invalid_request", "Invalid path format. Expected: /gemini/v1beta/models/{model}:{action}")
+		sendError(w, http.StatusBadRequest, "invalid_request", "Invalid path format. Expected: /gemini/v1beta/models/{model}:{action} or /gemini/v1beta/publishers/google/models/{model}:{action}")
 		return
 	}
 
@@ -47,6 +53,34 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("GeminiHandler: model=%s, action=%s", model, action)
 
+	if !isGeminiActionAllowed(action) {
+		sendError(w, http.StatusForbidden, "permission_denied", "Action not allowed: "+action)
+		return
+	}
+
+	if !models.IsModelAllowed(model) {
+		sendError(w, http.StatusForbidden, "permission_denied", "Model not allowed on this proxy: "+model)
+		return
+	}
+
+	if !checkCapacity(w) {
+		return
+	}
+
+	ctx := r.Context()
+	if action == "streamGenerateContent" {
+		if !acquireStreamSlot(w) {
+			return
+		}
+		defer releaseStreamSlot()
+		var done func()
+		var ok bool
+		if ctx, done, ok = beginStream(ctx, w); !ok {
+			return
+		}
+		defer done()
+	}
+
 	// Read request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -55,26 +89,29 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	log.Printf("GeminiHandler request body: %s", string(body))
+	if config.Get().LogBodies {
+		log.Printf("GeminiHandler request body: %s", truncateForLog(body))
+	}
 
 	// Get auth info
-	ctx := r.Context()
 	auth, err := keyManager.PickAuth(ctx)
 	if err != nil {
+		if errors.Is(err, keys.ErrBudgetExhausted) {
+			sendBudgetExhausted(w)
+			return
+		}
 		sendError(w, http.StatusInternalServerError, "server_error", "Failed to get auth: "+err.Error())
 		return
 	}
 
-	// Determine location - gemini-2.5/3 models require "global"
-	location := auth.Location
-	if strings.Contains(model, "gemini-2.5") || strings.Contains(model, "gemini-3") {
-		location = "global"
-	}
+	setKeyIndexHeader(w, auth.KeyIndex)
+	location := models.ResolveLocation(model, auth.Location)
 
 	// Build Gemini native endpoint URL
-	// Format: https://aiplatform.googleapis.com/v1/projects/{project}/locations/{location}/publishers/google/models/{model}:{action}?key={key}
+	// Format: https://aiplatform.googleapis.com/{version}/projects/{project}/locations/{location}/publishers/google/models/{model}:{action}?key={key}
 	url := fmt.Sprintf(
-		"https://aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:%s?key=%s",
+		"https://aiplatform.googleapis.com/%s/projects/%s/locations/%s/publishers/google/models/%s:%s?key=%s",
+		models.ResolveAPIVersion(model),
 		auth.ProjectID,
 		location,
 		model,
@@ -106,6 +143,9 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		log.Printf("GeminiHandler error: %v", err)
+		if sendTimeoutError(w, ctx) {
+			return
+		}
 		sendError(w, http.StatusInternalServerError, "server_error", err.Error())
 		return
 	}
@@ -117,7 +157,7 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 	if resp.StatusCode != http.StatusOK {
 		// Read error response; ignore read errors as we're already on error path
 		respBody, _ := io.ReadAll(resp.Body)
-		log.Printf("GeminiHandler error response: %s", string(respBody))
+		log.Printf("GeminiHandler error response: %s", truncateForLog(respBody))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(resp.StatusCode)
 		w.Write(respBody)
@@ -139,22 +179,48 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		translate.WriteSSERetry(w)
+
 		// Stream response
 		scanner := bufio.NewScanner(resp.Body)
 		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
 		lineCount := 0
+		inEvent := false
+		tokens := 0
 		for scanner.Scan() {
 			line := scanner.Text()
 			lineCount++
+			if n := geminiUsageTokens(line); n > 0 {
+				tokens = n
+			}
+
+			// SSE comments (heartbeats) are forwarded as standalone comment
+			// blocks between events; a comment inside an event is dropped so
+			// it cannot split the event's data lines
+			if isSSEComment(line) {
+				if !inEvent {
+					w.Write([]byte(line + "\n\n"))
+					flusher.Flush()
+				}
+				continue
+			}
+
+			inEvent = line != ""
 			w.Write([]byte(line + "\n"))
 			flusher.Flush()
 		}
 
 		if err := scanner.Err(); err != nil {
 			log.Printf("GeminiHandler stream scanner error: %v", err)
+			if streamsTerminated() {
+				// Server is shutting down: end with an error event instead of cutting the stream
+				w.Write([]byte(geminiShutdownEvent))
+				flusher.Flush()
+			}
 		}
 
+		keyManager.RecordTokens(auth.KeyIndex, tokens)
 		log.Printf("GeminiHandler stream completed, lines: %d", lineCount)
 	} else {
 		// Non-streaming response - copy headers then body
@@ -164,11 +230,43 @@ func GeminiHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		w.WriteHeader(resp.StatusCode)
-		n, _ := io.Copy(w, resp.Body)
+		respBody, _ := io.ReadAll(resp.Body)
+		n, _ := w.Write(respBody)
+		keyManager.RecordTokens(auth.KeyIndex, geminiUsageTokens(string(respBody)))
 		log.Printf("GeminiHandler non-streaming response, bytes: %d", n)
 	}
 }
 
+// geminiShutdownEvent ends a passthrough stream terminated by the shutdown
+// drain, in the Gemini error format
+const geminiShutdownEvent = `data: {"error":{"code":503,"message":"Server is shutting down, stream terminated","status":"UNAVAILABLE"}}` + "\n\n"
+
+// geminiUsageTokens returns the total token count of a Gemini response body
+// or SSE data line, or 0 when it reports no usage
+func geminiUsageTokens(data string) int {
+	data = strings.TrimPrefix(data, "data:")
+	if !strings.Contains(data, "usageMetadata") {
+		return 0
+	}
+	var resp struct {
+		UsageMetadata struct {
+			TotalTokenCount int `json:"totalTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	json.Unmarshal([]byte(data), &resp)
+	return resp.UsageMetadata.TotalTokenCount
+}
+
+// isGeminiActionAllowed checks the action against ALLOWED_GEMINI_ACTIONS ("*" allows all)
+func isGeminiActionAllowed(action string) bool {
+	for _, allowed := range config.Get().AllowedGeminiActions {
+		if allowed == "*" || allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
 // GeminiModelsHandler handles /gemini/v1beta/models endpoint
 func GeminiModelsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+// geminiRequest builds a POST to the Gemini passthrough
+func geminiRequest(path, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/gemini/v1beta/"+path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestGeminiActionAllowlist(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.AllowedGeminiActions = []string{"generateContent", "countTokens"}
+	})
+	var upstreamPath string
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"totalTokens":3}`)
+	})
+
+	tests := []struct {
+		name       string
+		action     string
+		wantStatus int
+	}{
+		{"allowed action", "countTokens", http.StatusOK},
+		{"disallowed action", "predictLongRunning", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamPath = ""
+			w := httptest.NewRecorder()
+			GeminiHandler(w, geminiRequest("models/gemini-2.5-flash:"+tt.action, `{"contents":[]}`))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			forwarded := strings.HasSuffix(upstreamPath, ":"+tt.action)
+			if forwarded != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("upstream path = %q, forwarded = %v", upstreamPath, forwarded)
+			}
+		})
+	}
+}
+
+func TestGeminiBodyLogging(t *testing.T) {
+	const prompt = "my secret prompt that should stay out of the logs"
+	tests := []struct {
+		name     string
+		enabled  bool // LOG_BODIES
+		max      int  // LOG_BODY_MAX_BYTES
+		wantBody string
+	}{
+		{"off by default", false, 1024, ""},
+		{"enabled", true, 1024, prompt},
+		{"enabled and truncated", true, 30, "...(truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.LogBodies = tt.enabled
+				c.LogBodyMax = tt.max
+			})
+			jsonUpstream(t, http.StatusOK, `{"totalTokens":3}`)
+			logs := captureLog(t)
+
+			body := `{"contents":[{"role":"user","parts":[{"text":"` + prompt + `"}]}]}`
+			GeminiHandler(httptest.NewRecorder(), geminiRequest("models/gemini-2.5-flash:countTokens", body))
+
+			if tt.wantBody == "" {
+				if strings.Contains(logs.String(), "secret") {
+					t.Errorf("request body logged with LOG_BODIES off:\n%s", logs)
+				}
+				return
+			}
+			if !strings.Contains(logs.String(), tt.wantBody) {
+				t.Errorf("log does not contain %q:\n%s", tt.wantBody, logs)
+			}
+			if tt.max < len(body) && strings.Contains(logs.String(), prompt) {
+				t.Errorf("body logged beyond LOG_BODY_MAX_BYTES=%d:\n%s", tt.max, logs)
+			}
+		})
+	}
+}
+
+func TestGeminiStreamComments(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.SSERetryMS = 0 })
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, ": heartbeat\n\n"+
+			`data: {"n":1}`+"\n: inside an event\n\n"+
+			": keepalive\n\n"+
+			`data: {"n":2}`+"\n\n")
+	})
+
+	w := httptest.NewRecorder()
+	GeminiHandler(w, geminiRequest("models/gemini-2.5-flash:streamGenerateContent?alt=sse", `{"contents":[]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	var events []string
+	for _, event := range strings.Split(w.Body.String(), "\n\n") {
+		if event = strings.TrimSpace(event); event != "" {
+			events = append(events, event)
+		}
+	}
+	want := []string{": heartbeat", `data: {"n":1}`, ": keepalive", `data: {"n":2}`}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestGeminiQualifiedModelPath(t *testing.T) {
+	var upstreamPath string
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		if strings.HasSuffix(r.URL.Path, ":streamGenerateContent") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, `data: {"candidates":[]}`+"\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"candidates":[]}`)
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantAction string
+	}{
+		{"short", "models/gemini-2.5-flash:generateContent", http.StatusOK, "generateContent"},
+		{"qualified", "publishers/google/models/gemini-2.5-flash:generateContent", http.StatusOK, "generateContent"},
+		{"short streaming", "models/gemini-2.5-flash:streamGenerateContent?alt=sse", http.StatusOK, "streamGenerateContent"},
+		{"qualified streaming", "publishers/google/models/gemini-2.5-flash:streamGenerateContent?alt=sse", http.StatusOK, "streamGenerateContent"},
+		{"other publisher", "publishers/acme/models/gemini-2.5-flash:generateContent", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamPath = ""
+			w := httptest.NewRecorder()
+			GeminiHandler(w, geminiRequest(tt.path, `{"contents":[]}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			// Both forms reach the same upstream model path
+			if !strings.HasSuffix(upstreamPath, "/publishers/google/models/gemini-2.5-flash:"+tt.wantAction) {
+				t.Errorf("upstream path = %q", upstreamPath)
+			}
+		})
+	}
+}
+
+func TestAPIVersionSelection(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.VertexAPIVersion = "v1beta1"
+		c.ModelAPIVersions = map[string]string{"gemini-2.5-pro": "v1"}
+	})
+	var upstreamPath string
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionBody)
+	})
+	chatCall := func(w http.ResponseWriter, model string) {
+		ChatCompletionsHandler(w, newChatRequest(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+	}
+	geminiCall := func(w http.ResponseWriter, model string) {
+		GeminiHandler(w, geminiRequest("models/"+model+":generateContent", `{"contents":[]}`))
+	}
+
+	tests := []struct {
+		name    string
+		model   string
+		call    func(w http.ResponseWriter, model string)
+		version string
+	}{
+		{"chat default", "gemini-2.5-flash", chatCall, "v1beta1"},
+		{"chat per model", "gemini-2.5-pro", chatCall, "v1"},
+		{"passthrough default", "gemini-2.5-flash", geminiCall, "v1beta1"},
+		{"passthrough per model", "gemini-2.5-pro", geminiCall, "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamPath = ""
+			w := httptest.NewRecorder()
+			tt.call(w, tt.model)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if !strings.HasPrefix(upstreamPath, "/"+tt.version+"/projects/") {
+				t.Errorf("upstream path = %q, want API version %s", upstreamPath, tt.version)
+			}
+		})
+	}
+}
+
+func TestPassthroughAndNativeClientShareAPIVersion(t *testing.T) {
+	var paths []string
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"candidates":[{"content":{"role":"model","parts":[{"text":"ok"}]},"finishReason":"STOP"}]}`)
+	})
+
+	for _, version := range []string{"v1beta1", "v1"} {
+		t.Run(version, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.VertexAPIVersion = version })
+			paths = nil
+
+			w := httptest.NewRecorder()
+			GeminiHandler(w, geminiRequest("models/gemini-2.5-flash:generateContent", `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("passthrough: status = %d: %s", w.Code, w.Body)
+			}
+			// /v1/responses goes through the native client
+			w = httptest.NewRecorder()
+			ResponsesHandler(w, httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{"model":"gemini-2.5-flash","input":"hi"}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("native client: status = %d: %s", w.Code, w.Body)
+			}
+
+			if len(paths) != 2 || paths[0] != paths[1] {
+				t.Fatalf("upstream paths = %q, want the same path from both", paths)
+			}
+			if !strings.HasPrefix(paths[0], "/"+version+"/") {
+				t.Errorf("upstream path = %q, want API version %s", paths[0], version)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	// One key with an inline project, so handler tests never run discovery
+	os.Setenv("VERTEX_EXPRESS_API_KEY", "test-key:test-project")
+	InitClient()
+	os.Exit(m.Run())
+}
+
+// useConfig makes a modified copy of the current config active for a test
+func useConfig(t *testing.T, modify func(c *config.Config)) {
+	t.Helper()
+	prev := config.Get()
+	next := *prev
+	modify(&next)
+	config.Override(&next)
+	t.Cleanup(func() { config.Override(prev) })
+}
+
+// captureLog collects log output for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return &buf
+}
+
+// redirectTransport sends every request to a test server, whatever its URL
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// stubUpstream sends every upstream request to handler for the rest of the
+// test. The raw proxy, the passthrough and the native client share the key
+// manager's HTTP client, so swapping its transport covers all of them.
+func stubUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	client := keyManager.GetHTTPClient()
+	prev := client.Transport
+	client.Transport = redirectTransport{target: target}
+	t.Cleanup(func() { client.Transport = prev })
+	return srv
+}
+
+// sseUpstream answers every request with the given SSE lines, each followed
+// by a blank line
+func sseUpstream(t *testing.T, lines ...string) *httptest.Server {
+	t.Helper()
+	return stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, line := range lines {
+			fmt.Fprintf(w, "%s\n\n", line)
+		}
+	})
+}
+
+// jsonUpstream answers every request with status and body
+func jsonUpstream(t *testing.T, status int, body string) *httptest.Server {
+	t.Helper()
+	return stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	})
+}
+
+// runStreamingProxy streams from the stubbed upstream with opts and returns
+// the response the client received
+func runStreamingProxy(t *testing.T, opts proxyOptions) *httptest.ResponseRecorder {
+	t.Helper()
+	if opts.tokens == nil {
+		opts.tokens = new(int)
+	}
+	w := httptest.NewRecorder()
+	if err := handleStreamingProxy(context.Background(), w, "https://upstream.test/chat/completions", []byte(`{}`), "gemini-2.5-flash", opts); err != nil {
+		t.Fatalf("handleStreamingProxy: %v", err)
+	}
+	return w
+}
+
+// sseData returns the data payloads of an SSE body in order
+func sseData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if payload, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, payload)
+		}
+	}
+	return data
+}
+
+// decodeChunk parses a stream chunk payload, failing the test if it is not JSON
+func decodeChunk(t *testing.T, payload string) streamChunk {
+	t.Helper()
+	var chunk streamChunk
+	if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+		t.Fatalf("chunk %q is not JSON: %v", payload, err)
+	}
+	return chunk
+}
+
+// newChatRequest builds a POST /v1/chat/completions request with a client credential
+func newChatRequest(body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer client-key")
+	return r
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// jsonModeInstruction is appended when a json_object response fails validation
+const jsonModeInstruction = "Your previous answer was not valid JSON. Respond with a single valid JSON object only, with no prose, markdown code fences or explanations."
+
+// normalizeJSONContent validates the first choice's content as JSON after
+// stripping leftover thinking tags and markdown code fences. It returns the
+// response with the cleaned content and whether the content is valid JSON.
+func normalizeJSONContent(respBody []byte) ([]byte, bool) {
+	var resp nonStreamResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil || len(resp.Choices) == 0 {
+		return respBody, false
+	}
+
+	content, ok := cleanJSONContent(resp.Choices[0].Message.Content)
+	if !ok {
+		return respBody, false
+	}
+
+	if content == resp.Choices[0].Message.Content {
+		return respBody, true
+	}
+	resp.Choices[0].Message.Content = content
+	result, err := json.Marshal(resp)
+	if err != nil {
+		return respBody, true
+	}
+	return result, true
+}
+
+// cleanJSONContent strips leftover thinking tags and markdown code fences from
+// content and reports whether the result is valid JSON
+func cleanJSONContent(content string) (string, bool) {
+	content = reasoningTagPattern.ReplaceAllString(content, "")
+	content = stripCodeFence(strings.TrimSpace(content))
+	return content, json.Valid([]byte(content))
+}
+
+// stripCodeFence removes a surrounding ```json ... ``` fence if present
+func stripCodeFence(s string) string {
+	if !strings.HasPrefix(s, "```") || !strings.HasSuffix(s, "```") || len(s) < 6 {
+		return s
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "```"), "```")
+	// Drop the optional language tag on the opening line
+	if idx := strings.Index(s, "\n"); idx >= 0 && !strings.ContainsAny(s[:idx], "{[") {
+		s = s[idx+1:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// appendJSONInstruction adds a stricter JSON-only user instruction to the request
+func appendJSONInstruction(body []byte) ([]byte, error) {
+	var rawReq map[string]json.RawMessage
+	if err := json.Unmarshal(body, &rawReq); err != nil {
+		return nil, err
+	}
+
+	var messages []json.RawMessage
+	if err := json.Unmarshal(rawReq["messages"], &messages); err != nil {
+		return nil, err
+	}
+
+	instruction, err := json.Marshal(map[string]string{
+		"role":    "user",
+		"content": jsonModeInstruction,
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, instruction)
+
+	if rawReq["messages"], err = json.Marshal(messages); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rawReq)
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+// completionWithContent is a non-streaming upstream answer carrying content
+func completionWithContent(content string) string {
+	encoded, _ := json.Marshal(content)
+	return fmt.Sprintf(`{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gemini-2.5-flash","choices":[{"index":0,"message":{"role":"assistant","content":%s},"finish_reason":"stop"}]}`, encoded)
+}
+
+func TestJSONModeEnforce(t *testing.T) {
+	tests := []struct {
+		name         string
+		answers      []string // upstream content per call
+		wantCalls    int
+		wantContent  string
+		wantRetryMsg bool // the second call carries the stricter instruction
+	}{
+		{"valid", []string{`{"a":1}`}, 1, `{"a":1}`, false},
+		{"fenced with thinking tags", []string{"<vertex_think_tag>hmm</vertex_think_tag>```json\n{\"a\":1}\n```"}, 1, `{"a":1}`, false},
+		{"invalid then corrected", []string{`Sure! Here it is: {"a":1}`, `{"a":2}`}, 2, `{"a":2}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.JSONModeEnforce = true })
+			var calls []string
+			stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Messages []struct {
+						Content string `json:"content"`
+					} `json:"messages"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				calls = append(calls, body.Messages[len(body.Messages)-1].Content)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, completionWithContent(tt.answers[min(len(calls), len(tt.answers))-1]))
+			})
+
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","response_format":{"type":"json_object"},"messages":[{"role":"user","content":"give me json"}]}`))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("upstream calls = %d, want %d", len(calls), tt.wantCalls)
+			}
+			if tt.wantRetryMsg && calls[1] != jsonModeInstruction {
+				t.Errorf("retry ends with %q, want the JSON instruction", calls[1])
+			}
+			var resp nonStreamResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response is not JSON: %s", w.Body)
+			}
+			if got := strings.TrimSpace(resp.Choices[0].Message.Content); got != tt.wantContent {
+				t.Errorf("content = %q, want %q", got, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestJSONModeStreamAfterThinking(t *testing.T) {
+	deltas := []string{"<vertex_think", "_tag>the user wants {json}", "</vertex_thi", "nk_tag>", "```json\n{\"a\":", " [1, 2]}", "\n```"}
+	lines := make([]string, 0, len(deltas)+2)
+	for _, delta := range deltas {
+		encoded, _ := json.Marshal(delta)
+		lines = append(lines, fmt.Sprintf(`data: {"id":"c1","choices":[{"index":0,"delta":{"content":%s}}]}`, encoded))
+	}
+	lines = append(lines, `data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`, `data: [DONE]`)
+
+	tests := []struct {
+		name        string
+		enforce     bool
+		wantContent string
+	}{
+		{"thinking separated", false, "```json\n{\"a\": [1, 2]}\n```"},
+		{"buffered and validated", true, `{"a": [1, 2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+			sseUpstream(t, lines...)
+			w := runStreamingProxy(t, proxyOptions{enforceJSON: tt.enforce})
+
+			var content, reasoning strings.Builder
+			for _, payload := range sseData(w.Body.String()) {
+				if payload == "[DONE]" {
+					continue
+				}
+				for _, choice := range decodeChunk(t, payload).Choices {
+					content.WriteString(choice.Delta.Content)
+					reasoning.WriteString(choice.Delta.ReasoningContent)
+				}
+			}
+			if content.String() != tt.wantContent {
+				t.Errorf("content = %q, want %q", content.String(), tt.wantContent)
+			}
+			if reasoning.String() != "the user wants {json}" {
+				t.Errorf("reasoning = %q, want the thinking text", reasoning.String())
+			}
+			if tt.enforce && !json.Valid([]byte(content.String())) {
+				t.Errorf("concatenated content %q is not valid JSON", content.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"fmt"
+
+	"vertex2api-golang/internal/config"
+)
+
+// truncateForLog limits a body to LOG_BODY_MAX_BYTES for logging, noting how much was cut
+func truncateForLog(body []byte) string {
+	limit := config.Get().LogBodyMax
+	if limit <= 0 || len(body) <= limit {
+		return string(body)
+	}
+	return fmt.Sprintf("%s...(truncated %d bytes)", body[:limit], len(body)-limit)
+}
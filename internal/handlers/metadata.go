@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// OpenAI request metadata and store.
+//
+// "metadata" is a map of client key-values used for correlation, and "store"
+// asks for the exchange to be kept. Vertex knows neither, so both are removed
+// from the upstream body. Metadata travels with the request context into the
+// request log and the audit line; store=true makes the audit line include the
+// prompt and response in full instead of only their digests.
+
+// maxMetadataPairs and maxMetadataValueLen mirror OpenAI's metadata limits
+const (
+	maxMetadataPairs    = 16
+	maxMetadataKeyLen   = 64
+	maxMetadataValueLen = 512
+)
+
+type metadataKey struct{}
+
+// validateMetadata applies OpenAI's limits to a request's metadata map
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataPairs {
+		return fmt.Errorf("metadata has %d entries, at most %d are allowed", len(metadata), maxMetadataPairs)
+	}
+	for k, v := range metadata {
+		if len(k) > maxMetadataKeyLen {
+			return fmt.Errorf("metadata key %q is longer than %d characters", k, maxMetadataKeyLen)
+		}
+		if len(v) > maxMetadataValueLen {
+			return fmt.Errorf("metadata value for %q is longer than %d characters", k, maxMetadataValueLen)
+		}
+	}
+	return nil
+}
+
+// withRequestMetadata attaches client metadata to a request context
+func withRequestMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	if len(metadata) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// requestMetadata returns the client metadata attached to ctx, if any
+func requestMetadata(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return metadata
+}
+
+// metadataTag formats metadata for log lines, "-" when there is none
+func metadataTag(metadata map[string]string) string {
+	if len(metadata) == 0 {
+		return "-"
+	}
+	// Map keys are marshalled in sorted order, so equal maps log identically
+	tag, err := json.Marshal(metadata)
+	if err != nil {
+		return "-"
+	}
+	return string(tag)
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// jsonExemptPrefixes lists endpoints that accept non-JSON bodies (multipart uploads)
+var jsonExemptPrefixes = []string{
+	"/v1/audio/",
+}
+
+// RequireJSON rejects POST requests whose body is not declared as application/json.
+// Requests without a Content-Type are allowed unless STRICT_CONTENT_TYPE is enabled.
+func RequireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || isJSONExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" {
+			if config.Get().StrictContentType {
+				sendError(w, http.StatusUnsupportedMediaType, "invalid_request", "Content-Type must be application/json")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// ParseMediaType strips parameters such as charset
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			sendError(w, http.StatusUnsupportedMediaType, "invalid_request", "Unsupported Content-Type: "+contentType+", expected application/json")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isJSONExempt reports whether the path accepts non-JSON request bodies
+func isJSONExempt(path string) bool {
+	for _, prefix := range jsonExemptPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecompressRequest transparently decodes gzip-encoded request bodies.
+// The decoded size is capped by MAX_DECOMPRESSED_MB to guard against zip bombs.
+func DecompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "invalid_request", "Invalid gzip body: "+err.Error())
+			return
+		}
+		defer gz.Close()
+
+		// Read one byte past the limit to detect oversized bodies
+		limit := int64(config.Get().MaxDecompressedMB) * 1024 * 1024
+		decoded, err := io.ReadAll(io.LimitReader(gz, limit+1))
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "invalid_request", "Invalid gzip body: "+err.Error())
+			return
+		}
+		if int64(len(decoded)) > limit {
+			sendError(w, http.StatusRequestEntityTooLarge, "invalid_request", "Decompressed request body exceeds "+strconv.Itoa(config.Get().MaxDecompressedMB)+"MB")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(decoded))
+		r.ContentLength = int64(len(decoded))
+		r.Header.Del("Content-Encoding")
+		r.Header.Set("Content-Length", strconv.Itoa(len(decoded)))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestTimeout applies REQUEST_TIMEOUT (seconds) to non-streaming requests and
+// STREAM_REQUEST_TIMEOUT to streaming ones. Clients may ask for a shorter
+// deadline with X-Request-Timeout ("30s" or "30"), capped by the server
+// timeout or MAX_CLIENT_TIMEOUT when none is set. The deadline is carried by
+// the request context, so upstream calls are cancelled when it expires, and a
+// clean 504 is returned if nothing was written yet.
+func RequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Get()
+		seconds := cfg.RequestTimeoutSec
+		if isStreamingRequest(r) {
+			seconds = cfg.StreamTimeoutSec
+		}
+		timeout := time.Duration(seconds) * time.Second
+
+		if header := r.Header.Get("X-Request-Timeout"); header != "" {
+			clientTimeout, err := parseClientTimeout(header)
+			if err != nil {
+				sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			limit := timeout
+			if limit <= 0 {
+				limit = time.Duration(cfg.MaxClientTimeoutSec) * time.Second
+			}
+			if limit > 0 && clientTimeout > limit {
+				clientTimeout = limit
+			}
+			timeout = clientTimeout
+		}
+
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{ResponseWriter: w}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+
+		if !tw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			sendError(w, http.StatusGatewayTimeout, "gateway_timeout", "Request timed out")
+		}
+	})
+}
+
+// parseClientTimeout parses an X-Request-Timeout value: a Go duration or a
+// number of seconds
+func parseClientTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.ParseFloat(value, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid X-Request-Timeout %q, expected a duration such as 30s", value)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid X-Request-Timeout %q, must be positive", value)
+	}
+	return d, nil
+}
+
+// isStreamingRequest peeks at the request to decide whether it will stream,
+// restoring the body for the handler
+func isStreamingRequest(r *http.Request) bool {
+	if strings.Contains(r.URL.Path, ":streamGenerateContent") {
+		return true
+	}
+	if r.Method != http.MethodPost || r.Body == nil {
+		return false
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(body, &req) == nil && req.Stream
+}
+
+// timeoutWriter records whether a response was started
+type timeoutWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.wroteHeader = true
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming support
+func (tw *timeoutWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// sendTimeoutError sends a 504 if the request context deadline has passed and
+// reports whether it did
+func sendTimeoutError(w http.ResponseWriter, ctx context.Context) bool {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+	sendError(w, http.StatusGatewayTimeout, "gateway_timeout", "Request timed out waiting for upstream")
+	return true
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// gzipBytes compresses data
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressRequest(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.MaxDecompressedMB = 1 })
+	plain := []byte(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		encoding   string
+		wantStatus int
+		wantBody   []byte // what the handler reads; nil when it must not run
+	}{
+		{"gzipped body", gzipBytes(t, plain), "gzip", http.StatusOK, plain},
+		{"plain body", plain, "", http.StatusOK, plain},
+		{"bomb-like body", gzipBytes(t, make([]byte, 2<<20)), "gzip", http.StatusRequestEntityTooLarge, nil},
+		{"not gzip", plain, "gzip", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			handler := DecompressRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+				if r.Header.Get("Content-Encoding") != "" {
+					t.Errorf("handler still sees Content-Encoding %q", r.Header.Get("Content-Encoding"))
+				}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if !bytes.Equal(got, tt.wantBody) {
+				t.Errorf("handler read %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.RetryMax = 0
+		c.RequestTimeoutSec = 1
+	})
+	cancelled := make(chan struct{})
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices a closed connection once the body is consumed
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	r := newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`)
+	// A shorter client deadline keeps the test fast; the server timeout still applies
+	r.Header.Set("X-Request-Timeout", "100ms")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	RequestTimeout(http.HandlerFunc(ChatCompletionsHandler)).ServeHTTP(w, r)
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, want it cut off at the deadline", elapsed)
+	}
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504: %s", w.Code, w.Body.String())
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("body %q is not a JSON error: %v", w.Body.String(), err)
+	}
+	if resp.Error.Type != "gateway_timeout" {
+		t.Errorf("error type = %q, want gateway_timeout", resp.Error.Type)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("upstream request was not cancelled at the deadline")
+	}
+}
+
+func TestClientTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		serverSec  int
+		maxSec     int
+		wantStatus int
+		want       time.Duration // deadline applied to the handler, 0 = none
+	}{
+		{"no header, no server timeout", "", 0, 600, http.StatusOK, 0},
+		{"duration", "30s", 0, 600, http.StatusOK, 30 * time.Second},
+		{"plain seconds", "2.5", 0, 600, http.StatusOK, 2500 * time.Millisecond},
+		{"shorter than the server timeout", "5s", 60, 600, http.StatusOK, 5 * time.Second},
+		{"clamped to the server timeout", "2m", 60, 600, http.StatusOK, time.Minute},
+		{"clamped to MAX_CLIENT_TIMEOUT", "1h", 0, 600, http.StatusOK, 10 * time.Minute},
+		{"not a duration", "soon", 60, 600, http.StatusBadRequest, 0},
+		{"not positive", "-5s", 60, 600, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.RequestTimeoutSec = tt.serverSec
+				c.MaxClientTimeoutSec = tt.maxSec
+			})
+			var got time.Duration
+			handler := RequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if deadline, ok := r.Context().Deadline(); ok {
+					got = time.Until(deadline)
+				}
+			}))
+			r := newChatRequest(`{"model":"gemini-2.5-flash","messages":[]}`)
+			if tt.header != "" {
+				r.Header.Set("X-Request-Timeout", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got > tt.want || got < tt.want-time.Second {
+				t.Errorf("deadline in %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
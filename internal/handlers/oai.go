@@ -3,17 +3,25 @@ package handlers
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"vertex2api-golang/internal/config"
 	"vertex2api-golang/internal/keys"
 	"vertex2api-golang/internal/models"
+	"vertex2api-golang/internal/translate"
 	"vertex2api-golang/internal/vertex"
 )
 
@@ -25,18 +33,11 @@ const (
 var (
 	keyManager *keys.KeyManager
 	httpClient *http.Client
+	// vertexClient calls the native Gemini API for translated endpoints
+	vertexClient *vertex.Client
 
 	// reasoningTagPattern matches the thinking tag and its content
 	reasoningTagPattern = regexp.MustCompile(`<` + ThinkingTagMarker + `>([\s\S]*?)</` + ThinkingTagMarker + `>`)
-
-	// safetySettings disables content filtering
-	safetySettings = []vertex.SafetySetting{
-		{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_NONE"},
-		{Category: "HARM_CATEGORY_HATE_SPEECH", Threshold: "BLOCK_NONE"},
-		{Category: "HARM_CATEGORY_SEXUALLY_EXPLICIT", Threshold: "BLOCK_NONE"},
-		{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Threshold: "BLOCK_NONE"},
-		{Category: "HARM_CATEGORY_CIVIC_INTEGRITY", Threshold: "BLOCK_NONE"},
-	}
 )
 
 // OpenAI-compatible request/response types for the proxy endpoint
@@ -58,19 +59,23 @@ type googleConfig struct {
 	SafetySettings   []vertex.SafetySetting `json:"safety_settings"`
 	ThoughtTagMarker string                 `json:"thought_tag_marker"`
 	ThinkingConfig   thinkingConfig         `json:"thinking_config"`
+	CachedContent    string                 `json:"cached_content,omitempty"`
+	Labels           map[string]string      `json:"labels,omitempty"`
 }
 
 type thinkingConfig struct {
 	IncludeThoughts bool `json:"include_thoughts"`
+	ThinkingBudget  *int `json:"thinking_budget,omitempty"`
 }
 
 // streamChunk represents a parsed SSE chunk for streaming responses
 type streamChunk struct {
-	ID      string         `json:"id"`
-	Object  string         `json:"object"`
-	Created int64          `json:"created"`
-	Model   string         `json:"model"`
-	Choices []streamChoice `json:"choices"`
+	ID      string           `json:"id"`
+	Object  string           `json:"object"`
+	Created int64            `json:"created"`
+	Model   string           `json:"model"`
+	Choices []streamChoice   `json:"choices"`
+	Usage   *translate.Usage `json:"usage,omitempty"`
 }
 
 type streamChoice struct {
@@ -87,30 +92,54 @@ type streamDelta struct {
 
 // nonStreamResponse represents the non-streaming API response
 type nonStreamResponse struct {
-	ID      string            `json:"id"`
-	Object  string            `json:"object"`
-	Created int64             `json:"created"`
-	Model   string            `json:"model"`
-	Choices []responseChoice  `json:"choices"`
-	Usage   *responseUsage    `json:"usage,omitempty"`
+	ID      string           `json:"id"`
+	Object  string           `json:"object"`
+	Created int64            `json:"created"`
+	Model   string           `json:"model"`
+	Choices []responseChoice `json:"choices"`
+	Usage   *responseUsage   `json:"usage,omitempty"`
 }
 
 type responseChoice struct {
-	Index        int             `json:"index"`
-	Message      responseMessage `json:"message"`
-	FinishReason string          `json:"finish_reason"`
+	Index        int                       `json:"index"`
+	Message      responseMessage           `json:"message"`
+	FinishReason string                    `json:"finish_reason"`
+	Logprobs     *translate.ChoiceLogprobs `json:"logprobs,omitempty"`
 }
 
 type responseMessage struct {
-	Role             string `json:"role"`
-	Content          string `json:"content"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string          `json:"role"`
+	Content          string          `json:"content"`
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ToolCalls        json.RawMessage `json:"tool_calls,omitempty"`
 }
 
 type responseUsage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// Estimated marks usage synthesized by ESTIMATE_USAGE
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// proxyOptions controls how an upstream response is shaped for the client
+type proxyOptions struct {
+	includeRaw    bool         // attach the upstream OpenAI-compatible payload as _raw (debug only)
+	enforceJSON   bool         // validate json_object content
+	singleChoice  bool         // return only the first candidate
+	bestOf        bool         // return only the best candidate (best_of)
+	estimateUsage bool         // synthesize usage when upstream omits it
+	unbillReason  bool         // leave reasoning tokens out of reported usage (BILL_REASONING_TOKENS=false)
+	nestReasoning bool         // emit reasoning as a nested object (REASONING_SHAPE=object)
+	audit         *auditRecord // nil when auditing is disabled
+	tokens        *int         // total tokens reported by upstream, for key budgets
+	fileBaseURL   string       // replace image data URLs with stored files (IMAGE_RESPONSE_MODE=url)
+	fileOwner     string       // owner of the stored image files, see fileOwner
+	ephemeral     bool         // stream reasoning without recording it; omit it from responses
+	retryOnEmpty  bool         // fail empty completions with errEmptyResponse (RETRY_ON_EMPTY)
+	runningUsage  bool         // annotate stream chunks with a running usage estimate (debug only)
+	client        string       // clientCredential of the caller, owner of the replay stream
+	fingerprint   string       // system_fingerprint for the model of this attempt
 }
 
 // errorResponse represents an OpenAI-compatible error response
@@ -128,6 +157,7 @@ type errorDetail struct {
 func InitClient() {
 	keyManager = keys.GetManager()
 	httpClient = keyManager.GetHTTPClient()
+	vertexClient = vertex.NewClient()
 }
 
 // ModelsHandler handles /v1/models endpoint
@@ -149,6 +179,23 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkCapacity(w) {
+		return
+	}
+
+	// Resume a previously started stream instead of generating again
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		if rs, seq, ok := lookupReplay(r, lastEventID); ok {
+			if !checkRateLimit(w, r, "") {
+				return
+			}
+			log.Printf("ChatCompletions: resuming stream from Last-Event-ID=%s", lastEventID)
+			resumeStream(w, r, rs, seq)
+			return
+		}
+		log.Printf("ChatCompletions: unknown or expired Last-Event-ID=%s, starting new stream", lastEventID)
+	}
+
 	// Read request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -159,26 +206,84 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse to get model and stream flag
 	var req struct {
-		Model  string `json:"model"`
-		Stream bool   `json:"stream"`
+		Model          string `json:"model"`
+		Stream         bool   `json:"stream"`
+		CachedContent  string `json:"cached_content"`
+		User           string `json:"user"`
+		ResponseFormat *struct {
+			Type string `json:"type"`
+		} `json:"response_format"`
+		Modalities       []string          `json:"modalities"`
+		IncludeReasoning *bool             `json:"include_reasoning"`
+		N                *int              `json:"n"`
+		BestOf           *int              `json:"best_of"`
+		Tools            []json.RawMessage `json:"tools"`
+		Metadata         map[string]string `json:"metadata"`
+		Store            bool              `json:"store"`
+		// Stream reasoning live but keep it out of anything persisted
+		EphemeralReasoning bool `json:"ephemeral_reasoning"`
 	}
 	if err := json.Unmarshal(body, &req); err != nil {
 		sendError(w, http.StatusBadRequest, "invalid_request", "Invalid JSON: "+err.Error())
 		return
 	}
 
+	// Rate limiting needs the user field, so it runs once the body is parsed
+	if !checkRateLimit(w, r, req.User) {
+		return
+	}
+
 	if req.Model == "" {
 		sendError(w, http.StatusBadRequest, "invalid_request", "Model is required")
 		return
 	}
 
+	if req.CachedContent != "" {
+		if err := vertex.ValidateCachedContentName(req.CachedContent); err != nil {
+			sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	}
+
+	if err := validateMetadata(req.Metadata); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	r = r.WithContext(withRequestMetadata(r.Context(), req.Metadata))
+
+	labels, err := requestLabels(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if !models.IsModelAllowed(req.Model) {
+		sendError(w, http.StatusForbidden, "permission_denied", "Model not allowed on this proxy: "+req.Model)
+		return
+	}
+
 	// Resolve model alias
 	actualModel, _ := models.ResolveModel(req.Model)
 
-	// OpenAI-compatible endpoint requires "google/" prefix
-	vertexModelID := "google/" + actualModel
+	if err := translate.ValidateModalities(actualModel, req.Modalities); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	// X-Gen-* headers override generation parameters from the body
+	overrides, err := translate.ParseGenerationOverrides(r.Header, actualModel)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	// OpenAI-compatible endpoint requires a publisher prefix ("google/" by default)
+	vertexModelID := config.Get().OAIModelPrefix + actualModel
 
-	log.Printf("ChatCompletions: model=%s (actual=%s, vertex=%s), stream=%v", req.Model, actualModel, vertexModelID, req.Stream)
+	// The user identifier is only kept internally (hashed), never logged raw
+	userTag := hashUser(req.User)
+
+	log.Printf("ChatCompletions: model=%s (actual=%s, vertex=%s), stream=%v, user=%s, metadata=%s", req.Model, actualModel, vertexModelID, req.Stream, userTag, metadataTag(requestMetadata(r.Context())))
 
 	// Build the request with google config for thinking chain support
 	// We merge the original request with our additions using a two-pass approach
@@ -188,7 +293,77 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set the model with google/ prefix
+	// FORCE_NON_STREAMING or X-Force-Buffer: for network paths where SSE is
+	// unreliable, a streaming request is answered with one complete response.
+	// Upstream is then called without streaming as well, so the answer takes
+	// exactly the stream=false path.
+	if req.Stream && forceBuffer(r) {
+		log.Printf("ChatCompletions: buffering stream=true request into a single response")
+		req.Stream = false
+		rawReq["stream"] = json.RawMessage("false")
+		delete(rawReq, "stream_options")
+	}
+
+	// best_of becomes n candidates, of which one is returned
+	if err := validateBestOf(req.BestOf, req.N, req.Stream); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	bestOf := req.BestOf != nil && *req.BestOf > 1
+	if bestOf {
+		rawReq["n"] = json.RawMessage(strconv.Itoa(*req.BestOf))
+	}
+	delete(rawReq, "best_of")
+
+	// Hash the prompt as the client sent it, before any of our additions
+	audit := newAuditRecord(r.Context(), userTag, rawReq["messages"], req.Store)
+
+	// metadata and store are ours to interpret; Vertex rejects unknown fields
+	delete(rawReq, "metadata")
+	delete(rawReq, "store")
+
+	// Legacy functions/function_call become tools/tool_choice
+	if translate.UpgradeLegacyFunctions(rawReq) {
+		json.Unmarshal(rawReq["tools"], &req.Tools)
+	}
+
+	// Drop duplicate tool names and enforce MAX_TOOLS before Vertex rejects the request
+	if len(req.Tools) > 0 {
+		tools, dropped, err := translate.DedupeTools(req.Tools)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if dropped > 0 {
+			log.Printf("ChatCompletions: dropped %d duplicate tools", dropped)
+			if toolsBytes, err := json.Marshal(tools); err == nil {
+				rawReq["tools"] = toolsBytes
+			}
+		}
+	}
+
+	// Normalize malformed histories instead of letting Vertex reject them
+	if config.Get().RepairConversation {
+		var messages []json.RawMessage
+		if err := json.Unmarshal(rawReq["messages"], &messages); err == nil {
+			repaired, changes := translate.RepairMessages(messages)
+			for _, change := range changes {
+				log.Printf("ChatCompletions: repaired conversation: %s", change)
+			}
+			if len(changes) > 0 {
+				if messagesBytes, err := json.Marshal(repaired); err == nil {
+					rawReq["messages"] = messagesBytes
+				}
+			}
+		}
+	}
+
+	// Drop the oldest turns of over-long histories instead of failing upstream
+	if strategy := config.Get().AutoTrimContext; strategy == translate.TrimDropOldest || strategy == translate.TrimPlaceholder {
+		trimContext(rawReq, actualModel, strategy)
+	}
+
+	// Set the model with the publisher prefix
 	modelBytes, err := json.Marshal(vertexModelID)
 	if err != nil {
 		sendError(w, http.StatusInternalServerError, "server_error", "Failed to encode model")
@@ -196,11 +371,18 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	rawReq["model"] = modelBytes
 
-	// Add google config for thinking chain support
+	// Add google config for thinking chain support, keeping a client-requested thinking budget.
+	// include_reasoning=false keeps thinking upstream but leaves thoughts out of the response.
+	includeReasoning := req.IncludeReasoning == nil || *req.IncludeReasoning
 	gConfig := googleConfig{
-		SafetySettings:   safetySettings,
+		SafetySettings:   vertex.SafetySettingsFor(actualModel),
 		ThoughtTagMarker: ThinkingTagMarker,
-		ThinkingConfig:   thinkingConfig{IncludeThoughts: true},
+		ThinkingConfig:   thinkingConfig{IncludeThoughts: includeReasoning, ThinkingBudget: clientThinkingBudget(rawReq["google"])},
+		CachedContent:    req.CachedContent,
+		Labels:           labels,
+	}
+	if overrides.ThinkingBudget != nil {
+		gConfig.ThinkingConfig.ThinkingBudget = overrides.ThinkingBudget
 	}
 	googleBytes, err := json.Marshal(gConfig)
 	if err != nil {
@@ -208,6 +390,34 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	rawReq["google"] = googleBytes
+	// cached_content is an extension field; it travels inside the google config
+	delete(rawReq, "cached_content")
+	// Vertex does not accept the OpenAI user field or our include_reasoning extension
+	delete(rawReq, "user")
+	delete(rawReq, "include_reasoning")
+	delete(rawReq, "ephemeral_reasoning")
+	// Cap output tokens when the client did not ask for a limit
+	if def := config.Get().DefaultMaxOutputTokens; def > 0 {
+		_, hasMax := rawReq["max_tokens"]
+		_, hasMaxCompletion := rawReq["max_completion_tokens"]
+		if !hasMax && !hasMaxCompletion {
+			if maxBytes, err := json.Marshal(def); err == nil {
+				rawReq["max_tokens"] = maxBytes
+			}
+		}
+	}
+	// Predicted outputs have no Gemini equivalent; a future mapping belongs here
+	if _, ok := rawReq["prediction"]; ok {
+		delete(rawReq, "prediction")
+		if config.Get().DebugMode {
+			log.Printf("ChatCompletions: stripped unsupported prediction field")
+		}
+	}
+	overrides.ApplyRaw(rawReq)
+	// Parameters the model is configured to reject (UNSUPPORTED_PARAMS)
+	if dropped := translate.DropUnsupportedParams(rawReq, actualModel); len(dropped) > 0 {
+		log.Printf("ChatCompletions: dropped unsupported parameters for %s: %v", actualModel, dropped)
+	}
 
 	body, err = json.Marshal(rawReq)
 	if err != nil {
@@ -215,53 +425,183 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward to Vertex AI OpenAI-compatible endpoint
+	// Raw upstream payloads are a debug-only extension
+	cfg := config.Get()
+	opts := proxyOptions{
+		includeRaw:    cfg.DebugMode && (cfg.IncludeRawResponse || strings.EqualFold(r.Header.Get("X-Include-Raw"), "true")),
+		enforceJSON:   cfg.JSONModeEnforce && req.ResponseFormat != nil && req.ResponseFormat.Type == "json_object",
+		singleChoice:  !cfg.ReturnAllCandidates && (req.N == nil || *req.N <= 1) && !bestOf,
+		bestOf:        bestOf,
+		estimateUsage: cfg.EstimateUsage,
+		unbillReason:  !cfg.BillReasoningTokens,
+		nestReasoning: translate.ReasoningAsObject(),
+		audit:         audit,
+		tokens:        new(int),
+		fileBaseURL:   fileBaseURL(r),
+		fileOwner:     fileOwner(r),
+		ephemeral:     req.EphemeralReasoning,
+		runningUsage:  cfg.DebugMode && cfg.StreamUsageEstimate,
+		client:        clientCredential(r),
+	}
+
+	// A stream holds its slot and its drain registration across retries
 	ctx := r.Context()
+	if req.Stream {
+		if !acquireStreamSlot(w) {
+			return
+		}
+		defer releaseStreamSlot()
+		var done func()
+		var ok bool
+		if ctx, done, ok = beginStream(ctx, w); !ok {
+			return
+		}
+		defer done()
+	}
+
+	// Forward to Vertex AI OpenAI-compatible endpoint
 	retryConfig := keys.GetRetryConfig()
+	retryStart := time.Now()
 	var lastErr error
 	keyIndex := -1
+	triedModels := map[string]bool{actualModel: true}
+	clampedModels := map[string]bool{}
 
 	for attempt := 0; attempt <= retryConfig.MaxRetries; attempt++ {
 		var auth *keys.AuthInfo
 		var err error
 
-		if keyIndex < 0 {
+		if cfg.EchoMode {
+			// Nothing leaves the process, so no real key is needed
+			auth = &keys.AuthInfo{ProjectID: "echo", Location: "echo", KeyIndex: -1}
+		} else if keyIndex < 0 {
 			auth, err = keyManager.PickAuth(ctx)
 		} else {
 			auth, err = keyManager.PickAuthAtIndex(ctx, keyIndex)
 		}
 
 		if err != nil {
+			if sendTimeoutError(w, ctx) {
+				return
+			}
+			if errors.Is(err, keys.ErrBudgetExhausted) {
+				sendBudgetExhausted(w)
+				return
+			}
 			sendError(w, http.StatusInternalServerError, "server_error", "Failed to get auth: "+err.Error())
 			return
 		}
 
 		// Build Vertex AI OpenAI-compatible endpoint URL
-		// Format: https://aiplatform.googleapis.com/v1beta1/projects/{project}/locations/{location}/endpoints/openapi/chat/completions?key={key}
+		// Format: https://aiplatform.googleapis.com/{version}/projects/{project}/locations/{location}/endpoints/openapi/chat/completions?key={key}
 		url := fmt.Sprintf(
-			"https://aiplatform.googleapis.com/v1beta1/projects/%s/locations/%s/endpoints/openapi/chat/completions?key=%s",
+			"https://aiplatform.googleapis.com/%s/projects/%s/locations/%s/endpoints/openapi/chat/completions?key=%s",
+			models.ResolveAPIVersion(actualModel),
 			auth.ProjectID,
-			auth.Location,
+			models.ResolveLocation(actualModel, auth.Location),
 			auth.APIKey,
 		)
 
+		setKeyIndexHeader(w, auth.KeyIndex)
+		setRetryAttemptHeader(w, attempt)
+		// The last attempt returns an empty completion instead of failing
+		opts.retryOnEmpty = cfg.RetryOnEmpty && attempt < retryConfig.MaxRetries
+		opts.fingerprint = translate.SystemFingerprint(actualModel)
 		startTime := time.Now()
+		*opts.tokens = 0
 
 		if req.Stream {
-			err = handleStreamingProxy(w, url, body)
+			err = handleStreamingProxy(ctx, w, url, body, actualModel, opts)
 		} else {
-			err = handleNonStreamingProxy(w, url, body)
+			err = handleNonStreamingProxy(ctx, w, url, body, opts)
 		}
 
 		latency := time.Since(startTime)
+		// Stream duration depends on output length, so only its outcome is recorded
+		if req.Stream {
+			keyManager.RecordResult(auth.KeyIndex, 0, err)
+		} else {
+			keyManager.RecordResult(auth.KeyIndex, latency, err)
+		}
+		keyManager.RecordTokens(auth.KeyIndex, *opts.tokens)
 
 		if err == nil {
-			log.Printf("ChatCompletions success: model=%s, key_index=%d, latency=%v", actualModel, auth.KeyIndex, latency)
+			log.Printf("ChatCompletions success: model=%s, key_index=%d, latency=%v, user=%s", actualModel, auth.KeyIndex, latency, userTag)
+			audit.write(actualModel)
 			return
 		}
 
 		lastErr = err
-		log.Printf("ChatCompletions attempt %d failed: model=%s, key_index=%d, error=%v", attempt+1, actualModel, auth.KeyIndex, err)
+		audit.reset()
+
+		// Already retried once; report it instead of spending the retry budget
+		if errors.Is(err, errMalformedFunctionCall) {
+			log.Printf("ChatCompletions malformed function call: model=%s, key_index=%d, user=%s", actualModel, auth.KeyIndex, userTag)
+			sendError(w, http.StatusBadGateway, "upstream_error", err.Error())
+			return
+		}
+		log.Printf("ChatCompletions attempt %d failed: model=%s, key_index=%d, user=%s, error=%v", attempt+1, actualModel, auth.KeyIndex, userTag, err)
+
+		// A rejected thinking budget is clamped to the model ceiling and
+		// re-issued right away, once per model and without counting an attempt
+		if isThinkingBudgetError(err) && gConfig.ThinkingConfig.ThinkingBudget != nil && !clampedModels[actualModel] {
+			clampedModels[actualModel] = true
+			requested := *gConfig.ThinkingConfig.ThinkingBudget
+			ceiling := models.ThinkingBudgetCeiling(actualModel)
+			if ceiling > 0 && requested > ceiling {
+				gConfig.ThinkingConfig.ThinkingBudget = &ceiling
+			} else {
+				// Unknown ceiling or already within it: let the model use its default
+				gConfig.ThinkingConfig.ThinkingBudget = nil
+			}
+			log.Printf("ChatCompletions thinking budget downgraded: model=%s, requested=%d, ceiling=%d", actualModel, requested, ceiling)
+			if googleBytes, err := json.Marshal(gConfig); err == nil {
+				rawReq["google"] = googleBytes
+				if newBody, err := json.Marshal(rawReq); err == nil {
+					body = newBody
+					attempt--
+					continue
+				}
+			}
+		}
+
+		// Availability errors switch to the configured fallback model right away
+		if fallback, ok := fallbackModel(actualModel, err, triedModels); ok {
+			log.Printf("ChatCompletions falling back: model=%s -> %s", actualModel, fallback)
+			triedModels[fallback] = true
+			actualModel = fallback
+			vertexModelID = cfg.OAIModelPrefix + fallback
+			// The fallback may belong to a family with different safety categories
+			gConfig.SafetySettings = vertex.SafetySettingsFor(fallback)
+			if dropped := translate.DropUnsupportedParams(rawReq, fallback); len(dropped) > 0 {
+				log.Printf("ChatCompletions: dropped unsupported parameters for %s: %v", fallback, dropped)
+			}
+			if googleBytes, err := json.Marshal(gConfig); err == nil {
+				rawReq["google"] = googleBytes
+			}
+			if modelBytes, err := json.Marshal(vertexModelID); err == nil {
+				rawReq["model"] = modelBytes
+				if newBody, err := json.Marshal(rawReq); err == nil {
+					body = newBody
+					w.Header().Set("X-Model-Fallback", req.Model+" -> "+fallback)
+					// Each model is tried once, so the switch is not counted
+					// as an attempt and works with RETRY_MAX=0 too
+					attempt--
+					continue
+				}
+			}
+		}
+
+		// The request itself was rejected: another attempt would fail the same way
+		if upErr, ok := asUpstreamError(err); ok && !upErr.retryable() {
+			log.Printf("ChatCompletions not retrying upstream status %d: model=%s", upErr.status, actualModel)
+			break
+		}
+
+		// An empty completion says nothing about the key that served it
+		if !errors.Is(err, errEmptyResponse) {
+			keyManager.Penalize(auth.KeyIndex, err)
+		}
 
 		// Switch to next key for retry
 		if retryConfig.SwitchKey && keyManager.KeyCount() > 1 {
@@ -269,47 +609,432 @@ func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if attempt < retryConfig.MaxRetries {
+			if retryConfig.BudgetExhausted(ctx, retryStart) {
+				log.Printf("ChatCompletions retry budget exhausted after %d attempts: model=%s", attempt+1, actualModel)
+				break
+			}
 			time.Sleep(time.Duration(retryConfig.IntervalMS) * time.Millisecond)
 		}
 	}
 
-	sendError(w, http.StatusInternalServerError, "server_error", "All retries exhausted: "+lastErr.Error())
+	errMsg := "All retries exhausted: " + lastErr.Error()
+	if isModelNotFoundError(lastErr) {
+		// Surface the exact upstream model ID so prefix/mapping mistakes are diagnosable
+		errMsg = fmt.Sprintf("Model not found upstream (vertex model ID sent: %q, check OAI_MODEL_PREFIX/MODEL_MAP): %s", vertexModelID, lastErr.Error())
+	}
+	if sendTimeoutError(w, ctx) || !checkCapacity(w) {
+		return
+	}
+	// Upstream answers are mapped to a client status (see upstreamError.clientStatus)
+	if upErr, ok := asUpstreamError(lastErr); ok {
+		if !isModelNotFoundError(lastErr) {
+			errMsg = upErr.message()
+			if upErr.retryable() {
+				errMsg = "All retries exhausted: " + errMsg
+			}
+		}
+		sendError(w, upErr.clientStatus(), upErr.errorType(), errMsg)
+		return
+	}
+	sendError(w, http.StatusInternalServerError, "server_error", errMsg)
 }
 
-func handleNonStreamingProxy(w http.ResponseWriter, url string, body []byte) error {
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// requestLabels merges VERTEX_LABELS defaults with the X-Vertex-Labels header
+// (header wins) and validates the result
+func requestLabels(r *http.Request) (map[string]string, error) {
+	labels := make(map[string]string)
+	for k, v := range config.Get().VertexLabels {
+		labels[k] = v
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	if header := r.Header.Get("X-Vertex-Labels"); header != "" {
+		for _, pair := range strings.Split(header, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid X-Vertex-Labels entry %q, expected key=value", pair)
+			}
+			labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+	if len(labels) == 0 {
+		return nil, nil
 	}
-	defer resp.Body.Close()
+	if err := vertex.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
 
-	respBody, err := io.ReadAll(resp.Body)
+// clientThinkingBudget reads google.thinking_config.thinking_budget from the client request
+func clientThinkingBudget(raw json.RawMessage) *int {
+	if len(raw) == 0 {
+		return nil
+	}
+	var g struct {
+		ThinkingConfig struct {
+			ThinkingBudget *int `json:"thinking_budget"`
+		} `json:"thinking_config"`
+	}
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return nil
+	}
+	return g.ThinkingConfig.ThinkingBudget
+}
+
+// trimContext removes the oldest messages from rawReq when the estimated
+// prompt plus the requested output exceeds the model's context window
+func trimContext(rawReq map[string]json.RawMessage, model, strategy string) {
+	window := models.ContextWindow(model)
+	if window <= 0 {
+		return
+	}
+
+	var messages []json.RawMessage
+	if err := json.Unmarshal(rawReq["messages"], &messages); err != nil {
+		return
+	}
+
+	// Leave room for the output the client asked for
+	reserve := config.Get().DefaultMaxOutputTokens
+	for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+		var n int
+		if err := json.Unmarshal(rawReq[field], &n); err == nil && n > 0 {
+			reserve = n
+			break
+		}
+	}
+
+	before := translate.EstimateTokens(messages)
+	trimmed, removed := translate.TrimMessages(messages, window-reserve, strategy)
+	if removed == 0 {
+		return
+	}
+	if messagesBytes, err := json.Marshal(trimmed); err == nil {
+		rawReq["messages"] = messagesBytes
+		log.Printf("ChatCompletions: trimmed %d oldest messages to fit context: model=%s, strategy=%s, estimated_tokens=%d->%d, limit=%d",
+			removed, model, strategy, before, translate.EstimateTokens(trimmed), window-reserve)
+	}
+}
+
+// isThinkingBudgetError reports whether an upstream 400 rejected the thinking budget
+func isThinkingBudgetError(err error) bool {
+	upErr, ok := asUpstreamError(err)
+	if !ok || upErr.status != http.StatusBadRequest {
+		return false
+	}
+	body := strings.ToLower(string(upErr.body))
+	return strings.Contains(body, "thinking") && strings.Contains(body, "budget")
+}
+
+// fallbackModel returns the MODEL_FALLBACKS target for model when err is an
+// availability error and the target has not been tried yet
+func fallbackModel(model string, err error, tried map[string]bool) (string, bool) {
+	if !isModelUnavailableError(err) {
+		return "", false
+	}
+	fallback, ok := config.Get().ModelFallbacks[model]
+	if !ok || tried[fallback] || !models.IsModelAllowed(fallback) {
+		return "", false
+	}
+	return fallback, true
+}
+
+// isModelUnavailableError reports whether Vertex answered that the model
+// itself is unavailable: 404 (not found) or 503 (temporarily unavailable)
+func isModelUnavailableError(err error) bool {
+	upErr, ok := asUpstreamError(err)
+	return ok && (upErr.status == http.StatusNotFound || upErr.status == http.StatusServiceUnavailable)
+}
+
+// isModelNotFoundError reports whether Vertex answered that the model is
+// unknown: a 404, or a 400 whose body names a missing model
+func isModelNotFoundError(err error) bool {
+	upErr, ok := asUpstreamError(err)
+	if !ok {
+		return false
+	}
+	switch upErr.status {
+	case http.StatusNotFound:
+		return true
+	case http.StatusBadRequest:
+		body := string(upErr.body)
+		return strings.Contains(body, "NOT_FOUND") || strings.Contains(strings.ToLower(body), "model not found")
+	}
+	return false
+}
+
+func handleNonStreamingProxy(ctx context.Context, w http.ResponseWriter, url string, body []byte, opts proxyOptions) error {
+	rawBody, err := doNonStreamingRequest(ctx, url, body)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(respBody))
+	// A malformed function call is often transient: retry once before failing
+	if hasMalformedFunctionCall(rawBody) {
+		log.Printf("handleNonStreamingProxy: malformed function call, retrying once")
+		if rawBody, err = doNonStreamingRequest(ctx, url, body); err != nil {
+			return err
+		}
+		if hasMalformedFunctionCall(rawBody) {
+			return errMalformedFunctionCall
+		}
+	}
+
+	// Process response to extract reasoning content, dropping extra
+	// candidates the client did not ask for
+	process := func(raw []byte) []byte {
+		if opts.singleChoice {
+			raw, _ = firstChoiceOnly(raw)
+		} else if opts.bestOf {
+			raw = bestChoiceOnly(raw)
+		}
+		return processNonStreamingResponse(raw)
+	}
+	respBody := process(rawBody)
+
+	// An empty, unblocked 200 is a transient glitch; let the caller retry
+	if opts.retryOnEmpty && isEmptyCompletion(respBody) {
+		return errEmptyResponse
+	}
+
+	// JSON mode: validate the content and retry once with a stricter instruction
+	if opts.enforceJSON {
+		if fixed, ok := normalizeJSONContent(respBody); ok {
+			respBody = fixed
+		} else {
+			log.Printf("handleNonStreamingProxy: json_object response is not valid JSON, retrying with stricter instruction")
+			if retryBody, err := appendJSONInstruction(body); err == nil {
+				if retryRaw, err := doNonStreamingRequest(ctx, url, retryBody); err == nil {
+					rawBody = retryRaw
+					respBody = process(retryRaw)
+					if fixed, ok := normalizeJSONContent(respBody); ok {
+						respBody = fixed
+					} else {
+						log.Printf("handleNonStreamingProxy: json_object retry still not valid JSON, returning as-is")
+					}
+				} else {
+					log.Printf("handleNonStreamingProxy: json_object retry failed: %v", err)
+				}
+			}
+		}
+	}
+
+	if opts.estimateUsage {
+		respBody = fillEstimatedUsage(respBody, body)
+	}
+
+	var resp nonStreamResponse
+	if err := json.Unmarshal(respBody, &resp); err == nil {
+		for _, choice := range resp.Choices {
+			opts.audit.addResponse(choice.Message.Content)
+		}
+		if resp.Usage != nil {
+			opts.audit.setUsage(resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+			if opts.tokens != nil && !resp.Usage.Estimated {
+				*opts.tokens = resp.Usage.TotalTokens
+			}
+		}
 	}
 
-	// Process response to extract reasoning content
-	respBody = processNonStreamingResponse(respBody)
+	if opts.unbillReason {
+		respBody = unbillReasoning(respBody)
+	}
+
+	if opts.ephemeral {
+		respBody = stripReasoning(respBody)
+	}
+
+	if opts.nestReasoning {
+		respBody = translate.NestReasoning(respBody)
+	}
+
+	respBody = externalizeImages(respBody, opts.fileBaseURL, opts.fileOwner)
+	respBody = addSystemFingerprint(respBody, opts.fingerprint)
+
+	if opts.includeRaw {
+		respBody = attachRawResponse(respBody, rawBody)
+	}
 
 	// Forward response
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
+	w.WriteHeader(http.StatusOK)
 	w.Write(respBody)
 
 	return nil
 }
 
+// errEmptyResponse is returned for an empty completion under RETRY_ON_EMPTY
+var errEmptyResponse error = &responseError{"upstream returned an empty completion"}
+
+// isEmptyCompletion reports whether a response is worth retrying as empty:
+// it has no choices, or every choice stopped normally (finish reason stop or
+// none) without content, tool calls or refusal. A length cutoff, a
+// content_filter block or prompt feedback is a real answer and is returned
+// as is. Unparseable responses are not considered empty.
+func isEmptyCompletion(respBody []byte) bool {
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content   json.RawMessage `json:"content"`
+				ToolCalls []any           `json:"tool_calls"`
+				Refusal   string          `json:"refusal"`
+			} `json:"message"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		PromptFeedback json.RawMessage `json:"prompt_feedback"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil || len(resp.PromptFeedback) > 0 {
+		return false
+	}
+	for _, choice := range resp.Choices {
+		if choice.FinishReason != nil && *choice.FinishReason != "stop" {
+			return false
+		}
+		m := choice.Message
+		content := strings.TrimSpace(string(m.Content))
+		if len(m.ToolCalls) > 0 || m.Refusal != "" ||
+			(content != "" && content != "null" && content != `""`) {
+			return false
+		}
+	}
+	return true
+}
+
+// errMalformedFunctionCall is returned when the model keeps producing an invalid tool call
+var errMalformedFunctionCall error = &responseError{"the model produced a malformed function call (finish reason MALFORMED_FUNCTION_CALL); retry the request or simplify the tool schemas"}
+
+// responseError rejects an upstream response that arrived intact; it is a
+// keys.ErrUnusableResponse, so the key that served it is not blamed
+type responseError struct {
+	msg string
+}
+
+func (e *responseError) Error() string {
+	return e.msg
+}
+
+func (e *responseError) Is(target error) bool {
+	return target == keys.ErrUnusableResponse
+}
+
+// hasMalformedFunctionCall reports whether any choice finished with a malformed function call
+func hasMalformedFunctionCall(respBody []byte) bool {
+	var resp struct {
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return false
+	}
+	for _, choice := range resp.Choices {
+		if translate.IsMalformedFunctionCall(choice.FinishReason) {
+			return true
+		}
+	}
+	return false
+}
+
+// promptTokenEstimate estimates the prompt size of an upstream request body
+func promptTokenEstimate(reqBody []byte) int {
+	var req struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	json.Unmarshal(reqBody, &req)
+	return translate.EstimateTokens(req.Messages)
+}
+
+// annotateRunningUsage counts a stream chunk's generated text and adds the
+// running estimate as "usage_estimate". Chunks without choices (errors, the
+// final usage chunk) are left alone.
+func annotateRunningUsage(data string, running *translate.RunningUsage) string {
+	var chunk streamChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil || len(chunk.Choices) == 0 {
+		return data
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return data
+	}
+	for _, choice := range chunk.Choices {
+		running.Add(choice.Delta.Content)
+		running.Add(choice.Delta.ReasoningContent)
+	}
+	estimate, err := json.Marshal(running.Usage())
+	if err != nil {
+		return data
+	}
+	fields["usage_estimate"] = estimate
+	if out, err := json.Marshal(fields); err == nil {
+		return string(out)
+	}
+	return data
+}
+
+// fillEstimatedUsage adds an estimated usage to a response that has none,
+// sizing the prompt from the request messages
+func fillEstimatedUsage(respBody, reqBody []byte) []byte {
+	var resp nonStreamResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil || resp.Usage != nil {
+		return respBody
+	}
+
+	var req struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	json.Unmarshal(reqBody, &req)
+
+	completion := 0
+	for _, choice := range resp.Choices {
+		completion += translate.EstimateTextTokens(choice.Message.Content) + translate.EstimateTextTokens(choice.Message.ReasoningContent)
+	}
+	usage := translate.EstimateUsage(translate.EstimateTokens(req.Messages), completion)
+	resp.Usage = &responseUsage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		Estimated:        true,
+	}
+
+	result, err := json.Marshal(resp)
+	if err != nil {
+		return respBody
+	}
+	return result
+}
+
+// doNonStreamingRequest sends a non-streaming request and returns the raw response body
+func doNonStreamingRequest(ctx context.Context, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := upstreamClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{status: resp.StatusCode, body: respBody}
+	}
+
+	return respBody, nil
+}
+
 // processNonStreamingResponse extracts reasoning from thinking tags and adds reasoning_content field
 func processNonStreamingResponse(respBody []byte) []byte {
 	var resp nonStreamResponse
@@ -321,18 +1046,33 @@ func processNonStreamingResponse(respBody []byte) []byte {
 		return respBody
 	}
 
-	// Process the first choice's message content
-	content := resp.Choices[0].Message.Content
-	if content == "" {
-		return respBody
+	// Add UTF-8 bytes to logprobs tokens that lack them
+	changed := false
+	for i := range resp.Choices {
+		if translate.FillLogprobBytes(resp.Choices[i].Logprobs) {
+			changed = true
+		}
 	}
 
-	// Extract reasoning from thinking tags using regexp
-	reasoning, actualContent := extractReasoningByTags(content)
-	resp.Choices[0].Message.Content = actualContent
-	if reasoning != "" {
-		resp.Choices[0].Message.ReasoningContent = reasoning
-		log.Printf("Extracted reasoning: %d chars, content: %d chars", len(reasoning), len(actualContent))
+	// Process each choice's message content; with n>1 every candidate
+	// carries its own reasoning and tool calls
+	for i := range resp.Choices {
+		content := resp.Choices[i].Message.Content
+		if content == "" {
+			continue
+		}
+		// Extract reasoning from thinking tags using regexp
+		reasoning, actualContent := extractReasoningByTags(content)
+		resp.Choices[i].Message.Content = actualContent
+		if reasoning != "" {
+			resp.Choices[i].Message.ReasoningContent = reasoning
+			log.Printf("Extracted reasoning: choice=%d, %d chars, content: %d chars", i, len(reasoning), len(actualContent))
+		}
+		changed = true
+	}
+
+	if !changed {
+		return respBody
 	}
 
 	result, err := json.Marshal(resp)
@@ -342,6 +1082,27 @@ func processNonStreamingResponse(respBody []byte) []byte {
 	return result
 }
 
+// attachRawResponse adds the upstream payload as a "_raw" field. On the chat
+// completions path that payload is Vertex's OpenAI-compatible response as
+// received, before reasoning extraction and our other rewrites, not the
+// native Gemini response.
+func attachRawResponse(respBody, rawBody []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(respBody, &fields); err != nil {
+		return respBody
+	}
+	if !json.Valid(rawBody) {
+		return respBody
+	}
+	fields["_raw"] = rawBody
+
+	result, err := json.Marshal(fields)
+	if err != nil {
+		return respBody
+	}
+	return result
+}
+
 // extractReasoningByTags extracts content between thinking tags using regexp
 func extractReasoningByTags(content string) (reasoning, actualContent string) {
 	matches := reasoningTagPattern.FindAllStringSubmatch(content, -1)
@@ -389,8 +1150,11 @@ func (p *StreamingReasoningProcessor) ProcessChunk(chunk string) (processedConte
 		if p.inTag {
 			idx := strings.Index(buf, p.closeTag)
 			if idx < 0 {
-				// Keep buffer minus the potential partial close tag
+				// Keep buffer minus the potential partial close tag,
+				// never splitting a multibyte rune
 				keep := max(0, len(buf)-len(p.closeTag)+1)
+				complete, _ := translate.SplitIncompleteUTF8(buf[:keep])
+				keep = len(complete)
 				p.reasoning.WriteString(buf[:keep])
 				p.buffer.Reset()
 				p.buffer.WriteString(buf[keep:])
@@ -409,8 +1173,11 @@ func (p *StreamingReasoningProcessor) ProcessChunk(chunk string) (processedConte
 					p.buffer.Reset()
 					p.buffer.WriteString(buf[partialIdx:])
 				} else {
-					p.content.WriteString(buf)
+					// Hold back an incomplete trailing rune for the next chunk
+					complete, tail := translate.SplitIncompleteUTF8(buf)
+					p.content.WriteString(complete)
 					p.buffer.Reset()
+					p.buffer.WriteString(tail)
 				}
 				break
 			}
@@ -447,10 +1214,15 @@ func (p *StreamingReasoningProcessor) FlushRemaining() (content, reasoning strin
 	return buf, ""
 }
 
-func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error {
+func handleStreamingProxy(ctx context.Context, w http.ResponseWriter, url string, body []byte, model string, opts proxyOptions) error {
 	log.Printf("handleStreamingProxy: starting request")
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	// The caller registered the stream with beginStream, so ctx is also
+	// cancelled if the shutdown drain grace period runs out
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -458,7 +1230,7 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "text/event-stream")
 
-	resp, err := httpClient.Do(req)
+	resp, err := upstreamClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -469,8 +1241,8 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 	if resp.StatusCode != http.StatusOK {
 		// Read error response body for logging; ignore read errors on error path
 		respBody, _ := io.ReadAll(resp.Body)
-		log.Printf("handleStreamingProxy: error response: %s", string(respBody))
-		return fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(respBody))
+		log.Printf("handleStreamingProxy: error response: %s", truncateForLog(respBody))
+		return &upstreamError{status: resp.StatusCode, body: respBody}
 	}
 
 	// Set SSE headers
@@ -488,15 +1260,77 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 
 	log.Printf("handleStreamingProxy: flusher available, starting stream")
 
+	// MAX_STREAM_DURATION: cut a runaway stream off and end it cleanly below
+	var durationExceeded atomic.Bool
+	if limit := time.Duration(config.Get().MaxStreamDurationSec) * time.Second; limit > 0 {
+		timer := time.AfterFunc(limit, func() {
+			durationExceeded.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
 	// Create reasoning processor
 	processor := NewStreamingReasoningProcessor(ThinkingTagMarker)
+	coalesceEmpty := config.Get().CoalesceEmptyChunks
+
+	// Identity of the upstream stream, captured from the first parsed chunk
+	var streamID, streamModel string
+	var streamCreated int64
+
+	// Record every event so a reconnecting client can resume via Last-Event-ID
+	replay := newReplayStream(opts.client, cancel)
+	defer replay.finish()
+	w.Header().Set("X-Stream-ID", replay.id)
+	translate.WriteSSERetry(w)
+
+	// Helper to write an SSE message with proper format (id: ...\ndata: json\n\n)
+	var running *translate.RunningUsage
+	if opts.runningUsage {
+		running = translate.NewRunningUsage(promptTokenEstimate(body))
+	}
 
-	// Helper to send SSE message with proper format (data: json\n\n)
-	sendSSE := func(data string) {
-		fmt.Fprintf(w, "data: %s\n\n", data)
+	writeSSE := func(data string) {
+		if opts.unbillReason && data != "[DONE]" {
+			data = string(unbillReasoning([]byte(data)))
+		}
+		data = string(addSystemFingerprint([]byte(data), opts.fingerprint))
+		if running != nil && data != "[DONE]" {
+			data = annotateRunningUsage(data, running)
+		}
+		// Ephemeral reasoning is shown live but never replayed
+		if opts.ephemeral && isReasoningOnlyChunk(data) {
+			if opts.nestReasoning {
+				data = string(translate.NestReasoning([]byte(data)))
+			}
+			writeSSEEvent(w, "", data)
+			flusher.Flush()
+			return
+		}
+		if opts.nestReasoning && data != "[DONE]" {
+			data = string(translate.NestReasoning([]byte(data)))
+		}
+		data = string(externalizeImages([]byte(data), opts.fileBaseURL, opts.fileOwner))
+		writeSSEEvent(w, replay.record(data), data)
 		flusher.Flush()
 	}
 
+	// All writes go through the coalescer, which merges small deltas when
+	// STREAM_COALESCE_MS is set
+	coalescer := newSSECoalescer(time.Duration(config.Get().StreamCoalesceMS)*time.Millisecond, writeSSE)
+	defer coalescer.stop()
+	sendSSE := coalescer.send
+
+	// Events that must follow the content (finish reason, usage, [DONE]) are
+	// held back until the stream ends: the reasoning processor may still hold
+	// a partial tag to flush, and in JSON mode content deltas are buffered
+	// and validated once the stream ends
+	var jsonContent strings.Builder
+	var deferred []string
+	sendAfterContent := func(data string) {
+		deferred = append(deferred, data)
+	}
+
 	// Stream response
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
@@ -511,15 +1345,32 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 			continue
 		}
 
+		// Forward SSE comments (heartbeats) as standalone comment blocks;
+		// every data line below is re-framed as its own event
+		if isSSEComment(line) {
+			coalescer.do(func() {
+				fmt.Fprintf(w, "%s\n\n", line)
+				flusher.Flush()
+			})
+			continue
+		}
+
 		// Process data lines for reasoning extraction
 		if strings.HasPrefix(line, "data: ") {
 			jsonStr := strings.TrimPrefix(line, "data: ")
 			if jsonStr == "[DONE]" {
-				fmt.Fprintf(w, "data: [DONE]\n\n")
-				flusher.Flush()
+				sendAfterContent("[DONE]")
 				continue
 			}
 
+			if opts.singleChoice {
+				filtered, keep := firstChoiceOnly([]byte(jsonStr))
+				if !keep {
+					continue
+				}
+				jsonStr = string(filtered)
+			}
+
 			// Parse the chunk using typed struct
 			var chunk streamChunk
 			if err := json.Unmarshal([]byte(jsonStr), &chunk); err != nil {
@@ -528,16 +1379,45 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 				continue
 			}
 
-			// Check if we have content to process
+			opts.audit.setStreamUsage(chunk.Usage)
+			if chunk.Usage != nil && opts.tokens != nil {
+				*opts.tokens = chunk.Usage.TotalTokens
+			}
+
+			// Remember the stream identity so flush chunks stay consistent
+			if streamID == "" && chunk.ID != "" {
+				streamID, streamModel, streamCreated = chunk.ID, chunk.Model, chunk.Created
+			}
+
+			// Drop chunks that carry nothing a client can use
+			if coalesceEmpty && isEmptyDeltaChunk(jsonStr) {
+				continue
+			}
+
+			// Chunks without choices: keep the final usage chunk (after any
+			// held-back content) and anything else meaningful, drop the rest
 			if len(chunk.Choices) == 0 {
-				sendSSE(jsonStr)
+				if chunk.Usage != nil {
+					sendAfterContent(jsonStr)
+				} else if !isBareChunk(jsonStr) {
+					sendSSE(jsonStr)
+				}
 				continue
 			}
 
+			if fr := chunk.Choices[0].FinishReason; fr != nil && translate.IsMalformedFunctionCall(*fr) {
+				// Content is already on the wire, so a retry is not possible here
+				log.Printf("handleStreamingProxy: stream ended with a malformed function call: model=%s", model)
+			}
+
 			content := chunk.Choices[0].Delta.Content
 			if content == "" {
 				// No content to process, forward as-is (might have finish_reason)
-				sendSSE(jsonStr)
+				if chunk.Choices[0].FinishReason != nil || chunk.Usage != nil {
+					sendAfterContent(jsonStr)
+				} else {
+					sendSSE(jsonStr)
+				}
 				continue
 			}
 
@@ -556,36 +1436,42 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 						Delta: streamDelta{ReasoningContent: reasoningContent},
 					}},
 				}
-				if reasoningJSON, err := json.Marshal(reasoningChunk); err == nil {
-					sendSSE(string(reasoningJSON))
-				}
+				coalescer.delta(reasoningChunk)
 			}
 
 			// Send content chunk if any
+			opts.audit.addResponse(processedContent)
+			if opts.enforceJSON {
+				jsonContent.WriteString(processedContent)
+				processedContent = ""
+			}
 			if processedContent != "" {
 				chunk.Choices[0].Delta.Content = processedContent
-				if outputChunk, err := json.Marshal(chunk); err == nil {
-					sendSSE(string(outputChunk))
-				}
+				coalescer.delta(chunk)
 			} else if chunk.Choices[0].FinishReason != nil {
 				// Has finish_reason but no content - forward the chunk without content
 				chunk.Choices[0].Delta.Content = ""
 				if outputChunk, err := json.Marshal(chunk); err == nil {
-					sendSSE(string(outputChunk))
+					sendAfterContent(string(outputChunk))
 				}
 			}
 		}
 	}
 
-	// Flush remaining buffer
+	// Flush remaining buffer, reusing the upstream stream identity when known
 	remainingContent, remainingReasoning := processor.FlushRemaining()
-	now := time.Now().Unix()
+	if streamID == "" {
+		streamID, streamModel, streamCreated = translate.NewCompletionID(), model, time.Now().Unix()
+	}
+	if streamModel == "" {
+		streamModel = model
+	}
 	if remainingReasoning != "" {
 		flushChunk := streamChunk{
-			ID:      fmt.Sprintf("chatcmpl-flush-%d", now),
-			Object:  "chat.completion.chunk",
-			Created: now,
-			Model:   "unknown",
+			ID:      streamID,
+			Object:  translate.ObjectChatCompletionChunk,
+			Created: streamCreated,
+			Model:   streamModel,
 			Choices: []streamChoice{{
 				Index: 0,
 				Delta: streamDelta{ReasoningContent: remainingReasoning},
@@ -595,12 +1481,18 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 			sendSSE(string(flushJSON))
 		}
 	}
+	if opts.enforceJSON {
+		opts.audit.addResponse(remainingContent)
+		jsonContent.WriteString(remainingContent)
+		remainingContent = ""
+	}
 	if remainingContent != "" {
+		opts.audit.addResponse(remainingContent)
 		flushChunk := streamChunk{
-			ID:      fmt.Sprintf("chatcmpl-flush-%d", now),
-			Object:  "chat.completion.chunk",
-			Created: now,
-			Model:   "unknown",
+			ID:      streamID,
+			Object:  translate.ObjectChatCompletionChunk,
+			Created: streamCreated,
+			Model:   streamModel,
 			Choices: []streamChoice{{
 				Index: 0,
 				Delta: streamDelta{Content: remainingContent},
@@ -611,15 +1503,248 @@ func handleStreamingProxy(w http.ResponseWriter, url string, body []byte) error
 		}
 	}
 
+	cutOff := false
 	if err := scanner.Err(); err != nil {
-		log.Printf("handleStreamingProxy: scanner error: %v", err)
-		return fmt.Errorf("stream read error: %w", err)
+		if streamsTerminated() {
+			// Server is shutting down: end the stream cleanly instead of retrying
+			log.Printf("handleStreamingProxy: stream terminated by shutdown, lines=%d", lineCount)
+			if errJSON, err := json.Marshal(errorResponse{Error: errorDetail{
+				Message: "Server is shutting down, stream terminated",
+				Type:    "server_error",
+				Code:    http.StatusServiceUnavailable,
+			}}); err == nil {
+				sendSSE(string(errJSON))
+			}
+			sendSSE("[DONE]")
+			return nil
+		}
+		if replay.wasAborted() {
+			// Cancelled via StreamCancelHandler: the upstream request is gone, end cleanly
+			log.Printf("handleStreamingProxy: stream cancelled by client, lines=%d", lineCount)
+			if errJSON, err := json.Marshal(errorResponse{Error: errorDetail{
+				Message: "Stream cancelled by client",
+				Type:    "cancelled",
+				Code:    499,
+			}}); err == nil {
+				sendSSE(string(errJSON))
+			}
+			sendSSE("[DONE]")
+			return nil
+		}
+		if !durationExceeded.Load() {
+			log.Printf("handleStreamingProxy: scanner error: %v", err)
+			return fmt.Errorf("stream read error: %w", err)
+		}
+		log.Printf("handleStreamingProxy: stream exceeded MAX_STREAM_DURATION, lines=%d", lineCount)
+		cutOff = true
+	}
+
+	// JSON mode: emit the validated content as one chunk, then the held-back events
+	if opts.enforceJSON {
+		content, ok := cleanJSONContent(jsonContent.String())
+		if !ok {
+			log.Printf("handleStreamingProxy: json_object stream content is not valid JSON, returning as-is")
+			content = jsonContent.String()
+		}
+		if content != "" {
+			contentChunk := streamChunk{
+				ID:      streamID,
+				Object:  translate.ObjectChatCompletionChunk,
+				Created: streamCreated,
+				Model:   streamModel,
+				Choices: []streamChoice{{
+					Index: 0,
+					Delta: streamDelta{Content: content},
+				}},
+			}
+			if contentJSON, err := json.Marshal(contentChunk); err == nil {
+				sendSSE(string(contentJSON))
+			}
+		}
+	}
+	for _, data := range deferred {
+		sendSSE(data)
+	}
+
+	// A stream cut off by MAX_STREAM_DURATION gets the finish chunk and
+	// [DONE] upstream never sent
+	if cutOff {
+		reason := config.Get().MaxStreamFinishReason
+		finishChunk := streamChunk{
+			ID:      streamID,
+			Object:  translate.ObjectChatCompletionChunk,
+			Created: streamCreated,
+			Model:   streamModel,
+			Choices: []streamChoice{{Index: 0, FinishReason: &reason}},
+		}
+		if finishJSON, err := json.Marshal(finishChunk); err == nil {
+			sendSSE(string(finishJSON))
+		}
+		sendSSE("[DONE]")
 	}
 
 	log.Printf("handleStreamingProxy: stream completed, lines=%d", lineCount)
 	return nil
 }
 
+// firstChoiceOnly removes choices other than index 0 from a response or
+// stream chunk. It reports false when nothing is left worth sending (a chunk
+// that only carried other candidates). Unparseable payloads are kept as-is.
+func firstChoiceOnly(payload []byte) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload, true
+	}
+	var choices []json.RawMessage
+	if err := json.Unmarshal(fields["choices"], &choices); err != nil || len(choices) == 0 {
+		return payload, true
+	}
+
+	kept := make([]json.RawMessage, 0, 1)
+	for _, choice := range choices {
+		var c struct {
+			Index int `json:"index"`
+		}
+		if err := json.Unmarshal(choice, &c); err == nil && c.Index == 0 {
+			kept = append(kept, choice)
+		}
+	}
+	if len(kept) == len(choices) {
+		return payload, true
+	}
+
+	usage, hasUsage := fields["usage"]
+	if len(kept) == 0 && (!hasUsage || string(usage) == "null") {
+		return nil, false
+	}
+
+	choicesJSON, err := json.Marshal(kept)
+	if err != nil {
+		return payload, true
+	}
+	fields["choices"] = choicesJSON
+	result, err := json.Marshal(fields)
+	if err != nil {
+		return payload, true
+	}
+	return result, true
+}
+
+// emptyCheckChunk is a loose view of a stream chunk used to detect empty deltas
+type emptyCheckChunk struct {
+	Choices []struct {
+		Delta struct {
+			Role             string          `json:"role"`
+			Content          string          `json:"content"`
+			ReasoningContent string          `json:"reasoning_content"`
+			ToolCalls        json.RawMessage `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage json.RawMessage `json:"usage"`
+}
+
+// isEmptyDeltaChunk reports whether a chunk has no role, content, reasoning,
+// tool calls, finish reason or usage. Unparseable chunks are never considered empty.
+func isEmptyDeltaChunk(jsonStr string) bool {
+	var chunk emptyCheckChunk
+	if err := json.Unmarshal([]byte(jsonStr), &chunk); err != nil {
+		return false
+	}
+
+	if len(chunk.Usage) > 0 && string(chunk.Usage) != "null" {
+		return false
+	}
+	if len(chunk.Choices) == 0 {
+		return true
+	}
+
+	for _, choice := range chunk.Choices {
+		d := choice.Delta
+		if d.Role != "" || d.Content != "" || d.ReasoningContent != "" {
+			return false
+		}
+		if len(d.ToolCalls) > 0 && string(d.ToolCalls) != "null" && string(d.ToolCalls) != "[]" {
+			return false
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// bareChunkFields are the identity fields every chunk carries
+var bareChunkFields = map[string]bool{
+	"id": true, "object": true, "created": true, "model": true,
+	"system_fingerprint": true, "choices": true, "usage": true,
+}
+
+// isBareChunk reports whether a chunk without choices or usage has no other
+// fields either (such as prompt filter results or an error), so dropping it
+// loses nothing. Unparseable chunks are never considered bare.
+func isBareChunk(jsonStr string) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(jsonStr), &fields); err != nil {
+		return false
+	}
+	for key, value := range fields {
+		if !bareChunkFields[key] && string(value) != "null" {
+			return false
+		}
+	}
+	return true
+}
+
+// forceBuffer reports whether a streaming request should be answered with a
+// single non-streaming response
+func forceBuffer(r *http.Request) bool {
+	return config.Get().ForceNonStreaming || strings.EqualFold(r.Header.Get("X-Force-Buffer"), "true")
+}
+
+// setKeyIndexHeader reports which key serves the request in X-Key-Index. It
+// needs both EXPOSE_KEY_INDEX and DEBUG_MODE, so a stray EXPOSE_KEY_INDEX alone
+// cannot reveal key rotation in production. Only the index is ever exposed.
+func setKeyIndexHeader(w http.ResponseWriter, index int) {
+	cfg := config.Get()
+	if !cfg.ExposeKeyIndex || !cfg.DebugMode || index < 0 {
+		return
+	}
+	w.Header().Set("X-Key-Index", strconv.Itoa(index))
+}
+
+// setRetryAttemptHeader reports in X-Retry-Attempt which attempt (1-based)
+// produced the response, so client-side latency can be matched to retries.
+// Like the key index it is rewritten before each attempt and only needs
+// DEBUG_MODE.
+func setRetryAttemptHeader(w http.ResponseWriter, attempt int) {
+	if !config.Get().DebugMode {
+		return
+	}
+	w.Header().Set("X-Retry-Attempt", strconv.Itoa(attempt+1))
+}
+
+// hashUser returns a short stable hash of the OpenAI user field for logs and
+// per-user bookkeeping, or "-" when the field is unset
+func hashUser(user string) string {
+	if user == "" {
+		return "-"
+	}
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:6])
+}
+
+// translateErrorType returns the error type for a request the native
+// translation rejected. A content part that could not be fetched is reported
+// as OpenAI does for unreachable image URLs.
+func translateErrorType(err error) string {
+	var mediaErr *translate.MediaFetchError
+	if errors.As(err, &mediaErr) {
+		return "invalid_request_error"
+	}
+	return "invalid_request"
+}
+
 func sendError(w http.ResponseWriter, statusCode int, errType, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
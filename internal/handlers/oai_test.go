@@ -0,0 +1,1246 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/models"
+	"vertex2api-golang/internal/translate"
+)
+
+func TestIsEmptyCompletion(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"no choices", `{"choices":[]}`, true},
+		{"stop without content", `{"choices":[{"message":{"content":""},"finish_reason":"stop"}]}`, true},
+		{"no finish reason or content", `{"choices":[{"message":{"content":null},"finish_reason":null}]}`, true},
+		{"length cutoff", `{"choices":[{"message":{"content":""},"finish_reason":"length"}]}`, false},
+		{"content filter", `{"choices":[{"message":{},"finish_reason":"content_filter"}]}`, false},
+		{"text", `{"choices":[{"message":{"content":"hi"},"finish_reason":"stop"}]}`, false},
+		{"tool call", `{"choices":[{"message":{"tool_calls":[{"id":"1"}]},"finish_reason":"tool_calls"}]}`, false},
+		{"prompt feedback", `{"choices":[],"prompt_feedback":{"block_reason":"SAFETY"}}`, false},
+		{"unparseable", `not json`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isEmptyCompletion([]byte(tt.body)); got != tt.want {
+				t.Errorf("isEmptyCompletion(%s) = %v, want %v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceEmptyChunks(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.CoalesceEmptyChunks = true
+		c.StreamCoalesceMS = 0
+	})
+	sseUpstream(t,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":""}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":null}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`data: {"id":"c1","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		`data: [DONE]`,
+	)
+
+	w := runStreamingProxy(t, proxyOptions{})
+	data := sseData(w.Body.String())
+	want := []string{"role", "Hel", "lo", "finish", "usage", "[DONE]"}
+	if len(data) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(data), len(want), strings.Join(data, "\n"))
+	}
+	if c := decodeChunk(t, data[0]); c.Choices[0].Delta.Role != "assistant" {
+		t.Errorf("event 0 = %s, want the role chunk", data[0])
+	}
+	if c := decodeChunk(t, data[1]); c.Choices[0].Delta.Content != "Hel" {
+		t.Errorf("event 1 = %s, want content Hel", data[1])
+	}
+	if c := decodeChunk(t, data[2]); c.Choices[0].Delta.Content != "lo" {
+		t.Errorf("event 2 = %s, want content lo", data[2])
+	}
+	if c := decodeChunk(t, data[3]); c.Choices[0].FinishReason == nil || *c.Choices[0].FinishReason != "stop" {
+		t.Errorf("event 3 = %s, want the finish chunk", data[3])
+	}
+	if c := decodeChunk(t, data[4]); c.Usage == nil || c.Usage.TotalTokens != 5 {
+		t.Errorf("event 4 = %s, want the usage chunk", data[4])
+	}
+	if data[5] != "[DONE]" {
+		t.Errorf("last event = %s, want [DONE]", data[5])
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.RetryMax = 20
+		c.RetryIntervalMS = 10
+		c.RetryDeadlineMS = 150
+	})
+	var attempts atomic.Int32
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		http.Error(w, `{"error":{"message":"backend error"}}`, http.StatusInternalServerError)
+	})
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`))
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+	if n := attempts.Load(); n < 2 || n > 4 {
+		t.Errorf("upstream saw %d attempts, want 2-4 within a 150ms budget", n)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("retrying took %v, want the 150ms budget to stop it early", elapsed)
+	}
+}
+
+// completionBody is a minimal non-streaming upstream answer
+const completionBody = `{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gemini-2.5-flash","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`
+
+func TestUserFieldStrippedUpstreamAndLogged(t *testing.T) {
+	var upstream map[string]json.RawMessage
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstream)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionBody)
+	})
+	logs := captureLog(t)
+
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","user":"alice@example.com","messages":[{"role":"user","content":"hi"}]}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if _, ok := upstream["user"]; ok {
+		t.Errorf("upstream body still has user: %s", upstream["user"])
+	}
+	if !strings.Contains(logs.String(), "user="+hashUser("alice@example.com")) {
+		t.Errorf("log does not record the hashed user:\n%s", logs)
+	}
+	if strings.Contains(logs.String(), "alice@example.com") {
+		t.Errorf("log records the raw user:\n%s", logs)
+	}
+}
+
+func TestIncludeRawResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		debug   bool
+		always  bool // INCLUDE_RAW_RESPONSE
+		header  string
+		wantRaw bool
+	}{
+		{"off by default", false, false, "", false},
+		{"header needs debug mode", false, false, "true", false},
+		{"config needs debug mode", false, true, "", false},
+		{"header in debug mode", true, false, "true", true},
+		{"config in debug mode", true, true, "", true},
+		{"debug mode alone", true, false, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.DebugMode = tt.debug
+				c.IncludeRawResponse = tt.always
+			})
+			jsonUpstream(t, http.StatusOK, completionBody)
+
+			r := newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`)
+			if tt.header != "" {
+				r.Header.Set("X-Include-Raw", tt.header)
+			}
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, r)
+
+			var resp map[string]json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response is not JSON: %s", w.Body)
+			}
+			raw, ok := resp["_raw"]
+			if ok != tt.wantRaw {
+				t.Fatalf("_raw present = %v, want %v", ok, tt.wantRaw)
+			}
+			// _raw is the OpenAI-compatible upstream body exactly as received
+			if ok && string(raw) != completionBody {
+				t.Errorf("_raw = %s, want the upstream body %s", raw, completionBody)
+			}
+		})
+	}
+}
+
+func TestOAIModelPrefix(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.OAIModelPrefix = "publishers/google/models/"
+		c.RetryIntervalMS = 0
+	})
+	const sent = "publishers/google/models/gemini-2.5-flash"
+	var model string
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		model = body.Model
+		http.Error(w, `{"error":{"code":404,"message":"Publisher model not found","status":"NOT_FOUND"}}`, http.StatusNotFound)
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`))
+
+	if model != sent {
+		t.Errorf("upstream model = %q, want %q", model, sent)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), sent) {
+		t.Errorf("error does not name the vertex model ID %q: %s", sent, w.Body)
+	}
+}
+
+func TestStreamFlushChunkIdentity(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+	// A trailing partial thinking tag is held back and flushed at the end
+	sseUpstream(t,
+		`data: {"id":"chatcmpl-up","object":"chat.completion.chunk","created":42,"model":"google/gemini-2.5-flash","choices":[{"index":0,"delta":{"content":"hello <vertex_th"}}]}`,
+		`data: [DONE]`,
+	)
+
+	w := runStreamingProxy(t, proxyOptions{})
+	var flush *streamChunk
+	for _, payload := range sseData(w.Body.String()) {
+		if payload == "[DONE]" {
+			continue
+		}
+		chunk := decodeChunk(t, payload)
+		if chunk.Choices[0].Delta.Content == "<vertex_th" {
+			flush = &chunk
+		}
+	}
+	if flush == nil {
+		t.Fatalf("no flush chunk for the held-back content:\n%s", w.Body)
+	}
+	if flush.ID != "chatcmpl-up" || flush.Model != "google/gemini-2.5-flash" || flush.Created != 42 || flush.Object != "chat.completion.chunk" {
+		t.Errorf("flush chunk identity = %q %q %d %q, want the upstream stream's", flush.ID, flush.Model, flush.Created, flush.Object)
+	}
+}
+
+func TestStreamConsistentIdentity(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+
+	t.Run("upstream identity", func(t *testing.T) {
+		// Unterminated reasoning is flushed at the end of the stream
+		sseUpstream(t,
+			`data: {"id":"chatcmpl-up","object":"chat.completion.chunk","created":42,"model":"google/gemini-2.5-flash","choices":[{"index":0,"delta":{"content":"<vertex_think_tag>pondering"}}]}`,
+			`data: {"id":"chatcmpl-up","object":"chat.completion.chunk","created":42,"model":"google/gemini-2.5-flash","choices":[{"index":0,"delta":{"content":" more"}}]}`,
+			`data: [DONE]`,
+		)
+		w := runStreamingProxy(t, proxyOptions{})
+		chunks := 0
+		for _, payload := range sseData(w.Body.String()) {
+			if payload == "[DONE]" {
+				continue
+			}
+			chunks++
+			if c := decodeChunk(t, payload); c.ID != "chatcmpl-up" || c.Model != "google/gemini-2.5-flash" {
+				t.Errorf("chunk %s does not carry the upstream id and model", payload)
+			}
+		}
+		if chunks == 0 {
+			t.Fatalf("no chunks:\n%s", w.Body)
+		}
+		if data := sseData(w.Body.String()); data[len(data)-1] != "[DONE]" {
+			t.Errorf("stream does not end with [DONE]:\n%s", w.Body)
+		}
+	})
+
+	t.Run("no upstream identity", func(t *testing.T) {
+		sseUpstream(t,
+			`data: {"choices":[{"index":0,"delta":{"content":"hi <vertex_th"}}]}`,
+			`data: [DONE]`,
+		)
+		w := runStreamingProxy(t, proxyOptions{})
+		data := sseData(w.Body.String())
+		if len(data) < 2 {
+			t.Fatalf("got %d events, want the content and a flush chunk:\n%s", len(data), w.Body)
+		}
+		// The flush comes before [DONE]
+		flush := decodeChunk(t, data[len(data)-2])
+		if flush.Model != "gemini-2.5-flash" || !strings.HasPrefix(flush.ID, "chatcmpl-") || flush.ID == "chatcmpl-flush" {
+			t.Errorf("flush chunk id %q model %q, want a generated ID and the requested model", flush.ID, flush.Model)
+		}
+	})
+}
+
+func TestModelFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int // what the preview model answers
+		wantStatus   int
+		wantFallback bool
+	}{
+		{"not found", http.StatusNotFound, http.StatusOK, true},
+		{"unavailable", http.StatusServiceUnavailable, http.StatusOK, true},
+		{"server error is not an availability error", http.StatusInternalServerError, http.StatusBadGateway, false},
+		{"bad request is not an availability error", http.StatusBadRequest, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.ModelFallbacks = map[string]string{"gemini-3-pro-preview": "gemini-2.5-pro"}
+				c.RetryMax = 0 // the switch must not need a retry
+				c.RetryIntervalMS = 0
+			})
+			var models []string
+			stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Model string `json:"model"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				models = append(models, body.Model)
+				if body.Model == "google/gemini-3-pro-preview" {
+					http.Error(w, `{"error":{"message":"model unavailable"}}`, tt.status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, completionBody)
+			})
+
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-3-pro-preview","messages":[{"role":"user","content":"hi"}]}`))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			header := w.Header().Get("X-Model-Fallback")
+			if tt.wantFallback {
+				if want := []string{"google/gemini-3-pro-preview", "google/gemini-2.5-pro"}; !slices.Equal(models, want) {
+					t.Errorf("upstream models = %v, want %v", models, want)
+				}
+				if header != "gemini-3-pro-preview -> gemini-2.5-pro" {
+					t.Errorf("X-Model-Fallback = %q, want the switch reported", header)
+				}
+				return
+			}
+			if len(models) != 1 || header != "" {
+				t.Errorf("upstream models = %v, X-Model-Fallback = %q; want no fallback", models, header)
+			}
+		})
+	}
+}
+
+func TestModelFallbackOncePerModel(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		// A cycle must not loop
+		c.ModelFallbacks = map[string]string{"gemini-3-pro-preview": "gemini-2.5-pro", "gemini-2.5-pro": "gemini-3-pro-preview"}
+		c.RetryMax = 0
+	})
+	var calls atomic.Int32
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-3-pro-preview","messages":[{"role":"user","content":"hi"}]}`))
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream calls = %d, want 2 (each model once)", n)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404: %s", w.Code, w.Body)
+	}
+}
+
+func TestStreamUsageReasoningTokens(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.StreamCoalesceMS = 0
+		c.BillReasoningTokens = true
+	})
+	sseUpstream(t,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hi"}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"!"},"finish_reason":"stop"}],"usage":{"prompt_tokens":4,"completion_tokens":2,"total_tokens":36,"completion_tokens_details":{"reasoning_tokens":30}}}`,
+		`data: [DONE]`,
+	)
+
+	w := runStreamingProxy(t, proxyOptions{})
+	var usage *translate.Usage
+	for _, payload := range sseData(w.Body.String()) {
+		if payload != "[DONE]" {
+			if c := decodeChunk(t, payload); c.Usage != nil {
+				usage = c.Usage
+			}
+		}
+	}
+	if usage == nil {
+		t.Fatalf("no usage chunk:\n%s", w.Body)
+	}
+	if usage.CompletionTokensDetails == nil || usage.CompletionTokensDetails.ReasoningTokens != 30 {
+		t.Errorf("completion_tokens_details = %+v, want reasoning_tokens 30", usage.CompletionTokensDetails)
+	}
+}
+
+func TestReasoningProcessorSplitRune(t *testing.T) {
+	emoji := "😀" // 4 bytes, split after the second
+	tests := []struct {
+		name          string
+		chunks        []string
+		wantContent   string
+		wantReasoning string
+	}{
+		{"content", []string{"hi " + emoji[:2], emoji[2:] + "!"}, "hi " + emoji + "!", ""},
+		{"reasoning", []string{"<vertex_think_tag>hmm " + emoji[:2], emoji[2:] + " ok</vertex_think_tag>done"}, "done", "hmm " + emoji + " ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewStreamingReasoningProcessor(ThinkingTagMarker)
+			var content, reasoning string
+			for _, chunk := range tt.chunks {
+				c, r := p.ProcessChunk(chunk)
+				if !utf8.ValidString(c) || !utf8.ValidString(r) {
+					t.Fatalf("chunk %q emitted invalid UTF-8: content %q, reasoning %q", chunk, c, r)
+				}
+				content += c
+				reasoning += r
+			}
+			c, r := p.FlushRemaining()
+			content += c
+			reasoning += r
+			if content != tt.wantContent || reasoning != tt.wantReasoning {
+				t.Errorf("content %q, reasoning %q; want %q, %q", content, reasoning, tt.wantContent, tt.wantReasoning)
+			}
+		})
+	}
+}
+
+func TestThinkingBudgetDowngrade(t *testing.T) {
+	tests := []struct {
+		name        string
+		alwaysFail  bool // the upstream rejects every budget
+		wantStatus  int
+		wantBudgets []int // budgets the upstream saw, 0 = none sent
+	}{
+		{"clamped to the ceiling", false, http.StatusOK, []int{100000, 24576}},
+		{"re-issued once per model", true, http.StatusBadRequest, []int{100000, 24576}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// RETRY_MAX=0: the downgrade must not need a retry
+			useConfig(t, func(c *config.Config) { c.RetryMax = 0 })
+			var budgets []int
+			stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Google struct {
+						ThinkingConfig struct {
+							ThinkingBudget int `json:"thinking_budget"`
+						} `json:"thinking_config"`
+					} `json:"google"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				budget := req.Google.ThinkingConfig.ThinkingBudget
+				budgets = append(budgets, budget)
+				w.Header().Set("Content-Type", "application/json")
+				if tt.alwaysFail || budget > 24576 {
+					w.WriteHeader(http.StatusBadRequest)
+					io.WriteString(w, `[{"error":{"code":400,"message":"The thinking budget 100000 is invalid. Please choose a value between 0 and 24576.","status":"INVALID_ARGUMENT"}}]`)
+					return
+				}
+				io.WriteString(w, completionBody)
+			})
+
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}],"google":{"thinking_config":{"thinking_budget":100000}}}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if !slices.Equal(budgets, tt.wantBudgets) {
+				t.Errorf("upstream budgets = %v, want %v", budgets, tt.wantBudgets)
+			}
+		})
+	}
+}
+
+func TestVertexLabels(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.VertexLabels = map[string]string{"team": "default", "env": "prod"}
+	})
+	var labels map[string]string
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Google struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"google"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		labels = req.Google.Labels
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionBody)
+	})
+	body := `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`
+
+	r := newChatRequest(body)
+	r.Header.Set("X-Vertex-Labels", "team=search, owner=ana")
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	want := map[string]string{"team": "search", "env": "prod", "owner": "ana"}
+	if !maps.Equal(labels, want) {
+		t.Errorf("upstream labels = %v, want %v", labels, want)
+	}
+
+	r = newChatRequest(body)
+	r.Header.Set("X-Vertex-Labels", "Team=Search")
+	w = httptest.NewRecorder()
+	ChatCompletionsHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid label: status = %d, want 400", w.Code)
+	}
+}
+
+func TestDefaultMaxOutputTokens(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.DefaultMaxOutputTokens = 1000 })
+	var sent map[string]json.RawMessage
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionBody)
+	})
+	tests := []struct {
+		name     string
+		limit    string // client limit field, appended to the request
+		wantMax  string
+		wantComp string
+	}{
+		{"unset uses the default", ``, `1000`, ``},
+		{"max_tokens wins", `,"max_tokens":50`, `50`, ``},
+		{"max_completion_tokens wins", `,"max_completion_tokens":50`, ``, `50`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]`+tt.limit+`}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			if got := string(sent["max_tokens"]); got != tt.wantMax {
+				t.Errorf("upstream max_tokens = %q, want %q", got, tt.wantMax)
+			}
+			if got := string(sent["max_completion_tokens"]); got != tt.wantComp {
+				t.Errorf("upstream max_completion_tokens = %q, want %q", got, tt.wantComp)
+			}
+		})
+	}
+}
+
+func TestStreamComments(t *testing.T) {
+	sseUpstream(t,
+		": heartbeat",
+		`data: {"id":"x","choices":[{"index":0,"delta":{"content":"hi"}}]}`,
+		": keepalive",
+		`data: {"id":"x","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		"data: [DONE]",
+	)
+	w := runStreamingProxy(t, proxyOptions{})
+
+	var comments []string
+	for _, event := range strings.Split(w.Body.String(), "\n\n") {
+		event = strings.TrimSpace(event)
+		if strings.HasPrefix(event, ":") {
+			if strings.Contains(event, "\n") {
+				t.Errorf("comment shares an event with other lines: %q", event)
+			}
+			comments = append(comments, event)
+		}
+	}
+	if !slices.Equal(comments, []string{": heartbeat", ": keepalive"}) {
+		t.Errorf("comments = %q, want both heartbeats as standalone blocks", comments)
+	}
+	data := sseData(w.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("data = %q, want a stream ending in [DONE]", data)
+	}
+	for _, payload := range data[:len(data)-1] {
+		decodeChunk(t, payload)
+	}
+}
+
+func TestIncludeReasoningOverride(t *testing.T) {
+	const thought = "<vertex_think_tag>hmm</vertex_think_tag>answer"
+	tests := []struct {
+		name          string
+		field         string // include_reasoning, appended to the request
+		wantReasoning string
+	}{
+		{"default", ``, "hmm"},
+		{"opt out", `,"include_reasoning":false`, ""},
+		{"opt in", `,"include_reasoning":true`, "hmm"},
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var sent map[string]json.RawMessage
+				stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+					var req struct {
+						Google struct {
+							ThinkingConfig struct {
+								IncludeThoughts bool `json:"include_thoughts"`
+							} `json:"thinking_config"`
+						} `json:"google"`
+					}
+					body, _ := io.ReadAll(r.Body)
+					json.Unmarshal(body, &sent)
+					json.Unmarshal(body, &req)
+					// Vertex only tags thoughts it was asked to include
+					content := "answer"
+					if req.Google.ThinkingConfig.IncludeThoughts {
+						content = thought
+					}
+					w.Header().Set("Content-Type", "application/json")
+					io.WriteString(w, completionWithContent(content))
+				})
+
+				w := httptest.NewRecorder()
+				ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]`+tt.field+`}`))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				if _, ok := sent["include_reasoning"]; ok {
+					t.Error("include_reasoning was forwarded upstream")
+				}
+				var resp struct {
+					Choices []struct {
+						Message struct {
+							Content          string `json:"content"`
+							ReasoningContent string `json:"reasoning_content"`
+						} `json:"message"`
+					} `json:"choices"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				msg := resp.Choices[0].Message
+				if msg.Content != "answer" || msg.ReasoningContent != tt.wantReasoning {
+					t.Errorf("content %q, reasoning %q; want answer, %q", msg.Content, msg.ReasoningContent, tt.wantReasoning)
+				}
+			})
+		}
+	})
+
+	t.Run("native", func(t *testing.T) {
+		useConfig(t, func(c *config.Config) { c.DebugMode = true })
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				body := `{"request":{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]` + tt.field + `},` +
+					`"response":{"candidates":[{"content":{"role":"model","parts":[{"text":"` + thought + `"}]},"finishReason":"STOP"}]}}`
+				w := httptest.NewRecorder()
+				DebugTranslateHandler(w, httptest.NewRequest(http.MethodPost, "/debug/translate", strings.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				var resp debugTranslateResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				msg := resp.OpenAIResponse.Choices[0].Message
+				if msg.ReasoningContent != tt.wantReasoning {
+					t.Errorf("reasoning = %q, want %q", msg.ReasoningContent, tt.wantReasoning)
+				}
+			})
+		}
+	})
+}
+
+func TestSingleChoice(t *testing.T) {
+	const twoChoices = `{"id":"c1","object":"chat.completion","created":1,"model":"gemini-2.5-flash","choices":[` +
+		`{"index":0,"message":{"role":"assistant","content":"first"},"finish_reason":"stop"},` +
+		`{"index":1,"message":{"role":"assistant","content":"second"},"finish_reason":"stop"}]}`
+	tests := []struct {
+		name      string
+		n         string // n field, appended to the request
+		returnAll bool   // RETURN_ALL_CANDIDATES
+		want      int
+	}{
+		{"n unset", ``, false, 1},
+		{"n=1", `,"n":1`, false, 1},
+		{"n=2", `,"n":2`, false, 2},
+		{"all candidates configured", ``, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.ReturnAllCandidates = tt.returnAll })
+
+			jsonUpstream(t, http.StatusOK, twoChoices)
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]`+tt.n+`}`))
+			var resp nonStreamResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("status %d, body %s: %v", w.Code, w.Body, err)
+			}
+			if len(resp.Choices) != tt.want || resp.Choices[0].Message.Content != "first" {
+				t.Errorf("non-streaming choices = %+v, want %d starting with the first candidate", resp.Choices, tt.want)
+			}
+
+			sseUpstream(t,
+				`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"first"}},{"index":1,"delta":{"content":"second"}}]}`,
+				`data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"stop"},{"index":1,"delta":{},"finish_reason":"stop"}]}`,
+				`data: [DONE]`,
+			)
+			w = httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","stream":true,"messages":[{"role":"user","content":"hi"}]`+tt.n+`}`))
+			indexes := map[int]bool{}
+			for _, payload := range sseData(w.Body.String()) {
+				if payload == "[DONE]" {
+					continue
+				}
+				for _, choice := range decodeChunk(t, payload).Choices {
+					indexes[choice.Index] = true
+				}
+			}
+			if len(indexes) != tt.want {
+				t.Errorf("streamed choice indexes = %v, want %d", indexes, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepairConversation(t *testing.T) {
+	body := `{"model":"gemini-2.5-flash","messages":[{"role":"assistant","content":"hello"},{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name      string
+		repair    bool
+		wantRoles []string
+	}{
+		{"strict by default", false, []string{"assistant", "user"}},
+		{"repaired", true, []string{"user"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.RepairConversation = tt.repair })
+			var roles []string
+			stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Messages []struct {
+						Role string `json:"role"`
+					} `json:"messages"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				roles = nil
+				for _, m := range req.Messages {
+					roles = append(roles, m.Role)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, completionBody)
+			})
+			logs := captureLog(t)
+
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			if !slices.Equal(roles, tt.wantRoles) {
+				t.Errorf("upstream roles = %q, want %q", roles, tt.wantRoles)
+			}
+			if logged := strings.Contains(logs.String(), "repaired conversation"); logged != tt.repair {
+				t.Errorf("repair warning logged = %v, want %v", logged, tt.repair)
+			}
+		})
+	}
+}
+
+func TestMediaFetchFailure(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.DebugMode = true })
+	// Loopback is refused before anything is sent
+	body := `{"request":{"model":"gemini-2.5-flash","messages":[{"role":"user","content":[` +
+		`{"type":"text","text":"transcribe"},{"type":"input_audio","input_audio":{"url":"http://127.0.0.1:9/clip.wav"}}]}]}}`
+	w := httptest.NewRecorder()
+	DebugTranslateHandler(w, httptest.NewRequest(http.MethodPost, "/debug/translate", strings.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", w.Code, w.Body.String())
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Type != "invalid_request_error" || !strings.Contains(resp.Error.Message, "messages[0]: content[1]: failed to fetch input_audio part") {
+		t.Errorf("error = %+v, want invalid_request_error naming the part", resp.Error)
+	}
+}
+
+func TestDebugTranslateStream(t *testing.T) {
+	body := `{"stream":true,"request":{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]},"chunks":[` +
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"<vertex_think_tag>plan"}]}}]},` +
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"ning</vertex_think_tag>Hel"}]}}]},` +
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"lo"},{"functionCall":{"name":"lookup","args":{"q":"x"}}}]}}]},` +
+		`{"candidates":[{"content":{"role":"model","parts":[]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":4,"totalTokenCount":7}}]}`
+
+	useConfig(t, func(c *config.Config) { c.DebugMode = false })
+	w := httptest.NewRecorder()
+	DebugTranslateHandler(w, httptest.NewRequest(http.MethodPost, "/debug/translate", strings.NewReader(body)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("without DEBUG_MODE: status = %d, want 404", w.Code)
+	}
+
+	useConfig(t, func(c *config.Config) { c.DebugMode = true })
+	w = httptest.NewRecorder()
+	DebugTranslateHandler(w, httptest.NewRequest(http.MethodPost, "/debug/translate", strings.NewReader(body)))
+	data := sseData(w.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("stream does not end with [DONE]:\n%s", w.Body)
+	}
+
+	var content, reasoning, role, finish, callName, callArgs string
+	var usage *translate.Usage
+	for _, payload := range data[:len(data)-1] {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Role             string `json:"role"`
+					Content          string `json:"content"`
+					ReasoningContent string `json:"reasoning_content"`
+					ToolCalls        []struct {
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *translate.Usage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("chunk %q is not JSON: %v", payload, err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if role == "" {
+				role = choice.Delta.Role
+			}
+			content += choice.Delta.Content
+			reasoning += choice.Delta.ReasoningContent
+			// Names and arguments may arrive in separate deltas
+			for _, call := range choice.Delta.ToolCalls {
+				callName += call.Function.Name
+				callArgs += call.Function.Arguments
+			}
+			if choice.FinishReason != nil {
+				finish = *choice.FinishReason
+			}
+		}
+	}
+	if role != "assistant" {
+		t.Errorf("first role = %q, want assistant", role)
+	}
+	if content != "Hello" || reasoning != "planning" {
+		t.Errorf("content %q, reasoning %q; want Hello, planning", content, reasoning)
+	}
+	if callName != "lookup" || callArgs != `{"q":"x"}` {
+		t.Errorf("tool call %q(%s), want lookup with its arguments", callName, callArgs)
+	}
+	if finish != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", finish)
+	}
+	if usage == nil || usage.TotalTokens != 7 {
+		t.Errorf("usage = %+v, want the upstream total of 7", usage)
+	}
+}
+
+func TestReasoningShape(t *testing.T) {
+	for _, shape := range []string{"flat", "object"} {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s stream=%v", shape, stream), func(t *testing.T) {
+				// Echo mode answers with thinking tags through the real proxy path
+				useConfig(t, func(c *config.Config) {
+					c.EchoMode = true
+					c.StreamCoalesceMS = 0
+					c.ReasoningShape = shape
+				})
+				w := httptest.NewRecorder()
+				ChatCompletionsHandler(w, newChatRequest(fmt.Sprintf(`{"model":"gemini-2.5-flash","stream":%v,"include_reasoning":true,"messages":[{"role":"user","content":"hi"}]}`, stream)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				payloads := []string{w.Body.String()}
+				if stream {
+					payloads = sseData(w.Body.String())
+				}
+
+				var flat, nested strings.Builder
+				for _, payload := range payloads {
+					if payload == "[DONE]" {
+						continue
+					}
+					type reasoningMsg struct {
+						ReasoningContent string `json:"reasoning_content"`
+						Reasoning        *struct {
+							Content string `json:"content"`
+						} `json:"reasoning"`
+					}
+					var resp struct {
+						Choices []struct {
+							Message reasoningMsg `json:"message"`
+							Delta   reasoningMsg `json:"delta"`
+						} `json:"choices"`
+					}
+					if err := json.Unmarshal([]byte(payload), &resp); err != nil {
+						t.Fatalf("payload %q is not JSON: %v", payload, err)
+					}
+					for _, choice := range resp.Choices {
+						for _, msg := range []reasoningMsg{choice.Message, choice.Delta} {
+							flat.WriteString(msg.ReasoningContent)
+							if msg.Reasoning != nil {
+								nested.WriteString(msg.Reasoning.Content)
+							}
+						}
+					}
+				}
+
+				wantFlat, wantNested := echoReasoning, ""
+				if shape == "object" {
+					wantFlat, wantNested = "", echoReasoning
+				}
+				if flat.String() != wantFlat || nested.String() != wantNested {
+					t.Errorf("reasoning_content %q, reasoning.content %q; want %q, %q", flat.String(), nested.String(), wantFlat, wantNested)
+				}
+			})
+		}
+	}
+}
+
+func TestModelAccessLists(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.AllowedModels = []string{"gemini-2.5-*"}
+		c.DeniedModels = []string{"gemini-2.5-pro"}
+	})
+	var upstreamCalls atomic.Int32
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionWithContent("ok"))
+	})
+
+	tests := []struct {
+		name       string
+		model      string
+		wantStatus int
+	}{
+		{"allowed", "gemini-2.5-flash", http.StatusOK},
+		{"denied", "gemini-2.5-pro", http.StatusForbidden},
+		{"not on the allowlist", "gemini-3-pro-preview", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamCalls.Store(0)
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"`+tt.model+`","messages":[{"role":"user","content":"hi"}]}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusForbidden {
+				if !strings.Contains(w.Body.String(), "Model not allowed on this proxy: "+tt.model) {
+					t.Errorf("error does not name the model: %s", w.Body.String())
+				}
+				if upstreamCalls.Load() != 0 {
+					t.Error("blocked model reached the upstream")
+				}
+			}
+		})
+	}
+
+	t.Run("gemini path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		GeminiHandler(w, geminiRequest("models/gemini-2.5-pro:generateContent", `{"contents":[]}`))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("status = %d, want 403: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("model list", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ModelsHandler(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+		var resp models.ModelsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(resp.Data))
+		for _, m := range resp.Data {
+			ids = append(ids, m.ID)
+		}
+		if !slices.Contains(ids, "gemini-2.5-flash") || slices.Contains(ids, "gemini-2.5-pro") || slices.Contains(ids, "gemini-3-pro-preview") {
+			t.Errorf("listed models = %v, want only allowed ones", ids)
+		}
+	})
+}
+
+func TestSSERetryDirective(t *testing.T) {
+	streams := []struct {
+		name string
+		run  func(t *testing.T, w http.ResponseWriter)
+	}{
+		{"chat completions", func(t *testing.T, w http.ResponseWriter) {
+			sseUpstream(t, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`, "data: [DONE]")
+			ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+		}},
+		{"gemini", func(t *testing.T, w http.ResponseWriter) {
+			sseUpstream(t, `data: {"candidates":[]}`)
+			GeminiHandler(w, geminiRequest("models/gemini-2.5-flash:streamGenerateContent?alt=sse", `{"contents":[]}`))
+		}},
+	}
+	for _, retryMS := range []int{1500, 0} {
+		for _, stream := range streams {
+			t.Run(fmt.Sprintf("%s retry=%d", stream.name, retryMS), func(t *testing.T) {
+				useConfig(t, func(c *config.Config) { c.SSERetryMS = retryMS })
+				w := httptest.NewRecorder()
+				stream.run(t, w)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				body := w.Body.String()
+				if retryMS == 0 {
+					if strings.Contains(body, "retry:") {
+						t.Errorf("retry directive sent although SSE_RETRY_MS=0:\n%s", body)
+					}
+					return
+				}
+				if !strings.HasPrefix(body, "retry: 1500\n\n") || strings.Count(body, "retry:") != 1 {
+					t.Errorf("stream does not start with a single retry directive:\n%s", body)
+				}
+				if data := sseData(body); len(data) == 0 {
+					t.Error("no data events after the directive")
+				}
+			})
+		}
+	}
+}
+
+func TestStreamEmptyChoicesChunks(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+	// The trailing partial thinking tag is held back until the end of the stream
+	sseUpstream(t,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hi <vertex_th"}}]}`,
+		`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gemini-2.5-flash","choices":[]}`,
+		`data: {"id":"c1","choices":[],"prompt_filter_results":[{"prompt_index":0}]}`,
+		`data: {"id":"c1","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		`data: [DONE]`,
+	)
+
+	w := runStreamingProxy(t, proxyOptions{})
+	data := sseData(w.Body.String())
+	var content strings.Builder
+	filterChunks, usageAt := 0, -1
+	for i, payload := range data {
+		if payload == "[DONE]" {
+			if i != len(data)-1 {
+				t.Errorf("[DONE] at event %d of %d", i, len(data))
+			}
+			continue
+		}
+		chunk := decodeChunk(t, payload)
+		if len(chunk.Choices) == 0 {
+			switch {
+			case chunk.Usage != nil:
+				usageAt = i
+			case strings.Contains(payload, "prompt_filter_results"):
+				filterChunks++
+			default:
+				t.Errorf("bare empty-choices chunk forwarded: %s", payload)
+			}
+			continue
+		}
+		if usageAt >= 0 {
+			t.Errorf("content after the usage chunk: %s", payload)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if filterChunks != 1 {
+		t.Errorf("prompt filter chunk forwarded %d times, want once", filterChunks)
+	}
+	if usageAt != len(data)-2 {
+		t.Errorf("usage chunk at event %d, want just before [DONE]:\n%s", usageAt, strings.Join(data, "\n"))
+	}
+	if content.String() != "hi <vertex_th" {
+		t.Errorf("content = %q, want the held-back text flushed before usage", content.String())
+	}
+}
+
+func TestKeyIndexHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		expose, debug bool
+		want          bool
+	}{
+		{"off by default", false, false, false},
+		{"needs debug mode", true, false, false},
+		{"enabled", true, true, true},
+	}
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s stream=%v", tt.name, stream), func(t *testing.T) {
+				useConfig(t, func(c *config.Config) {
+					c.ExposeKeyIndex = tt.expose
+					c.DebugMode = tt.debug
+				})
+				if stream {
+					sseUpstream(t, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`, "data: [DONE]")
+				} else {
+					jsonUpstream(t, http.StatusOK, completionBody)
+				}
+				w := httptest.NewRecorder()
+				ChatCompletionsHandler(w, newChatRequest(fmt.Sprintf(`{"model":"gemini-2.5-flash","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				got, ok := w.Header()["X-Key-Index"]
+				if ok != tt.want {
+					t.Fatalf("X-Key-Index present = %v, want %v", ok, tt.want)
+				}
+				if ok && (len(got) != 1 || got[0] != "0") {
+					t.Errorf("X-Key-Index = %q, want the index of the only key", got)
+				}
+				if strings.Contains(strings.Join(got, ""), "test-key") {
+					t.Error("X-Key-Index exposes the key")
+				}
+			})
+		}
+	}
+}
+
+func TestStreamRunningUsageEstimate(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.StreamCoalesceMS = 0 })
+	var lines []string
+	for _, text := range []string{"The quick brown ", "fox jumps over ", "the lazy dog, ", "again and again."} {
+		lines = append(lines, `data: {"id":"c1","choices":[{"index":0,"delta":{"content":"`+text+`"}}]}`)
+	}
+	lines = append(lines,
+		`data: {"id":"c1","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":14,"total_tokens":17}}`,
+		`data: [DONE]`,
+	)
+	sseUpstream(t, lines...)
+
+	w := runStreamingProxy(t, proxyOptions{runningUsage: true})
+	var estimates []int
+	for _, payload := range sseData(w.Body.String()) {
+		var chunk struct {
+			Choices  []json.RawMessage `json:"choices"`
+			Estimate *translate.Usage  `json:"usage_estimate"`
+		}
+		if payload == "[DONE]" || json.Unmarshal([]byte(payload), &chunk) != nil {
+			continue
+		}
+		if len(chunk.Choices) == 0 {
+			if chunk.Estimate != nil {
+				t.Errorf("usage chunk carries an estimate: %s", payload)
+			}
+			continue
+		}
+		if chunk.Estimate == nil || !chunk.Estimate.Estimated {
+			t.Fatalf("content chunk without a marked estimate: %s", payload)
+		}
+		estimates = append(estimates, chunk.Estimate.CompletionTokens)
+	}
+	if len(estimates) != 4 {
+		t.Fatalf("estimates = %v, want one per content chunk", estimates)
+	}
+	for i := 1; i < len(estimates); i++ {
+		if estimates[i] < estimates[i-1] {
+			t.Errorf("estimate decreased: %v", estimates)
+		}
+	}
+	if estimates[len(estimates)-1] <= estimates[0] {
+		t.Errorf("estimate did not grow: %v", estimates)
+	}
+
+	t.Run("off by default", func(t *testing.T) {
+		sseUpstream(t, lines...)
+		if w := runStreamingProxy(t, proxyOptions{}); strings.Contains(w.Body.String(), "usage_estimate") {
+			t.Errorf("usage_estimate sent without the option:\n%s", w.Body.String())
+		}
+	})
+}
+
+func TestForceNonStreaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		config bool   // FORCE_NON_STREAMING
+		header string // X-Force-Buffer
+	}{
+		{"config", true, ""},
+		{"header", false, "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.ForceNonStreaming = tt.config })
+			var sent map[string]json.RawMessage
+			stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				json.Unmarshal(body, &sent)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, completionWithContent("the whole answer"))
+			})
+
+			r := newChatRequest(`{"model":"gemini-2.5-flash","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+			if tt.header != "" {
+				r.Header.Set("X-Force-Buffer", tt.header)
+			}
+			w := httptest.NewRecorder()
+			ChatCompletionsHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var resp struct {
+				Object  string `json:"object"`
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body is not a single JSON response: %v\n%s", err, w.Body.String())
+			}
+			if resp.Object != "chat.completion" || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "the whole answer" {
+				t.Errorf("response = %s, want the complete completion", w.Body.String())
+			}
+			if string(sent["stream"]) != "false" {
+				t.Errorf("upstream stream = %s, want false", sent["stream"])
+			}
+			if _, ok := sent["stream_options"]; ok {
+				t.Error("stream_options forwarded on a buffered request")
+			}
+		})
+	}
+}
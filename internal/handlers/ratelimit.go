@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/keys"
+)
+
+// Per-client request rate limiting and upstream backpressure for completion
+// endpoints.
+//
+// Clients are identified by their Authorization/x-goog-api-key credential
+// (hashed), falling back to the remote IP. Each client gets RATE_LIMIT_RPM
+// requests per fixed one-minute window, whatever "user" its requests name.
+// Requests that carry an OpenAI "user" field are also counted against a
+// bucket per user under that credential, limited to RATE_LIMIT_USER_RPM, so
+// one user of a shared API key cannot use up the whole client window. When
+// RATE_LIMIT_RPM is set, completion responses carry OpenAI-style headers for
+// the client window:
+//
+//	x-ratelimit-limit-requests     requests allowed per window
+//	x-ratelimit-remaining-requests requests left in the current window
+//	x-ratelimit-reset-requests     time until the window resets (e.g. "12s")
+
+// rateWindow is the fixed window length
+const rateWindow = time.Minute
+
+type rateBucket struct {
+	windowStart time.Time
+	count       int
+}
+
+var (
+	rateBuckets   = make(map[string]*rateBucket)
+	rateBucketsMu sync.Mutex
+)
+
+// rateLimitUserID identifies an end user of a client for the per-user bucket
+func rateLimitUserID(client, user string) string {
+	return client + "/" + hashUser(user)
+}
+
+// clientCredential identifies the calling client by its (hashed) credential,
+// falling back to the remote IP
+func clientCredential(r *http.Request) string {
+	if cred := r.Header.Get("Authorization"); cred != "" {
+		return hashUser(cred)
+	}
+	if cred := r.Header.Get("x-goog-api-key"); cred != "" {
+		return hashUser(cred)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimit counts the request against the window of the client and,
+// when it names one, of the user, sets the x-ratelimit-* headers and reports
+// whether the request may proceed. A request is only counted when every
+// window it falls under has room. It is a no-op when neither RATE_LIMIT_RPM
+// nor RATE_LIMIT_USER_RPM applies.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, user string) bool {
+	cfg := config.Get()
+	limit, userLimit := cfg.RateLimitRPM, cfg.RateLimitUserRPM
+	if user == "" {
+		userLimit = 0
+	}
+	if limit <= 0 && userLimit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	client := clientCredential(r)
+
+	rateBucketsMu.Lock()
+	var clientBucket, userBucket *rateBucket
+	if limit > 0 {
+		clientBucket = currentBucket(client, now)
+	}
+	if userLimit > 0 {
+		userBucket = currentBucket(rateLimitUserID(client, user), now)
+	}
+	allowed := true
+	var reset time.Duration
+	if clientBucket != nil && clientBucket.count >= limit {
+		allowed = false
+		reset = clientBucket.windowStart.Add(rateWindow).Sub(now)
+	}
+	if userBucket != nil && userBucket.count >= userLimit {
+		allowed = false
+		reset = max(reset, userBucket.windowStart.Add(rateWindow).Sub(now))
+	}
+	if allowed {
+		if clientBucket != nil {
+			clientBucket.count++
+		}
+		if userBucket != nil {
+			userBucket.count++
+		}
+	}
+	var remaining int
+	var clientReset time.Duration
+	if clientBucket != nil {
+		remaining = limit - clientBucket.count
+		clientReset = clientBucket.windowStart.Add(rateWindow).Sub(now)
+	}
+	rateBucketsMu.Unlock()
+
+	// The headers describe the client window; per-user windows are internal
+	if clientBucket != nil {
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(limit))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(remaining))
+		w.Header().Set("x-ratelimit-reset-requests", fmt.Sprintf("%ds", int(clientReset.Round(time.Second).Seconds())))
+	}
+
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(reset.Round(time.Second).Seconds())))
+		sendError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit exceeded, retry after "+reset.Round(time.Second).String())
+	}
+	return allowed
+}
+
+// currentBucket returns the bucket for id, starting a new window when the
+// last one has ended. The caller holds rateBucketsMu.
+func currentBucket(id string, now time.Time) *rateBucket {
+	bucket, ok := rateBuckets[id]
+	if !ok || now.Sub(bucket.windowStart) >= rateWindow {
+		// Drop stale buckets while we hold the lock
+		for k, b := range rateBuckets {
+			if now.Sub(b.windowStart) >= rateWindow {
+				delete(rateBuckets, k)
+			}
+		}
+		bucket = &rateBucket{windowStart: now}
+		rateBuckets[id] = bucket
+	}
+	return bucket
+}
+
+// checkCapacity fails fast with 503 and a Retry-After hint when every key is
+// benched or cooling down and one will be back (see KeyManager.RetryAfter),
+// instead of sending requests with keys that are known to be failing or
+// throttled. It reports whether the request may proceed.
+func checkCapacity(w http.ResponseWriter) bool {
+	if keyManager.BudgetExhausted() {
+		sendBudgetExhausted(w)
+		return false
+	}
+	wait, exhausted := keyManager.RetryAfter()
+	if !exhausted {
+		return true
+	}
+	seconds := int(wait.Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendError(w, http.StatusServiceUnavailable, "service_unavailable", fmt.Sprintf("All upstream keys are unavailable, retry after %ds", seconds))
+	return false
+}
+
+// sendBudgetExhausted answers 429 when every key has used its daily budget,
+// with the time budgets reset
+func sendBudgetExhausted(w http.ResponseWriter) {
+	reset := keys.BudgetResetTime()
+	seconds := int(time.Until(reset).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendError(w, http.StatusTooManyRequests, "insufficient_quota",
+		"All upstream keys have used their daily budget, resets at "+reset.Format(time.RFC3339))
+}
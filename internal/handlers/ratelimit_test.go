@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// resetRateBuckets starts every client with a fresh window
+func resetRateBuckets() {
+	rateBucketsMu.Lock()
+	rateBuckets = make(map[string]*rateBucket)
+	rateBucketsMu.Unlock()
+}
+
+func TestRateLimitUsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		rpm        int // RATE_LIMIT_RPM
+		userRPM    int // RATE_LIMIT_USER_RPM
+		users      []string
+		wantPassed int
+	}{
+		{"changing user does not bypass the client limit", 2, 0, []string{"a", "b", "c", "d"}, 2},
+		{"per-user limit on top of the client limit", 10, 1, []string{"a", "a", "b", "b", ""}, 3},
+		{"client limit still applies with a per-user limit", 2, 5, []string{"a", "b", "c"}, 2},
+		{"per-user limit alone", 0, 1, []string{"a", "a", "b", "", ""}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.RateLimitRPM = tt.rpm
+				c.RateLimitUserRPM = tt.userRPM
+			})
+			resetRateBuckets()
+
+			passed := 0
+			for _, user := range tt.users {
+				r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+				r.Header.Set("Authorization", "Bearer shared-key")
+				w := httptest.NewRecorder()
+				if checkRateLimit(w, r, user) {
+					passed++
+				} else if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+					t.Errorf("refused request: status %d, Retry-After %q, want 429 with Retry-After",
+						w.Code, w.Header().Get("Retry-After"))
+				}
+			}
+			if passed != tt.wantPassed {
+				t.Errorf("rate limiter passed %d requests, want %d", passed, tt.wantPassed)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	jsonUpstream(t, http.StatusOK, completionBody)
+	body := `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`
+
+	useConfig(t, func(c *config.Config) { c.RateLimitRPM = 3 })
+	resetRateBuckets()
+	for i, wantRemaining := range []string{"2", "1"} {
+		w := httptest.NewRecorder()
+		ChatCompletionsHandler(w, newChatRequest(body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, w.Code, w.Body.String())
+		}
+		h := w.Header()
+		if got := h.Get("x-ratelimit-limit-requests"); got != "3" {
+			t.Errorf("request %d: x-ratelimit-limit-requests = %q, want 3", i, got)
+		}
+		if got := h.Get("x-ratelimit-remaining-requests"); got != wantRemaining {
+			t.Errorf("request %d: x-ratelimit-remaining-requests = %q, want %s", i, got, wantRemaining)
+		}
+		if got := h.Get("x-ratelimit-reset-requests"); !strings.HasSuffix(got, "s") {
+			t.Errorf("request %d: x-ratelimit-reset-requests = %q, want seconds", i, got)
+		}
+	}
+
+	useConfig(t, func(c *config.Config) { c.RateLimitRPM = 0 })
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(body))
+	if got := w.Header().Get("x-ratelimit-limit-requests"); got != "" {
+		t.Errorf("x-ratelimit-limit-requests = %q with rate limiting off, want none", got)
+	}
+}
+
+func TestCapacityRetryAfter(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.KeyCooldownSeconds = 1 })
+	var calls atomic.Int32
+	stubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completionBody)
+	})
+
+	// The only key cools down; wait the cooldown out so later tests can use it
+	keyManager.Cooldown(0, "test")
+	t.Cleanup(func() {
+		if until, ok := keyManager.CooldownUntil(0); ok {
+			time.Sleep(time.Until(until))
+		}
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletionsHandler(w, newChatRequest(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", w.Code, w.Body.String())
+	}
+	seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || seconds < 1 || seconds > 2 {
+		t.Errorf("Retry-After = %q, want 1-2 seconds for a 1s cooldown", w.Header().Get("Retry-After"))
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("upstream calls = %d, want a fast fail", n)
+	}
+}
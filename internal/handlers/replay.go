@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vertex2api-golang/internal/translate"
+)
+
+// SSE reconnection support.
+//
+// Every event of a proxied chat stream is emitted with an "id: {stream}-{seq}"
+// line and recorded in a short-lived in-memory replay buffer. A client that
+// reconnects with a Last-Event-ID header for a known stream receives only the
+// events after that sequence number (following the stream live if it is still
+// in progress) instead of a fresh, duplicated generation. Unknown or expired
+// IDs fall through to a normal request.
+//
+// A stream can only be resumed (or cancelled) with the credential that
+// started it. Each stream buffers at most replayMaxBytes of events; a longer
+// stream keeps going live but is no longer resumable.
+
+const (
+	// replayTTL is how long a stream stays resumable after its last event
+	replayTTL = 5 * time.Minute
+	// replayMaxStreams bounds the number of streams kept in memory
+	replayMaxStreams = 256
+	// replayMaxBytes bounds the events buffered per stream
+	replayMaxBytes = 512 << 10
+)
+
+// replayStream records the events of a single SSE stream
+type replayStream struct {
+	id      string
+	owner   string // clientCredential of the request that started it
+	mu      sync.Mutex
+	events  []string
+	seq     int  // events emitted, including ones no longer buffered
+	size    int  // bytes buffered in events
+	dropped bool // over replayMaxBytes, events released
+	done    bool
+	updated chan struct{} // closed and replaced whenever the stream changes
+	touched time.Time
+	cancel  context.CancelFunc // cancels the upstream request
+	aborted bool               // cancelled by the client, see StreamCancelHandler
+}
+
+var (
+	replayStreams   = make(map[string]*replayStream)
+	replayStreamsMu sync.Mutex
+)
+
+// newReplayStream registers a new resumable stream owned by the client
+// credential owner; cancel stops its upstream request
+func newReplayStream(owner string, cancel context.CancelFunc) *replayStream {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+
+	rs := &replayStream{
+		id:      hex.EncodeToString(buf),
+		owner:   owner,
+		updated: make(chan struct{}),
+		touched: time.Now(),
+		cancel:  cancel,
+	}
+
+	replayStreamsMu.Lock()
+	pruneReplayStreamsLocked()
+	replayStreams[rs.id] = rs
+	replayStreamsMu.Unlock()
+
+	return rs
+}
+
+// pruneReplayStreamsLocked drops expired streams, then the oldest ones if over capacity
+func pruneReplayStreamsLocked() {
+	now := time.Now()
+	for id, rs := range replayStreams {
+		rs.mu.Lock()
+		expired := now.Sub(rs.touched) > replayTTL
+		rs.mu.Unlock()
+		if expired {
+			delete(replayStreams, id)
+		}
+	}
+
+	for len(replayStreams) >= replayMaxStreams {
+		var oldestID string
+		var oldest time.Time
+		for id, rs := range replayStreams {
+			rs.mu.Lock()
+			t := rs.touched
+			rs.mu.Unlock()
+			if oldestID == "" || t.Before(oldest) {
+				oldestID, oldest = id, t
+			}
+		}
+		delete(replayStreams, oldestID)
+	}
+}
+
+// record appends an event payload and returns its SSE id
+func (rs *replayStream) record(data string) string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.seq++
+	if !rs.dropped {
+		rs.size += len(data)
+		if rs.size > replayMaxBytes {
+			rs.dropped = true
+			rs.events = nil
+		} else {
+			rs.events = append(rs.events, data)
+		}
+	}
+	rs.touched = time.Now()
+	close(rs.updated)
+	rs.updated = make(chan struct{})
+
+	return fmt.Sprintf("%s-%d", rs.id, rs.seq)
+}
+
+// finish marks the stream as complete so followers stop waiting
+func (rs *replayStream) finish() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.done {
+		return
+	}
+	rs.done = true
+	rs.touched = time.Now()
+	close(rs.updated)
+	rs.updated = make(chan struct{})
+}
+
+// abort cancels a running stream's upstream request. It reports false if the
+// stream had already finished.
+func (rs *replayStream) abort() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.done {
+		return false
+	}
+	rs.aborted = true
+	if rs.cancel != nil {
+		rs.cancel()
+	}
+	return true
+}
+
+// wasAborted reports whether the client cancelled the stream
+func (rs *replayStream) wasAborted() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.aborted
+}
+
+// resumable reports whether the stream still holds all of its events
+func (rs *replayStream) resumable() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return !rs.dropped
+}
+
+// findReplayStream returns the stream with the given id if it was started
+// by the calling client
+func findReplayStream(r *http.Request, id string) (*replayStream, bool) {
+	replayStreamsMu.Lock()
+	rs, ok := replayStreams[id]
+	replayStreamsMu.Unlock()
+	if !ok || rs.owner != clientCredential(r) {
+		return nil, false
+	}
+	return rs, true
+}
+
+// lookupReplay resolves a Last-Event-ID to its stream and sequence number
+func lookupReplay(r *http.Request, lastEventID string) (*replayStream, int, bool) {
+	idx := strings.LastIndex(lastEventID, "-")
+	if idx <= 0 {
+		return nil, 0, false
+	}
+	seq, err := strconv.Atoi(lastEventID[idx+1:])
+	if err != nil || seq < 0 {
+		return nil, 0, false
+	}
+
+	rs, ok := findReplayStream(r, lastEventID[:idx])
+	if !ok || !rs.resumable() {
+		return nil, 0, false
+	}
+	return rs, seq, true
+}
+
+// writeSSEEvent writes one SSE event with an optional id line
+func writeSSEEvent(w http.ResponseWriter, id, data string) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// isSSEComment reports whether a line is an SSE comment (starts with ':')
+func isSSEComment(line string) bool {
+	return strings.HasPrefix(line, ":")
+}
+
+// resumeStream replays events after seq and follows the stream until it finishes
+// or the client goes away
+func resumeStream(w http.ResponseWriter, r *http.Request, rs *replayStream, seq int) {
+	// Registered for draining, but it keeps following until the original
+	// stream ends, so a terminated stream's final event still reaches it
+	_, done, ok := beginStream(r.Context(), w)
+	if !ok {
+		return
+	}
+	defer done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	translate.WriteSSERetry(w)
+	flusher, _ := w.(http.Flusher)
+	sent := seq
+
+	for {
+		rs.mu.Lock()
+		pending := rs.events[min(sent, len(rs.events)):]
+		done := rs.done
+		dropped := rs.dropped
+		updated := rs.updated
+		rs.mu.Unlock()
+
+		// The stream outgrew its buffer while we were following it
+		if dropped {
+			log.Printf("resumeStream: stream=%s exceeded the replay buffer at seq=%d", rs.id, sent)
+			return
+		}
+
+		for _, data := range pending {
+			sent++
+			writeSSEEvent(w, fmt.Sprintf("%s-%d", rs.id, sent), data)
+		}
+		if flusher != nil && len(pending) > 0 {
+			flusher.Flush()
+		}
+
+		if done {
+			log.Printf("resumeStream: stream=%s replayed from seq=%d to seq=%d", rs.id, seq, sent)
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
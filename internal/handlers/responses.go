@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/keys"
+	"vertex2api-golang/internal/models"
+	"vertex2api-golang/internal/translate"
+	"vertex2api-golang/internal/vertex"
+)
+
+// ResponsesHandler handles /v1/responses, the OpenAI Responses API. Requests
+// are translated to the native Gemini API (see translate/responses.go) rather
+// than proxied to the OpenAI-compatible endpoint, which has no Responses
+// support.
+func ResponsesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	if !checkCapacity(w) {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+
+	var req translate.ResponsesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Invalid JSON: "+err.Error())
+		return
+	}
+	if !checkRateLimit(w, r, req.User) {
+		return
+	}
+	if req.Model == "" {
+		sendError(w, http.StatusBadRequest, "invalid_request", "Model is required")
+		return
+	}
+	if !models.IsModelAllowed(req.Model) {
+		sendError(w, http.StatusForbidden, "permission_denied", "Model not allowed on this proxy: "+req.Model)
+		return
+	}
+
+	chatReq, err := req.ToChatRequest()
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	geminiReq, actualModel, err := translate.ToGeminiRequest(r.Context(), chatReq)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, translateErrorType(err), err.Error())
+		return
+	}
+	overrides, err := translate.ParseGenerationOverrides(r.Header, actualModel)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	overrides.ApplyGemini(geminiReq)
+
+	responseID := translate.NewResponseID()
+	log.Printf("Responses: model=%s (actual=%s), stream=%v, user=%s", req.Model, actualModel, req.Stream, hashUser(req.User))
+
+	ctx := r.Context()
+	if !req.Stream {
+		geminiResp, err := vertexClient.GenerateContent(ctx, actualModel, geminiReq)
+		if err != nil {
+			sendResponsesError(w, r, err)
+			return
+		}
+		chat := translate.FromGeminiResponse(geminiResp, req.Model, responseID)
+		if config.Get().EstimateUsage {
+			translate.FillEstimatedUsage(chat, translate.EstimatePromptTokens(chatReq.Messages))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(translate.ResponsesFromChat(chat, responseID, req.Model))
+		return
+	}
+
+	if !acquireStreamSlot(w) {
+		return
+	}
+	defer releaseStreamSlot()
+	ctx, done, ok := beginStream(ctx, w)
+	if !ok {
+		return
+	}
+	defer done()
+
+	state := translate.NewStreamState()
+	stream := translate.NewResponsesStream(w, responseID, req.Model)
+	var estimate *translate.RunningUsage
+	if config.Get().EstimateUsage {
+		estimate = translate.NewRunningUsage(translate.EstimatePromptTokens(chatReq.Messages))
+	}
+	var finishReason string
+	err = vertexClient.StreamGenerateContent(ctx, actualModel, geminiReq, func(chunk *vertex.GeminiResponse) error {
+		content, reasoning, toolCalls, finish := state.ProcessChunk(chunk)
+		if estimate != nil {
+			estimate.Add(content)
+			estimate.Add(reasoning)
+		}
+		stream.WriteText(content)
+		for _, call := range toolCalls {
+			stream.WriteToolCall(call)
+		}
+		if finish != "" {
+			finishReason = finish
+		}
+		return nil
+	})
+	if err != nil {
+		// Retries only happen before output, so a started stream failed mid-way
+		if stream.Started() {
+			log.Printf("Responses stream failed: model=%s, error=%v", actualModel, err)
+			if streamsTerminated() {
+				stream.Fail("Server is shutting down, stream terminated")
+				return
+			}
+			stream.Fail(responsesErrorMessage(err))
+			return
+		}
+		sendResponsesError(w, r, err)
+		return
+	}
+	usage := state.Usage()
+	if usage == nil && estimate != nil {
+		usage = estimate.Usage()
+	}
+	stream.Finish(finishReason, state.Annotations(), usage)
+}
+
+// sendResponsesError reports a failed generation. The full error stays in
+// the log: transport errors quote the request URL, API key included.
+func sendResponsesError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Responses failed: error=%v", err)
+	if sendTimeoutError(w, r.Context()) {
+		return
+	}
+	if errors.Is(err, keys.ErrBudgetExhausted) {
+		sendBudgetExhausted(w)
+		return
+	}
+	if upErr, ok := asUpstreamError(err); ok {
+		sendUpstreamError(w, upErr)
+		return
+	}
+	sendError(w, http.StatusBadGateway, "upstream_error", responsesErrorMessage(err))
+}
+
+// responsesErrorMessage is the client-facing message for a failed
+// generation: the upstream message when Vertex answered, a fixed one otherwise
+func responsesErrorMessage(err error) string {
+	if upErr, ok := asUpstreamError(err); ok {
+		return upErr.message()
+	}
+	return "Upstream request failed"
+}
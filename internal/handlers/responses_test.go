@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestSendResponsesError(t *testing.T) {
+	transport := &url.Error{
+		Op:  "Post",
+		URL: "https://aiplatform.googleapis.com/v1beta1/projects/p/locations/global/publishers/google/models/m:generateContent?key=secret-key",
+		Err: errors.New("connection reset by peer"),
+	}
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantMessage string
+	}{
+		{"transport error", fmt.Errorf("all retries exhausted: request failed: %w", transport), http.StatusBadGateway, "Upstream request failed"},
+		{
+			"bad request",
+			fmt.Errorf("all retries exhausted: %w", &vertex.APIError{Status: 400, Body: []byte(`{"error":{"message":"Invalid argument"}}`)}),
+			http.StatusBadRequest, "Invalid argument",
+		},
+		{
+			"throttled",
+			&vertex.APIError{Status: 429, Body: []byte(`{"error":{"message":"Resource exhausted"}}`)},
+			http.StatusServiceUnavailable, "Resource exhausted",
+		},
+		{
+			"rejected key",
+			&vertex.APIError{Status: 403, Body: []byte(`{"error":{"message":"Permission denied"}}`)},
+			http.StatusBadGateway, "Permission denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sendResponsesError(w, httptest.NewRequest(http.MethodPost, "/v1/responses", nil), tt.err)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, tt.wantMessage) {
+				t.Errorf("body = %s, want message %q", body, tt.wantMessage)
+			}
+			if strings.Contains(body, "secret-key") {
+				t.Errorf("body leaks the API key: %s", body)
+			}
+		})
+	}
+}
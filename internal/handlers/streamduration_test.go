@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// endlessStream is an upstream that sends a content chunk every few
+// milliseconds until the request is cancelled
+func endlessStream(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for i := 0; ; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			fmt.Fprintf(w, "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"gemini\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"tok%d \"}}]}\n\n", i)
+			flusher.Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	prev := httpClient
+	httpClient = srv.Client()
+	t.Cleanup(func() { httpClient = prev })
+	return srv
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		reason     string // MAX_STREAM_FINISH_REASON
+		wantReason string
+	}{
+		{"default reason", "length", `"finish_reason":"length"`},
+		{"custom reason", "timeout", `"finish_reason":"timeout"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.MaxStreamDurationSec = 1
+				c.MaxStreamFinishReason = tt.reason
+				c.StreamCoalesceMS = 0
+			})
+			srv := endlessStream(t)
+
+			w := httptest.NewRecorder()
+			done := make(chan error, 1)
+			start := time.Now()
+			go func() {
+				done <- handleStreamingProxy(context.Background(), w, srv.URL, []byte(`{}`), "gemini", proxyOptions{tokens: new(int)})
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("handleStreamingProxy: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream still running 5s after a 1s MAX_STREAM_DURATION")
+			}
+			if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+				t.Errorf("stream ended after %v, want about 1s", elapsed)
+			}
+
+			body := w.Body.String()
+			if !strings.Contains(body, "tok0") {
+				t.Errorf("no upstream content relayed before the cutoff:\n%s", body)
+			}
+			events := strings.Split(strings.TrimSpace(body), "\n\n")
+			if len(events) < 2 {
+				t.Fatalf("got %d events, want content, a finish chunk and [DONE]", len(events))
+			}
+			if last := events[len(events)-1]; !strings.HasSuffix(last, "data: [DONE]") {
+				t.Errorf("last event = %q, want [DONE]", last)
+			}
+			if finish := events[len(events)-2]; !strings.Contains(finish, tt.wantReason) {
+				t.Errorf("finish event = %q, want %s", finish, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/health"
+)
+
+// Streaming concurrency limit (MAX_CONCURRENT_STREAMS).
+//
+// Every streaming request holds an upstream connection for as long as the
+// model keeps generating, so a burst of streams can exhaust the connection
+// pool while short requests wait. Streaming chat and Gemini requests take a
+// slot for their whole lifetime, retries included; non-streaming requests are
+// not counted. The limit is read per request, so a config reload applies to
+// new streams right away.
+
+var streamsInFlight int64
+
+// acquireStreamSlot takes a stream slot, or answers 503 and reports false
+// when MAX_CONCURRENT_STREAMS streams are already in flight
+func acquireStreamSlot(w http.ResponseWriter) bool {
+	limit := int64(config.Get().MaxConcurrentStreams)
+	for {
+		n := atomic.LoadInt64(&streamsInFlight)
+		if limit > 0 && n >= limit {
+			w.Header().Set("Retry-After", "1")
+			sendError(w, http.StatusServiceUnavailable, "service_unavailable",
+				fmt.Sprintf("Too many concurrent streams (MAX_CONCURRENT_STREAMS=%d), retry shortly", limit))
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&streamsInFlight, n, n+1) {
+			return true
+		}
+	}
+}
+
+// releaseStreamSlot returns a slot taken by acquireStreamSlot
+func releaseStreamSlot() {
+	atomic.AddInt64(&streamsInFlight, -1)
+}
+
+// StreamGauge reports streaming requests in flight for /health
+func StreamGauge() health.StreamStats {
+	return health.StreamStats{
+		InFlight: int(atomic.LoadInt64(&streamsInFlight)),
+		Limit:    config.Get().MaxConcurrentStreams,
+	}
+}
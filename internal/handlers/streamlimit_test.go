@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestStreamLimitIndependentOfRateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		streams    int // MAX_CONCURRENT_STREAMS
+		rpm        int // RATE_LIMIT_RPM
+		acquire    int // streams opened
+		wantSlots  int // streams that get a slot
+		requests   int // requests through the rate limiter meanwhile
+		wantPassed int // requests the rate limiter lets through
+	}{
+		{"stream limit with rate limiting off", 2, 0, 5, 2, 5, 5},
+		{"full stream slots leave the rate limiter alone", 1, 3, 3, 1, 3, 3},
+		{"rate limit does not consume stream slots", 3, 1, 3, 3, 2, 1},
+		{"no stream limit", 0, 2, 10, 10, 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.MaxConcurrentStreams = tt.streams
+				c.RateLimitRPM = tt.rpm
+			})
+			rateBucketsMu.Lock()
+			rateBuckets = make(map[string]*rateBucket)
+			rateBucketsMu.Unlock()
+
+			slots := 0
+			for range tt.acquire {
+				w := httptest.NewRecorder()
+				if acquireStreamSlot(w) {
+					slots++
+					continue
+				}
+				if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+					t.Errorf("refused stream: status %d, Retry-After %q, want 503 with Retry-After",
+						w.Code, w.Header().Get("Retry-After"))
+				}
+			}
+			t.Cleanup(func() {
+				for range slots {
+					releaseStreamSlot()
+				}
+			})
+			if slots != tt.wantSlots {
+				t.Errorf("stream slots taken = %d, want %d", slots, tt.wantSlots)
+			}
+			if gauge := StreamGauge(); gauge.InFlight != slots || gauge.Limit != tt.streams {
+				t.Errorf("StreamGauge = %+v, want %d in flight of %d", gauge, slots, tt.streams)
+			}
+
+			passed := 0
+			for range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+				r.Header.Set("Authorization", "Bearer "+tt.name)
+				if checkRateLimit(httptest.NewRecorder(), r, "") {
+					passed++
+				}
+			}
+			if passed != tt.wantPassed {
+				t.Errorf("rate limiter passed %d requests, want %d", passed, tt.wantPassed)
+			}
+		})
+	}
+
+	if gauge := StreamGauge(); gauge.InFlight != 0 {
+		t.Errorf("streams in flight after release = %d, want 0", gauge.InFlight)
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+// upstreamError is a non-200 answer from Vertex. Checks on it go through
+// asUpstreamError or keys.StatusError, never its message.
+type upstreamError struct {
+	status int
+	body   []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.status, string(e.body))
+}
+
+// StatusCode returns the upstream status, for keys.StatusError
+func (e *upstreamError) StatusCode() int {
+	return e.status
+}
+
+// asUpstreamError returns the upstream error wrapped in err, if any. Errors
+// from the native client (vertex.APIError) are converted so they map to the
+// same client statuses.
+func asUpstreamError(err error) (*upstreamError, bool) {
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return upErr, true
+	}
+	var apiErr *vertex.APIError
+	if errors.As(err, &apiErr) {
+		return &upstreamError{status: apiErr.Status, body: apiErr.Body}, true
+	}
+	return nil, false
+}
+
+// retryable reports whether another attempt can succeed. Server errors and
+// throttling can clear up; 401 and 403 are key-level here, so a retry on
+// another key can succeed too. Any other 4xx is the request's own fault and
+// fails the same way every time.
+func (e *upstreamError) retryable() bool {
+	switch {
+	case e.status >= 500:
+		return true
+	case e.status == http.StatusTooManyRequests, e.status == http.StatusRequestTimeout,
+		e.status == http.StatusUnauthorized, e.status == http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// clientStatus maps the upstream status to the one returned to the client.
+// Statuses that describe the request itself pass through. Anything else is
+// the proxy's problem, not the client's: rejected or throttled keys (401,
+// 403, 429) mean no key could serve the request, so they become 502 and 503
+// rather than telling the client its own credentials or rate are at fault.
+// Server errors become a 502 except for unavailability and timeouts, which
+// keep their meaning.
+func (e *upstreamError) clientStatus() int {
+	switch e.status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return e.status
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return http.StatusServiceUnavailable
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// errorType is the OpenAI error type for the client status
+func (e *upstreamError) errorType() string {
+	switch e.clientStatus() {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return "invalid_request"
+	case http.StatusServiceUnavailable:
+		return "service_unavailable"
+	case http.StatusGatewayTimeout:
+		return "gateway_timeout"
+	}
+	return "upstream_error"
+}
+
+// message extracts the upstream error message from a Google error body,
+// which is an {"error": {...}} object or an array of them, falling back to
+// the raw body
+func (e *upstreamError) message() string {
+	type googleError struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var single googleError
+	if err := json.Unmarshal(e.body, &single); err == nil && single.Error.Message != "" {
+		return single.Error.Message
+	}
+	var list []googleError
+	if err := json.Unmarshal(e.body, &list); err == nil && len(list) > 0 && list[0].Error.Message != "" {
+		return list[0].Error.Message
+	}
+	if body := strings.TrimSpace(string(e.body)); body != "" {
+		return body
+	}
+	return http.StatusText(e.status)
+}
+
+// sendUpstreamError answers with the upstream status and message
+func sendUpstreamError(w http.ResponseWriter, e *upstreamError) {
+	sendError(w, e.clientStatus(), e.errorType(), e.message())
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestUpstreamErrorClientStatus(t *testing.T) {
+	tests := []struct {
+		upstream  int
+		want      int
+		wantType  string
+		retryable bool
+	}{
+		{http.StatusBadRequest, http.StatusBadRequest, "invalid_request", false},
+		{http.StatusNotFound, http.StatusNotFound, "invalid_request", false},
+		{http.StatusRequestEntityTooLarge, http.StatusRequestEntityTooLarge, "invalid_request", false},
+		{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity, "invalid_request", false},
+		{http.StatusUnauthorized, http.StatusBadGateway, "upstream_error", true},
+		{http.StatusForbidden, http.StatusBadGateway, "upstream_error", true},
+		{http.StatusTooManyRequests, http.StatusServiceUnavailable, "service_unavailable", true},
+		{http.StatusRequestTimeout, http.StatusGatewayTimeout, "gateway_timeout", true},
+		{http.StatusConflict, http.StatusBadGateway, "upstream_error", false},
+		{http.StatusInternalServerError, http.StatusBadGateway, "upstream_error", true},
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable, "service_unavailable", true},
+		{http.StatusGatewayTimeout, http.StatusGatewayTimeout, "gateway_timeout", true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.upstream), func(t *testing.T) {
+			e := &upstreamError{status: tt.upstream}
+			if got := e.clientStatus(); got != tt.want {
+				t.Errorf("clientStatus = %d, want %d", got, tt.want)
+			}
+			if got := e.errorType(); got != tt.wantType {
+				t.Errorf("errorType = %q, want %q", got, tt.wantType)
+			}
+			if got := e.retryable(); got != tt.retryable {
+				t.Errorf("retryable = %v, want %v", got, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestIsModelNotFoundError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"404", &upstreamError{status: http.StatusNotFound}, true},
+		{"wrapped 404 from the native client", fmt.Errorf("generate: %w", &vertex.APIError{Status: http.StatusNotFound}), true},
+		{"400 naming NOT_FOUND", &upstreamError{status: http.StatusBadRequest, body: []byte(`{"error":{"status":"NOT_FOUND"}}`)}, true},
+		{"400 naming a missing model", &upstreamError{status: http.StatusBadRequest, body: []byte("Model not found: gemini-x")}, true},
+		{"other 400", &upstreamError{status: http.StatusBadRequest, body: []byte("invalid argument")}, false},
+		{"server error", &upstreamError{status: http.StatusInternalServerError, body: []byte("NOT_FOUND")}, false},
+		{"untyped error with a status in its text", errors.New("API error (status 404): not found"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isModelNotFoundError(tt.err); got != tt.want {
+			t.Errorf("%s: isModelNotFoundError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/keys"
+	"vertex2api-golang/internal/models"
+)
+
+// DeepStatus is the result of the most recent real upstream probe
+type DeepStatus struct {
+	OK        bool   `json:"ok"`
+	Model     string `json:"model"`
+	KeyIndex  int    `json:"key_index"`
+	Latency   string `json:"latency"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt string `json:"checked_at"`
+}
+
+var (
+	deepStatus   *DeepStatus
+	deepStatusMu sync.RWMutex
+)
+
+// deepProbeBody requests a single output token
+const deepProbeBody = `{"contents":[{"role":"user","parts":[{"text":"ping"}]}],"generationConfig":{"maxOutputTokens":1}}`
+
+// StartDeepProbe periodically issues a tiny real completion against one key
+// when DEEP_HEALTH_INTERVAL_SECONDS is set. Probes go straight to the
+// upstream and never count against client rate limits.
+func StartDeepProbe(ctx context.Context) {
+	cfg := config.Get()
+	interval := time.Duration(cfg.DeepHealthIntervalSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		runDeepProbe(ctx, cfg.DeepHealthModel)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runDeepProbe(ctx, cfg.DeepHealthModel)
+			}
+		}
+	}()
+
+	log.Printf("Deep health probe started: interval=%v, model=%s", interval, cfg.DeepHealthModel)
+}
+
+// getDeepStatus returns the latest probe result, or nil if none has run
+func getDeepStatus() *DeepStatus {
+	deepStatusMu.RLock()
+	defer deepStatusMu.RUnlock()
+	return deepStatus
+}
+
+func runDeepProbe(ctx context.Context, model string) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	status := &DeepStatus{Model: model, KeyIndex: -1}
+	start := time.Now()
+	err := deepProbe(ctx, model, status)
+	status.Latency = time.Since(start).Round(time.Millisecond).String()
+	status.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+	status.OK = err == nil
+	if err != nil {
+		status.Error = err.Error()
+		log.Printf("Deep health probe failed: model=%s, key_index=%d, error=%v", model, status.KeyIndex, err)
+	}
+
+	deepStatusMu.Lock()
+	deepStatus = status
+	deepStatusMu.Unlock()
+}
+
+func deepProbe(ctx context.Context, model string, status *DeepStatus) error {
+	km := keys.GetManager()
+	// Probes must not spend daily budgets or move the rotation
+	auth, err := km.ProbeAuth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get auth: %w", err)
+	}
+	status.KeyIndex = auth.KeyIndex
+
+	probeURL := fmt.Sprintf(
+		"https://aiplatform.googleapis.com/%s/projects/%s/locations/%s/publishers/google/models/%s:generateContent?key=%s",
+		models.ResolveAPIVersion(model), auth.ProjectID, models.ResolveLocation(model, auth.Location), model, auth.APIKey,
+	)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", probeURL, strings.NewReader(deepProbeBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := km.GetHTTPClient().Do(req)
+	if err != nil {
+		// The status is served on /health and the URL carries the API key,
+		// so report only the cause
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
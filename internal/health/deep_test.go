@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/keys"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Setenv("VERTEX_EXPRESS_API_KEY", "test-key:test-project")
+	os.Exit(m.Run())
+}
+
+// redirectTransport sends every request to a test server, whatever its URL
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestDeepProbeFailure(t *testing.T) {
+	var probed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed = r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"error":{"code":404,"message":"model is broken","status":"NOT_FOUND"}}`)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client := keys.GetManager().GetHTTPClient()
+	prev := client.Transport
+	client.Transport = redirectTransport{target: target}
+	defer func() { client.Transport = prev }()
+	defer func() {
+		deepStatusMu.Lock()
+		deepStatus = nil
+		deepStatusMu.Unlock()
+	}()
+
+	runDeepProbe(context.Background(), "gemini-2.5-flash")
+
+	if !strings.HasSuffix(probed, "/models/gemini-2.5-flash:generateContent") {
+		t.Errorf("probe path = %q, want a generateContent call for the probe model", probed)
+	}
+	w := httptest.NewRecorder()
+	Handler()(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var resp HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "degraded" {
+		t.Errorf("status = %q, want degraded", resp.Status)
+	}
+	if resp.Deep == nil || resp.Deep.OK || resp.Deep.KeyIndex != 0 {
+		t.Fatalf("deep = %+v, want a failed probe on key 0", resp.Deep)
+	}
+	if !strings.Contains(resp.Deep.Error, "status 404") || !strings.Contains(resp.Deep.Error, "model is broken") {
+		t.Errorf("deep error = %q, want the upstream status and message", resp.Deep.Error)
+	}
+	if strings.Contains(w.Body.String(), "test-key") {
+		t.Errorf("/health exposes the API key: %s", w.Body.String())
+	}
+}
@@ -3,15 +3,42 @@ package health
 import (
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
 var startTime = time.Now()
 
+// shuttingDown is set once shutdown starts draining
+var shuttingDown atomic.Bool
+
+// SetShuttingDown makes /health answer 503 "shutting_down" so load balancers
+// stop routing new traffic while in-flight requests drain
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Timestamp string `json:"timestamp"`
-	Uptime    string `json:"uptime"`
+	Status    string       `json:"status"`
+	Timestamp string       `json:"timestamp"`
+	Uptime    string       `json:"uptime"`
+	Deep      *DeepStatus  `json:"deep,omitempty"`
+	Sizes     *SizeStats   `json:"sizes,omitempty"`
+	Streams   *StreamStats `json:"streams,omitempty"`
+}
+
+// StreamStats is the streaming concurrency gauge
+type StreamStats struct {
+	InFlight int `json:"in_flight"`
+	Limit    int `json:"limit"` // 0 = unlimited
+}
+
+// streamGauge reads the gauge; set by SetStreamGauge
+var streamGauge func() StreamStats
+
+// SetStreamGauge registers the source of the streaming gauge reported on /health
+func SetStreamGauge(gauge func() StreamStats) {
+	streamGauge = gauge
 }
 
 // Handler returns health check endpoint handler
@@ -21,10 +48,27 @@ func Handler() http.HandlerFunc {
 			Status:    "ok",
 			Timestamp: time.Now().UTC().Format(time.RFC3339),
 			Uptime:    time.Since(startTime).Round(time.Second).String(),
+			Deep:      getDeepStatus(),
+			Sizes:     getSizeStats(),
+		}
+		if streamGauge != nil {
+			stats := streamGauge()
+			resp.Streams = &stats
+		}
+
+		// A failing real upstream call marks the service degraded
+		if resp.Deep != nil && !resp.Deep.OK {
+			resp.Status = "degraded"
+		}
+
+		status := http.StatusOK
+		if shuttingDown.Load() {
+			resp.Status = "shutting_down"
+			status = http.StatusServiceUnavailable
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(resp)
 	}
 }
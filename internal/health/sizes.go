@@ -0,0 +1,78 @@
+package health
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Request and response size histograms for capacity planning, reported on
+// /health. Sizes are wire bytes: request bodies before decompression and
+// response bodies including streamed events.
+
+// sizeBuckets are histogram upper bounds in bytes; larger sizes land in "+Inf"
+var sizeBuckets = []int64{1 << 10, 8 << 10, 64 << 10, 512 << 10, 4 << 20, 32 << 20}
+
+// SizeHistogram counts observed sizes per bucket
+type SizeHistogram struct {
+	Count   int64            `json:"count"`
+	Sum     int64            `json:"sum_bytes"`
+	Max     int64            `json:"max_bytes"`
+	Buckets map[string]int64 `json:"buckets"` // "le_<bytes>" or "le_inf" -> count
+}
+
+// SizeStats holds the request and response histograms
+type SizeStats struct {
+	Request  SizeHistogram `json:"request"`
+	Response SizeHistogram `json:"response"`
+}
+
+var (
+	sizeStats   = SizeStats{Request: newSizeHistogram(), Response: newSizeHistogram()}
+	sizeStatsMu sync.Mutex
+)
+
+func newSizeHistogram() SizeHistogram {
+	return SizeHistogram{Buckets: make(map[string]int64)}
+}
+
+// observe adds one size to the histogram
+func (h *SizeHistogram) observe(size int64) {
+	h.Count++
+	h.Sum += size
+	h.Max = max(h.Max, size)
+	for _, bound := range sizeBuckets {
+		if size <= bound {
+			h.Buckets["le_"+strconv.FormatInt(bound, 10)]++
+			return
+		}
+	}
+	h.Buckets["le_inf"]++
+}
+
+// clone returns a copy safe to use outside the lock
+func (h *SizeHistogram) clone() SizeHistogram {
+	c := *h
+	c.Buckets = make(map[string]int64, len(h.Buckets))
+	for k, v := range h.Buckets {
+		c.Buckets[k] = v
+	}
+	return c
+}
+
+// RecordSizes records the body sizes of one request
+func RecordSizes(requestBytes, responseBytes int64) {
+	sizeStatsMu.Lock()
+	defer sizeStatsMu.Unlock()
+	sizeStats.Request.observe(requestBytes)
+	sizeStats.Response.observe(responseBytes)
+}
+
+// getSizeStats returns a snapshot of the size histograms
+func getSizeStats() *SizeStats {
+	sizeStatsMu.Lock()
+	defer sizeStatsMu.Unlock()
+	if sizeStats.Request.Count == 0 {
+		return nil
+	}
+	return &SizeStats{Request: sizeStats.Request.clone(), Response: sizeStats.Response.clone()}
+}
@@ -0,0 +1,137 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Adaptive key selection (SELECTION_STRATEGY=adaptive).
+//
+// Each key keeps an exponentially weighted moving average of its success rate
+// and latency. PickAuth then chooses among healthy keys at random, weighted by
+// success rate squared over latency, so slow or flaky keys get less traffic
+// without being benched. Every key keeps a minimum share so its statistics
+// recover once it improves, and keys without samples are treated as perfect.
+
+const (
+	// adaptiveAlpha is the weight of the newest sample in the averages
+	adaptiveAlpha = 0.2
+	// adaptiveMinShare is the minimum weight of a key relative to the best one
+	adaptiveMinShare = 0.05
+	// adaptiveLatencyFloorMS keeps very fast keys from dominating on noise
+	adaptiveLatencyFloorMS = 100.0
+)
+
+// keyStats holds the moving averages for one key
+type keyStats struct {
+	successRate float64
+	latencyMS   float64 // 0 until a latency sample arrives
+}
+
+// RecordResult feeds the outcome of a request made with a key into its
+// statistics. A zero latency (e.g. streams, whose duration depends on output
+// length) updates the success rate only. Client errors are not the key's
+// fault and are ignored.
+func (km *KeyManager) RecordResult(index int, latency time.Duration, err error) {
+	if index < 0 || (err != nil && !countsAgainstKey(err)) {
+		return
+	}
+
+	km.statsMu.Lock()
+	defer km.statsMu.Unlock()
+
+	s, ok := km.stats[index]
+	if !ok {
+		s = &keyStats{successRate: 1}
+		km.stats[index] = s
+	}
+
+	outcome := 0.0
+	if err == nil {
+		outcome = 1
+	}
+	s.successRate += adaptiveAlpha * (outcome - s.successRate)
+
+	if err == nil && latency > 0 {
+		ms := float64(latency) / float64(time.Millisecond)
+		if s.latencyMS == 0 {
+			s.latencyMS = ms
+		} else {
+			s.latencyMS += adaptiveAlpha * (ms - s.latencyMS)
+		}
+	}
+}
+
+// StatusError is implemented by upstream errors that carry the HTTP status
+// the request failed with
+type StatusError interface {
+	error
+	StatusCode() int
+}
+
+// ErrUnusableResponse marks errors about an upstream response that arrived
+// intact but could not be used, such as an empty completion. They say
+// nothing about the key that served it.
+var ErrUnusableResponse = errors.New("unusable upstream response")
+
+// countsAgainstKey reports whether an error reflects on the key or upstream
+// rather than on the request itself. Cancellations and unusable responses
+// never do; upstream statuses do when they are server errors or key-level
+// (see benchStatuses); anything else is a transport failure and does.
+func countsAgainstKey(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrUnusableResponse) {
+		return false
+	}
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		status := statusErr.StatusCode()
+		return status >= 500 || slices.Contains(benchStatuses, status)
+	}
+	return true
+}
+
+// pickAdaptive chooses one of the candidate indexes weighted by key statistics
+func (km *KeyManager) pickAdaptive(candidates []int) int {
+	km.statsMu.Lock()
+	weights := make([]float64, len(candidates))
+	best := 0.0
+	for i, index := range candidates {
+		rate, latency := 1.0, 0.0
+		if s, ok := km.stats[index]; ok {
+			rate, latency = s.successRate, s.latencyMS
+		}
+		weights[i] = rate * rate / math.Max(latency, adaptiveLatencyFloorMS)
+		best = math.Max(best, weights[i])
+	}
+	km.statsMu.Unlock()
+
+	total := 0.0
+	for i := range weights {
+		weights[i] = math.Max(weights[i], best*adaptiveMinShare)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// resetStats drops all key statistics; indexes refer to the old key list
+func (km *KeyManager) resetStats() {
+	km.statsMu.Lock()
+	km.stats = make(map[int]*keyStats)
+	km.statsMu.Unlock()
+}
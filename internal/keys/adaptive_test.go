@@ -0,0 +1,48 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// statusError is an upstream error with a status, as handlers produce
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("API error (status %d): {}", int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+// unusableError is an error about an intact response, as handlers produce
+type unusableError struct{}
+
+func (unusableError) Error() string        { return "upstream returned an empty completion" }
+func (unusableError) Is(target error) bool { return target == ErrUnusableResponse }
+
+func TestCountsAgainstKey(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", statusError(500), true},
+		{"unavailable", fmt.Errorf("attempt 2: %w", statusError(503)), true},
+		{"unauthorized", statusError(401), true},
+		{"throttled", statusError(429), true},
+		{"bad request", statusError(400), false},
+		{"not found", statusError(404), false},
+		{"bad request mentioning a 429", fmt.Errorf("%w: upstream said status 429 once", statusError(400)), false},
+		{"transport failure", errors.New("request failed: connection reset"), true},
+		{"client cancelled", fmt.Errorf("request failed: %w", context.Canceled), false},
+		{"deadline", fmt.Errorf("request failed: %w", context.DeadlineExceeded), false},
+		{"unusable response", unusableError{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countsAgainstKey(tt.err); got != tt.want {
+				t.Errorf("countsAgainstKey(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
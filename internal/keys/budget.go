@@ -0,0 +1,162 @@
+package keys
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// Daily key budgets (KEY_DAILY_REQUEST_LIMIT, KEY_DAILY_TOKEN_LIMIT).
+//
+// Every upstream attempt made with a key counts as one request, and token
+// counts reported by upstream are added afterwards. A key that reaches either
+// limit is left out of selection until the next UTC day. Counters are kept
+// per API key, so refreshing the key list does not move usage between keys,
+// and they live in memory only: a restart starts the day over.
+
+// ErrBudgetExhausted is returned when every key has used its daily budget
+var ErrBudgetExhausted = errors.New("all keys have used their daily budget")
+
+// keyBudget holds one key's usage for the current UTC day
+type keyBudget struct {
+	requests int
+	tokens   int
+}
+
+// budgetsEnabled reports whether any daily limit is configured
+func budgetsEnabled() bool {
+	cfg := config.Get()
+	return cfg.KeyDailyRequestLimit > 0 || cfg.KeyDailyTokenLimit > 0
+}
+
+// utcDay identifies the budget period containing t
+func utcDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// BudgetResetTime returns when daily budgets next reset (midnight UTC)
+func BudgetResetTime() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// rollBudgetsLocked starts a new period when the UTC day has changed.
+// budgetMu must be held.
+func (km *KeyManager) rollBudgetsLocked() {
+	today := utcDay(time.Now())
+	if km.budgetDay == today {
+		return
+	}
+	if km.budgetDay != "" {
+		log.Printf("Key budgets reset for %s", today)
+	}
+	km.budgetDay = today
+	km.budgets = make(map[string]*keyBudget)
+}
+
+// overBudgetLocked reports whether a key has reached a daily limit.
+// budgetMu must be held.
+func (km *KeyManager) overBudgetLocked(key string) bool {
+	b, ok := km.budgets[key]
+	if !ok {
+		return false
+	}
+	cfg := config.Get()
+	return (cfg.KeyDailyRequestLimit > 0 && b.requests >= cfg.KeyDailyRequestLimit) ||
+		(cfg.KeyDailyTokenLimit > 0 && b.tokens >= cfg.KeyDailyTokenLimit)
+}
+
+// withinBudget returns the indexes into keys whose keys still have budget
+// left today
+func (km *KeyManager) withinBudget(keys []string, indexes []int) []int {
+	if !budgetsEnabled() {
+		return indexes
+	}
+
+	km.budgetMu.Lock()
+	defer km.budgetMu.Unlock()
+	km.rollBudgetsLocked()
+
+	result := make([]int, 0, len(indexes))
+	for _, index := range indexes {
+		if index < len(keys) && !km.overBudgetLocked(keys[index]) {
+			result = append(result, index)
+		}
+	}
+	return result
+}
+
+// chargeRequest counts one request against a key, or reports false without
+// counting when the key has no budget left
+func (km *KeyManager) chargeRequest(key string, index int) bool {
+	if !budgetsEnabled() {
+		return true
+	}
+
+	km.budgetMu.Lock()
+	defer km.budgetMu.Unlock()
+	km.rollBudgetsLocked()
+
+	if km.overBudgetLocked(key) {
+		return false
+	}
+	b, ok := km.budgets[key]
+	if !ok {
+		b = &keyBudget{}
+		km.budgets[key] = b
+	}
+	b.requests++
+	if km.overBudgetLocked(key) {
+		log.Printf("Key budget exhausted: key_index=%d, requests=%d, tokens=%d, resets=%s",
+			index, b.requests, b.tokens, BudgetResetTime().Format(time.RFC3339))
+	}
+	return true
+}
+
+// RecordTokens adds upstream-reported token usage to a key's daily budget
+func (km *KeyManager) RecordTokens(index int, tokens int) {
+	if index < 0 || tokens <= 0 || config.Get().KeyDailyTokenLimit <= 0 {
+		return
+	}
+	keys := km.keyList()
+	if index >= len(keys) {
+		return
+	}
+	key := keys[index]
+
+	km.budgetMu.Lock()
+	defer km.budgetMu.Unlock()
+	km.rollBudgetsLocked()
+
+	b, ok := km.budgets[key]
+	if !ok {
+		b = &keyBudget{}
+		km.budgets[key] = b
+	}
+	wasOver := km.overBudgetLocked(key)
+	b.tokens += tokens
+	if !wasOver && km.overBudgetLocked(key) {
+		log.Printf("Key budget exhausted: key_index=%d, requests=%d, tokens=%d, resets=%s",
+			index, b.requests, b.tokens, BudgetResetTime().Format(time.RFC3339))
+	}
+}
+
+// BudgetExhausted reports whether every key has used its daily budget
+func (km *KeyManager) BudgetExhausted() bool {
+	keys := km.keyList()
+	if !budgetsEnabled() || len(keys) == 0 {
+		return false
+	}
+	return len(km.withinBudget(keys, allIndexes(len(keys)))) == 0
+}
+
+// allIndexes returns the indexes 0..count-1
+func allIndexes(count int) []int {
+	indexes := make([]int, count)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
@@ -0,0 +1,119 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestPickAuthBudgets(t *testing.T) {
+	tests := []struct {
+		name         string
+		requestLimit int
+		tokenLimit   int
+		tokens       map[int]int // tokens recorded per key index before picking
+		picks        int
+		wantPicked   map[string]int
+	}{
+		{
+			name:         "request limit spreads picks",
+			requestLimit: 3,
+			picks:        10,
+			wantPicked:   map[string]int{"a": 3, "b": 3},
+		},
+		{
+			name:       "token limit excludes a spent key",
+			tokenLimit: 100,
+			tokens:     map[int]int{0: 100},
+			picks:      4,
+			wantPicked: map[string]int{"b": 4},
+		},
+		{
+			name:       "every key spent",
+			tokenLimit: 100,
+			tokens:     map[int]int{0: 150, 1: 100},
+			picks:      2,
+			wantPicked: map[string]int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.KeyDailyRequestLimit = tt.requestLimit
+				c.KeyDailyTokenLimit = tt.tokenLimit
+			})
+			km, _ := newTestManager(t, "a", "b")
+			for index, tokens := range tt.tokens {
+				km.RecordTokens(index, tokens)
+			}
+
+			// Concurrent picks race between selection and charging
+			var mu sync.Mutex
+			picked := make(map[string]int)
+			var wg sync.WaitGroup
+			for range tt.picks {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					auth, err := km.PickAuth(context.Background())
+					if err != nil {
+						if !errors.Is(err, ErrBudgetExhausted) {
+							t.Errorf("PickAuth: %v", err)
+						}
+						return
+					}
+					mu.Lock()
+					picked[auth.APIKey]++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if len(picked) != len(tt.wantPicked) {
+				t.Errorf("picked = %v, want %v", picked, tt.wantPicked)
+			}
+			for key, want := range tt.wantPicked {
+				if picked[key] != want {
+					t.Errorf("picked = %v, want %v", picked, tt.wantPicked)
+					break
+				}
+			}
+			wantExhausted := len(tt.wantPicked) == 0 || tt.requestLimit > 0
+			if got := km.BudgetExhausted(); got != wantExhausted {
+				t.Errorf("BudgetExhausted = %v, want %v", got, wantExhausted)
+			}
+		})
+	}
+}
+
+func TestProbeAuthDoesNotCharge(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.KeyDailyRequestLimit = 1 })
+	km, _ := newTestManager(t, "a", "b")
+
+	for range 5 {
+		auth, err := km.ProbeAuth(context.Background())
+		if err != nil {
+			t.Fatalf("ProbeAuth: %v", err)
+		}
+		if auth.APIKey != "a" {
+			t.Errorf("ProbeAuth picked %q, want the next key in rotation, a", auth.APIKey)
+		}
+	}
+
+	for _, want := range []string{"a", "b"} {
+		auth, err := km.PickAuth(context.Background())
+		if err != nil {
+			t.Fatalf("PickAuth after probes: %v", err)
+		}
+		if auth.APIKey != want {
+			t.Errorf("PickAuth picked %q, want %q", auth.APIKey, want)
+		}
+	}
+	if _, err := km.PickAuth(context.Background()); !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("PickAuth with budgets spent: err = %v, want ErrBudgetExhausted", err)
+	}
+}
@@ -0,0 +1,96 @@
+package keys
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// Key cooldowns (KEY_COOLDOWN_SECONDS).
+//
+// A throttled key usually recovers on its own within seconds, so with a
+// cooldown configured a 429 (or a 403 naming a quota) takes the key out of
+// rotation for a fixed window instead of benching it until the prober runs.
+// When every key is cooling down, requests are refused with a Retry-After
+// running to the soonest cooldown end (see RetryAfter); PickAuth itself falls
+// back to the key whose cooldown ends first.
+
+// ShouldCooldown reports whether an upstream error means the key is throttled
+func ShouldCooldown(err error) bool {
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode() {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		msg := err.Error()
+		return strings.Contains(strings.ToLower(msg), "quota") || strings.Contains(msg, "RESOURCE_EXHAUSTED")
+	}
+	return false
+}
+
+// Cooldown takes a key out of rotation for KEY_COOLDOWN_SECONDS. It reports
+// false, doing nothing, when cooldowns are disabled.
+func (km *KeyManager) Cooldown(index int, reason string) bool {
+	window := time.Duration(config.Get().KeyCooldownSeconds) * time.Second
+	if window <= 0 {
+		return false
+	}
+	if index < 0 || index >= km.KeyCount() {
+		return true
+	}
+
+	km.healthMu.Lock()
+	defer km.healthMu.Unlock()
+	km.cooldowns[index] = time.Now().Add(window)
+	log.Printf("Key cooling down: key_index=%d, for=%v, reason=%s", index, window, reason)
+	return true
+}
+
+// CooldownUntil reports when a key's cooldown ends, if it is cooling down
+func (km *KeyManager) CooldownUntil(index int) (time.Time, bool) {
+	km.healthMu.RLock()
+	defer km.healthMu.RUnlock()
+	return km.cooldownUntilLocked(index)
+}
+
+func (km *KeyManager) cooldownUntilLocked(index int) (time.Time, bool) {
+	until, ok := km.cooldowns[index]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// soonestCooldown returns the candidate whose cooldown ends first, or false
+// when none of them is cooling down
+func (km *KeyManager) soonestCooldown(candidates []int) (int, bool) {
+	km.healthMu.RLock()
+	defer km.healthMu.RUnlock()
+
+	best, bestUntil := -1, time.Time{}
+	for _, index := range candidates {
+		if until, ok := km.cooldownUntilLocked(index); ok && (best < 0 || until.Before(bestUntil)) {
+			best, bestUntil = index, until
+		}
+	}
+	return best, best >= 0
+}
+
+// Penalize takes a key out of rotation after a key-level upstream error:
+// throttling cools it down when cooldowns are enabled, and other auth or
+// quota errors bench it until the prober sees it recover
+func (km *KeyManager) Penalize(index int, err error) {
+	if ShouldCooldown(err) && km.Cooldown(index, err.Error()) {
+		return
+	}
+	if ShouldBench(err) {
+		km.Bench(index, err.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestCooldownSkipsThrottledKey(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.KeyCooldownSeconds = 60 })
+	km, _ := newTestManager(t, "a", "b", "c")
+	ctx := context.Background()
+
+	km.Penalize(1, statusError(http.StatusTooManyRequests))
+	if _, cooling := km.CooldownUntil(1); !cooling {
+		t.Fatal("key 1 is not cooling down after a 429")
+	}
+	for range 6 {
+		auth, err := km.PickAuth(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.KeyIndex == 1 {
+			t.Fatal("PickAuth picked the throttled key")
+		}
+	}
+	if auth, err := km.PickAuthAtIndex(ctx, 1); err != nil || auth.KeyIndex != 2 {
+		t.Errorf("PickAuthAtIndex(1) = %+v, %v; want the next key that is not cooling", auth, err)
+	}
+
+	// A 403 that is not about quota is not throttling
+	km.Penalize(0, statusError(http.StatusForbidden))
+	if _, cooling := km.CooldownUntil(0); cooling {
+		t.Error("key 0 cooling down after a plain 403")
+	}
+
+	// With every key cooling, the one whose cooldown ends first is used
+	km.healthMu.Lock()
+	km.cooldowns[0] = time.Now().Add(50 * time.Second)
+	km.cooldowns[1] = time.Now().Add(40 * time.Second)
+	km.cooldowns[2] = time.Now().Add(10 * time.Second)
+	km.healthMu.Unlock()
+	for range 3 {
+		if auth, err := km.PickAuth(ctx); err != nil || auth.KeyIndex != 2 {
+			t.Fatalf("PickAuth = %+v, %v; want the soonest cooldown, key 2", auth, err)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		useConfig(t, func(c *config.Config) { c.KeyCooldownSeconds = 0 })
+		km, _ := newTestManager(t, "a", "b")
+		km.Penalize(0, statusError(http.StatusTooManyRequests))
+		if _, cooling := km.CooldownUntil(0); cooling {
+			t.Error("key cooling down with KEY_COOLDOWN_SECONDS=0")
+		}
+	})
+}
+
+func TestShouldCooldown(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"429", statusError(http.StatusTooManyRequests), true},
+		{"wrapped 429", fmt.Errorf("attempt 2: %w", statusError(http.StatusTooManyRequests)), true},
+		{"403 naming a quota", fmt.Errorf("RESOURCE_EXHAUSTED: %w", statusError(http.StatusForbidden)), true},
+		{"plain 403", statusError(http.StatusForbidden), false},
+		{"server error", statusError(http.StatusInternalServerError), false},
+		{"untyped error with a status in its text", errors.New("API error (status 429): RESOURCE_EXHAUSTED"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := ShouldCooldown(tt.err); got != tt.want {
+			t.Errorf("%s: ShouldCooldown = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
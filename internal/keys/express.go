@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -29,14 +30,35 @@ type AuthInfo struct {
 // KeyManager manages Express API keys with round-robin/random selection and retry
 type KeyManager struct {
 	keys         []string
+	keysMu       sync.RWMutex
+	source       KeySource
 	currentIndex int
 	roundRobin   bool
+	pinnedIndex  int // -1 when rotation is enabled
 	mu           sync.Mutex
 
-	// Project ID cache: apiKey -> projectId
+	// Project ID cache: apiKey -> projectId; discoveries in flight share
+	// one probe per key (both guarded by cacheMu)
 	projectCache map[string]string
+	discovering  map[string]*discovery
 	cacheMu      sync.RWMutex
 
+	// Key health: benched key index -> time benched, and throttled key
+	// index -> end of its cooldown
+	benched   map[int]time.Time
+	cooldowns map[int]time.Time
+	nextProbe time.Time // next background probe of benched keys
+	healthMu  sync.RWMutex
+
+	// Adaptive selection: key index -> success rate and latency averages
+	stats   map[int]*keyStats
+	statsMu sync.Mutex
+
+	// Daily budgets: API key -> usage during budgetDay (UTC)
+	budgets   map[string]*keyBudget
+	budgetDay string
+	budgetMu  sync.Mutex
+
 	// HTTP client for discovery
 	httpClient *http.Client
 
@@ -54,19 +76,29 @@ func GetManager() *KeyManager {
 	once.Do(func() {
 		cfg := config.Get()
 		manager = &KeyManager{
-			keys:         cfg.VertexExpressAPIKeys,
 			currentIndex: 0,
 			roundRobin:   cfg.RoundRobin,
+			pinnedIndex:  cfg.PinnedKeyIndex,
 			projectCache: make(map[string]string),
+			discovering:  make(map[string]*discovery),
+			benched:      make(map[int]time.Time),
+			cooldowns:    make(map[int]time.Time),
+			stats:        make(map[int]*keyStats),
+			budgets:      make(map[string]*keyBudget),
 			location:     cfg.GCPLocation,
 			httpClient:   createHTTPClient(cfg),
 		}
 
-		// If GCP_PROJECT_ID is set, use it for all keys
-		if cfg.GCPProjectID != "" {
-			for _, key := range manager.keys {
-				manager.projectCache[key] = cfg.GCPProjectID
-			}
+		// Load keys from KEY_SOURCE. GCP_PROJECT_ID applies to every key;
+		// per-key projects ("key:project") take precedence and skip discovery.
+		source, err := NewKeySource(cfg)
+		if err != nil {
+			log.Printf("Key source error: %v", err)
+			return
+		}
+		manager.source = source
+		if err := manager.loadKeys(context.Background()); err != nil {
+			log.Printf("Key source error: source=%s, error=%v", source.Name(), err)
 		}
 	})
 	return manager
@@ -102,25 +134,89 @@ func createHTTPClient(cfg *config.Config) *http.Client {
 
 // PickAuth selects an API key and returns auth info
 func (km *KeyManager) PickAuth(ctx context.Context) (*AuthInfo, error) {
-	if len(km.keys) == 0 {
-		return nil, fmt.Errorf("no Express API keys configured")
+	// A pinned key bypasses rotation and health checks entirely
+	if km.pinnedIndex >= 0 {
+		return km.PickAuthAtIndex(ctx, km.pinnedIndex)
+	}
+
+	// A concurrent request may spend the picked key's last budget before
+	// this one is charged; the key is then over budget and the next pick
+	// skips it
+	for range km.KeyCount() + 1 {
+		keys, index, err := km.pickIndex(true)
+		if err != nil {
+			return nil, err
+		}
+		if km.chargeRequest(keys[index], index) {
+			return km.authFor(ctx, keys[index], index)
+		}
+	}
+	return nil, ErrBudgetExhausted
+}
+
+// ProbeAuth selects a key as PickAuth would, without advancing the rotation
+// or charging the key's budget, for health probes
+func (km *KeyManager) ProbeAuth(ctx context.Context) (*AuthInfo, error) {
+	keys := km.keyList()
+	if km.pinnedIndex >= 0 && km.pinnedIndex < len(keys) {
+		return km.authFor(ctx, keys[km.pinnedIndex], km.pinnedIndex)
+	}
+	keys, index, err := km.pickIndex(false)
+	if err != nil {
+		return nil, err
 	}
+	return km.authFor(ctx, keys[index], index)
+}
 
+// pickIndex selects a key from a snapshot of the key list, returning the
+// snapshot and the key's index in it; rotate advances round-robin selection
+func (km *KeyManager) pickIndex(rotate bool) ([]string, int, error) {
 	km.mu.Lock()
-	var key string
-	var index int
+	defer km.mu.Unlock()
 
-	if km.roundRobin {
-		index = km.currentIndex
-		key = km.keys[index]
-		km.currentIndex = (km.currentIndex + 1) % len(km.keys)
+	keys := km.keyList()
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("no Express API keys configured")
+	}
+
+	// Keys over their daily budget are never used. Every index below comes
+	// from this one snapshot: a refresh may replace the list meanwhile.
+	available := km.withinBudget(keys, allIndexes(len(keys)))
+	if len(available) == 0 {
+		return nil, 0, ErrBudgetExhausted
+	}
+
+	// Only benched or cooling keys left: use the cooldown that ends first,
+	// else fall back to the full set rather than failing
+	healthy := km.withinBudget(keys, km.healthyIndexes(len(keys)))
+	if len(healthy) == 0 {
+		if index, ok := km.soonestCooldown(available); ok {
+			healthy = []int{index}
+		} else {
+			healthy = available
+		}
+	}
+
+	var index int
+	if config.Get().SelectionStrategy == "adaptive" {
+		index = km.pickAdaptive(healthy)
+	} else if km.roundRobin {
+		index = km.currentIndex % len(keys)
+		for i := 0; i < len(keys) && !slices.Contains(healthy, index); i++ {
+			index = (index + 1) % len(keys)
+		}
+		if rotate {
+			km.currentIndex = (index + 1) % len(keys)
+		}
 	} else {
-		index = rand.Intn(len(km.keys))
-		key = km.keys[index]
+		index = healthy[rand.Intn(len(healthy))]
 	}
-	km.mu.Unlock()
+	return keys, index, nil
+}
 
-	// Get or discover project ID
+// authFor returns the auth info for a picked key, discovering its project
+// if needed
+func (km *KeyManager) authFor(ctx context.Context, key string, index int) (*AuthInfo, error) {
 	projectID, err := km.getProjectID(ctx, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get project ID: %w", err)
@@ -136,42 +232,92 @@ func (km *KeyManager) PickAuth(ctx context.Context) (*AuthInfo, error) {
 
 // PickAuthAtIndex picks a specific key by index
 func (km *KeyManager) PickAuthAtIndex(ctx context.Context, index int) (*AuthInfo, error) {
-	if len(km.keys) == 0 {
+	keys := km.keyList()
+	if len(keys) == 0 {
 		return nil, fmt.Errorf("no Express API keys configured")
 	}
 
-	if index < 0 || index >= len(km.keys) {
+	if index < 0 || index >= len(keys) {
 		index = 0
 	}
 
-	key := km.keys[index]
-
-	projectID, err := km.getProjectID(ctx, key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get project ID: %w", err)
+	// A key still cooling down gives way to the next key that is not
+	if _, cooling := km.CooldownUntil(index); cooling && km.pinnedIndex < 0 {
+		if next := km.nextKeyIndex(keys, index); next != index {
+			if _, nextCooling := km.CooldownUntil(next); !nextCooling {
+				index = next
+			}
+		}
 	}
 
-	return &AuthInfo{
-		ProjectID: projectID,
-		APIKey:    key,
-		Location:  km.location,
-		KeyIndex:  index,
-	}, nil
+	key := keys[index]
+	if !km.chargeRequest(key, index) {
+		return nil, fmt.Errorf("key_index=%d: %w", index, ErrBudgetExhausted)
+	}
+	return km.authFor(ctx, key, index)
 }
 
 // NextKeyIndex returns the next key index for retry
 func (km *KeyManager) NextKeyIndex(currentIndex int) int {
-	if len(km.keys) <= 1 {
+	return km.nextKeyIndex(km.keyList(), currentIndex)
+}
+
+// nextKeyIndex returns the key after currentIndex in the keys snapshot
+func (km *KeyManager) nextKeyIndex(keys []string, currentIndex int) int {
+	count := len(keys)
+	if count <= 1 || km.pinnedIndex >= 0 {
 		return currentIndex
 	}
-	return (currentIndex + 1) % len(km.keys)
+
+	// Prefer the next healthy key with budget left, then any key with budget
+	// left; fall back to plain rotation if none are
+	next := (currentIndex + 1) % count
+	available := km.withinBudget(keys, allIndexes(count))
+	for i := 0; i < count; i++ {
+		candidate := (currentIndex + 1 + i) % count
+		if km.IsHealthy(candidate) && slices.Contains(available, candidate) {
+			return candidate
+		}
+	}
+	for i := 0; i < count; i++ {
+		candidate := (currentIndex + 1 + i) % count
+		if slices.Contains(available, candidate) {
+			return candidate
+		}
+	}
+	return next
+}
+
+// healthyIndexes returns the indexes below count of keys currently in rotation
+func (km *KeyManager) healthyIndexes(count int) []int {
+	km.healthMu.RLock()
+	defer km.healthMu.RUnlock()
+
+	indexes := make([]int, 0, count)
+	for i := range count {
+		_, benched := km.benched[i]
+		_, cooling := km.cooldownUntilLocked(i)
+		if !benched && !cooling {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
 }
 
 // KeyCount returns the number of available keys
 func (km *KeyManager) KeyCount() int {
+	km.keysMu.RLock()
+	defer km.keysMu.RUnlock()
 	return len(km.keys)
 }
 
+// keyList returns the current key list; it is replaced, never modified, on refresh
+func (km *KeyManager) keyList() []string {
+	km.keysMu.RLock()
+	defer km.keysMu.RUnlock()
+	return km.keys
+}
+
 // getProjectID retrieves or discovers the project ID for a key
 func (km *KeyManager) getProjectID(ctx context.Context, apiKey string) (string, error) {
 	// Check cache first
@@ -182,28 +328,89 @@ func (km *KeyManager) getProjectID(ctx context.Context, apiKey string) (string,
 	}
 	km.cacheMu.RUnlock()
 
-	// Discover project ID
-	projectID, err := km.discoverProjectID(ctx, apiKey)
-	if err != nil {
-		return "", err
+	// Join a discovery already running for this key, or start one
+	km.cacheMu.Lock()
+	if projectID, ok := km.projectCache[apiKey]; ok {
+		km.cacheMu.Unlock()
+		return projectID, nil
 	}
+	d, ok := km.discovering[apiKey]
+	if !ok {
+		d = &discovery{done: make(chan struct{})}
+		km.discovering[apiKey] = d
+		go km.runDiscovery(ctx, apiKey, d)
+	}
+	km.cacheMu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.projectID, d.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// discoveryTimeout bounds one project ID discovery, all probes included
+const discoveryTimeout = 30 * time.Second
+
+// runDiscovery discovers the project ID of a key for every caller waiting on
+// d. It is detached from the starting request's context, so that request
+// being cancelled does not fail the callers that joined it.
+func (km *KeyManager) runDiscovery(ctx context.Context, apiKey string, d *discovery) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryTimeout)
+	defer cancel()
+
+	d.projectID, d.err = km.discoverProjectID(ctx, apiKey)
 
 	// Cache the result
 	km.cacheMu.Lock()
-	km.projectCache[apiKey] = projectID
+	if d.err == nil {
+		km.projectCache[apiKey] = d.projectID
+	}
+	delete(km.discovering, apiKey)
 	km.cacheMu.Unlock()
+	close(d.done)
+}
 
-	return projectID, nil
+// discovery is a project ID discovery in flight; waiters read the result
+// once done is closed
+type discovery struct {
+	done      chan struct{}
+	projectID string
+	err       error
 }
 
-// discoverProjectID discovers project ID by sending an intentionally invalid request
+// discoveryProbeURLs are the endpoints tried, in order, to provoke an error
+// that names the key's project. Some regions and key types answer the
+// regional endpoint with a bare 404/403, so the global endpoints follow.
+// They stay pinned to v1beta1 rather than VERTEX_API_VERSION: discovery
+// depends on the error text, which must not change with the serving version.
+var discoveryProbeURLs = []string{
+	"https://%[1]s-aiplatform.googleapis.com/v1beta1/projects/unknown/locations/%[1]s/publishers/google/models/gemini-1.0-pro:generateContent?key=%[2]s",
+	"https://aiplatform.googleapis.com/v1beta1/projects/unknown/locations/global/publishers/google/models/gemini-2.5-flash:countTokens?key=%[2]s",
+	"https://aiplatform.googleapis.com/v1beta1/projects/unknown/locations/global/endpoints/openapi/chat/completions?key=%[2]s",
+}
+
+// discoverProjectID discovers project ID by sending intentionally invalid requests
 func (km *KeyManager) discoverProjectID(ctx context.Context, apiKey string) (string, error) {
-	// Send a request to a non-existent model to get the project ID from error
-	url := fmt.Sprintf(
-		"https://%s-aiplatform.googleapis.com/v1beta1/projects/unknown/locations/%s/publishers/google/models/gemini-1.0-pro:generateContent?key=%s",
-		km.location, km.location, apiKey,
-	)
+	var lastErr error
+	for i, probe := range discoveryProbeURLs {
+		projectID, err := km.discoverProjectIDAt(ctx, fmt.Sprintf(probe, km.location, apiKey))
+		if err == nil {
+			log.Printf("Discovered project ID: %s (probe %d)", projectID, i+1)
+			return projectID, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return "", fmt.Errorf("%w; set GCP_PROJECT_ID (or a per-key project) explicitly for this key", lastErr)
+}
 
+// discoverProjectIDAt sends one discovery probe and parses the project ID from the error
+func (km *KeyManager) discoverProjectIDAt(ctx context.Context, url string) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(`{"contents":[]}`))
 	if err != nil {
 		return "", err
@@ -224,11 +431,10 @@ func (km *KeyManager) discoverProjectID(ctx context.Context, apiKey string) (str
 	// Parse error response to extract project ID
 	// Error message typically contains: "projects/PROJECT_ID/..."
 	projectID := extractProjectIDFromError(string(body))
-	if projectID == "" {
-		return "", fmt.Errorf("failed to discover project ID from response: %s", string(body))
+	if projectID == "" || projectID == "unknown" {
+		return "", fmt.Errorf("failed to discover project ID from response (status %d): %s", resp.StatusCode, string(body))
 	}
 
-	log.Printf("Discovered project ID: %s", projectID)
 	return projectID, nil
 }
 
@@ -282,9 +488,10 @@ func (km *KeyManager) GetHTTPClient() *http.Client {
 
 // RetryConfig contains retry configuration
 type RetryConfig struct {
-	MaxRetries  int
-	IntervalMS  int
-	SwitchKey   bool // Whether to switch to next key on retry
+	MaxRetries int
+	IntervalMS int
+	DeadlineMS int  // Total time budget for all attempts, 0 = unlimited
+	SwitchKey  bool // Whether to switch to next key on retry
 }
 
 // GetRetryConfig returns retry configuration from config
@@ -293,6 +500,25 @@ func GetRetryConfig() RetryConfig {
 	return RetryConfig{
 		MaxRetries: cfg.RetryMax,
 		IntervalMS: cfg.RetryIntervalMS,
-		SwitchKey:  true,
+		DeadlineMS: cfg.RetryDeadlineMS,
+		SwitchKey:  cfg.PinnedKeyIndex < 0,
+	}
+}
+
+// BudgetExhausted reports whether another attempt, started after the retry
+// interval, would exceed the retry deadline or the request context deadline
+func (rc RetryConfig) BudgetExhausted(ctx context.Context, start time.Time) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+
+	next := time.Now().Add(time.Duration(rc.IntervalMS) * time.Millisecond)
+
+	if rc.DeadlineMS > 0 && next.After(start.Add(time.Duration(rc.DeadlineMS)*time.Millisecond)) {
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); ok && next.After(deadline) {
+		return true
 	}
+	return false
 }
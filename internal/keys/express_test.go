@@ -0,0 +1,358 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// useConfig makes a modified copy of the current config active for a test
+func useConfig(t *testing.T, modify func(c *config.Config)) {
+	t.Helper()
+	prev := config.Get()
+	next := *prev
+	modify(&next)
+	config.Override(&next)
+	t.Cleanup(func() { config.Override(prev) })
+}
+
+// staticSource serves whichever key list was set last
+type staticSource struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *staticSource) Name() string { return "test" }
+
+func (s *staticSource) Load(ctx context.Context) ([]string, map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	projects := make(map[string]string, len(s.keys))
+	for _, key := range s.keys {
+		projects[key] = "project-" + key
+	}
+	return s.keys, projects, nil
+}
+
+func (s *staticSource) set(keys ...string) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+// newTestManager returns a manager rotating the given keys
+func newTestManager(t *testing.T, keys ...string) (*KeyManager, *staticSource) {
+	t.Helper()
+	source := &staticSource{}
+	source.set(keys...)
+	km := &KeyManager{
+		roundRobin:   true,
+		pinnedIndex:  -1,
+		source:       source,
+		projectCache: make(map[string]string),
+		discovering:  make(map[string]*discovery),
+		benched:      make(map[int]time.Time),
+		cooldowns:    make(map[int]time.Time),
+		stats:        make(map[int]*keyStats),
+		budgets:      make(map[string]*keyBudget),
+		location:     "global",
+	}
+	if err := km.loadKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return km, source
+}
+
+func TestPickAuthDuringKeyRefresh(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.KeyCooldownSeconds = 60 })
+	km, source := newTestManager(t, "a", "b", "c", "d")
+	// Random selection indexes keys straight from the healthy set
+	km.roundRobin = false
+	km.setNextProbe(time.Now().Add(time.Hour))
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Alternate between a long and a short list while picks run
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				source.set("a")
+			} else {
+				source.set("a", "b", "c", "d")
+			}
+			km.loadKeys(ctx)
+			km.Cooldown(0, "test")
+			km.Bench(2, "test")
+		}
+	}()
+
+	var pickers sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		pickers.Add(1)
+		go func() {
+			defer pickers.Done()
+			for range 5000 {
+				auth, err := km.PickAuth(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if auth.ProjectID != "project-"+auth.APIKey {
+					errs <- fmt.Errorf("key %q picked with project %q", auth.APIKey, auth.ProjectID)
+					return
+				}
+				if _, err := km.PickAuthAtIndex(ctx, 1); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	pickers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// redirectTransport sends every request to a test server, whatever its URL
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// discoveryUpstream answers discovery probes with an error naming a project
+// once release is closed, and counts the probes it receives
+func discoveryUpstream(t *testing.T, km *KeyManager) (hits *atomic.Int32, started <-chan struct{}, release chan<- struct{}) {
+	t.Helper()
+	hits = new(atomic.Int32)
+	startedCh := make(chan struct{}, 1)
+	releaseCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case startedCh <- struct{}{}:
+		default:
+		}
+		select {
+		case <-releaseCh:
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"error":{"message":"Permission denied on resource projects/discovered-123/locations/global","status":"PERMISSION_DENIED"}}`)
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	km.httpClient = &http.Client{Transport: redirectTransport{target: target}}
+
+	// Forget the project the test source supplied so PickAuth has to discover it
+	km.cacheMu.Lock()
+	clear(km.projectCache)
+	km.cacheMu.Unlock()
+	return hits, startedCh, releaseCh
+}
+
+func TestPickAuthProjectDiscovery(t *testing.T) {
+	tests := []struct {
+		name          string
+		callers       int
+		cancelStarter bool // cancel the request that started discovery while it runs
+	}{
+		{"50 concurrent callers", 50, false},
+		{"starter cancelled", 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km, _ := newTestManager(t, "a")
+			km.setNextProbe(time.Now().Add(time.Hour))
+			hits, started, release := discoveryUpstream(t, km)
+
+			starterCtx, cancelStarter := context.WithCancel(context.Background())
+			defer cancelStarter()
+			starterErr := make(chan error, 1)
+			go func() {
+				_, err := km.PickAuth(starterCtx)
+				starterErr <- err
+			}()
+			<-started
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.callers)
+			for range tt.callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					auth, err := km.PickAuth(context.Background())
+					if err != nil {
+						errs <- err
+						return
+					}
+					if auth.ProjectID != "discovered-123" {
+						errs <- fmt.Errorf("project = %q, want discovered-123", auth.ProjectID)
+					}
+				}()
+			}
+
+			// Let the callers join the discovery in flight
+			time.Sleep(20 * time.Millisecond)
+			if tt.cancelStarter {
+				cancelStarter()
+				if err := <-starterErr; !errors.Is(err, context.Canceled) {
+					t.Errorf("cancelled starter: err = %v, want context.Canceled", err)
+				}
+			}
+			close(release)
+
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+			if !tt.cancelStarter {
+				if err := <-starterErr; err != nil {
+					t.Errorf("starter: %v", err)
+				}
+			}
+			if got := hits.Load(); got != 1 {
+				t.Errorf("discovery requests = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestPickAuthPinnedKey(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.PinnedKeyIndex = 1
+		c.KeyCooldownSeconds = 60
+	})
+	km, _ := newTestManager(t, "a", "b", "c")
+	km.pinnedIndex = 1
+	// Neither health nor cooldowns move a pinned pick
+	km.setNextProbe(time.Now().Add(time.Minute))
+	km.Bench(1, "test")
+	km.Cooldown(1, "test")
+
+	for range 10 {
+		auth, err := km.PickAuth(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.KeyIndex != 1 || auth.APIKey != "b" {
+			t.Fatalf("PickAuth = key %d (%s), want pinned key 1", auth.KeyIndex, auth.APIKey)
+		}
+	}
+	if next := km.NextKeyIndex(1); next != 1 {
+		t.Errorf("NextKeyIndex = %d, want the pinned key", next)
+	}
+	if GetRetryConfig().SwitchKey {
+		t.Error("retries switch keys while a key is pinned")
+	}
+}
+
+func TestDiscoverProjectIDFallback(t *testing.T) {
+	const bare = `{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND"}}`
+	const named = `{"error":{"code":403,"message":"Permission denied on resource projects/found-42/locations/global","status":"PERMISSION_DENIED"}}`
+	tests := []struct {
+		name        string
+		answers     []string // per probe, the last one repeats
+		wantProject string
+		wantProbes  int32
+	}{
+		{"first probe parses", []string{named}, "found-42", 1},
+		{"bare 404 falls through", []string{bare, named}, "found-42", 2},
+		{"echoed placeholder is not a project", []string{`{"error":{"message":"projects/unknown not found"}}`, bare, named}, "found-42", 3},
+		{"nothing parses", []string{bare}, "", int32(len(discoveryProbeURLs))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km, _ := newTestManager(t, "a")
+			var probes atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(probes.Add(1)) - 1
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, tt.answers[min(n, len(tt.answers)-1)])
+			}))
+			defer srv.Close()
+			target, _ := url.Parse(srv.URL)
+			km.httpClient = &http.Client{Transport: redirectTransport{target: target}}
+
+			project, err := km.discoverProjectID(context.Background(), "a")
+			if project != tt.wantProject {
+				t.Errorf("project = %q, want %q", project, tt.wantProject)
+			}
+			if tt.wantProject == "" && (err == nil || !strings.Contains(err.Error(), "GCP_PROJECT_ID")) {
+				t.Errorf("err = %v, want a hint to set GCP_PROJECT_ID", err)
+			}
+			if got := probes.Load(); got != tt.wantProbes {
+				t.Errorf("probes = %d, want %d", got, tt.wantProbes)
+			}
+		})
+	}
+}
+
+func TestInlineKeyProjects(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.VertexExpressAPIKeys, c.KeyProjects = config.ParseKeyProjects("a:proj-a,b")
+		c.GCPProjectID = "global-proj"
+	})
+	km, _ := newTestManager(t, "placeholder")
+	km.source = envSource{}
+	if err := km.loadKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Any discovery request would fail the test
+	km.httpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected discovery request to %s", r.URL.Path)
+		return nil, errors.New("no discovery")
+	})}
+
+	for index, want := range []string{"proj-a", "global-proj"} {
+		auth, err := km.PickAuthAtIndex(context.Background(), index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.ProjectID != want {
+			t.Errorf("key %d project = %q, want %q", index, auth.ProjectID, want)
+		}
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,250 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/models"
+)
+
+// Key health tracking.
+//
+// A key that fails with an auth or quota error is benched: request paths skip
+// it, and a background prober periodically sends a cheap request with it,
+// returning it to rotation once it succeeds. Real requests therefore never pay
+// the latency of re-probing a bad key. With the prober disabled nothing would
+// ever return a key, so keys are not benched at all.
+
+// benchStatuses are upstream status codes that indicate a key-level problem
+var benchStatuses = []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests}
+
+// ShouldBench reports whether an upstream error indicates the key itself is unhealthy
+func ShouldBench(err error) bool {
+	var statusErr StatusError
+	return errors.As(err, &statusErr) && slices.Contains(benchStatuses, statusErr.StatusCode())
+}
+
+// Bench removes a key from rotation until the prober sees it recover. It
+// does nothing while the prober is not running.
+func (km *KeyManager) Bench(index int, reason string) {
+	if index < 0 || index >= km.KeyCount() {
+		return
+	}
+
+	km.healthMu.Lock()
+	defer km.healthMu.Unlock()
+
+	// nextProbe is only set by a running prober
+	if km.nextProbe.IsZero() {
+		return
+	}
+	if _, ok := km.benched[index]; ok {
+		return
+	}
+	km.benched[index] = time.Now()
+	log.Printf("Key benched: key_index=%d, reason=%s", index, reason)
+}
+
+// IsHealthy reports whether a key is currently in rotation: neither benched
+// nor cooling down
+func (km *KeyManager) IsHealthy(index int) bool {
+	km.healthMu.RLock()
+	defer km.healthMu.RUnlock()
+	_, benched := km.benched[index]
+	_, cooling := km.cooldownUntilLocked(index)
+	return !benched && !cooling
+}
+
+// HealthyKeyCount returns the number of keys currently in rotation: neither
+// benched nor cooling down
+func (km *KeyManager) HealthyKeyCount() int {
+	return len(km.healthyIndexes(km.KeyCount()))
+}
+
+// restore returns a benched key to rotation
+func (km *KeyManager) restore(index int) {
+	km.healthMu.Lock()
+	defer km.healthMu.Unlock()
+
+	if since, ok := km.benched[index]; ok {
+		delete(km.benched, index)
+		log.Printf("Key recovered: key_index=%d, benched_for=%v", index, time.Since(since).Round(time.Second))
+	}
+}
+
+// benchedIndexes returns a snapshot of benched key indexes
+func (km *KeyManager) benchedIndexes() []int {
+	km.healthMu.RLock()
+	defer km.healthMu.RUnlock()
+
+	indexes := make([]int, 0, len(km.benched))
+	for index := range km.benched {
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+// setNextProbe records when the prober will next try benched keys
+func (km *KeyManager) setNextProbe(t time.Time) {
+	km.healthMu.Lock()
+	defer km.healthMu.Unlock()
+	km.nextProbe = t
+}
+
+// RetryAfter estimates when capacity returns if no key is in rotation. A
+// benched key returns at the next prober run and a cooling key when its
+// cooldown ends (a key that is both needs both); the wait runs to the first
+// key back. It reports false while any key is healthy, and when no key can
+// come back on its own: they are benched and the prober is disabled.
+func (km *KeyManager) RetryAfter() (time.Duration, bool) {
+	count := km.KeyCount()
+
+	km.healthMu.RLock()
+	defer km.healthMu.RUnlock()
+
+	var soonest time.Time
+	for i := range count {
+		_, benched := km.benched[i]
+		until, cooling := km.cooldownUntilLocked(i)
+		var back time.Time
+		switch {
+		case benched && km.nextProbe.IsZero():
+			continue
+		case benched && cooling:
+			back = km.nextProbe
+			if until.After(back) {
+				back = until
+			}
+		case benched:
+			back = km.nextProbe
+		case cooling:
+			back = until
+		default:
+			return 0, false
+		}
+		if soonest.IsZero() || back.Before(soonest) {
+			soonest = back
+		}
+	}
+	if soonest.IsZero() {
+		return 0, false
+	}
+	// Round up so clients never come back before a key has
+	wait := time.Until(soonest).Truncate(time.Second) + time.Second
+	return max(wait, time.Second), true
+}
+
+// StartProber probes benched keys in the background until ctx is cancelled.
+// The interval and method come from KEY_PROBE_INTERVAL_SECONDS and KEY_PROBE_METHOD.
+func (km *KeyManager) StartProber(ctx context.Context) {
+	cfg := config.Get()
+	interval := time.Duration(cfg.KeyProbeIntervalSeconds) * time.Second
+	if interval <= 0 {
+		log.Println("Key prober disabled")
+		return
+	}
+
+	km.setNextProbe(time.Now().Add(interval))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				km.setNextProbe(time.Now().Add(interval))
+				km.probeBenched(ctx, cfg.KeyProbeMethod)
+			}
+		}
+	}()
+
+	log.Printf("Key prober started: interval=%v, method=%s", interval, cfg.KeyProbeMethod)
+}
+
+// probeBenched probes every benched key once, returning those that succeed
+// to rotation
+func (km *KeyManager) probeBenched(ctx context.Context, method string) {
+	for _, index := range km.benchedIndexes() {
+		if err := km.probeKey(ctx, index, method); err != nil {
+			log.Printf("Key probe failed: key_index=%d, error=%v", index, err)
+			continue
+		}
+		km.restore(index)
+	}
+}
+
+// probeKey sends a cheap request with the key at index. Supported methods:
+// "discovery" (project ID discovery request) and "count_tokens" (countTokens
+// call on KEY_PROBE_MODEL).
+func (km *KeyManager) probeKey(ctx context.Context, index int, method string) error {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	keys := km.keyList()
+	if index >= len(keys) {
+		return fmt.Errorf("key index %d no longer exists", index)
+	}
+	key := keys[index]
+
+	switch method {
+	case "count_tokens":
+		probeModel := config.Get().KeyProbeModel
+		projectID, err := km.getProjectID(ctx, key)
+		if err != nil {
+			return err
+		}
+		url := fmt.Sprintf(
+			"https://aiplatform.googleapis.com/%s/projects/%s/locations/%s/publishers/google/models/%s:countTokens?key=%s",
+			models.ResolveAPIVersion(probeModel), projectID, models.ResolveLocation(probeModel, km.location), probeModel, key,
+		)
+		return km.probeRequest(ctx, url, `{"contents":[{"role":"user","parts":[{"text":"ping"}]}]}`)
+
+	default:
+		// Discovery succeeds whenever the key is accepted, even though the
+		// request itself is intentionally invalid
+		projectID, err := km.discoverProjectID(ctx, key)
+		if err != nil {
+			return err
+		}
+		// A cached project was configured for the key (or discovered
+		// before) and stays authoritative
+		km.cacheMu.Lock()
+		if _, ok := km.projectCache[key]; !ok {
+			km.projectCache[key] = projectID
+		}
+		km.cacheMu.Unlock()
+		return nil
+	}
+}
+
+// probeRequest posts body to url and treats any 2xx response as healthy
+func (km *KeyManager) probeRequest(ctx context.Context, url, body string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := km.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("probe error (status %d): %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package keys
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name        string
+		prober      time.Duration // time to the next prober run, 0 = prober disabled
+		benched     []int
+		cooling     map[int]time.Duration
+		wantHealthy int
+		want        time.Duration // 0 = capacity available
+	}{
+		{name: "all healthy", prober: time.Minute, wantHealthy: 2},
+		{name: "one key left", prober: time.Minute, benched: []int{0}, wantHealthy: 1},
+		{name: "all benched", prober: time.Minute, benched: []int{0, 1}, want: time.Minute},
+		{
+			name:    "all cooling: soonest cooldown",
+			cooling: map[int]time.Duration{0: 40 * time.Second, 1: 10 * time.Second},
+			want:    10 * time.Second,
+		},
+		{
+			name:    "benched and cooling: cooldown first",
+			prober:  time.Minute,
+			benched: []int{0},
+			cooling: map[int]time.Duration{1: 20 * time.Second},
+			want:    20 * time.Second,
+		},
+		{
+			name:    "benched and cooling: probe first",
+			prober:  5 * time.Second,
+			benched: []int{0},
+			cooling: map[int]time.Duration{1: 20 * time.Second},
+			want:    5 * time.Second,
+		},
+		{
+			name:    "a key both benched and cooling waits for both",
+			prober:  5 * time.Second,
+			benched: []int{0, 1},
+			cooling: map[int]time.Duration{0: 30 * time.Second, 1: 20 * time.Second},
+			want:    20 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.KeyCooldownSeconds = 60 })
+			km, _ := newTestManager(t, "a", "b")
+			if tt.prober > 0 {
+				km.setNextProbe(time.Now().Add(tt.prober))
+			}
+			for _, index := range tt.benched {
+				km.Bench(index, "test")
+			}
+			km.healthMu.Lock()
+			for index, d := range tt.cooling {
+				km.cooldowns[index] = time.Now().Add(d)
+			}
+			km.healthMu.Unlock()
+
+			if got := km.HealthyKeyCount(); got != tt.wantHealthy {
+				t.Errorf("HealthyKeyCount = %d, want %d", got, tt.wantHealthy)
+			}
+			wait, exhausted := km.RetryAfter()
+			if exhausted != (tt.want > 0) {
+				t.Fatalf("RetryAfter exhausted = %v, want %v", exhausted, tt.want > 0)
+			}
+			// Rounded up to whole seconds
+			if exhausted && (wait < tt.want || wait > tt.want+time.Second) {
+				t.Errorf("RetryAfter = %v, want %v rounded up", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestProberRestoresRecoveredKey(t *testing.T) {
+	km, _ := newTestManager(t, "a", "b")
+	var healthy atomic.Bool
+	var probes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if !healthy.Load() {
+			http.Error(w, `{"error":{"status":"PERMISSION_DENIED"}}`, http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, `{"totalTokens":1}`)
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	km.httpClient = &http.Client{Transport: redirectTransport{target: target}}
+
+	// A running prober is what allows benching
+	km.setNextProbe(time.Now().Add(time.Minute))
+	km.Penalize(0, statusError(http.StatusForbidden))
+	if km.IsHealthy(0) {
+		t.Fatal("key 0 still healthy after a 403")
+	}
+	for range 5 {
+		if auth, err := km.PickAuth(context.Background()); err != nil || auth.KeyIndex != 1 {
+			t.Fatalf("PickAuth = %+v, %v; want only key 1 while key 0 is benched", auth, err)
+		}
+	}
+
+	// Still failing: the key stays benched
+	km.probeBenched(context.Background(), "count_tokens")
+	if km.IsHealthy(0) {
+		t.Error("key 0 restored although its probe failed")
+	}
+
+	// Recovered out-of-band: the next probe returns it to rotation
+	healthy.Store(true)
+	km.probeBenched(context.Background(), "count_tokens")
+	if !km.IsHealthy(0) {
+		t.Error("key 0 still benched after a successful probe")
+	}
+	if n := probes.Load(); n != 2 {
+		t.Errorf("probes = %d, want 2 (healthy keys are never probed)", n)
+	}
+}
@@ -0,0 +1,176 @@
+package keys
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"vertex2api-golang/internal/config"
+)
+
+// Pluggable key sources.
+//
+// KEY_SOURCE selects where Express API keys come from:
+//
+//	env            VERTEX_EXPRESS_API_KEY (default)
+//	file           KEY_FILE, one "key" or "key:projectID" entry per line
+//	secretmanager  GCP Secret Manager (not implemented yet)
+//	vault          HashiCorp Vault (not implemented yet)
+//
+// With KEY_REFRESH_SECONDS set, the KeyManager re-reads its source
+// periodically so keys can be rotated without a restart.
+
+// KeySource supplies Express API keys and optional per-key project IDs
+type KeySource interface {
+	// Name identifies the source in logs
+	Name() string
+	// Load returns the current keys and a key -> project ID map
+	Load(ctx context.Context) ([]string, map[string]string, error)
+}
+
+// NewKeySource returns the key source selected by KEY_SOURCE
+func NewKeySource(cfg *config.Config) (KeySource, error) {
+	switch cfg.KeySource {
+	case "", "env":
+		return envSource{}, nil
+	case "file":
+		if cfg.KeyFile == "" {
+			return nil, fmt.Errorf("KEY_SOURCE=file requires KEY_FILE")
+		}
+		return fileSource{path: cfg.KeyFile}, nil
+	case "secretmanager":
+		return secretManagerSource{}, nil
+	case "vault":
+		return vaultSource{}, nil
+	default:
+		return nil, fmt.Errorf("unknown KEY_SOURCE %q", cfg.KeySource)
+	}
+}
+
+// envSource reads keys from VERTEX_EXPRESS_API_KEY
+type envSource struct{}
+
+func (envSource) Name() string { return "env" }
+
+func (envSource) Load(ctx context.Context) ([]string, map[string]string, error) {
+	cfg := config.Get()
+	return cfg.VertexExpressAPIKeys, cfg.KeyProjects, nil
+}
+
+// fileSource reads keys from a file, one entry per line; blank lines and
+// lines starting with '#' are ignored
+type fileSource struct {
+	path string
+}
+
+func (s fileSource) Name() string { return "file:" + s.path }
+
+func (s fileSource) Load(ctx context.Context) ([]string, map[string]string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	keys, projects := config.ParseKeyProjects(strings.Join(entries, ","))
+	return keys, projects, nil
+}
+
+// secretManagerSource is a placeholder for GCP Secret Manager
+type secretManagerSource struct{}
+
+func (secretManagerSource) Name() string { return "secretmanager" }
+
+func (secretManagerSource) Load(ctx context.Context) ([]string, map[string]string, error) {
+	return nil, nil, fmt.Errorf("KEY_SOURCE=secretmanager is not implemented yet")
+}
+
+// vaultSource is a placeholder for HashiCorp Vault
+type vaultSource struct{}
+
+func (vaultSource) Name() string { return "vault" }
+
+func (vaultSource) Load(ctx context.Context) ([]string, map[string]string, error) {
+	return nil, nil, fmt.Errorf("KEY_SOURCE=vault is not implemented yet")
+}
+
+// loadKeys replaces the key set from the source. Health state is reset when
+// the keys change, since benched indexes refer to the old list.
+func (km *KeyManager) loadKeys(ctx context.Context) error {
+	keys, projects, err := km.source.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("key source %s returned no keys", km.source.Name())
+	}
+
+	cfg := config.Get()
+	km.cacheMu.Lock()
+	for _, key := range keys {
+		if projectID, ok := projects[key]; ok {
+			km.projectCache[key] = projectID
+		} else if _, ok := km.projectCache[key]; !ok && cfg.GCPProjectID != "" {
+			km.projectCache[key] = cfg.GCPProjectID
+		}
+	}
+	km.cacheMu.Unlock()
+
+	km.keysMu.Lock()
+	changed := !slices.Equal(km.keys, keys)
+	km.keys = keys
+	km.keysMu.Unlock()
+
+	if changed {
+		km.healthMu.Lock()
+		km.benched = make(map[int]time.Time)
+		km.cooldowns = make(map[int]time.Time)
+		km.healthMu.Unlock()
+		km.resetStats()
+
+		km.mu.Lock()
+		km.currentIndex = 0
+		km.mu.Unlock()
+		log.Printf("Keys loaded: source=%s, keys=%d", km.source.Name(), len(keys))
+	}
+	return nil
+}
+
+// StartKeyRefresh re-reads the key source every KEY_REFRESH_SECONDS until ctx
+// is cancelled
+func (km *KeyManager) StartKeyRefresh(ctx context.Context) {
+	interval := time.Duration(config.Get().KeyRefreshSeconds) * time.Second
+	if interval <= 0 || km.source == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := km.loadKeys(ctx); err != nil {
+					log.Printf("Key refresh failed: source=%s, error=%v", km.source.Name(), err)
+				}
+			}
+		}
+	}()
+
+	log.Printf("Key refresh started: source=%s, interval=%v", km.source.Name(), interval)
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -172,18 +174,25 @@ func parseModelsJSON(data []byte) []string {
 	return nil
 }
 
-// GetModels returns all available models
+// GetModels returns all available models, leaving out those blocked by
+// ALLOWED_MODELS/DENIED_MODELS
 func GetModels() []Model {
 	modelMu.RLock()
-	defer modelMu.RUnlock()
-
 	if !initialized {
 		modelMu.RUnlock()
 		Initialize()
 		modelMu.RLock()
 	}
+	list := modelList
+	modelMu.RUnlock()
 
-	return modelList
+	available := make([]Model, 0, len(list))
+	for _, m := range list {
+		if IsModelAllowed(m.ID) {
+			available = append(available, m)
+		}
+	}
+	return available
 }
 
 // GetModelsResponse returns OpenAI-style models response
@@ -194,8 +203,21 @@ func GetModelsResponse() ModelsResponse {
 	}
 }
 
-// ResolveModel resolves alias to actual model and returns config
+// ResolveModel resolves a model name to the actual model and returns alias config.
+// Resolution order: MODEL_MAP rewrite -> alias -> passthrough.
 func ResolveModel(modelID string) (string, *ModelAlias) {
+	if target, ok := config.Get().ModelMap[modelID]; ok {
+		log.Printf("Model mapped: %s -> %s", modelID, target)
+	}
+	return resolveModel(modelID)
+}
+
+// resolveModel is ResolveModel without logging, for checks run on every listed model
+func resolveModel(modelID string) (string, *ModelAlias) {
+	if target, ok := config.Get().ModelMap[modelID]; ok {
+		modelID = target
+	}
+
 	modelMu.RLock()
 	defer modelMu.RUnlock()
 
@@ -204,3 +226,186 @@ func ResolveModel(modelID string) (string, *ModelAlias) {
 	}
 	return modelID, nil
 }
+
+// SupportsAudioOutput reports whether a model can produce audio output
+func SupportsAudioOutput(modelID string) bool {
+	actual, _ := ResolveModel(modelID)
+	actual = strings.ToLower(actual)
+	return strings.Contains(actual, "audio") || strings.Contains(actual, "tts")
+}
+
+// SupportsImageOutput reports whether a model can produce image output
+func SupportsImageOutput(modelID string) bool {
+	actual, _ := ResolveModel(modelID)
+	return strings.Contains(strings.ToLower(actual), "image")
+}
+
+// defaultThinkingBudgetCeilings are the maximum thinking budgets per model
+// family, matched by prefix (longest prefix wins)
+var defaultThinkingBudgetCeilings = map[string]int{
+	"gemini-2.5-pro":        32768,
+	"gemini-2.5-flash":      24576,
+	"gemini-2.5-flash-lite": 24576,
+	"gemini-3-pro":          32768,
+	"gemini-3-flash":        24576,
+}
+
+// ThinkingBudgetCeiling returns the maximum thinking budget for a model, from
+// THINKING_BUDGET_LIMITS or the built-in table, or 0 if unknown
+func ThinkingBudgetCeiling(modelID string) int {
+	ceilings := make(map[string]int, len(defaultThinkingBudgetCeilings))
+	for prefix, limit := range defaultThinkingBudgetCeilings {
+		ceilings[prefix] = limit
+	}
+	for prefix, limit := range config.Get().ThinkingBudgetLimits {
+		if n, err := strconv.Atoi(limit); err == nil {
+			ceilings[prefix] = n
+		}
+	}
+
+	best, ceiling := "", 0
+	for prefix, limit := range ceilings {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) > len(best) {
+			best, ceiling = prefix, limit
+		}
+	}
+	return ceiling
+}
+
+// defaultContextWindows are the input token limits per model family, matched
+// by prefix (longest prefix wins)
+var defaultContextWindows = map[string]int{
+	"gemini-2.0-flash":      1048576,
+	"gemini-2.5-pro":        1048576,
+	"gemini-2.5-flash":      1048576,
+	"gemini-2.5-flash-lite": 1048576,
+	"gemini-3-pro":          1048576,
+	"gemini-3-flash":        1048576,
+}
+
+// ContextWindow returns the input token limit for a model, from
+// CONTEXT_WINDOW_LIMITS or the built-in table, or 0 if unknown
+func ContextWindow(modelID string) int {
+	windows := make(map[string]int, len(defaultContextWindows))
+	for prefix, limit := range defaultContextWindows {
+		windows[prefix] = limit
+	}
+	for prefix, limit := range config.Get().ContextWindowLimits {
+		if n, err := strconv.Atoi(limit); err == nil {
+			windows[prefix] = n
+		}
+	}
+
+	best, window := "", 0
+	for prefix, limit := range windows {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) > len(best) {
+			best, window = prefix, limit
+		}
+	}
+	return window
+}
+
+// UnsupportedParams returns the OpenAI request parameters a model rejects,
+// from UNSUPPORTED_PARAMS entries such as "gemini-2.5-pro=temperature|top_k"
+// (longest model prefix wins)
+func UnsupportedParams(modelID string) []string {
+	best, params := "", ""
+	for prefix, list := range config.Get().UnsupportedParams {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) > len(best) {
+			best, params = prefix, list
+		}
+	}
+	var result []string
+	for _, p := range strings.Split(params, "|") {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// ResolveAPIVersion returns the Vertex API version to call a model with: a
+// MODEL_API_VERSIONS entry (longest model prefix wins) or VERTEX_API_VERSION.
+//
+// Every URL builder goes through here so a model behaves the same on the
+// OpenAI-compatible, native and passthrough paths. The passthrough used to
+// call v1 while the others used v1beta1, so thinking and tool options that
+// only exist in v1beta1 worked on one path and vanished on the other. The
+// default is therefore v1beta1 everywhere.
+func ResolveAPIVersion(modelID string) string {
+	cfg := config.Get()
+	best, version := "", ""
+	for prefix, v := range cfg.ModelAPIVersions {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) > len(best) {
+			best, version = prefix, v
+		}
+	}
+	if version != "" {
+		return version
+	}
+	return cfg.VertexAPIVersion
+}
+
+// globalOnlyFamilies are model families served only from the "global" location
+var globalOnlyFamilies = []string{"gemini-2.5", "gemini-3"}
+
+// ResolveLocation returns the location to call a model in: a MODEL_LOCATIONS
+// entry (longest model prefix wins), "global" for families only served there,
+// or defaultLocation. Both the OpenAI-compatible and Gemini paths use it.
+func ResolveLocation(modelID, defaultLocation string) string {
+	best, location := "", ""
+	for prefix, loc := range config.Get().ModelLocations {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) > len(best) {
+			best, location = prefix, loc
+		}
+	}
+	if location != "" {
+		return location
+	}
+
+	for _, family := range globalOnlyFamilies {
+		if strings.Contains(modelID, family) {
+			return "global"
+		}
+	}
+	return defaultLocation
+}
+
+// IsModelAllowed checks a client model name against ALLOWED_MODELS and
+// DENIED_MODELS. Both the name and its resolved upstream model are checked,
+// so an alias cannot be used to reach a denied model. Entries are exact names
+// or prefixes ending in "*"; an empty allowlist allows every model.
+func IsModelAllowed(modelID string) bool {
+	cfg := config.Get()
+	resolved, _ := resolveModel(modelID)
+	names := []string{modelID, resolved}
+
+	for _, name := range names {
+		if matchesModelPattern(cfg.DeniedModels, name) {
+			return false
+		}
+	}
+	if len(cfg.AllowedModels) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if matchesModelPattern(cfg.AllowedModels, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesModelPattern reports whether name matches any exact or "prefix*" pattern
+func matchesModelPattern(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if p == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	Initialize()
+	os.Exit(m.Run())
+}
+
+// useConfig makes a modified copy of the current config active for a test
+func useConfig(t *testing.T, modify func(c *config.Config)) {
+	t.Helper()
+	prev := config.Get()
+	next := *prev
+	modify(&next)
+	config.Override(&next)
+	t.Cleanup(func() { config.Override(prev) })
+}
+
+func TestResolveModelMap(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.ModelMap = map[string]string{
+			"gpt-4o":      "gemini-2.5-pro",
+			"gpt-4o-high": "gemini-3-pro-preview-high",
+		}
+	})
+
+	tests := []struct {
+		name      string
+		model     string
+		want      string
+		wantAlias bool
+	}{
+		{"mapped", "gpt-4o", "gemini-2.5-pro", false},
+		{"mapped to an alias", "gpt-4o-high", "gemini-3-pro-preview", true},
+		{"aliased", "gemini-3-pro-preview-low", "gemini-3-pro-preview", true},
+		{"unmapped", "gemini-2.5-flash", "gemini-2.5-flash", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, alias := ResolveModel(tt.model)
+			if got != tt.want {
+				t.Errorf("ResolveModel(%q) = %q, want %q", tt.model, got, tt.want)
+			}
+			if (alias != nil) != tt.wantAlias {
+				t.Errorf("ResolveModel(%q) alias = %+v, want alias %v", tt.model, alias, tt.wantAlias)
+			}
+		})
+	}
+}
+
+func TestIsModelAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		model   string
+		want    bool
+	}{
+		{"no lists", nil, nil, "gemini-2.5-pro", true},
+		{"allowed by name", []string{"gemini-2.5-flash"}, nil, "gemini-2.5-flash", true},
+		{"not on the allowlist", []string{"gemini-2.5-flash"}, nil, "gemini-2.5-pro", false},
+		{"allowed by prefix", []string{"gemini-2.5-*"}, nil, "gemini-2.5-pro", true},
+		{"denied by name", nil, []string{"gemini-2.5-pro"}, "gemini-2.5-pro", false},
+		{"deny beats allow", []string{"gemini-*"}, []string{"gemini-2.5-pro"}, "gemini-2.5-pro", false},
+		{"alias of a denied model", nil, []string{"gemini-3-pro-preview"}, "gemini-3-pro-preview-high", false},
+		{"mapped name of a denied model", nil, []string{"gemini-2.5-pro"}, "gpt-4o", false},
+		{"alias allowed through its target", []string{"gemini-3-pro-preview"}, nil, "gemini-3-pro-preview-low", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.AllowedModels, c.DeniedModels = tt.allowed, tt.denied
+				c.ModelMap = map[string]string{"gpt-4o": "gemini-2.5-pro"}
+			})
+			if got := IsModelAllowed(tt.model); got != tt.want {
+				t.Errorf("IsModelAllowed(%q) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetModelsFiltered(t *testing.T) {
+	all := GetModels()
+	useConfig(t, func(c *config.Config) {
+		c.AllowedModels = []string{"gemini-*"}
+		c.DeniedModels = []string{"gemini-3-pro-preview"}
+	})
+	listed := GetModels()
+	if len(listed) == 0 || len(listed) >= len(all) {
+		t.Fatalf("listed %d of %d models, want a non-empty subset", len(listed), len(all))
+	}
+	for _, m := range listed {
+		if !IsModelAllowed(m.ID) {
+			t.Errorf("blocked model %s is listed", m.ID)
+		}
+		if strings.HasPrefix(m.ID, "gemini-3-pro-preview") {
+			t.Errorf("%s is listed although it resolves to a denied model", m.ID)
+		}
+	}
+}
+
+func TestResolveAPIVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		global   string
+		perModel map[string]string
+		model    string
+		want     string
+	}{
+		{"global version", "v1beta1", nil, "gemini-2.5-flash", "v1beta1"},
+		{"global override", "v1", nil, "gemini-2.5-flash", "v1"},
+		{"model prefix", "v1beta1", map[string]string{"gemini-3": "v1"}, "gemini-3-pro-preview", "v1"},
+		{"longest prefix wins", "v1beta1", map[string]string{"gemini-2.5": "v1", "gemini-2.5-pro": "v1beta"}, "gemini-2.5-pro", "v1beta"},
+		{"unmatched model", "v1beta1", map[string]string{"gemini-3": "v1"}, "gemini-2.5-flash", "v1beta1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.VertexAPIVersion = tt.global
+				c.ModelAPIVersions = tt.perModel
+			})
+			if got := ResolveAPIVersion(tt.model); got != tt.want {
+				t.Errorf("ResolveAPIVersion(%q) = %q, want %q", tt.model, got, tt.want)
+			}
+		})
+	}
+}
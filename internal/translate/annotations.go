@@ -0,0 +1,67 @@
+package translate
+
+import (
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/vertex"
+)
+
+// Message annotations (ANNOTATIONS_MODE).
+//
+//	citations  grounding citations as url_citation annotations (default)
+//	all        citations plus one safety_rating annotation per Gemini rating
+//	off        no annotations
+//
+// Safety ratings become:
+//
+//	{"type": "safety_rating",
+//	 "safety_rating": {"category": "HARM_CATEGORY_HARASSMENT", "probability": "NEGLIGIBLE", "score": 0.1}}
+//
+// When streaming, Gemini repeats ratings on every chunk, so they are only
+// annotated on the chunk that carries the finish reason.
+
+const (
+	AnnotationsCitations = "citations"
+	AnnotationsAll       = "all"
+	AnnotationsOff       = "off"
+)
+
+// SafetyAnnotation is a Gemini safety rating exposed as an annotation
+type SafetyAnnotation struct {
+	Category    string  `json:"category"`
+	Probability string  `json:"probability"`
+	Score       float64 `json:"score,omitempty"`
+	Blocked     bool    `json:"blocked,omitempty"`
+}
+
+// candidateAnnotations builds the annotations for a candidate whose text so
+// far is text, of which the client does not see the hidden ranges;
+// withSafety controls whether safety ratings are included
+func candidateAnnotations(candidate vertex.Candidate, text string, hidden []textRange, withSafety bool) []Annotation {
+	mode := config.Get().AnnotationsMode
+	if mode == AnnotationsOff {
+		return nil
+	}
+
+	annotations := convertGrounding(candidate.GroundingMetadata, text, hidden)
+	if mode == AnnotationsAll && withSafety {
+		annotations = append(annotations, convertSafetyRatings(candidate.SafetyRatings)...)
+	}
+	return annotations
+}
+
+// convertSafetyRatings maps Gemini safety ratings to safety_rating annotations
+func convertSafetyRatings(ratings []vertex.SafetyRating) []Annotation {
+	annotations := make([]Annotation, 0, len(ratings))
+	for _, r := range ratings {
+		annotations = append(annotations, Annotation{
+			Type: "safety_rating",
+			SafetyRating: &SafetyAnnotation{
+				Category:    r.Category,
+				Probability: r.Probability,
+				Score:       r.Score,
+				Blocked:     r.Blocked,
+			},
+		})
+	}
+	return annotations
+}
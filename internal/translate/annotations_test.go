@@ -0,0 +1,61 @@
+package translate
+
+import (
+	"testing"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestAnnotationsMode(t *testing.T) {
+	candidate := groundedCandidate("Paris", "Capital: Paris.")
+	candidate.SafetyRatings = []vertex.SafetyRating{
+		{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE", Score: 0.1},
+		{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "HIGH", Score: 0.9, Blocked: true},
+	}
+	tests := []struct {
+		mode          string
+		wantCitations int
+		wantSafety    []SafetyAnnotation
+	}{
+		{AnnotationsOff, 0, nil},
+		{AnnotationsCitations, 1, nil},
+		{AnnotationsAll, 1, []SafetyAnnotation{
+			{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE", Score: 0.1},
+			{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "HIGH", Score: 0.9, Blocked: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.AnnotationsMode = tt.mode })
+			resp := FromGeminiResponse(&vertex.GeminiResponse{Candidates: []vertex.Candidate{candidate}}, "m", "id")
+
+			citations := 0
+			var safety []SafetyAnnotation
+			for _, a := range resp.Choices[0].Message.Annotations {
+				switch a.Type {
+				case "url_citation":
+					citations++
+					if a.URLCitation.URL != "https://example.com" {
+						t.Errorf("citation URL = %q", a.URLCitation.URL)
+					}
+				case "safety_rating":
+					safety = append(safety, *a.SafetyRating)
+				default:
+					t.Errorf("unexpected annotation type %q", a.Type)
+				}
+			}
+			if citations != tt.wantCitations {
+				t.Errorf("citations = %d, want %d", citations, tt.wantCitations)
+			}
+			if len(safety) != len(tt.wantSafety) {
+				t.Fatalf("safety annotations = %+v, want %+v", safety, tt.wantSafety)
+			}
+			for i := range safety {
+				if safety[i] != tt.wantSafety[i] {
+					t.Errorf("safety annotation %d = %+v, want %+v", i, safety[i], tt.wantSafety[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package translate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/models"
+)
+
+// SystemFingerprint identifies the backend that served a model version: the
+// version itself plus the API version and location it is called with. It is
+// the same for every response from that backend and changes when any of
+// them does, which is what clients compare system_fingerprint for.
+func SystemFingerprint(modelVersion string) string {
+	if modelVersion == "" {
+		return ""
+	}
+	backend := modelVersion + "|" +
+		models.ResolveAPIVersion(modelVersion) + "|" +
+		models.ResolveLocation(modelVersion, config.Get().GCPLocation)
+	sum := sha256.Sum256([]byte(backend))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
@@ -0,0 +1,171 @@
+package translate
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+// Grounding citations.
+//
+// Grounded Gemini responses carry groundingMetadata: a list of sources
+// (groundingChunks) and the text segments each supports (groundingSupports).
+// They are exposed as OpenAI url_citation annotations on the message (or the
+// delta when streaming), one per supported segment and source:
+//
+//	"annotations": [{
+//	  "type": "url_citation",
+//	  "url_citation": {"url": "...", "title": "...", "start_index": 0, "end_index": 42}
+//	}]
+//
+// start_index/end_index are character offsets into the message content,
+// which lacks the thinking blocks (and the whitespace trimmed around them) of
+// the text Gemini generated, so offsets past a block shift left.
+
+// Annotation is an OpenAI message annotation
+type Annotation struct {
+	Type         string            `json:"type"`
+	URLCitation  *URLCitation      `json:"url_citation,omitempty"`
+	SafetyRating *SafetyAnnotation `json:"safety_rating,omitempty"`
+}
+
+// URLCitation cites a web source for a span of the message content
+type URLCitation struct {
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+}
+
+// convertGrounding maps grounding metadata to url_citation annotations. Gemini
+// segment offsets are UTF-8 byte offsets into text, the candidate text as
+// generated; hidden lists the byte ranges of text the client does not see.
+// They are converted to character offsets into the visible content.
+func convertGrounding(meta *vertex.GroundingMetadata, text string, hidden []textRange) []Annotation {
+	if meta == nil {
+		return nil
+	}
+
+	var annotations []Annotation
+	for _, support := range meta.GroundingSupports {
+		start := visibleOffset(text, hidden, support.Segment.StartIndex)
+		end := visibleOffset(text, hidden, support.Segment.EndIndex)
+		for _, idx := range support.GroundingChunkIndices {
+			if idx < 0 || idx >= len(meta.GroundingChunks) || meta.GroundingChunks[idx].Web == nil {
+				continue
+			}
+			web := meta.GroundingChunks[idx].Web
+			annotations = append(annotations, Annotation{
+				Type: "url_citation",
+				URLCitation: &URLCitation{
+					URL:        web.URI,
+					Title:      web.Title,
+					StartIndex: start,
+					EndIndex:   end,
+				},
+			})
+		}
+	}
+	return annotations
+}
+
+// textRange is a byte range [start, end) of generated text
+type textRange struct {
+	start, end int
+}
+
+// hiddenRanges returns the byte ranges of text missing from the client's
+// content: its thinking blocks. Streamed text hides everything after an
+// unclosed tag; text that went through extractThinking (extracted) keeps it,
+// but loses the whitespace around the rest once a block was removed.
+func hiddenRanges(text string, extracted bool) []textRange {
+	const openTag, closeTag = "<vertex_think_tag>", "</vertex_think_tag>"
+
+	// The visible ranges between thinking blocks
+	var visible []textRange
+	pos := 0
+	for pos < len(text) {
+		open := strings.Index(text[pos:], openTag)
+		if open < 0 {
+			break
+		}
+		close := strings.Index(text[pos+open:], closeTag)
+		if close < 0 {
+			if !extracted {
+				visible = append(visible, textRange{pos, pos + open})
+				pos = len(text)
+			}
+			break
+		}
+		visible = append(visible, textRange{pos, pos + open})
+		pos += open + close + len(closeTag)
+	}
+	removed := len(visible) > 0
+	visible = append(visible, textRange{pos, len(text)})
+
+	if extracted && removed {
+		for i := range visible {
+			r := &visible[i]
+			r.start += leadingSpace(text[r.start:r.end])
+			if r.start < r.end {
+				break
+			}
+		}
+		for i := len(visible) - 1; i >= 0; i-- {
+			r := &visible[i]
+			r.end -= trailingSpace(text[r.start:r.end])
+			if r.start < r.end {
+				break
+			}
+		}
+	}
+
+	var hidden []textRange
+	pos = 0
+	for _, r := range visible {
+		if r.start > pos {
+			hidden = append(hidden, textRange{pos, r.start})
+		}
+		pos = max(pos, r.end)
+	}
+	if pos < len(text) {
+		hidden = append(hidden, textRange{pos, len(text)})
+	}
+	return hidden
+}
+
+// leadingSpace returns the byte length of the leading whitespace of s
+func leadingSpace(s string) int {
+	return len(s) - len(strings.TrimLeftFunc(s, unicode.IsSpace))
+}
+
+// trailingSpace returns the byte length of the trailing whitespace of s
+func trailingSpace(s string) int {
+	return len(s) - len(strings.TrimRightFunc(s, unicode.IsSpace))
+}
+
+// visibleOffset converts a byte offset in text to a character offset in the
+// content left once the hidden ranges are removed
+func visibleOffset(text string, hidden []textRange, byteOffset int) int {
+	offset := charOffset(text, byteOffset)
+	for _, r := range hidden {
+		if r.start >= byteOffset {
+			break
+		}
+		offset -= charOffset(text, min(r.end, byteOffset)) - charOffset(text, r.start)
+	}
+	return offset
+}
+
+// charOffset converts a byte offset in text to a character offset
+func charOffset(text string, byteOffset int) int {
+	if byteOffset <= 0 {
+		return 0
+	}
+	if byteOffset > len(text) {
+		return utf8.RuneCountInString(text) + (byteOffset - len(text))
+	}
+	return utf8.RuneCountInString(text[:byteOffset])
+}
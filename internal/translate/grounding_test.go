@@ -0,0 +1,80 @@
+package translate
+
+import (
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+// groundedCandidate returns a candidate with the given text parts whose
+// grounding cites the first occurrence of cited in their concatenation
+func groundedCandidate(cited string, parts ...string) vertex.Candidate {
+	generated := strings.Join(parts, "")
+	start := strings.Index(generated, cited)
+	content := &vertex.Content{Role: "model"}
+	for _, text := range parts {
+		content.Parts = append(content.Parts, vertex.Part{Text: text})
+	}
+	return vertex.Candidate{
+		Content:      content,
+		FinishReason: "STOP",
+		GroundingMetadata: &vertex.GroundingMetadata{
+			GroundingChunks: []vertex.GroundingChunk{{Web: &vertex.GroundingWeb{URI: "https://example.com", Title: "Example"}}},
+			GroundingSupports: []vertex.GroundingSupport{{
+				Segment:               vertex.GroundingSegment{StartIndex: start, EndIndex: start + len(cited)},
+				GroundingChunkIndices: []int{0},
+			}},
+		},
+	}
+}
+
+func TestGroundingOffsetsSkipThinking(t *testing.T) {
+	tests := []struct {
+		name  string
+		cited string
+		parts []string
+	}{
+		{"no thinking", "Paris", []string{"Capital: Paris."}},
+		{"multibyte text", "Paris", []string{"Capitale é: Paris."}},
+		{"thinking first", "Paris", []string{"<vertex_think_tag>Let me think é</vertex_think_tag>\n\nCapital: Paris."}},
+		{"thinking between", "Paris", []string{"Capital: <vertex_think_tag>hmm</vertex_think_tag>Paris."}},
+		{"thinking in an earlier part", "Paris", []string{"<vertex_think_tag>plan</vertex_think_tag> Intro. ", "Capital: Paris."}},
+	}
+
+	for _, tt := range tests {
+		candidate := groundedCandidate(tt.cited, tt.parts...)
+		check := func(t *testing.T, content string, annotations []Annotation) {
+			t.Helper()
+			if len(annotations) != 1 {
+				t.Fatalf("annotations = %+v, want one citation", annotations)
+			}
+			c := annotations[0].URLCitation
+			runes := []rune(content)
+			if c.StartIndex < 0 || c.EndIndex > len(runes) || string(runes[c.StartIndex:c.EndIndex]) != tt.cited {
+				t.Errorf("citation [%d, %d) of %q, want it to cover %q", c.StartIndex, c.EndIndex, content, tt.cited)
+			}
+		}
+
+		t.Run(tt.name+"/response", func(t *testing.T) {
+			resp := FromGeminiResponse(&vertex.GeminiResponse{Candidates: []vertex.Candidate{candidate}}, "m", "id")
+			msg := resp.Choices[0].Message
+			check(t, msg.Content, msg.Annotations)
+		})
+
+		t.Run(tt.name+"/stream", func(t *testing.T) {
+			state := NewStreamState()
+			var content string
+			for i, text := range tt.parts {
+				chunk := vertex.Candidate{Content: &vertex.Content{Parts: []vertex.Part{{Text: text}}}}
+				if i == len(tt.parts)-1 {
+					chunk.FinishReason = candidate.FinishReason
+					chunk.GroundingMetadata = candidate.GroundingMetadata
+				}
+				c, _, _, _ := state.ProcessChunk(&vertex.GeminiResponse{Candidates: []vertex.Candidate{chunk}})
+				content += c
+			}
+			check(t, content, state.Annotations())
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package translate
+
+import (
+	"crypto/rand"
+
+	"vertex2api-golang/internal/config"
+)
+
+// OpenAI object types used across the raw proxy and native translation paths
+const (
+	ObjectChatCompletion      = "chat.completion"
+	ObjectChatCompletionChunk = "chat.completion.chunk"
+)
+
+// idAlphabet is the character set for generated IDs
+const idAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// NewCompletionID returns a completion ID in the OpenAI "chatcmpl-<random>"
+// format; the prefix can be overridden with ID_PREFIX
+func NewCompletionID() string {
+	return config.Get().IDPrefix + randomID(24)
+}
+
+// randomID returns n random alphanumeric characters
+func randomID(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	for i, b := range buf {
+		buf[i] = idAlphabet[int(b)%len(idAlphabet)]
+	}
+	return string(buf)
+}
@@ -0,0 +1,35 @@
+package translate
+
+import (
+	"regexp"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestNewCompletionID(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string // ID_PREFIX
+		want   *regexp.Regexp
+	}{
+		{"default prefix", "chatcmpl-", regexp.MustCompile(`^chatcmpl-[A-Za-z0-9]{24}$`)},
+		{"custom prefix", "gen-", regexp.MustCompile(`^gen-[A-Za-z0-9]{24}$`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.IDPrefix = tt.prefix })
+			seen := make(map[string]bool)
+			for range 100 {
+				id := NewCompletionID()
+				if !tt.want.MatchString(id) {
+					t.Fatalf("NewCompletionID = %q, want %s", id, tt.want)
+				}
+				if seen[id] {
+					t.Fatalf("NewCompletionID repeated %q", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package translate
+
+import "encoding/json"
+
+// Legacy function calling.
+//
+// Older clients send the deprecated top-level "functions" and "function_call"
+// fields instead of "tools" and "tool_choice". They are upgraded to the tool
+// form so both translation paths handle them like any other tool request.
+// Explicit tools/tool_choice win when a request carries both.
+
+// legacyFunctionChoice converts a function_call value to a tool_choice value:
+// "none" and "auto" are kept, {"name": x} forces that function
+func legacyFunctionChoice(functionCall interface{}) interface{} {
+	switch v := functionCall.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok && name != "" {
+			return map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": name},
+			}
+		}
+	}
+	return nil
+}
+
+// applyLegacyFunctions fills Tools and ToolChoice from the legacy fields
+func (r *ChatCompletionRequest) applyLegacyFunctions() {
+	if len(r.Tools) == 0 {
+		for _, fn := range r.Functions {
+			r.Tools = append(r.Tools, OpenAITool{Type: "function", Function: fn})
+		}
+	}
+	if r.ToolChoice == nil && r.FunctionCall != nil {
+		r.ToolChoice = legacyFunctionChoice(r.FunctionCall)
+	}
+}
+
+// UpgradeLegacyFunctions rewrites "functions" and "function_call" in a raw
+// request to "tools" and "tool_choice". It reports whether tools changed.
+func UpgradeLegacyFunctions(rawReq map[string]json.RawMessage) bool {
+	toolsChanged := false
+
+	if raw, ok := rawReq["functions"]; ok {
+		delete(rawReq, "functions")
+		var functions []json.RawMessage
+		if _, hasTools := rawReq["tools"]; !hasTools && json.Unmarshal(raw, &functions) == nil && len(functions) > 0 {
+			tools := make([]map[string]json.RawMessage, 0, len(functions))
+			for _, fn := range functions {
+				tools = append(tools, map[string]json.RawMessage{
+					"type":     json.RawMessage(`"function"`),
+					"function": fn,
+				})
+			}
+			if toolsBytes, err := json.Marshal(tools); err == nil {
+				rawReq["tools"] = toolsBytes
+				toolsChanged = true
+			}
+		}
+	}
+
+	if raw, ok := rawReq["function_call"]; ok {
+		delete(rawReq, "function_call")
+		var functionCall interface{}
+		if _, hasChoice := rawReq["tool_choice"]; !hasChoice && json.Unmarshal(raw, &functionCall) == nil {
+			if choice := legacyFunctionChoice(functionCall); choice != nil {
+				if choiceBytes, err := json.Marshal(choice); err == nil {
+					rawReq["tool_choice"] = choiceBytes
+				}
+			}
+		}
+	}
+
+	return toolsChanged
+}
@@ -0,0 +1,77 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestToGeminiRequestLegacyFunctions(t *testing.T) {
+	const functions = `"functions":[{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}]`
+	tests := []struct {
+		name        string
+		fields      string
+		wantDecls   []string
+		wantMode    string
+		wantAllowed []string
+	}{
+		{"functions only", functions, []string{"get_weather"}, "", nil},
+		{"forced function", functions + `,"function_call":{"name":"get_weather"}`, []string{"get_weather"}, "ANY", []string{"get_weather"}},
+		{"function_call none", functions + `,"function_call":"none"`, []string{"get_weather"}, "NONE", nil},
+		{"tools win", functions + `,"tools":[{"type":"function","function":{"name":"lookup"}}]`, []string{"lookup"}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req ChatCompletionRequest
+			body := `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hi"}],` + tt.fields + `}`
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+			geminiReq, _, err := ToGeminiRequest(context.Background(), &req)
+			if err != nil {
+				t.Fatalf("ToGeminiRequest: %v", err)
+			}
+			var decls []string
+			for _, tool := range geminiReq.Tools {
+				for _, decl := range tool.FunctionDeclarations {
+					decls = append(decls, decl.Name)
+				}
+			}
+			if !slices.Equal(decls, tt.wantDecls) {
+				t.Errorf("function declarations = %v, want %v", decls, tt.wantDecls)
+			}
+			var mode string
+			var allowed []string
+			if tc := geminiReq.ToolConfig; tc != nil && tc.FunctionCallingConfig != nil {
+				mode, allowed = tc.FunctionCallingConfig.Mode, tc.FunctionCallingConfig.AllowedFunctionNames
+			}
+			if mode != tt.wantMode || !slices.Equal(allowed, tt.wantAllowed) {
+				t.Errorf("function calling config = %q %v, want %q %v", mode, allowed, tt.wantMode, tt.wantAllowed)
+			}
+		})
+	}
+
+	t.Run("raw request", func(t *testing.T) {
+		var raw map[string]json.RawMessage
+		json.Unmarshal([]byte(`{`+functions+`,"function_call":{"name":"get_weather"}}`), &raw)
+		if !UpgradeLegacyFunctions(raw) {
+			t.Error("UpgradeLegacyFunctions reported no tool change")
+		}
+		if _, ok := raw["functions"]; ok {
+			t.Error("functions still forwarded")
+		}
+		if _, ok := raw["function_call"]; ok {
+			t.Error("function_call still forwarded")
+		}
+		want := map[string]string{
+			"tools":       `[{"function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}},"type":"function"}]`,
+			"tool_choice": `{"function":{"name":"get_weather"},"type":"function"}`,
+		}
+		for field, w := range want {
+			if string(raw[field]) != w {
+				t.Errorf("%s = %s, want %s", field, raw[field], w)
+			}
+		}
+	})
+}
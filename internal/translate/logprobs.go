@@ -0,0 +1,90 @@
+package translate
+
+import "vertex2api-golang/internal/vertex"
+
+// ChoiceLogprobs is the OpenAI logprobs object on a choice
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+// TokenLogprob is a single token's log probability. Bytes holds the token's
+// UTF-8 encoding so clients can reconstruct text across split characters.
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+// TopLogprob is an alternative token at the same position
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// tokenBytes returns the UTF-8 byte values of a token
+func tokenBytes(token string) []int {
+	b := []byte(token)
+	result := make([]int, len(b))
+	for i, c := range b {
+		result[i] = int(c)
+	}
+	return result
+}
+
+// FillLogprobBytes sets the bytes field of every token that lacks it.
+// It returns true if any entry was changed.
+func FillLogprobBytes(lp *ChoiceLogprobs) bool {
+	if lp == nil {
+		return false
+	}
+
+	changed := false
+	for i := range lp.Content {
+		item := &lp.Content[i]
+		if item.Bytes == nil {
+			item.Bytes = tokenBytes(item.Token)
+			changed = true
+		}
+		if item.TopLogprobs == nil {
+			item.TopLogprobs = []TopLogprob{}
+			changed = true
+		}
+		for j := range item.TopLogprobs {
+			if item.TopLogprobs[j].Bytes == nil {
+				item.TopLogprobs[j].Bytes = tokenBytes(item.TopLogprobs[j].Token)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// convertLogprobs maps Gemini logprobsResult to OpenAI logprobs
+func convertLogprobs(result *vertex.LogprobsResult) *ChoiceLogprobs {
+	if result == nil || len(result.ChosenCandidates) == 0 {
+		return nil
+	}
+
+	lp := &ChoiceLogprobs{Content: make([]TokenLogprob, 0, len(result.ChosenCandidates))}
+	for i, chosen := range result.ChosenCandidates {
+		item := TokenLogprob{
+			Token:       chosen.Token,
+			Logprob:     chosen.LogProbability,
+			Bytes:       tokenBytes(chosen.Token),
+			TopLogprobs: []TopLogprob{},
+		}
+		if i < len(result.TopCandidates) {
+			for _, alt := range result.TopCandidates[i].Candidates {
+				item.TopLogprobs = append(item.TopLogprobs, TopLogprob{
+					Token:   alt.Token,
+					Logprob: alt.LogProbability,
+					Bytes:   tokenBytes(alt.Token),
+				})
+			}
+		}
+		lp.Content = append(lp.Content, item)
+	}
+	return lp
+}
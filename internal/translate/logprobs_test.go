@@ -0,0 +1,72 @@
+package translate
+
+import (
+	"slices"
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestConvertLogprobsBytes(t *testing.T) {
+	result := &vertex.LogprobsResult{
+		ChosenCandidates: []vertex.LogprobCandidate{
+			{Token: "Hi", LogProbability: -0.1},
+			{Token: " é", LogProbability: -0.5},
+			{Token: "日本", LogProbability: -1.2},
+		},
+		TopCandidates: []vertex.TopCandidates{
+			{Candidates: []vertex.LogprobCandidate{{Token: "Hi", LogProbability: -0.1}, {Token: "Hey", LogProbability: -2}}},
+			{Candidates: []vertex.LogprobCandidate{{Token: " é", LogProbability: -0.5}}},
+		},
+	}
+
+	lp := convertLogprobs(result)
+	if lp == nil || len(lp.Content) != 3 {
+		t.Fatalf("convertLogprobs = %+v, want 3 tokens", lp)
+	}
+	for _, item := range lp.Content {
+		if want := utf8Values(item.Token); !slices.Equal(item.Bytes, want) {
+			t.Errorf("token %q bytes = %v, want %v", item.Token, item.Bytes, want)
+		}
+		for _, alt := range item.TopLogprobs {
+			if want := utf8Values(alt.Token); !slices.Equal(alt.Bytes, want) {
+				t.Errorf("top token %q bytes = %v, want %v", alt.Token, alt.Bytes, want)
+			}
+		}
+	}
+	if got := lp.Content[1].Bytes; !slices.Equal(got, []int{0x20, 0xc3, 0xa9}) {
+		t.Errorf("bytes of \" é\" = %v, want [32 195 169]", got)
+	}
+	// A step without alternatives still gets an empty list, not null
+	if lp.Content[2].TopLogprobs == nil {
+		t.Error("top_logprobs is nil for a step without alternatives")
+	}
+}
+
+func TestFillLogprobBytes(t *testing.T) {
+	lp := &ChoiceLogprobs{Content: []TokenLogprob{
+		{Token: "ü", TopLogprobs: []TopLogprob{{Token: "u"}}},
+		{Token: "x", Bytes: []int{120}, TopLogprobs: []TopLogprob{}},
+	}}
+	if !FillLogprobBytes(lp) {
+		t.Fatal("FillLogprobBytes reported no change")
+	}
+	if got := lp.Content[0].Bytes; !slices.Equal(got, []int{0xc3, 0xbc}) {
+		t.Errorf("bytes of ü = %v, want [195 188]", got)
+	}
+	if got := lp.Content[0].TopLogprobs[0].Bytes; !slices.Equal(got, []int{'u'}) {
+		t.Errorf("bytes of top token u = %v, want [117]", got)
+	}
+	if FillLogprobBytes(lp) {
+		t.Error("FillLogprobBytes changed an already complete result")
+	}
+}
+
+// utf8Values returns the UTF-8 encoding of s as ints
+func utf8Values(s string) []int {
+	var values []int
+	for _, b := range []byte(s) {
+		values = append(values, int(b))
+	}
+	return values
+}
@@ -0,0 +1,220 @@
+package translate
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/vertex"
+)
+
+// Remote media fetching for content parts given by URL.
+//
+// Vertex only accepts inline data (or gs:// URIs), so http(s) URLs are fetched
+// by the proxy and base64-encoded. Requests are limited to public addresses:
+// the dialer rejects loopback, private, link-local and unspecified IPs after
+// DNS resolution, so redirects and rebinding cannot reach internal services.
+// Bodies larger than MEDIA_FETCH_MAX_BYTES are rejected.
+
+const mediaFetchTimeout = 30 * time.Second
+
+var mediaClient = newMediaClient(denyPrivateAddress)
+
+// newMediaClient returns the media fetch client; control vets every address
+// it dials (tests pass nil to reach a local stub server)
+func newMediaClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	return &http.Client{
+		Timeout: mediaFetchTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: control,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// denyPrivateAddress refuses connections to non-public IPs
+func denyPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("media fetch to non-public address %s refused", host)
+	}
+	return nil
+}
+
+// isRemoteURL reports whether s is an http(s) URL
+func isRemoteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// fetchMedia downloads a remote URL and returns it as an inline data part.
+// fallbackMime is used when the response has no usable Content-Type.
+func fetchMedia(ctx context.Context, rawURL, fallbackMime string) (*vertex.Part, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid media URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media fetch returned status %d", resp.StatusCode)
+	}
+
+	limit := config.Get().MediaFetchMaxBytes
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("media exceeds %d bytes", limit)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("media exceeds %d bytes", limit)
+	}
+
+	mimeType := fallbackMime
+	if ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && ct != "application/octet-stream" {
+		mimeType = ct
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	return &vertex.Part{
+		InlineData: &vertex.InlineData{
+			MimeType: mimeType,
+			Data:     base64.StdEncoding.EncodeToString(data),
+		},
+	}, nil
+}
+
+// MediaFetchError reports a content part whose URL could not be fetched
+type MediaFetchError struct {
+	PartType string // input_audio or file
+	Host     string
+	Err      error
+}
+
+func (e *MediaFetchError) Error() string {
+	return fmt.Sprintf("failed to fetch %s part from %s: %v", e.PartType, e.Host, e.Err)
+}
+
+func (e *MediaFetchError) Unwrap() error {
+	return e.Err
+}
+
+// fetchMediaPart fetches a remote content part of the given type within the
+// request's ctx
+func fetchMediaPart(ctx context.Context, partType, rawURL, fallbackMime string) (*vertex.Part, error) {
+	ctx, cancel := context.WithTimeout(ctx, mediaFetchTimeout)
+	defer cancel()
+
+	part, err := fetchMedia(ctx, rawURL, fallbackMime)
+	if err != nil {
+		log.Printf("Media fetch failed: type=%s, host=%s, error=%v", partType, mediaHost(rawURL), err)
+		return nil, &MediaFetchError{PartType: partType, Host: mediaHost(rawURL), Err: err}
+	}
+	return part, nil
+}
+
+// mediaHost returns the URL host for logging; paths may carry signed tokens
+func mediaHost(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// audioMimeType maps an OpenAI input_audio format to a MIME type
+func audioMimeType(format string) string {
+	switch strings.ToLower(format) {
+	case "":
+		return ""
+	case "mp3":
+		return "audio/mp3"
+	case "pcm16":
+		return "audio/l16"
+	default:
+		return "audio/" + strings.ToLower(format)
+	}
+}
+
+// convertInputAudio converts an input_audio part; data may be base64 or an http(s) URL
+func convertInputAudio(ctx context.Context, audio map[string]interface{}) (*vertex.Part, error) {
+	format, _ := audio["format"].(string)
+	data, _ := audio["data"].(string)
+	if u, ok := audio["url"].(string); ok && data == "" {
+		data = u
+	}
+
+	switch {
+	case data == "":
+		return nil, nil
+	case isRemoteURL(data):
+		return fetchMediaPart(ctx, "input_audio", data, audioMimeType(format))
+	case strings.HasPrefix(data, "data:"):
+		return parseDataURL(data), nil
+	default:
+		mimeType := audioMimeType(format)
+		if mimeType == "" {
+			mimeType = "audio/wav"
+		}
+		return &vertex.Part{InlineData: &vertex.InlineData{MimeType: mimeType, Data: data}}, nil
+	}
+}
+
+// convertFilePart converts a file part given as a data URL or an http(s) URL
+func convertFilePart(ctx context.Context, file map[string]interface{}) (*vertex.Part, error) {
+	data, _ := file["file_data"].(string)
+	if u, ok := file["url"].(string); ok && data == "" {
+		data = u
+	}
+
+	switch {
+	case isRemoteURL(data):
+		return fetchMediaPart(ctx, "file", data, "")
+	case strings.HasPrefix(data, "data:"):
+		return parseDataURL(data), nil
+	default:
+		return nil, nil
+	}
+}
+
+// parseDataURL converts a base64 data URL of any media type to an inline data part
+func parseDataURL(dataURL string) *vertex.Part {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(dataURL, "data:"), ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return nil
+	}
+	mimeType := strings.TrimSuffix(meta, ";base64")
+	if mimeType == "" {
+		return nil
+	}
+	return &vertex.Part{InlineData: &vertex.InlineData{MimeType: mimeType, Data: data}}
+}
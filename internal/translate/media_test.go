@@ -0,0 +1,94 @@
+package translate
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+// audioRequest is a user turn with text and one content part
+func audioRequest(part map[string]interface{}) *ChatCompletionRequest {
+	return &ChatCompletionRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: []interface{}{
+				map[string]interface{}{"type": "text", "text": "transcribe"},
+				part,
+			}},
+		},
+	}
+}
+
+func TestMediaURLParts(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.MediaFetchMaxBytes = 1024 })
+	audio := []byte("RIFF....WAVEfmt fake audio")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/clip.wav":
+			w.Header().Set("Content-Type", "audio/wav")
+			w.Write(audio)
+		case "/big.wav":
+			w.Header().Set("Content-Type", "audio/wav")
+			w.Write(make([]byte, 2048))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("loopback refused", func(t *testing.T) {
+		part := map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"url": srv.URL + "/clip.wav"}}
+		_, _, err := ToGeminiRequest(context.Background(), audioRequest(part))
+		var mediaErr *MediaFetchError
+		if !errors.As(err, &mediaErr) || !strings.Contains(err.Error(), "non-public address") {
+			t.Fatalf("err = %v, want a MediaFetchError refusing the loopback address", err)
+		}
+	})
+
+	// Past the address check, the stub server stands in for a public host
+	prev := mediaClient
+	mediaClient = newMediaClient(nil)
+	defer func() { mediaClient = prev }()
+
+	tests := []struct {
+		name    string
+		part    map[string]interface{}
+		wantErr string // substring of the error, empty on success
+	}{
+		{"input_audio url", map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"data": srv.URL + "/clip.wav", "format": "mp3"}}, ""},
+		{"file url", map[string]interface{}{"type": "file", "file": map[string]interface{}{"url": srv.URL + "/clip.wav"}}, ""},
+		{"not found", map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"url": srv.URL + "/missing.wav"}}, "messages[1]: content[1]: failed to fetch input_audio part"},
+		{"over the size limit", map[string]interface{}{"type": "file", "file": map[string]interface{}{"url": srv.URL + "/big.wav"}}, "messages[1]: content[1]: failed to fetch file part"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			geminiReq, _, err := ToGeminiRequest(context.Background(), audioRequest(tt.part))
+			if tt.wantErr != "" {
+				var mediaErr *MediaFetchError
+				if !errors.As(err, &mediaErr) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want a MediaFetchError containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := geminiReq.Contents[0].Parts
+			if len(parts) != 2 || parts[1].InlineData == nil {
+				t.Fatalf("parts = %+v, want text and inline data", parts)
+			}
+			inline := parts[1].InlineData
+			// The response Content-Type wins over the declared format
+			if inline.MimeType != "audio/wav" || inline.Data != base64.StdEncoding.EncodeToString(audio) {
+				t.Errorf("inline data = %s %q, want the fetched audio/wav bytes", inline.MimeType, inline.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package translate
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestModalities(t *testing.T) {
+	t.Run("request mapping", func(t *testing.T) {
+		req := &ChatCompletionRequest{
+			Model:      "gemini-2.5-flash-preview-tts",
+			Messages:   []Message{{Role: "user", Content: "say hi"}},
+			Modalities: []string{"text", "audio"},
+		}
+		geminiReq, _, err := ToGeminiRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := geminiReq.GenerationConfig.ResponseModalities; !slices.Equal(got, []string{"TEXT", "AUDIO"}) {
+			t.Errorf("responseModalities = %v, want [TEXT AUDIO]", got)
+		}
+	})
+
+	t.Run("capability check", func(t *testing.T) {
+		tests := []struct {
+			model      string
+			modalities []string
+			wantErr    bool
+		}{
+			{"gemini-2.5-flash", []string{"text"}, false},
+			{"gemini-2.5-flash-preview-tts", []string{"text", "audio"}, false},
+			{"gemini-2.5-flash", []string{"audio"}, true},
+			{"gemini-2.5-flash-image", []string{"image"}, false},
+			{"gemini-2.5-flash", []string{"image"}, true},
+			{"gemini-2.5-flash", []string{"video"}, true},
+		}
+		for _, tt := range tests {
+			err := ValidateModalities(tt.model, tt.modalities)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateModalities(%s, %v) = %v, want error %v", tt.model, tt.modalities, err, tt.wantErr)
+			}
+		}
+	})
+
+	t.Run("audio response", func(t *testing.T) {
+		candidate := vertex.Candidate{Content: &vertex.Content{Role: "model", Parts: []vertex.Part{
+			{Text: "here you go"},
+			{InlineData: &vertex.InlineData{MimeType: "audio/wav", Data: "UklGRg=="}},
+		}}}
+		resp := FromGeminiResponse(&vertex.GeminiResponse{Candidates: []vertex.Candidate{candidate}}, "m", "id")
+		audio := resp.Choices[0].Message.Audio
+		if audio == nil || audio.Data != "UklGRg==" || audio.Format != "wav" || audio.ID == "" {
+			t.Fatalf("audio = %+v, want the base64 wav data", audio)
+		}
+		if content := resp.Choices[0].Message.Content; content != "here you go" {
+			t.Errorf("content = %q, want the text part alone", content)
+		}
+	})
+}
@@ -1,11 +1,14 @@
 package translate
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"regexp"
 	"strings"
 
+	"vertex2api-golang/internal/config"
 	"vertex2api-golang/internal/models"
 	"vertex2api-golang/internal/vertex"
 )
@@ -14,28 +17,52 @@ import (
 
 // ChatCompletionRequest represents OpenAI chat completion request
 type ChatCompletionRequest struct {
-	Model            string                 `json:"model"`
-	Messages         []Message              `json:"messages"`
-	Temperature      *float64               `json:"temperature,omitempty"`
-	TopP             *float64               `json:"top_p,omitempty"`
-	TopK             *int                   `json:"top_k,omitempty"`
-	N                *int                   `json:"n,omitempty"`
-	Stream           bool                   `json:"stream,omitempty"`
-	Stop             interface{}            `json:"stop,omitempty"`
-	MaxTokens        *int                   `json:"max_tokens,omitempty"`
-	MaxCompletionTokens *int                `json:"max_completion_tokens,omitempty"`
-	PresencePenalty  *float64               `json:"presence_penalty,omitempty"`
-	FrequencyPenalty *float64               `json:"frequency_penalty,omitempty"`
-	LogitBias        map[string]float64     `json:"logit_bias,omitempty"`
-	User             string                 `json:"user,omitempty"`
-	Tools            []OpenAITool           `json:"tools,omitempty"`
-	ToolChoice       interface{}            `json:"tool_choice,omitempty"`
-	ResponseFormat   *ResponseFormat        `json:"response_format,omitempty"`
-	Seed             *int                   `json:"seed,omitempty"`
-	Logprobs         *bool                  `json:"logprobs,omitempty"`
-	TopLogprobs      *int                   `json:"top_logprobs,omitempty"`
+	Model               string             `json:"model"`
+	Messages            []Message          `json:"messages"`
+	Temperature         *float64           `json:"temperature,omitempty"`
+	TopP                *float64           `json:"top_p,omitempty"`
+	TopK                *int               `json:"top_k,omitempty"`
+	N                   *int               `json:"n,omitempty"`
+	Stream              bool               `json:"stream,omitempty"`
+	Stop                interface{}        `json:"stop,omitempty"`
+	MaxTokens           *int               `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int               `json:"max_completion_tokens,omitempty"`
+	PresencePenalty     *float64           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64           `json:"frequency_penalty,omitempty"`
+	LogitBias           map[string]float64 `json:"logit_bias,omitempty"`
+	User                string             `json:"user,omitempty"`
+	Tools               []OpenAITool       `json:"tools,omitempty"`
+	ToolChoice          interface{}        `json:"tool_choice,omitempty"`
+	ResponseFormat      *ResponseFormat    `json:"response_format,omitempty"`
+	Seed                *int               `json:"seed,omitempty"`
+	Logprobs            *bool              `json:"logprobs,omitempty"`
+	TopLogprobs         *int               `json:"top_logprobs,omitempty"`
 	// Extended fields
 	SafetySettings   []vertex.SafetySetting `json:"safety_settings,omitempty"`
+	CachedContent    string                 `json:"cached_content,omitempty"`
+	Modalities       []string               `json:"modalities,omitempty"`
+	Labels           map[string]string      `json:"labels,omitempty"`
+	IncludeReasoning *bool                  `json:"include_reasoning,omitempty"`
+	// Deprecated OpenAI function calling fields, see applyLegacyFunctions
+	Functions    []OpenAIFunction `json:"functions,omitempty"`
+	FunctionCall interface{}      `json:"function_call,omitempty"`
+}
+
+// ReasoningEnabled reports whether reasoning should be returned for this
+// request (include_reasoning defaults to true)
+func (r *ChatCompletionRequest) ReasoningEnabled() bool {
+	return r.IncludeReasoning == nil || *r.IncludeReasoning
+}
+
+// DropReasoning removes reasoning content from a response, for requests with
+// include_reasoning=false
+func DropReasoning(resp *ChatCompletionResponse) {
+	for i := range resp.Choices {
+		if resp.Choices[i].Message != nil {
+			resp.Choices[i].Message.ReasoningContent = ""
+			resp.Choices[i].Message.Reasoning = nil
+		}
+	}
 }
 
 // Message represents an OpenAI message
@@ -62,21 +89,23 @@ type ImageURL struct {
 
 // ToolCall represents an OpenAI tool call
 type ToolCall struct {
-	ID       string       `json:"id"`
-	Type     string       `json:"type"`
+	Index    *int         `json:"index,omitempty"` // Position in a streamed delta
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
 	Function FunctionCall `json:"function"`
 }
 
 // FunctionCall represents a function call
 type FunctionCall struct {
-	Name      string `json:"name"`
+	Name      string `json:"name,omitempty"`
 	Arguments string `json:"arguments"`
 }
 
 // OpenAITool represents an OpenAI tool
 type OpenAITool struct {
-	Type     string           `json:"type"`
-	Function OpenAIFunction   `json:"function"`
+	Type       string          `json:"type"`
+	Function   OpenAIFunction  `json:"function"`
+	FileSearch *FileSearchTool `json:"file_search,omitempty"`
 }
 
 // OpenAIFunction represents an OpenAI function definition
@@ -104,27 +133,57 @@ type ChatCompletionResponse struct {
 
 // Choice represents a response choice
 type Choice struct {
-	Index        int            `json:"index"`
-	Message      *ResponseMsg   `json:"message,omitempty"`
-	Delta        *ResponseMsg   `json:"delta,omitempty"`
-	FinishReason string         `json:"finish_reason,omitempty"`
-	Logprobs     interface{}    `json:"logprobs,omitempty"`
+	Index        int          `json:"index"`
+	Message      *ResponseMsg `json:"message,omitempty"`
+	Delta        *ResponseMsg `json:"delta,omitempty"`
+	FinishReason string       `json:"finish_reason,omitempty"`
+	Logprobs     interface{}  `json:"logprobs,omitempty"`
 }
 
 // ResponseMsg represents response message
 type ResponseMsg struct {
-	Role             string     `json:"role,omitempty"`
-	Content          string     `json:"content,omitempty"`
-	ReasoningContent string     `json:"reasoning_content,omitempty"`
-	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	Role             string `json:"role,omitempty"`
+	Content          string `json:"content,omitempty"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// Reasoning replaces ReasoningContent with REASONING_SHAPE=object
+	Reasoning *ReasoningObject `json:"reasoning,omitempty"`
+	ToolCalls []ToolCall       `json:"tool_calls,omitempty"`
+	Audio     *AudioOutput     `json:"audio,omitempty"`
+	// Annotations carries grounding citations as OpenAI url_citation entries
+	Annotations []Annotation `json:"annotations,omitempty"`
+	// ContentParts, when set, replaces Content with an array of parts for
+	// mixed text and image responses
+	ContentParts []ContentPart `json:"-"`
+}
+
+// AudioOutput is the OpenAI assistant audio payload
+type AudioOutput struct {
+	ID     string `json:"id"`
+	Data   string `json:"data"`   // base64 encoded
+	Format string `json:"format"` // wav, mp3, pcm16, ...
+}
+
+// MarshalJSON serializes content as a part array when ContentParts is set,
+// and as a plain string otherwise
+func (m ResponseMsg) MarshalJSON() ([]byte, error) {
+	type plain ResponseMsg
+	if len(m.ContentParts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), m.ContentParts})
 }
 
 // Usage represents token usage
 type Usage struct {
-	PromptTokens            int `json:"prompt_tokens"`
-	CompletionTokens        int `json:"completion_tokens"`
-	TotalTokens             int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
 	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+	// Estimated marks usage approximated by the proxy because upstream sent none
+	Estimated bool `json:"estimated,omitempty"`
 }
 
 // CompletionTokensDetails contains detailed completion token info
@@ -132,28 +191,42 @@ type CompletionTokensDetails struct {
 	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
 }
 
-// ToGeminiRequest converts OpenAI request to Gemini request
-func ToGeminiRequest(oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, string) {
+// ToGeminiRequest converts OpenAI request to Gemini request. Remote media
+// parts are fetched within ctx; a part that cannot be fetched fails the
+// request with a *MediaFetchError. It also fails when the request has more
+// tools than MAX_TOOLS.
+func ToGeminiRequest(ctx context.Context, oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, string, error) {
 	geminiReq := &vertex.GeminiRequest{}
+	oaiReq.applyLegacyFunctions()
 
 	// Resolve model alias
 	actualModel, alias := models.ResolveModel(oaiReq.Model)
 
+	// Parameters the model rejects would fail the whole request
+	if dropped := oaiReq.dropUnsupportedParams(actualModel); len(dropped) > 0 {
+		log.Printf("ToGeminiRequest: dropped unsupported parameters for %s: %v", actualModel, dropped)
+	}
+
 	// Convert messages
 	var systemParts []vertex.Part
 	var contents []vertex.Content
 
-	for _, msg := range oaiReq.Messages {
+	for i, msg := range oaiReq.Messages {
 		switch msg.Role {
 		case "system":
-			// Collect system messages
-			text := extractTextContent(msg.Content)
-			if text != "" {
-				systemParts = append(systemParts, vertex.Part{Text: text})
+			// Collect system messages; non-text parts such as reference
+			// images are kept in the system instruction as well
+			parts, err := convertContentToParts(ctx, msg.Content)
+			if err != nil {
+				return nil, "", fmt.Errorf("messages[%d]: %w", i, err)
 			}
+			systemParts = append(systemParts, parts...)
 
 		case "user":
-			parts := convertContentToParts(msg.Content)
+			parts, err := convertContentToParts(ctx, msg.Content)
+			if err != nil {
+				return nil, "", fmt.Errorf("messages[%d]: %w", i, err)
+			}
 			if len(parts) > 0 {
 				contents = append(contents, vertex.Content{
 					Role:  "user",
@@ -193,21 +266,27 @@ func ToGeminiRequest(oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, stri
 			}
 
 		case "tool":
-			// Tool response
+			// Tool response. Content may be a string or a content-part array;
+			// text parts form the function response, while image parts follow
+			// it as inlineData parts in the same user turn:
+			//   {role: user, parts: [{functionResponse}, {inlineData}, ...]}
 			var respData map[string]interface{}
 			text := extractTextContent(msg.Content)
 			if err := json.Unmarshal([]byte(text), &respData); err != nil {
 				respData = map[string]interface{}{"result": text}
 			}
 
+			parts := []vertex.Part{{
+				FunctionResponse: &vertex.FunctionResponse{
+					Name:     msg.Name,
+					Response: respData,
+				},
+			}}
+			parts = append(parts, extractImageParts(ctx, msg.Content)...)
+
 			contents = append(contents, vertex.Content{
-				Role: "user",
-				Parts: []vertex.Part{{
-					FunctionResponse: &vertex.FunctionResponse{
-						Name:     msg.Name,
-						Response: respData,
-					},
-				}},
+				Role:  "user",
+				Parts: parts,
 			})
 		}
 	}
@@ -241,6 +320,8 @@ func ToGeminiRequest(oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, stri
 	}
 	if maxTokens != nil {
 		geminiReq.GenerationConfig.MaxOutputTokens = maxTokens
+	} else if def := config.Get().DefaultMaxOutputTokens; def > 0 {
+		geminiReq.GenerationConfig.MaxOutputTokens = &def
 	}
 
 	// Stop sequences
@@ -262,6 +343,19 @@ func ToGeminiRequest(oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, stri
 		geminiReq.GenerationConfig.CandidateCount = oaiReq.N
 	}
 
+	// Output modalities
+	for _, m := range oaiReq.Modalities {
+		geminiReq.GenerationConfig.ResponseModalities = append(geminiReq.GenerationConfig.ResponseModalities, strings.ToUpper(m))
+	}
+
+	// Logprobs
+	if oaiReq.Logprobs != nil && *oaiReq.Logprobs {
+		geminiReq.GenerationConfig.ResponseLogprobs = true
+		if oaiReq.TopLogprobs != nil {
+			geminiReq.GenerationConfig.Logprobs = oaiReq.TopLogprobs
+		}
+	}
+
 	// Response format
 	if oaiReq.ResponseFormat != nil && oaiReq.ResponseFormat.Type == "json_object" {
 		geminiReq.GenerationConfig.ResponseMimeType = "application/json"
@@ -274,27 +368,41 @@ func ToGeminiRequest(oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, stri
 			budget = 8192
 		}
 		geminiReq.GenerationConfig.ThinkingConfig = &vertex.ThinkingConfig{
-			ThinkingBudget: budget,
+			ThinkingBudget: &budget,
 		}
 	}
 
-	// Convert tools
+	// Convert tools; a repeated function name keeps its first declaration.
+	// Callers reject unsupported tool types with ValidateTools first.
 	if len(oaiReq.Tools) > 0 {
 		var funcDecls []vertex.FunctionDeclaration
+		seen := make(map[string]bool)
+		kept := 0
 		for _, tool := range oaiReq.Tools {
+			if tool.Function.Name != "" && seen[tool.Function.Name] {
+				continue
+			}
+			kept++
 			if tool.Type == "function" {
+				seen[tool.Function.Name] = true
 				funcDecls = append(funcDecls, vertex.FunctionDeclaration{
 					Name:        tool.Function.Name,
 					Description: tool.Function.Description,
-					Parameters:  tool.Function.Parameters,
+					Parameters:  SanitizeSchema(tool.Function.Parameters),
 				})
 			}
 		}
+		if err := checkToolCount(kept); err != nil {
+			return nil, actualModel, err
+		}
 		if len(funcDecls) > 0 {
 			geminiReq.Tools = []vertex.Tool{{
 				FunctionDeclarations: funcDecls,
 			}}
 		}
+		if retrieval, err := convertRetrievalTools(oaiReq.Tools); err == nil && retrieval != nil {
+			geminiReq.Tools = append(geminiReq.Tools, vertex.Tool{Retrieval: retrieval})
+		}
 	}
 
 	// Tool choice
@@ -302,12 +410,95 @@ func ToGeminiRequest(oaiReq *ChatCompletionRequest) (*vertex.GeminiRequest, stri
 		geminiReq.ToolConfig = convertToolChoice(oaiReq.ToolChoice)
 	}
 
-	// Safety settings
+	// Safety settings: the client's, else the model family's
 	if len(oaiReq.SafetySettings) > 0 {
 		geminiReq.SafetySettings = oaiReq.SafetySettings
+	} else {
+		geminiReq.SafetySettings = vertex.SafetySettingsFor(actualModel)
+	}
+
+	// Billing labels (callers validate with vertex.ValidateLabels)
+	if len(oaiReq.Labels) > 0 {
+		geminiReq.Labels = oaiReq.Labels
 	}
 
-	return geminiReq, actualModel
+	// Context cache reference (invalid names are dropped; callers should validate first)
+	if oaiReq.CachedContent != "" && vertex.ValidateCachedContentName(oaiReq.CachedContent) == nil {
+		geminiReq.CachedContent = oaiReq.CachedContent
+	}
+
+	return geminiReq, actualModel, nil
+}
+
+// DedupeTools drops tools whose function name repeats an earlier tool and
+// rejects lists longer than MAX_TOOLS. Tools are raw JSON so that fields the
+// proxy does not model are forwarded untouched. It returns the kept tools and
+// how many duplicates were dropped.
+func DedupeTools(tools []json.RawMessage) ([]json.RawMessage, int, error) {
+	kept := make([]json.RawMessage, 0, len(tools))
+	seen := make(map[string]bool)
+	for _, raw := range tools {
+		var tool OpenAITool
+		if err := json.Unmarshal(raw, &tool); err == nil && tool.Function.Name != "" {
+			if seen[tool.Function.Name] {
+				continue
+			}
+			seen[tool.Function.Name] = true
+		}
+		kept = append(kept, raw)
+	}
+
+	if err := checkToolCount(len(kept)); err != nil {
+		return nil, 0, err
+	}
+	return kept, len(tools) - len(kept), nil
+}
+
+// checkToolCount rejects more distinct tools than MAX_TOOLS allows
+func checkToolCount(count int) error {
+	if limit := config.Get().MaxTools; limit > 0 && count > limit {
+		return fmt.Errorf("too many tools: %d (maximum is %d)", count, limit)
+	}
+	return nil
+}
+
+// ValidateModalities rejects output modalities the target model cannot produce
+func ValidateModalities(model string, modalities []string) error {
+	for _, m := range modalities {
+		switch strings.ToLower(m) {
+		case "text":
+		case "audio":
+			if !models.SupportsAudioOutput(model) {
+				return fmt.Errorf("model %s does not support audio output", model)
+			}
+		case "image":
+			if !models.SupportsImageOutput(model) {
+				return fmt.Errorf("model %s does not support image output", model)
+			}
+		default:
+			return fmt.Errorf("unsupported modality %q", m)
+		}
+	}
+	return nil
+}
+
+// audioFormat maps an audio MIME type to the OpenAI audio format name
+func audioFormat(mimeType string) string {
+	mimeType = strings.ToLower(mimeType)
+	switch {
+	case strings.Contains(mimeType, "wav"):
+		return "wav"
+	case strings.Contains(mimeType, "mpeg"), strings.Contains(mimeType, "mp3"):
+		return "mp3"
+	case strings.Contains(mimeType, "ogg"), strings.Contains(mimeType, "opus"):
+		return "opus"
+	case strings.Contains(mimeType, "flac"):
+		return "flac"
+	case strings.Contains(mimeType, "l16"), strings.Contains(mimeType, "pcm"):
+		return "pcm16"
+	default:
+		return strings.TrimPrefix(mimeType, "audio/")
+	}
 }
 
 // extractTextContent extracts text from OpenAI content field.
@@ -343,62 +534,99 @@ func extractTextFromParts(parts []interface{}) string {
 	return strings.Join(texts, "\n")
 }
 
+// extractImageParts returns the image parts of an array content as inlineData parts
+func extractImageParts(ctx context.Context, content interface{}) []vertex.Part {
+	items, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var parts []vertex.Part
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok || m["type"] != "image_url" {
+			continue
+		}
+		// Image parts are inline and never fetched, so they cannot fail
+		if part, err := convertSingleContentPart(ctx, m); err == nil && part != nil {
+			parts = append(parts, *part)
+		}
+	}
+	return parts
+}
+
 // convertContentToParts converts OpenAI content to Gemini parts.
 // Content can be either a string or an array of content parts.
-func convertContentToParts(content interface{}) []vertex.Part {
+func convertContentToParts(ctx context.Context, content interface{}) ([]vertex.Part, error) {
 	switch v := content.(type) {
 	case nil:
-		return nil
+		return nil, nil
 	case string:
 		if v == "" {
-			return nil
+			return nil, nil
 		}
-		return []vertex.Part{{Text: v}}
+		return []vertex.Part{{Text: v}}, nil
 	case []interface{}:
-		return convertContentArrayToParts(v)
+		return convertContentArrayToParts(ctx, v)
 	default:
-		return nil
+		return nil, nil
 	}
 }
 
-// convertContentArrayToParts handles array content conversion
-func convertContentArrayToParts(items []interface{}) []vertex.Part {
+// convertContentArrayToParts handles array content conversion. It fails when
+// a part given by URL cannot be fetched.
+func convertContentArrayToParts(ctx context.Context, items []interface{}) ([]vertex.Part, error) {
 	var parts []vertex.Part
-	for _, item := range items {
+	for i, item := range items {
 		m, ok := item.(map[string]interface{})
 		if !ok {
 			continue
 		}
-		part := convertSingleContentPart(m)
+		part, err := convertSingleContentPart(ctx, m)
+		if err != nil {
+			return nil, fmt.Errorf("content[%d]: %w", i, err)
+		}
 		if part != nil {
 			parts = append(parts, *part)
 		}
 	}
-	return parts
+	return parts, nil
 }
 
 // convertSingleContentPart converts a single content part map to a Gemini Part
-func convertSingleContentPart(m map[string]interface{}) *vertex.Part {
+func convertSingleContentPart(ctx context.Context, m map[string]interface{}) (*vertex.Part, error) {
 	partType, _ := m["type"].(string)
 	switch partType {
 	case "text":
 		text, ok := m["text"].(string)
 		if !ok || text == "" {
-			return nil
+			return nil, nil
 		}
-		return &vertex.Part{Text: text}
+		return &vertex.Part{Text: text}, nil
 	case "image_url":
 		imgURL, ok := m["image_url"].(map[string]interface{})
 		if !ok {
-			return nil
+			return nil, nil
 		}
 		url, ok := imgURL["url"].(string)
 		if !ok {
-			return nil
+			return nil, nil
 		}
-		return parseImageURL(url)
+		return parseImageURL(url), nil
+	case "input_audio":
+		audio, ok := m["input_audio"].(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		return convertInputAudio(ctx, audio)
+	case "file":
+		file, ok := m["file"].(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		return convertFilePart(ctx, file)
 	default:
-		return nil
+		return nil, nil
 	}
 }
 
@@ -475,7 +703,7 @@ func convertToolChoice(toolChoice interface{}) *vertex.ToolConfig {
 func FromGeminiResponse(geminiResp *vertex.GeminiResponse, model string, requestID string) *ChatCompletionResponse {
 	resp := &ChatCompletionResponse{
 		ID:      requestID,
-		Object:  "chat.completion",
+		Object:  ObjectChatCompletion,
 		Created: 0, // Will be set by caller
 		Model:   model,
 		Choices: make([]Choice, 0),
@@ -484,31 +712,72 @@ func FromGeminiResponse(geminiResp *vertex.GeminiResponse, model string, request
 	if geminiResp == nil {
 		return resp
 	}
+	resp.SystemFingerprint = SystemFingerprint(geminiResp.ModelVersion)
 
 	// Convert candidates to choices
 	for i, candidate := range geminiResp.Candidates {
+		// Candidates carry their own index when n>1; it may be omitted otherwise
+		index := i
+		if candidate.Index > 0 {
+			index = candidate.Index
+		}
 		choice := Choice{
-			Index:        i,
+			Index:        index,
 			FinishReason: mapFinishReason(candidate.FinishReason),
 			Message:      &ResponseMsg{Role: "assistant"},
 		}
 
+		if lp := convertLogprobs(candidate.LogprobsResult); lp != nil {
+			choice.Logprobs = lp
+		}
+
 		if candidate.Content != nil {
 			var textParts []string
 			var reasoningParts []string
+			// Ordered text and image parts, used only when images are present
+			var mixedParts []ContentPart
+			hasImage := false
+			// Text as generated, and the ranges of it the client won't see
+			var generated strings.Builder
+			var hidden []textRange
 
 			for _, part := range candidate.Content.Parts {
 				if part.Text != "" {
+					for _, r := range hiddenRanges(part.Text, true) {
+						hidden = append(hidden, textRange{generated.Len() + r.start, generated.Len() + r.end})
+					}
+					generated.WriteString(part.Text)
+
 					// Check for thinking tags
 					text, reasoning := extractThinking(part.Text)
 					if text != "" {
 						textParts = append(textParts, text)
+						mixedParts = append(mixedParts, ContentPart{Type: "text", Text: text})
 					}
 					if reasoning != "" {
 						reasoningParts = append(reasoningParts, reasoning)
 					}
 				}
 
+				if part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "audio/") {
+					choice.Message.Audio = &AudioOutput{
+						ID:     "audio_" + randomID(16),
+						Data:   part.InlineData.Data,
+						Format: audioFormat(part.InlineData.MimeType),
+					}
+					continue
+				}
+
+				if part.InlineData != nil {
+					hasImage = true
+					mixedParts = append(mixedParts, ContentPart{
+						Type: "image_url",
+						ImageURL: &ImageURL{
+							URL: "data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data,
+						},
+					})
+				}
+
 				if part.FunctionCall != nil {
 					args, err := json.Marshal(part.FunctionCall.Args)
 					if err != nil {
@@ -526,31 +795,52 @@ func FromGeminiResponse(geminiResp *vertex.GeminiResponse, model string, request
 			}
 
 			choice.Message.Content = strings.Join(textParts, "")
+			if hasImage {
+				choice.Message.ContentParts = mixedParts
+			}
+			choice.Message.Annotations = candidateAnnotations(candidate, generated.String(), hidden, true)
 			if len(reasoningParts) > 0 {
-				choice.Message.ReasoningContent = strings.Join(reasoningParts, "")
+				choice.Message.setReasoning(strings.Join(reasoningParts, ""))
 			}
 		}
 
+		// Gemini reports STOP after a function call; OpenAI clients expect tool_calls
+		if len(choice.Message.ToolCalls) > 0 && choice.FinishReason == "stop" {
+			choice.FinishReason = "tool_calls"
+		}
+
 		resp.Choices = append(resp.Choices, choice)
 	}
 
 	// Convert usage
-	if geminiResp.UsageMetadata != nil {
-		resp.Usage = &Usage{
-			PromptTokens:     geminiResp.UsageMetadata.PromptTokenCount,
-			CompletionTokens: geminiResp.UsageMetadata.CandidatesTokenCount,
-			TotalTokens:      geminiResp.UsageMetadata.TotalTokenCount,
-		}
-		if geminiResp.UsageMetadata.ThoughtsTokenCount > 0 {
-			resp.Usage.CompletionTokensDetails = &CompletionTokensDetails{
-				ReasoningTokens: geminiResp.UsageMetadata.ThoughtsTokenCount,
-			}
-		}
-	}
+	resp.Usage = ConvertUsage(geminiResp.UsageMetadata)
 
 	return resp
 }
 
+// ConvertUsage maps Gemini usage metadata to OpenAI usage, including reasoning tokens
+func ConvertUsage(meta *vertex.UsageMetadata) *Usage {
+	if meta == nil {
+		return nil
+	}
+
+	usage := &Usage{
+		PromptTokens:     meta.PromptTokenCount,
+		CompletionTokens: meta.CandidatesTokenCount,
+		TotalTokens:      meta.TotalTokenCount,
+	}
+	if meta.ThoughtsTokenCount > 0 {
+		usage.CompletionTokensDetails = &CompletionTokensDetails{
+			ReasoningTokens: meta.ThoughtsTokenCount,
+		}
+		// candidatesTokenCount already leaves thoughts out; the total does not
+		if !config.Get().BillReasoningTokens {
+			usage.TotalTokens = max(usage.TotalTokens-meta.ThoughtsTokenCount, 0)
+		}
+	}
+	return usage
+}
+
 // extractThinking extracts thinking content from text
 func extractThinking(text string) (content string, reasoning string) {
 	// Look for <vertex_think_tag> or similar thinking markers
@@ -574,6 +864,9 @@ func extractThinking(text string) (content string, reasoning string) {
 
 func mapFinishReason(geminiReason string) string {
 	switch geminiReason {
+	case "MALFORMED_FUNCTION_CALL":
+		// Not a real stop: the model tried to call a tool and produced invalid output
+		return FinishReasonMalformedCall
 	case "STOP":
 		return "stop"
 	case "MAX_TOKENS":
@@ -592,9 +885,17 @@ func mapFinishReason(geminiReason string) string {
 	}
 }
 
-var toolCallCounter int64
+// FinishReasonMalformedCall is reported when Gemini failed to produce a valid
+// function call (MALFORMED_FUNCTION_CALL); it is often transient
+const FinishReasonMalformedCall = "malformed_function_call"
+
+// IsMalformedFunctionCall reports whether a finish reason, in Gemini or OpenAI
+// spelling, signals a malformed function call
+func IsMalformedFunctionCall(finishReason string) bool {
+	return strings.EqualFold(finishReason, FinishReasonMalformedCall)
+}
 
+// generateToolCallID returns a unique "call_<random>" tool call ID
 func generateToolCallID() string {
-	toolCallCounter++
-	return "call_" + base64.RawURLEncoding.EncodeToString([]byte(string(rune(toolCallCounter))))[:8]
+	return "call_" + randomID(24)
 }
@@ -0,0 +1,155 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// useConfig makes a modified copy of the current config active for a test
+func useConfig(t *testing.T, modify func(c *config.Config)) {
+	t.Helper()
+	prev := config.Get()
+	next := *prev
+	modify(&next)
+	config.Override(&next)
+	t.Cleanup(func() { config.Override(prev) })
+}
+
+// functionTools returns count function tools named fn0, fn1, ...
+func functionTools(count int) []OpenAITool {
+	tools := make([]OpenAITool, count)
+	for i := range tools {
+		tools[i] = OpenAITool{Type: "function", Function: OpenAIFunction{Name: "fn" + strconv.Itoa(i)}}
+	}
+	return tools
+}
+
+func TestToGeminiRequestToolCap(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.MaxTools = 3 })
+
+	tests := []struct {
+		name      string
+		tools     []OpenAITool
+		wantErr   bool
+		wantDecls int
+	}{
+		{"under the cap", functionTools(2), false, 2},
+		{"at the cap", functionTools(3), false, 3},
+		{"over the cap", functionTools(4), true, 0},
+		{"duplicates do not count", append(functionTools(3), functionTools(3)...), false, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ChatCompletionRequest{
+				Model:    "gemini-2.5-flash",
+				Messages: []Message{{Role: "user", Content: "hi"}},
+				Tools:    tt.tools,
+			}
+			geminiReq, _, err := ToGeminiRequest(context.Background(), req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ToGeminiRequest succeeded, want a too many tools error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToGeminiRequest: %v", err)
+			}
+			if len(geminiReq.Tools) != 1 || len(geminiReq.Tools[0].FunctionDeclarations) != tt.wantDecls {
+				t.Errorf("Tools = %+v, want %d function declarations", geminiReq.Tools, tt.wantDecls)
+			}
+		})
+	}
+}
+
+func TestToGeminiRequestCachedContent(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short name", "cachedContents/abc-123", "cachedContents/abc-123"},
+		{"qualified name", "projects/p/locations/us-central1/cachedContents/abc", "projects/p/locations/us-central1/cachedContents/abc"},
+		{"malformed name is dropped", "caches/abc", ""},
+		{"unset", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ChatCompletionRequest{
+				Model:         "gemini-2.5-flash",
+				Messages:      []Message{{Role: "user", Content: "hi"}},
+				CachedContent: tt.in,
+			}
+			geminiReq, _, err := ToGeminiRequest(context.Background(), req)
+			if err != nil {
+				t.Fatalf("ToGeminiRequest: %v", err)
+			}
+			if geminiReq.CachedContent != tt.want {
+				t.Errorf("CachedContent = %q, want %q", geminiReq.CachedContent, tt.want)
+			}
+		})
+	}
+}
+
+func TestToGeminiRequestLabels(t *testing.T) {
+	labels := map[string]string{"team": "search", "env": "prod"}
+	req := &ChatCompletionRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []Message{{Role: "user", Content: "hi"}},
+		Labels:   labels,
+	}
+	geminiReq, _, err := ToGeminiRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ToGeminiRequest: %v", err)
+	}
+	if !maps.Equal(geminiReq.Labels, labels) {
+		t.Errorf("Labels = %v, want %v", geminiReq.Labels, labels)
+	}
+	body, _ := json.Marshal(geminiReq)
+	if !strings.Contains(string(body), `"labels":{"env":"prod","team":"search"}`) {
+		t.Errorf("request body %s does not carry the labels", body)
+	}
+}
+
+func TestToGeminiRequestDefaultMaxOutputTokens(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.DefaultMaxOutputTokens = 1000 })
+	n := 50
+	tests := []struct {
+		name string
+		req  ChatCompletionRequest
+		want int
+	}{
+		{"unset uses the default", ChatCompletionRequest{}, 1000},
+		{"max_tokens wins", ChatCompletionRequest{MaxTokens: &n}, 50},
+		{"max_completion_tokens wins", ChatCompletionRequest{MaxCompletionTokens: &n}, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Model = "gemini-2.5-flash"
+			req.Messages = []Message{{Role: "user", Content: "hi"}}
+			geminiReq, _, err := ToGeminiRequest(context.Background(), &req)
+			if err != nil {
+				t.Fatalf("ToGeminiRequest: %v", err)
+			}
+			if got := geminiReq.GenerationConfig.MaxOutputTokens; got == nil || *got != tt.want {
+				t.Errorf("MaxOutputTokens = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
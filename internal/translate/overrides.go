@@ -0,0 +1,114 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"vertex2api-golang/internal/models"
+	"vertex2api-golang/internal/vertex"
+)
+
+// Generation overrides from request headers.
+//
+//	X-Gen-Temperature      0-2, clamped
+//	X-Gen-Max-Tokens       at least 1
+//	X-Gen-Thinking-Budget  -1 (dynamic) or more, clamped to the model ceiling
+//
+// Headers take precedence over the request body, so a gateway or an A/B test
+// can adjust generation without rewriting bodies. Values that do not parse
+// are rejected rather than ignored.
+
+const (
+	HeaderGenTemperature    = "X-Gen-Temperature"
+	HeaderGenMaxTokens      = "X-Gen-Max-Tokens"
+	HeaderGenThinkingBudget = "X-Gen-Thinking-Budget"
+)
+
+// maxTemperature is the upper bound Gemini accepts
+const maxTemperature = 2.0
+
+// GenerationOverrides are header-supplied generation parameters; nil fields
+// leave the body's value alone
+type GenerationOverrides struct {
+	Temperature    *float64
+	MaxTokens      *int
+	ThinkingBudget *int
+}
+
+// ParseGenerationOverrides reads the X-Gen-* headers for a model
+func ParseGenerationOverrides(h http.Header, model string) (GenerationOverrides, error) {
+	var o GenerationOverrides
+
+	if v := strings.TrimSpace(h.Get(HeaderGenTemperature)); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return o, fmt.Errorf("invalid %s %q: must be a number", HeaderGenTemperature, v)
+		}
+		t = min(max(t, 0), maxTemperature)
+		o.Temperature = &t
+	}
+
+	if v := strings.TrimSpace(h.Get(HeaderGenMaxTokens)); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return o, fmt.Errorf("invalid %s %q: must be a positive integer", HeaderGenMaxTokens, v)
+		}
+		o.MaxTokens = &n
+	}
+
+	if v := strings.TrimSpace(h.Get(HeaderGenThinkingBudget)); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < -1 {
+			return o, fmt.Errorf("invalid %s %q: must be -1 (dynamic) or a non-negative integer", HeaderGenThinkingBudget, v)
+		}
+		if ceiling := models.ThinkingBudgetCeiling(model); ceiling > 0 && n > ceiling {
+			n = ceiling
+		}
+		o.ThinkingBudget = &n
+	}
+
+	return o, nil
+}
+
+// IsEmpty reports whether no override was given
+func (o GenerationOverrides) IsEmpty() bool {
+	return o.Temperature == nil && o.MaxTokens == nil && o.ThinkingBudget == nil
+}
+
+// ApplyRaw sets temperature and max tokens on a raw OpenAI request body. The
+// thinking budget travels in the google extension, which the caller builds.
+func (o GenerationOverrides) ApplyRaw(rawReq map[string]json.RawMessage) {
+	if o.Temperature != nil {
+		if b, err := json.Marshal(*o.Temperature); err == nil {
+			rawReq["temperature"] = b
+		}
+	}
+	if o.MaxTokens != nil {
+		if b, err := json.Marshal(*o.MaxTokens); err == nil {
+			rawReq["max_tokens"] = b
+			delete(rawReq, "max_completion_tokens")
+		}
+	}
+}
+
+// ApplyGemini sets the overrides on a translated Gemini request
+func (o GenerationOverrides) ApplyGemini(g *vertex.GeminiRequest) {
+	if o.IsEmpty() {
+		return
+	}
+	if g.GenerationConfig == nil {
+		g.GenerationConfig = &vertex.GenerationConfig{}
+	}
+	if o.Temperature != nil {
+		g.GenerationConfig.Temperature = o.Temperature
+	}
+	if o.MaxTokens != nil {
+		g.GenerationConfig.MaxOutputTokens = o.MaxTokens
+	}
+	if o.ThinkingBudget != nil {
+		g.GenerationConfig.ThinkingConfig = &vertex.ThinkingConfig{ThinkingBudget: o.ThinkingBudget}
+	}
+}
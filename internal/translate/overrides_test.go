@@ -0,0 +1,55 @@
+package translate
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestGenerationOverridesThinkingBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string // thinkingConfig in the marshalled request, "" = absent
+		wantErr bool
+	}{
+		{name: "zero turns thinking off", header: "0", want: `"thinkingConfig":{"thinkingBudget":0}`},
+		{name: "dynamic", header: "-1", want: `"thinkingConfig":{"thinkingBudget":-1}`},
+		{name: "explicit budget", header: "512", want: `"thinkingConfig":{"thinkingBudget":512}`},
+		{name: "no header"},
+		{name: "not a number", header: "lots", wantErr: true},
+		{name: "below dynamic", header: "-2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.header != "" {
+				h.Set(HeaderGenThinkingBudget, tt.header)
+			}
+			o, err := ParseGenerationOverrides(h, "gemini-2.5-flash")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseGenerationOverrides err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			g := &vertex.GeminiRequest{}
+			o.ApplyGemini(g)
+			body, err := json.Marshal(g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(body)
+			if tt.want == "" && strings.Contains(got, "thinkingConfig") {
+				t.Errorf("request = %s, want no thinkingConfig", got)
+			}
+			if tt.want != "" && !strings.Contains(got, tt.want) {
+				t.Errorf("request = %s, want it to contain %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package translate
+
+import (
+	"encoding/json"
+
+	"vertex2api-golang/internal/models"
+)
+
+// Per-model parameter dropping (UNSUPPORTED_PARAMS).
+//
+// Some models reject generation parameters others accept, and Vertex answers
+// with an opaque 400. Parameters listed for a model family are removed from
+// the request before it is sent, and the callers log what was dropped.
+
+// paramClearers reset a typed request field by its OpenAI name and report
+// whether it was set
+var paramClearers = map[string]func(r *ChatCompletionRequest) bool{
+	"temperature":           func(r *ChatCompletionRequest) bool { return clearParam(&r.Temperature) },
+	"top_p":                 func(r *ChatCompletionRequest) bool { return clearParam(&r.TopP) },
+	"top_k":                 func(r *ChatCompletionRequest) bool { return clearParam(&r.TopK) },
+	"n":                     func(r *ChatCompletionRequest) bool { return clearParam(&r.N) },
+	"max_tokens":            func(r *ChatCompletionRequest) bool { return clearParam(&r.MaxTokens) },
+	"max_completion_tokens": func(r *ChatCompletionRequest) bool { return clearParam(&r.MaxCompletionTokens) },
+	"presence_penalty":      func(r *ChatCompletionRequest) bool { return clearParam(&r.PresencePenalty) },
+	"frequency_penalty":     func(r *ChatCompletionRequest) bool { return clearParam(&r.FrequencyPenalty) },
+	"seed":                  func(r *ChatCompletionRequest) bool { return clearParam(&r.Seed) },
+	"logprobs":              func(r *ChatCompletionRequest) bool { return clearParam(&r.Logprobs) },
+	"top_logprobs":          func(r *ChatCompletionRequest) bool { return clearParam(&r.TopLogprobs) },
+	"stop": func(r *ChatCompletionRequest) bool {
+		set := r.Stop != nil
+		r.Stop = nil
+		return set
+	},
+	"logit_bias": func(r *ChatCompletionRequest) bool {
+		set := r.LogitBias != nil
+		r.LogitBias = nil
+		return set
+	},
+}
+
+func clearParam[T any](p **T) bool {
+	set := *p != nil
+	*p = nil
+	return set
+}
+
+// dropUnsupportedParams clears the parameters the model rejects and returns
+// the names of those that were set
+func (r *ChatCompletionRequest) dropUnsupportedParams(model string) []string {
+	var dropped []string
+	for _, name := range models.UnsupportedParams(model) {
+		if clear, ok := paramClearers[name]; ok && clear(r) {
+			dropped = append(dropped, name)
+		}
+	}
+	return dropped
+}
+
+// DropUnsupportedParams removes the parameters the model rejects from a raw
+// request body and returns the names of those that were present
+func DropUnsupportedParams(rawReq map[string]json.RawMessage, model string) []string {
+	var dropped []string
+	for _, name := range models.UnsupportedParams(model) {
+		if _, ok := rawReq[name]; ok {
+			delete(rawReq, name)
+			dropped = append(dropped, name)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,69 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestDropUnsupportedParams(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.UnsupportedParams = map[string]string{
+			"gemini-2.5":     "seed",
+			"gemini-2.5-pro": "temperature|top_k",
+		}
+	})
+	const body = `{"model":"m","messages":[{"role":"user","content":"hi"}],"temperature":0.5,"top_k":40,"top_p":0.9,"seed":7}`
+	tests := []struct {
+		model       string
+		wantDropped []string
+	}{
+		{"gemini-2.5-pro", []string{"temperature", "top_k"}}, // longest prefix wins
+		{"gemini-2.5-flash", []string{"seed"}},
+		{"gemini-3-pro-preview", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			var raw map[string]json.RawMessage
+			json.Unmarshal([]byte(body), &raw)
+			if got := DropUnsupportedParams(raw, tt.model); !slices.Equal(got, tt.wantDropped) {
+				t.Errorf("raw body: dropped %v, want %v", got, tt.wantDropped)
+			}
+			for _, name := range tt.wantDropped {
+				if _, ok := raw[name]; ok {
+					t.Errorf("raw body still has %s", name)
+				}
+			}
+			if _, ok := raw["top_p"]; !ok {
+				t.Error("raw body lost top_p, which no model rejects")
+			}
+
+			var req ChatCompletionRequest
+			json.Unmarshal([]byte(body), &req)
+			req.Model = tt.model
+			if got := req.dropUnsupportedParams(tt.model); !slices.Equal(got, tt.wantDropped) {
+				t.Errorf("typed request: dropped %v, want %v", got, tt.wantDropped)
+			}
+
+			json.Unmarshal([]byte(body), &req)
+			req.Model = tt.model
+			geminiReq, _, err := ToGeminiRequest(context.Background(), &req)
+			if err != nil {
+				t.Fatalf("ToGeminiRequest: %v", err)
+			}
+			gc := geminiReq.GenerationConfig
+			if hasTemp := gc.Temperature != nil; hasTemp == slices.Contains(tt.wantDropped, "temperature") {
+				t.Errorf("temperature sent = %v, want %v", hasTemp, !hasTemp)
+			}
+			if hasTopK := gc.TopK != nil; hasTopK == slices.Contains(tt.wantDropped, "top_k") {
+				t.Errorf("topK sent = %v, want %v", hasTopK, !hasTopK)
+			}
+			if gc.TopP == nil {
+				t.Error("topP not sent")
+			}
+		})
+	}
+}
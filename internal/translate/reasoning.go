@@ -0,0 +1,82 @@
+package translate
+
+import (
+	"encoding/json"
+
+	"vertex2api-golang/internal/config"
+)
+
+// Reasoning shape (REASONING_SHAPE).
+//
+// By default reasoning is returned as a flat "reasoning_content" string. With
+// REASONING_SHAPE=object it is returned as a nested object instead, for
+// clients written against the newer format:
+//
+//	"reasoning": {"content": "..."}
+
+// ReasoningObject is the nested reasoning shape
+type ReasoningObject struct {
+	Content string `json:"content"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// ReasoningAsObject reports whether reasoning uses the nested shape
+func ReasoningAsObject() bool {
+	return config.Get().ReasoningShape == "object"
+}
+
+// setReasoning stores reasoning on a message in the configured shape
+func (m *ResponseMsg) setReasoning(reasoning string) {
+	if reasoning == "" {
+		return
+	}
+	if ReasoningAsObject() {
+		m.Reasoning = &ReasoningObject{Content: reasoning}
+		return
+	}
+	m.ReasoningContent = reasoning
+}
+
+// NestReasoning moves "reasoning_content" of every choice's message or delta
+// in a raw response or stream chunk into a "reasoning" object. Other fields
+// are kept as-is; payloads without reasoning are returned unchanged.
+func NestReasoning(payload []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(fields["choices"], &choices); err != nil {
+		return payload
+	}
+
+	changed := false
+	for _, choice := range choices {
+		for _, key := range []string{"message", "delta"} {
+			var msg map[string]json.RawMessage
+			if err := json.Unmarshal(choice[key], &msg); err != nil {
+				continue
+			}
+			var reasoning string
+			if err := json.Unmarshal(msg["reasoning_content"], &reasoning); err != nil {
+				continue
+			}
+			delete(msg, "reasoning_content")
+			if reasoning != "" {
+				msg["reasoning"], _ = json.Marshal(ReasoningObject{Content: reasoning})
+			}
+			choice[key], _ = json.Marshal(msg)
+			changed = true
+		}
+	}
+	if !changed {
+		return payload
+	}
+
+	fields["choices"], _ = json.Marshal(choices)
+	result, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Conversation repair (REPAIR_CONVERSATION).
+//
+// Vertex rejects histories that OpenAI tolerates from sloppy clients. When
+// enabled, messages are normalized before they are sent upstream:
+//
+//   - a missing role is inferred (tool_call_id -> tool, tool_calls -> assistant,
+//     otherwise user)
+//   - assistant and tool turns before the first user turn are dropped
+//   - tool results are moved directly after the assistant turn that made the call
+//   - tool results without any matching call become user turns
+//
+// Messages are handled as raw JSON so fields the proxy does not model are
+// forwarded untouched.
+
+// repairMessage is the part of a message repair looks at
+type repairMessage struct {
+	index      int // position in the client's list, for change descriptions
+	raw        map[string]json.RawMessage
+	role       string
+	toolCallID string
+	callIDs    []string
+}
+
+// RepairMessages normalizes a message list and returns it with a description
+// of every change made. Messages that cannot be parsed are kept as-is.
+func RepairMessages(messages []json.RawMessage) ([]json.RawMessage, []string) {
+	var changes []string
+	parsed := make([]*repairMessage, 0, len(messages))
+	callOwner := make(map[string]int) // tool call id -> index in parsed
+
+	for i, raw := range messages {
+		m := &repairMessage{index: i}
+		if err := json.Unmarshal(raw, &m.raw); err != nil {
+			m.raw = nil
+			parsed = append(parsed, m)
+			continue
+		}
+		json.Unmarshal(m.raw["role"], &m.role)
+		json.Unmarshal(m.raw["tool_call_id"], &m.toolCallID)
+		var calls []struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(m.raw["tool_calls"], &calls)
+		for _, c := range calls {
+			if c.ID != "" {
+				m.callIDs = append(m.callIDs, c.ID)
+			}
+		}
+
+		if m.role == "" {
+			switch {
+			case m.toolCallID != "":
+				m.role = "tool"
+			case len(m.callIDs) > 0:
+				m.role = "assistant"
+			default:
+				m.role = "user"
+			}
+			m.setRole(m.role)
+			changes = append(changes, fmt.Sprintf("message %d: missing role set to %s", i, m.role))
+		}
+
+		for _, id := range m.callIDs {
+			callOwner[id] = len(parsed)
+		}
+		parsed = append(parsed, m)
+	}
+
+	// Drop assistant/tool turns that precede the first user turn
+	firstUser := -1
+	for i, m := range parsed {
+		if m.role == "user" {
+			firstUser = i
+			break
+		}
+	}
+	if firstUser > 0 {
+		kept := parsed[:0:0]
+		for i, m := range parsed {
+			if i < firstUser && (m.role == "assistant" || m.role == "tool") {
+				changes = append(changes, fmt.Sprintf("message %d: dropped leading %s turn", m.index, m.role))
+				for _, id := range m.callIDs {
+					delete(callOwner, id)
+				}
+				continue
+			}
+			kept = append(kept, m)
+		}
+		parsed = kept
+	}
+
+	// Place tool results right after their calls
+	pending := make(map[string][]*repairMessage) // results seen before their call
+	out := make([]*repairMessage, 0, len(parsed))
+	emittedCalls := make(map[string]int) // tool call id -> index in out of the owning assistant turn
+
+	for _, m := range parsed {
+		if m.role != "tool" || m.toolCallID == "" {
+			out = append(out, m)
+			if len(m.callIDs) > 0 {
+				for _, id := range m.callIDs {
+					emittedCalls[id] = len(out) - 1
+				}
+				for _, id := range m.callIDs {
+					if results := pending[id]; len(results) > 0 {
+						out = append(out, results...)
+						delete(pending, id)
+					}
+				}
+			}
+			continue
+		}
+
+		if owner, ok := emittedCalls[m.toolCallID]; ok {
+			// Insert after the owner's contiguous tool results
+			pos := owner + 1
+			for pos < len(out) && out[pos].role == "tool" {
+				pos++
+			}
+			if pos != len(out) {
+				changes = append(changes, fmt.Sprintf("message %d: moved tool result %s after its call", m.index, m.toolCallID))
+			}
+			out = append(out[:pos], append([]*repairMessage{m}, out[pos:]...)...)
+			for id, idx := range emittedCalls {
+				if idx >= pos {
+					emittedCalls[id] = idx + 1
+				}
+			}
+			continue
+		}
+
+		if _, ok := callOwner[m.toolCallID]; ok {
+			changes = append(changes, fmt.Sprintf("message %d: moved tool result %s after its call", m.index, m.toolCallID))
+			pending[m.toolCallID] = append(pending[m.toolCallID], m)
+			continue
+		}
+
+		// No call anywhere: keep the content as a user turn
+		changes = append(changes, fmt.Sprintf("message %d: tool result %s has no matching call, converted to user turn", m.index, m.toolCallID))
+		m.setRole("user")
+		delete(m.raw, "tool_call_id")
+		delete(m.raw, "name")
+		out = append(out, m)
+	}
+
+	if len(changes) == 0 {
+		return messages, nil
+	}
+
+	result := make([]json.RawMessage, 0, len(out))
+	for _, m := range out {
+		if m.raw == nil {
+			result = append(result, messages[m.index])
+			continue
+		}
+		raw, err := json.Marshal(m.raw)
+		if err != nil {
+			return messages, nil
+		}
+		result = append(result, raw)
+	}
+	return result, changes
+}
+
+// setRole updates the message role
+func (m *repairMessage) setRole(role string) {
+	m.role = role
+	m.raw["role"], _ = json.Marshal(role)
+}
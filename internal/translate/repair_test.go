@@ -0,0 +1,64 @@
+package translate
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestRepairMessages(t *testing.T) {
+	const (
+		user      = `{"role":"user","content":"q"}`
+		call      = `{"role":"assistant","content":"call","tool_calls":[{"id":"c1","type":"function","function":{"name":"f","arguments":"{}"}}]}`
+		result    = `{"role":"tool","tool_call_id":"c1","content":"result"}`
+		answer    = `{"role":"assistant","content":"a"}`
+		orphan    = `{"role":"tool","tool_call_id":"zz","name":"f","content":"orphan"}`
+		noRole    = `{"content":"q"}`
+		noRoleRes = `{"tool_call_id":"c1","content":"result"}`
+	)
+	tests := []struct {
+		name        string
+		in          []string
+		want        []string // role:content per message
+		wantChanges int
+	}{
+		{"well formed", []string{user, call, result, answer}, []string{"user:q", "assistant:call", "tool:result", "assistant:a"}, 0},
+		{"leading assistant", []string{answer, user}, []string{"user:q"}, 1},
+		{"leading tool call and result", []string{call, result, user}, []string{"user:q"}, 2},
+		{"missing roles", []string{noRole, call, noRoleRes}, []string{"user:q", "assistant:call", "tool:result"}, 2},
+		{"result before its call", []string{user, result, call, answer}, []string{"user:q", "assistant:call", "tool:result", "assistant:a"}, 1},
+		{"result after a later turn", []string{user, call, answer, result}, []string{"user:q", "assistant:call", "tool:result", "assistant:a"}, 1},
+		{"result without any call", []string{user, orphan}, []string{"user:q", "user:orphan"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make([]json.RawMessage, len(tt.in))
+			for i, m := range tt.in {
+				in[i] = json.RawMessage(m)
+			}
+			out, changes := RepairMessages(in)
+
+			var got []string
+			for _, raw := range out {
+				var m struct {
+					Role       string `json:"role"`
+					Content    string `json:"content"`
+					ToolCallID string `json:"tool_call_id"`
+				}
+				if err := json.Unmarshal(raw, &m); err != nil {
+					t.Fatalf("repaired message %s is not JSON: %v", raw, err)
+				}
+				if m.Role == "user" && m.ToolCallID != "" {
+					t.Errorf("user turn %s keeps a tool_call_id", raw)
+				}
+				got = append(got, m.Role+":"+m.Content)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+			if len(changes) != tt.wantChanges {
+				t.Errorf("changes = %q, want %d", changes, tt.wantChanges)
+			}
+		})
+	}
+}
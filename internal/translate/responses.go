@@ -0,0 +1,345 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// OpenAI Responses API (/v1/responses).
+//
+// A Responses request is rewritten as a chat completion request so the
+// Gemini translation in ToGeminiRequest is shared, and the chat completion
+// built by FromGeminiResponse is reshaped into output items. Text and
+// function tools are supported; other input item types are rejected.
+//
+//	input item                          chat message
+//	{"role": "user", "content": ...}    {"role": "user", "content": ...}
+//	{"type": "function_call", ...}      assistant message with tool_calls
+//	{"type": "function_call_output"}    {"role": "tool", "tool_call_id": ...}
+
+const (
+	ObjectResponse = "response"
+
+	// Output item and content part types
+	ResponseItemMessage      = "message"
+	ResponseItemFunctionCall = "function_call"
+	ResponsePartOutputText   = "output_text"
+)
+
+// ResponsesRequest is the supported subset of a Responses API request
+type ResponsesRequest struct {
+	Model           string          `json:"model"`
+	Input           json.RawMessage `json:"input"`
+	Instructions    string          `json:"instructions,omitempty"`
+	Tools           []ResponsesTool `json:"tools,omitempty"`
+	ToolChoice      interface{}     `json:"tool_choice,omitempty"`
+	Stream          bool            `json:"stream,omitempty"`
+	Temperature     *float64        `json:"temperature,omitempty"`
+	TopP            *float64        `json:"top_p,omitempty"`
+	MaxOutputTokens *int            `json:"max_output_tokens,omitempty"`
+	User            string          `json:"user,omitempty"`
+}
+
+// ResponsesTool is a Responses API tool; function tools are flat rather than
+// nested under "function" as in chat completions
+type ResponsesTool struct {
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// responsesInputItem is any input item; which fields apply depends on Type
+type responsesInputItem struct {
+	Type      string          `json:"type"`
+	Role      string          `json:"role"`
+	Content   json.RawMessage `json:"content"`
+	CallID    string          `json:"call_id"`
+	Name      string          `json:"name"`
+	Arguments string          `json:"arguments"`
+	Output    json.RawMessage `json:"output"`
+}
+
+// responsesContentPart is an input content part
+type responsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+}
+
+// ResponsesResponse is a Responses API response object
+type ResponsesResponse struct {
+	ID                string                `json:"id"`
+	Object            string                `json:"object"`
+	CreatedAt         int64                 `json:"created_at"`
+	Status            string                `json:"status"`
+	IncompleteDetails *ResponsesIncomplete  `json:"incomplete_details"`
+	Model             string                `json:"model"`
+	Output            []ResponsesOutputItem `json:"output"`
+	Usage             *ResponsesUsage       `json:"usage,omitempty"`
+}
+
+// ResponsesIncomplete explains a response with status "incomplete"
+type ResponsesIncomplete struct {
+	Reason string `json:"reason"`
+}
+
+// ResponsesOutputItem is a message or function_call output item
+type ResponsesOutputItem struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// message
+	Role    string                `json:"role,omitempty"`
+	Content []ResponsesOutputPart `json:"content,omitempty"`
+	// function_call
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// ResponsesOutputPart is an output_text content part
+type ResponsesOutputPart struct {
+	Type        string       `json:"type"`
+	Text        string       `json:"text"`
+	Annotations []Annotation `json:"annotations"`
+}
+
+// ResponsesUsage is the Responses API token usage
+type ResponsesUsage struct {
+	InputTokens         int                          `json:"input_tokens"`
+	OutputTokens        int                          `json:"output_tokens"`
+	TotalTokens         int                          `json:"total_tokens"`
+	OutputTokensDetails *ResponsesOutputTokenDetails `json:"output_tokens_details,omitempty"`
+}
+
+// ResponsesOutputTokenDetails breaks down output tokens
+type ResponsesOutputTokenDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+// NewResponseID returns a "resp_<random>" response ID
+func NewResponseID() string {
+	return "resp_" + randomID(24)
+}
+
+// ToChatRequest rewrites the request as a chat completion request
+func (r *ResponsesRequest) ToChatRequest() (*ChatCompletionRequest, error) {
+	chat := &ChatCompletionRequest{
+		Model:       r.Model,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		MaxTokens:   r.MaxOutputTokens,
+		User:        r.User,
+		ToolChoice:  responsesToolChoice(r.ToolChoice),
+	}
+
+	for _, tool := range r.Tools {
+		if tool.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool type %q: only function tools are supported on /v1/responses", tool.Type)
+		}
+		if tool.Name == "" {
+			return nil, fmt.Errorf("function tool requires a name")
+		}
+		chat.Tools = append(chat.Tools, OpenAITool{
+			Type: "function",
+			Function: OpenAIFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	if r.Instructions != "" {
+		chat.Messages = append(chat.Messages, Message{Role: "system", Content: r.Instructions})
+	}
+
+	messages, err := responsesInputMessages(r.Input)
+	if err != nil {
+		return nil, err
+	}
+	chat.Messages = append(chat.Messages, messages...)
+	if len(chat.Messages) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+	return chat, nil
+}
+
+// responsesToolChoice converts {"type": "function", "name": ...} to the
+// chat completions shape; string choices are the same in both APIs
+func responsesToolChoice(choice interface{}) interface{} {
+	if v, ok := choice.(map[string]interface{}); ok && v["type"] == "function" {
+		if name, ok := v["name"].(string); ok {
+			return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": name}}
+		}
+	}
+	return choice
+}
+
+// responsesInputMessages converts the input, a string or an item list, to
+// chat messages
+func responsesInputMessages(raw json.RawMessage) ([]Message, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []Message{{Role: "user", Content: text}}, nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of input items")
+	}
+
+	// Function call outputs name their call by ID; Gemini needs the name
+	callNames := make(map[string]string)
+	var messages []Message
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			content, err := responsesMessageContent(item.Content)
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %w", i, err)
+			}
+			role := item.Role
+			if role == "developer" {
+				role = "system"
+			}
+			if role != "user" && role != "assistant" && role != "system" {
+				return nil, fmt.Errorf("input[%d]: unsupported role %q", i, item.Role)
+			}
+			messages = append(messages, Message{Role: role, Content: content})
+
+		case "function_call":
+			callNames[item.CallID] = item.Name
+			call := ToolCall{ID: item.CallID, Type: "function", Function: FunctionCall{Name: item.Name, Arguments: item.Arguments}}
+			// Consecutive calls belong to the same assistant turn
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" && len(messages[n-1].ToolCalls) > 0 {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, Message{Role: "assistant", ToolCalls: []ToolCall{call}})
+			}
+
+		case "function_call_output":
+			var output string
+			if err := json.Unmarshal(item.Output, &output); err != nil {
+				output = string(item.Output)
+			}
+			messages = append(messages, Message{Role: "tool", ToolCallID: item.CallID, Name: callNames[item.CallID], Content: output})
+
+		default:
+			return nil, fmt.Errorf("input[%d]: unsupported input item type %q", i, item.Type)
+		}
+	}
+	return messages, nil
+}
+
+// responsesMessageContent converts message content, a string or a list of
+// input_text/output_text/input_image parts, to chat message content
+func responsesMessageContent(raw json.RawMessage) (interface{}, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []responsesContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("content must be a string or an array of content parts")
+	}
+
+	chatParts := make([]interface{}, 0, len(parts))
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			chatParts = append(chatParts, map[string]interface{}{"type": "text", "text": part.Text})
+		case "input_image":
+			chatParts = append(chatParts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": part.ImageURL}})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+	return chatParts, nil
+}
+
+// ResponsesFromChat reshapes a chat completion into a Responses API response
+func ResponsesFromChat(chat *ChatCompletionResponse, id, model string) *ResponsesResponse {
+	resp := &ResponsesResponse{
+		ID:        id,
+		Object:    ObjectResponse,
+		CreatedAt: time.Now().Unix(),
+		Status:    "completed",
+		Model:     model,
+		Output:    []ResponsesOutputItem{},
+	}
+
+	if len(chat.Choices) > 0 && chat.Choices[0].Message != nil {
+		choice := chat.Choices[0]
+		msg := choice.Message
+		if msg.Content != "" {
+			resp.Output = append(resp.Output, newResponsesMessage(msg.Content, msg.Annotations))
+		}
+		for _, call := range msg.ToolCalls {
+			resp.Output = append(resp.Output, newResponsesFunctionCall(call))
+		}
+		resp.setFinishReason(choice.FinishReason)
+	}
+
+	resp.Usage = responsesUsage(chat.Usage)
+	return resp
+}
+
+// setFinishReason marks a response cut short by the token limit or a
+// content filter as incomplete
+func (r *ResponsesResponse) setFinishReason(finishReason string) {
+	switch finishReason {
+	case "length":
+		r.Status = "incomplete"
+		r.IncompleteDetails = &ResponsesIncomplete{Reason: "max_output_tokens"}
+	case "content_filter":
+		r.Status = "incomplete"
+		r.IncompleteDetails = &ResponsesIncomplete{Reason: "content_filter"}
+	}
+}
+
+// newResponsesMessage returns a completed assistant message output item
+func newResponsesMessage(text string, annotations []Annotation) ResponsesOutputItem {
+	if annotations == nil {
+		annotations = []Annotation{}
+	}
+	return ResponsesOutputItem{
+		Type:    ResponseItemMessage,
+		ID:      "msg_" + randomID(24),
+		Status:  "completed",
+		Role:    "assistant",
+		Content: []ResponsesOutputPart{{Type: ResponsePartOutputText, Text: text, Annotations: annotations}},
+	}
+}
+
+// newResponsesFunctionCall returns a completed function_call output item
+func newResponsesFunctionCall(call ToolCall) ResponsesOutputItem {
+	return ResponsesOutputItem{
+		Type:      ResponseItemFunctionCall,
+		ID:        "fc_" + randomID(24),
+		Status:    "completed",
+		CallID:    call.ID,
+		Name:      call.Function.Name,
+		Arguments: call.Function.Arguments,
+	}
+}
+
+// responsesUsage converts chat usage to Responses usage
+func responsesUsage(usage *Usage) *ResponsesUsage {
+	if usage == nil {
+		return nil
+	}
+	result := &ResponsesUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.TotalTokens,
+	}
+	if usage.CompletionTokensDetails != nil {
+		result.OutputTokensDetails = &ResponsesOutputTokenDetails{ReasoningTokens: usage.CompletionTokensDetails.ReasoningTokens}
+	}
+	return result
+}
@@ -0,0 +1,208 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ResponsesStream writes a Responses API event stream. Events are named SSE
+// events whose data repeats the name in "type" and carries a sequence number:
+//
+//	response.created
+//	response.output_item.added           (message)
+//	response.content_part.added
+//	response.output_text.delta ...
+//	response.output_text.done
+//	response.content_part.done
+//	response.output_item.done
+//	response.output_item.added           (function_call)
+//	response.function_call_arguments.delta
+//	response.function_call_arguments.done
+//	response.output_item.done
+//	response.completed                   (or response.incomplete)
+//
+// Nothing is written before the first event, so a request that fails before
+// producing output can still be answered with a plain error response.
+type ResponsesStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	resp    *ResponsesResponse
+	seq     int
+	started bool
+
+	// The message item being streamed, -1 when none is open
+	message int
+	text    strings.Builder
+	// Function call items still open, by output index
+	calls []int
+}
+
+// NewResponsesStream creates a stream for a response with the given ID
+func NewResponsesStream(w http.ResponseWriter, id, model string) *ResponsesStream {
+	flusher, _ := w.(http.Flusher)
+	return &ResponsesStream{
+		w:       w,
+		flusher: flusher,
+		resp: &ResponsesResponse{
+			ID:        id,
+			Object:    ObjectResponse,
+			CreatedAt: time.Now().Unix(),
+			Status:    "in_progress",
+			Model:     model,
+			Output:    []ResponsesOutputItem{},
+		},
+		message: -1,
+	}
+}
+
+// Started reports whether any event has been written
+func (s *ResponsesStream) Started() bool {
+	return s.started
+}
+
+// WriteText streams assistant text, opening a message item if needed
+func (s *ResponsesStream) WriteText(delta string) {
+	if delta == "" {
+		return
+	}
+	s.start()
+	if s.message < 0 {
+		s.message = len(s.resp.Output)
+		item := ResponsesOutputItem{
+			Type:    ResponseItemMessage,
+			ID:      "msg_" + randomID(24),
+			Status:  "in_progress",
+			Role:    "assistant",
+			Content: []ResponsesOutputPart{},
+		}
+		s.resp.Output = append(s.resp.Output, item)
+		s.event("response.output_item.added", map[string]any{"output_index": s.message, "item": item})
+		s.event("response.content_part.added", map[string]any{
+			"item_id": item.ID, "output_index": s.message, "content_index": 0,
+			"part": ResponsesOutputPart{Type: ResponsePartOutputText, Annotations: []Annotation{}},
+		})
+	}
+	s.text.WriteString(delta)
+	s.event("response.output_text.delta", map[string]any{
+		"item_id": s.resp.Output[s.message].ID, "output_index": s.message, "content_index": 0, "delta": delta,
+	})
+}
+
+// WriteToolCall streams a tool call delta as produced by StreamState: a delta
+// with an ID opens a function_call item, and argument fragments extend the
+// most recent one
+func (s *ResponsesStream) WriteToolCall(call ToolCall) {
+	s.start()
+	if call.ID != "" {
+		s.closeMessage(nil)
+		index := len(s.resp.Output)
+		item := ResponsesOutputItem{
+			Type:   ResponseItemFunctionCall,
+			ID:     "fc_" + randomID(24),
+			Status: "in_progress",
+			CallID: call.ID,
+			Name:   call.Function.Name,
+		}
+		s.resp.Output = append(s.resp.Output, item)
+		s.calls = append(s.calls, index)
+		s.event("response.output_item.added", map[string]any{"output_index": index, "item": item})
+	}
+	if call.Function.Arguments == "" || len(s.calls) == 0 {
+		return
+	}
+	index := s.calls[len(s.calls)-1]
+	item := &s.resp.Output[index]
+	item.Arguments += call.Function.Arguments
+	s.event("response.function_call_arguments.delta", map[string]any{
+		"item_id": item.ID, "output_index": index, "delta": call.Function.Arguments,
+	})
+}
+
+// Finish closes open items and writes the final response event
+func (s *ResponsesStream) Finish(finishReason string, annotations []Annotation, usage *Usage) {
+	s.start()
+	s.closeMessage(annotations)
+	for _, index := range s.calls {
+		item := &s.resp.Output[index]
+		item.Status = "completed"
+		s.event("response.function_call_arguments.done", map[string]any{
+			"item_id": item.ID, "output_index": index, "arguments": item.Arguments,
+		})
+		s.event("response.output_item.done", map[string]any{"output_index": index, "item": *item})
+	}
+	s.calls = nil
+
+	s.resp.Status = "completed"
+	s.resp.setFinishReason(finishReason)
+	s.resp.Usage = responsesUsage(usage)
+	if s.resp.Status == "incomplete" {
+		s.event("response.incomplete", map[string]any{"response": s.resp})
+		return
+	}
+	s.event("response.completed", map[string]any{"response": s.resp})
+}
+
+// Fail ends a started stream with a response.failed event
+func (s *ResponsesStream) Fail(message string) {
+	s.start()
+	s.resp.Status = "failed"
+	s.event("response.failed", map[string]any{
+		"response": s.resp,
+		"error":    map[string]string{"code": "server_error", "message": message},
+	})
+}
+
+// start writes the SSE headers and response.created once
+func (s *ResponsesStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.w.Header().Set("X-Accel-Buffering", "no")
+	s.event("response.created", map[string]any{"response": s.resp})
+}
+
+// closeMessage completes the open message item, if any
+func (s *ResponsesStream) closeMessage(annotations []Annotation) {
+	if s.message < 0 {
+		return
+	}
+	if annotations == nil {
+		annotations = []Annotation{}
+	}
+	item := &s.resp.Output[s.message]
+	part := ResponsesOutputPart{Type: ResponsePartOutputText, Text: s.text.String(), Annotations: annotations}
+	item.Content = []ResponsesOutputPart{part}
+	item.Status = "completed"
+
+	s.event("response.output_text.done", map[string]any{
+		"item_id": item.ID, "output_index": s.message, "content_index": 0, "text": part.Text,
+	})
+	s.event("response.content_part.done", map[string]any{
+		"item_id": item.ID, "output_index": s.message, "content_index": 0, "part": part,
+	})
+	s.event("response.output_item.done", map[string]any{"output_index": s.message, "item": *item})
+	s.message = -1
+	s.text.Reset()
+}
+
+// event writes one named event
+func (s *ResponsesStream) event(eventType string, fields map[string]any) {
+	fields["type"] = eventType
+	fields["sequence_number"] = s.seq
+	s.seq++
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", eventType, data)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
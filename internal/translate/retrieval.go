@@ -0,0 +1,71 @@
+package translate
+
+import (
+	"fmt"
+	"strings"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+// Retrieval tools.
+//
+// OpenAI's file_search tool names vector stores; the closest Vertex
+// equivalent is a retrieval tool over RAG Engine corpora, so each
+// vector_store_ids entry must be a corpus resource name:
+//
+//	{"type": "file_search",
+//	 "file_search": {"vector_store_ids": ["projects/p/locations/us-central1/ragCorpora/123"]}}
+//
+// The Assistants-era "retrieval" type carries no store to search and other
+// hosted tool types have no Vertex counterpart, so both are rejected instead
+// of being dropped from the request.
+
+// FileSearchTool is the configuration of an OpenAI file_search tool
+type FileSearchTool struct {
+	VectorStoreIDs []string `json:"vector_store_ids"`
+}
+
+// ragCorpusMarker identifies a RAG Engine corpus resource name
+const ragCorpusMarker = "/ragCorpora/"
+
+// ValidateTools rejects tool types that cannot be translated to Gemini
+func ValidateTools(tools []OpenAITool) error {
+	for _, tool := range tools {
+		switch tool.Type {
+		case "function":
+		case "file_search", "retrieval":
+			if _, err := convertRetrievalTools([]OpenAITool{tool}); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported tool type %q: only function and file_search tools are supported", tool.Type)
+		}
+	}
+	return nil
+}
+
+// convertRetrievalTools merges the corpora of every file_search tool into one
+// Gemini retrieval tool, or returns nil when there are none
+func convertRetrievalTools(tools []OpenAITool) (*vertex.Retrieval, error) {
+	var resources []vertex.RAGResource
+	for _, tool := range tools {
+		switch tool.Type {
+		case "retrieval":
+			return nil, fmt.Errorf("unsupported tool type %q: use file_search with vector_store_ids naming Vertex RAG corpora", tool.Type)
+		case "file_search":
+			if tool.FileSearch == nil || len(tool.FileSearch.VectorStoreIDs) == 0 {
+				return nil, fmt.Errorf("file_search tool requires vector_store_ids")
+			}
+			for _, id := range tool.FileSearch.VectorStoreIDs {
+				if !strings.HasPrefix(id, "projects/") || !strings.Contains(id, ragCorpusMarker) {
+					return nil, fmt.Errorf("file_search vector store %q must be a Vertex RAG corpus (projects/{project}/locations/{location}/ragCorpora/{id})", id)
+				}
+				resources = append(resources, vertex.RAGResource{RAGCorpus: id})
+			}
+		}
+	}
+	if len(resources) == 0 {
+		return nil, nil
+	}
+	return &vertex.Retrieval{VertexRAGStore: &vertex.VertexRAGStore{RAGResources: resources}}, nil
+}
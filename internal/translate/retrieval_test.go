@@ -0,0 +1,86 @@
+package translate
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRetrievalTools(t *testing.T) {
+	const corpus = "projects/p/locations/us-central1/ragCorpora/123"
+	tests := []struct {
+		name       string
+		tools      []OpenAITool
+		wantErr    string
+		wantCorpus []string
+	}{
+		{
+			name:       "file_search maps to RAG retrieval",
+			tools:      []OpenAITool{{Type: "file_search", FileSearch: &FileSearchTool{VectorStoreIDs: []string{corpus}}}},
+			wantCorpus: []string{corpus},
+		},
+		{
+			name: "alongside functions",
+			tools: []OpenAITool{
+				{Type: "function", Function: OpenAIFunction{Name: "lookup"}},
+				{Type: "file_search", FileSearch: &FileSearchTool{VectorStoreIDs: []string{corpus}}},
+			},
+			wantCorpus: []string{corpus},
+		},
+		{
+			name:    "not a corpus",
+			tools:   []OpenAITool{{Type: "file_search", FileSearch: &FileSearchTool{VectorStoreIDs: []string{"vs_abc123"}}}},
+			wantErr: "must be a Vertex RAG corpus",
+		},
+		{
+			name:    "no vector stores",
+			tools:   []OpenAITool{{Type: "file_search"}},
+			wantErr: "requires vector_store_ids",
+		},
+		{
+			name:    "retrieval",
+			tools:   []OpenAITool{{Type: "retrieval"}},
+			wantErr: `unsupported tool type "retrieval"`,
+		},
+		{
+			name:    "code_interpreter",
+			tools:   []OpenAITool{{Type: "code_interpreter"}},
+			wantErr: `unsupported tool type "code_interpreter"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTools(tt.tools)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ValidateTools = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateTools: %v", err)
+			}
+
+			req := &ChatCompletionRequest{
+				Model:    "gemini-2.5-flash",
+				Messages: []Message{{Role: "user", Content: "hi"}},
+				Tools:    tt.tools,
+			}
+			geminiReq, _, err := ToGeminiRequest(context.Background(), req)
+			if err != nil {
+				t.Fatalf("ToGeminiRequest: %v", err)
+			}
+			var corpora []string
+			for _, tool := range geminiReq.Tools {
+				if tool.Retrieval != nil && tool.Retrieval.VertexRAGStore != nil {
+					for _, res := range tool.Retrieval.VertexRAGStore.RAGResources {
+						corpora = append(corpora, res.RAGCorpus)
+					}
+				}
+			}
+			if strings.Join(corpora, ",") != strings.Join(tt.wantCorpus, ",") {
+				t.Errorf("retrieval corpora = %v, want %v", corpora, tt.wantCorpus)
+			}
+		})
+	}
+}
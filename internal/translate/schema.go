@@ -0,0 +1,241 @@
+package translate
+
+import (
+	"slices"
+	"strings"
+
+	"vertex2api-golang/internal/config"
+)
+
+// Function parameter schema sanitizing.
+//
+// Vertex accepts only a subset of JSON Schema for function parameters and
+// rejects the rest with an opaque 400. SanitizeSchema rewrites parameters
+// before they are sent:
+//   - local "$ref" pointers (#/$defs/..., #/definitions/...) are inlined
+//   - unknown "format" values are dropped
+//   - "allOf" members are merged into the parent schema, and "oneOf" becomes
+//     "anyOf" (Vertex has neither); a node with both "anyOf" and "oneOf"
+//     gets the pairwise merges of their members, which keeps both conditions
+//   - "lenient" mode removes keywords known to be rejected
+//   - "strict" mode keeps only keywords Vertex documents as supported
+//   - "off" forwards the schema untouched
+
+// maxRefDepth bounds $ref inlining to guard against recursive schemas
+const maxRefDepth = 8
+
+// supportedSchemaKeys are the keywords Vertex documents for function schemas
+var supportedSchemaKeys = map[string]bool{
+	"type": true, "format": true, "title": true, "description": true,
+	"nullable": true, "enum": true, "items": true, "minItems": true,
+	"maxItems": true, "properties": true, "required": true,
+	"minProperties": true, "maxProperties": true, "minLength": true,
+	"maxLength": true, "pattern": true, "example": true, "anyOf": true,
+	"propertyOrdering": true, "default": true, "minimum": true, "maximum": true,
+}
+
+// rejectedSchemaKeys are removed in lenient mode
+var rejectedSchemaKeys = map[string]bool{
+	"$schema": true, "$id": true, "$ref": true, "$defs": true,
+	"definitions": true, "$comment": true, "additionalProperties": true,
+	"unevaluatedProperties": true, "patternProperties": true,
+	"dependentRequired": true, "dependentSchemas": true,
+	"if": true, "then": true, "else": true, "not": true, "const": true,
+}
+
+// supportedFormats lists accepted format values per type
+var supportedFormats = map[string]bool{
+	"enum": true, "date-time": true, "int32": true, "int64": true,
+	"float": true, "double": true,
+}
+
+// SanitizeSchema returns a copy of a function parameter schema with
+// unsupported constructs removed according to SCHEMA_SANITIZE_MODE
+func SanitizeSchema(schema map[string]interface{}) map[string]interface{} {
+	mode := config.Get().SchemaSanitizeMode
+	if schema == nil || mode == "off" {
+		return schema
+	}
+
+	defs := collectDefs(schema)
+	return sanitizeNode(schema, defs, mode == "strict", 0)
+}
+
+// collectDefs gathers $defs and definitions for local $ref resolution
+func collectDefs(schema map[string]interface{}) map[string]interface{} {
+	defs := make(map[string]interface{})
+	for _, key := range []string{"$defs", "definitions"} {
+		if m, ok := schema[key].(map[string]interface{}); ok {
+			for name, def := range m {
+				defs["#/"+key+"/"+name] = def
+			}
+		}
+	}
+	return defs
+}
+
+func sanitizeNode(node map[string]interface{}, defs map[string]interface{}, strict bool, depth int) map[string]interface{} {
+	// Inline local references, keeping sibling keywords such as description
+	if ref, ok := node["$ref"].(string); ok && depth < maxRefDepth {
+		if target, ok := defs[ref].(map[string]interface{}); ok {
+			merged := make(map[string]interface{}, len(target)+len(node))
+			for k, v := range target {
+				merged[k] = v
+			}
+			for k, v := range node {
+				if k != "$ref" {
+					merged[k] = v
+				}
+			}
+			return sanitizeNode(merged, defs, strict, depth+1)
+		}
+	}
+
+	result := make(map[string]interface{}, len(node))
+	for key, value := range node {
+		if compositionKeys[key] {
+			continue
+		}
+		if strict && !supportedSchemaKeys[key] {
+			continue
+		}
+		if !strict && rejectedSchemaKeys[key] {
+			continue
+		}
+
+		switch key {
+		case "format":
+			if f, ok := value.(string); !ok || !supportedFormats[strings.ToLower(f)] {
+				continue
+			}
+			result[key] = value
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			cleaned := make(map[string]interface{}, len(props))
+			for name, prop := range props {
+				if m, ok := prop.(map[string]interface{}); ok {
+					cleaned[name] = sanitizeNode(m, defs, strict, depth+1)
+				}
+			}
+			result[key] = cleaned
+		case "items":
+			if m, ok := value.(map[string]interface{}); ok {
+				result[key] = sanitizeNode(m, defs, strict, depth+1)
+			}
+		default:
+			result[key] = value
+		}
+	}
+
+	// Vertex only understands anyOf. A schema must match one member of each
+	// list, so anyOf and oneOf together become their pairwise merges.
+	for _, key := range []string{"anyOf", "oneOf"} {
+		members := sanitizeMembers(node[key], defs, strict, depth)
+		if members == nil {
+			continue
+		}
+		if existing, ok := result["anyOf"].([]interface{}); ok {
+			members = crossMerge(existing, members)
+		}
+		result["anyOf"] = members
+	}
+
+	// allOf is an intersection: every member's constraints apply to the node
+	for _, member := range sanitizeMembers(node["allOf"], defs, strict, depth) {
+		result = mergeSchemas(result, member.(map[string]interface{}))
+	}
+	return result
+}
+
+// compositionKeys are rewritten after the node's own keywords
+var compositionKeys = map[string]bool{"anyOf": true, "oneOf": true, "allOf": true}
+
+// sanitizeMembers sanitizes the schemas of an anyOf/oneOf/allOf list, or
+// returns nil when value is not a list
+func sanitizeMembers(value interface{}, defs map[string]interface{}, strict bool, depth int) []interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	cleaned := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			cleaned = append(cleaned, sanitizeNode(m, defs, strict, depth+1))
+		}
+	}
+	return cleaned
+}
+
+// crossMerge returns the merge of every pair of members from a and b
+func crossMerge(a, b []interface{}) []interface{} {
+	merged := make([]interface{}, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			merged = append(merged, mergeSchemas(x.(map[string]interface{}), y.(map[string]interface{})))
+		}
+	}
+	return merged
+}
+
+// mergeSchemas returns a schema requiring both a and b: properties are merged
+// recursively, required lists are joined, anyOf lists are crossed and any
+// other keyword keeps a's value when both set it. Neither input is modified.
+func mergeSchemas(a, b map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+
+	for k, v := range b {
+		existing, exists := merged[k]
+		if !exists {
+			merged[k] = v
+			continue
+		}
+		switch k {
+		case "properties":
+			aProps, okA := existing.(map[string]interface{})
+			bProps, okB := v.(map[string]interface{})
+			if !okA || !okB {
+				continue
+			}
+			props := make(map[string]interface{}, len(aProps)+len(bProps))
+			for name, prop := range aProps {
+				props[name] = prop
+			}
+			for name, prop := range bProps {
+				am, okA := props[name].(map[string]interface{})
+				bm, okB := prop.(map[string]interface{})
+				if okA && okB {
+					props[name] = mergeSchemas(am, bm)
+				} else if !okA {
+					props[name] = prop
+				}
+			}
+			merged[k] = props
+		case "required":
+			aList, okA := existing.([]interface{})
+			bList, okB := v.([]interface{})
+			if !okA || !okB {
+				continue
+			}
+			required := append([]interface{}{}, aList...)
+			for _, name := range bList {
+				if !slices.Contains(required, name) {
+					required = append(required, name)
+				}
+			}
+			merged[k] = required
+		case "anyOf":
+			aList, okA := existing.([]interface{})
+			bList, okB := v.([]interface{})
+			if okA && okB {
+				merged[k] = crossMerge(aList, bList)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,123 @@
+package translate
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+// decodeSchema parses a JSON schema literal
+func decodeSchema(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		t.Fatalf("bad schema literal %s: %v", s, err)
+	}
+	return schema
+}
+
+func TestSanitizeSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string // SCHEMA_SANITIZE_MODE
+		in   string
+		want string
+	}{
+		{
+			name: "local $ref is inlined",
+			mode: "lenient",
+			in: `{"type":"object","$defs":{"addr":{"type":"object","properties":{"city":{"type":"string"}},"additionalProperties":false}},
+				"properties":{"home":{"$ref":"#/$defs/addr","description":"home address"}}}`,
+			want: `{"type":"object","properties":{"home":{"type":"object","description":"home address","properties":{"city":{"type":"string"}}}}}`,
+		},
+		{
+			name: "definitions $ref inside items",
+			mode: "lenient",
+			in:   `{"type":"array","definitions":{"n":{"type":"integer","format":"int32"}},"items":{"$ref":"#/definitions/n"}}`,
+			want: `{"type":"array","items":{"type":"integer","format":"int32"}}`,
+		},
+		{
+			name: "recursive $ref stops",
+			mode: "lenient",
+			in:   `{"$defs":{"node":{"type":"object","properties":{"next":{"$ref":"#/$defs/node"}}}},"$ref":"#/$defs/node"}`,
+		},
+		{
+			name: "unknown format dropped",
+			mode: "lenient",
+			in:   `{"type":"string","format":"email"}`,
+			want: `{"type":"string"}`,
+		},
+		{
+			name: "oneOf becomes anyOf",
+			mode: "lenient",
+			in:   `{"oneOf":[{"type":"string"},{"type":"integer"}]}`,
+			want: `{"anyOf":[{"type":"string"},{"type":"integer"}]}`,
+		},
+		{
+			name: "allOf merged into the parent",
+			mode: "lenient",
+			in:   `{"type":"object","allOf":[{"properties":{"a":{"type":"string"}},"required":["a"]},{"properties":{"b":{"type":"integer"}},"required":["b"]}]}`,
+			want: `{"type":"object","properties":{"a":{"type":"string"},"b":{"type":"integer"}},"required":["a","b"]}`,
+		},
+		{
+			name: "strict keeps documented keywords only",
+			mode: "strict",
+			in:   `{"type":"object","x-custom":1,"properties":{"a":{"type":"string","x-hint":"y"}}}`,
+			want: `{"type":"object","properties":{"a":{"type":"string"}}}`,
+		},
+		{
+			name: "lenient keeps unknown keywords",
+			mode: "lenient",
+			in:   `{"type":"object","x-custom":1}`,
+			want: `{"type":"object","x-custom":1}`,
+		},
+		{
+			name: "off forwards untouched",
+			mode: "off",
+			in:   `{"type":"object","$ref":"#/$defs/x","additionalProperties":false}`,
+			want: `{"type":"object","$ref":"#/$defs/x","additionalProperties":false}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.SchemaSanitizeMode = tt.mode })
+			got := SanitizeSchema(decodeSchema(t, tt.in))
+			if tt.want == "" {
+				// Only needs to terminate without a $ref left behind
+				if containsKey(got, "$ref") {
+					encoded, _ := json.Marshal(got)
+					t.Errorf("SanitizeSchema left a $ref: %s", encoded)
+				}
+				return
+			}
+			if want := decodeSchema(t, tt.want); !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Errorf("SanitizeSchema =\n%s\nwant\n%s", gotJSON, tt.want)
+			}
+		})
+	}
+}
+
+// containsKey reports whether key appears anywhere in a decoded schema
+func containsKey(node interface{}, key string) bool {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if _, ok := v[key]; ok {
+			return true
+		}
+		for _, child := range v {
+			if containsKey(child, key) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if containsKey(child, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,11 +3,13 @@ package translate
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strings"
 	"time"
 
+	"vertex2api-golang/internal/config"
 	"vertex2api-golang/internal/vertex"
 )
 
@@ -16,6 +18,17 @@ type StreamState struct {
 	inThinking     bool
 	thinkingBuffer strings.Builder
 	contentBuffer  strings.Builder
+	usage          *Usage
+	toolCalls      []streamToolCall // Tool calls started so far; position is the delta index
+	text           strings.Builder  // All candidate text as generated, for grounding offsets
+	annotations    []Annotation     // Citations from the latest chunk
+	fingerprint    string           // System fingerprint of the reported model version
+}
+
+// streamToolCall is the per-call state of a streamed tool call
+type streamToolCall struct {
+	id   string
+	name string
 }
 
 // NewStreamState creates a new stream state
@@ -25,50 +38,108 @@ func NewStreamState() *StreamState {
 
 // ProcessChunk processes a streaming chunk and extracts content/reasoning
 func (s *StreamState) ProcessChunk(chunk *vertex.GeminiResponse) (content string, reasoning string, toolCalls []ToolCall, finishReason string) {
-	if chunk == nil || len(chunk.Candidates) == 0 {
+	if chunk == nil {
 		return
 	}
 
-	candidate := chunk.Candidates[0]
-	finishReason = mapFinishReason(candidate.FinishReason)
+	// Usage metadata is cumulative; keep the latest for the final usage chunk
+	if chunk.UsageMetadata != nil {
+		s.usage = ConvertUsage(chunk.UsageMetadata)
+	}
+	if chunk.ModelVersion != "" && s.fingerprint == "" {
+		s.fingerprint = SystemFingerprint(chunk.ModelVersion)
+	}
 
-	if candidate.Content == nil {
+	if len(chunk.Candidates) == 0 {
 		return
 	}
 
-	for _, part := range candidate.Content.Parts {
-		if part.Text != "" {
-			c, r := s.processText(part.Text)
-			content += c
-			reasoning += r
-		}
+	candidate := chunk.Candidates[0]
+	finishReason = mapFinishReason(candidate.FinishReason)
+
+	if candidate.Content != nil {
+		for _, part := range candidate.Content.Parts {
+			if part.Text != "" {
+				s.text.WriteString(part.Text)
+				c, r := s.processText(part.Text)
+				content += c
+				reasoning += r
+			}
 
-		if part.FunctionCall != nil {
-			args, err := json.Marshal(part.FunctionCall.Args)
-			if err != nil {
-				args = []byte("{}")
+			if part.FunctionCall != nil {
+				toolCalls = append(toolCalls, s.startToolCall(part.FunctionCall)...)
 			}
-			toolCalls = append(toolCalls, ToolCall{
-				ID:   generateToolCallID(),
-				Type: "function",
-				Function: FunctionCall{
-					Name:      part.FunctionCall.Name,
-					Arguments: string(args),
-				},
-			})
 		}
 	}
 
+	// Grounding metadata usually arrives with the final chunk and covers the
+	// whole answer; safety ratings are only annotated once, at the end
+	text := s.text.String()
+	s.annotations = candidateAnnotations(candidate, text, hiddenRanges(text, false), candidate.FinishReason != "")
+
+	// Gemini reports STOP after a function call (including calls forced by
+	// tool_choice "required"); OpenAI clients expect tool_calls
+	if finishReason == "stop" && len(s.toolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+
 	return
 }
 
+// startToolCall records a new tool call and returns its deltas in OpenAI
+// order: first the id, type and name with empty arguments, then the
+// arguments. Gemini delivers arguments whole, so there is a single fragment.
+func (s *StreamState) startToolCall(fc *vertex.FunctionCall) []ToolCall {
+	args, err := json.Marshal(fc.Args)
+	if err != nil {
+		args = []byte("{}")
+	}
+
+	index := len(s.toolCalls)
+	call := streamToolCall{id: generateToolCallID(), name: fc.Name}
+	s.toolCalls = append(s.toolCalls, call)
+
+	return []ToolCall{
+		{
+			Index:    &index,
+			ID:       call.id,
+			Type:     "function",
+			Function: FunctionCall{Name: call.name},
+		},
+		{
+			Index:    &index,
+			Function: FunctionCall{Arguments: string(args)},
+		},
+	}
+}
+
+// Annotations returns the grounding citations (and, at the end, safety
+// ratings) carried by the latest chunk, to be sent with WriteAnnotations
+func (s *StreamState) Annotations() []Annotation {
+	return s.annotations
+}
+
+// Usage returns the latest usage seen in the stream, including
+// completion_tokens_details.reasoning_tokens when the model reported thoughts
+func (s *StreamState) Usage() *Usage {
+	return s.usage
+}
+
+// SystemFingerprint returns the fingerprint of the model version the stream
+// reported, or "" before any chunk named one
+func (s *StreamState) SystemFingerprint() string {
+	return s.fingerprint
+}
+
 // processText handles thinking tag parsing with state machine
 func (s *StreamState) processText(text string) (content string, reasoning string) {
 	// Pattern for thinking tags
 	openTag := "<vertex_think_tag>"
 	closeTag := "</vertex_think_tag>"
 
-	remaining := text
+	// Prepend bytes held back from the previous chunk (partial tag or rune)
+	remaining := s.contentBuffer.String() + text
+	s.contentBuffer.Reset()
 
 	for len(remaining) > 0 {
 		if s.inThinking {
@@ -102,7 +173,10 @@ func (s *StreamState) processText(text string) (content string, reasoning string
 					s.contentBuffer.WriteString(remaining[partialIdx:])
 					remaining = ""
 				} else {
-					content += remaining
+					// Hold back an incomplete trailing rune
+					complete, tail := SplitIncompleteUTF8(remaining)
+					content += complete
+					s.contentBuffer.WriteString(tail)
 					remaining = ""
 				}
 			}
@@ -142,6 +216,8 @@ type SSEWriter struct {
 	requestID string
 	model     string
 	created   int64
+	// fingerprint is set once known, see SetSystemFingerprint
+	fingerprint string
 }
 
 // NewSSEWriter creates a new SSE writer
@@ -155,6 +231,8 @@ func NewSSEWriter(w http.ResponseWriter, requestID, model string) *SSEWriter {
 	w.Header().Set("Transfer-Encoding", "chunked")
 	w.Header().Set("X-Accel-Buffering", "no")
 
+	WriteSSERetry(w)
+
 	return &SSEWriter{
 		w:         w,
 		flusher:   flusher,
@@ -164,19 +242,32 @@ func NewSSEWriter(w http.ResponseWriter, requestID, model string) *SSEWriter {
 	}
 }
 
-// WriteChunk writes a streaming chunk
+// WriteChunk writes a streaming chunk. Tool call deltas are written one per
+// chunk after any text, so clients see each call's name before its
+// arguments; the finish reason and usage go on the last chunk.
 func (s *SSEWriter) WriteChunk(content, reasoning string, toolCalls []ToolCall, finishReason string, isFirst bool, usage *Usage) error {
-	chunk := StreamChunkResponse{
-		ID:      s.requestID,
-		Object:  "chat.completion.chunk",
-		Created: s.created,
-		Model:   s.model,
-		Choices: []Choice{{
-			Index: 0,
-			Delta: &ResponseMsg{},
-		}},
+	if len(toolCalls) > 0 {
+		if isFirst || content != "" || reasoning != "" {
+			if err := s.WriteChunk(content, reasoning, nil, "", isFirst, nil); err != nil {
+				return err
+			}
+		}
+		for i, call := range toolCalls {
+			last := i == len(toolCalls)-1
+			chunk := s.newChunk(&ResponseMsg{ToolCalls: []ToolCall{call}})
+			if last {
+				chunk.Choices[0].FinishReason = finishReason
+				chunk.Usage = usage
+			}
+			if err := s.writeSSE(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
+	chunk := s.newChunk(&ResponseMsg{})
+
 	// Set role on first chunk
 	if isFirst {
 		chunk.Choices[0].Delta.Role = "assistant"
@@ -189,12 +280,7 @@ func (s *SSEWriter) WriteChunk(content, reasoning string, toolCalls []ToolCall,
 
 	// Set reasoning
 	if reasoning != "" {
-		chunk.Choices[0].Delta.ReasoningContent = reasoning
-	}
-
-	// Set tool calls
-	if len(toolCalls) > 0 {
-		chunk.Choices[0].Delta.ToolCalls = toolCalls
+		chunk.Choices[0].Delta.setReasoning(reasoning)
 	}
 
 	// Set finish reason
@@ -210,6 +296,44 @@ func (s *SSEWriter) WriteChunk(content, reasoning string, toolCalls []ToolCall,
 	return s.writeSSE(chunk)
 }
 
+// WriteAnnotations writes a chunk carrying grounding citations in its delta
+func (s *SSEWriter) WriteAnnotations(annotations []Annotation) error {
+	if len(annotations) == 0 {
+		return nil
+	}
+	return s.writeSSE(s.newChunk(&ResponseMsg{Annotations: annotations}))
+}
+
+// SetSystemFingerprint sets the system_fingerprint of the chunks written from
+// now on
+func (s *SSEWriter) SetSystemFingerprint(fingerprint string) {
+	s.fingerprint = fingerprint
+}
+
+// newChunk returns a chunk for this stream with a single choice delta
+func (s *SSEWriter) newChunk(delta *ResponseMsg) StreamChunkResponse {
+	return StreamChunkResponse{
+		ID:      s.requestID,
+		Object:  ObjectChatCompletionChunk,
+		Created: s.created,
+		Model:   s.model,
+		Choices: []Choice{{
+			Index: 0,
+			Delta: delta,
+		}},
+		SystemFingerprint: s.fingerprint,
+	}
+}
+
+// WriteSSERetry writes the SSE_RETRY_MS reconnect interval as a standalone
+// "retry:" block. It carries no data, so parsers that only read data lines
+// skip it. Call it once, before the first event.
+func WriteSSERetry(w io.Writer) {
+	if ms := config.Get().SSERetryMS; ms > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", ms)
+	}
+}
+
 // WriteDone writes the final [DONE] message
 func (s *SSEWriter) WriteDone() error {
 	_, err := fmt.Fprintf(s.w, "data: [DONE]\n\n")
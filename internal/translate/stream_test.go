@@ -0,0 +1,34 @@
+package translate
+
+import (
+	"testing"
+
+	"vertex2api-golang/internal/vertex"
+)
+
+func TestStreamStateUsageReasoningTokens(t *testing.T) {
+	state := NewStreamState()
+	chunks := []*vertex.GeminiResponse{
+		{Candidates: []vertex.Candidate{{Content: &vertex.Content{Role: "model", Parts: []vertex.Part{{Text: "Hel"}}}}}},
+		{
+			Candidates:    []vertex.Candidate{{Content: &vertex.Content{Role: "model", Parts: []vertex.Part{{Text: "lo"}}}, FinishReason: "STOP"}},
+			UsageMetadata: &vertex.UsageMetadata{PromptTokenCount: 4, CandidatesTokenCount: 2, ThoughtsTokenCount: 30, TotalTokenCount: 36},
+		},
+		// A trailing usage-only chunk carries the final counts
+		{UsageMetadata: &vertex.UsageMetadata{PromptTokenCount: 4, CandidatesTokenCount: 2, ThoughtsTokenCount: 31, TotalTokenCount: 37}},
+	}
+	for _, chunk := range chunks {
+		state.ProcessChunk(chunk)
+	}
+
+	usage := state.Usage()
+	if usage == nil {
+		t.Fatal("Usage = nil, want the last usage metadata")
+	}
+	if usage.CompletionTokensDetails == nil || usage.CompletionTokensDetails.ReasoningTokens != 31 {
+		t.Errorf("completion_tokens_details = %+v, want reasoning_tokens 31", usage.CompletionTokensDetails)
+	}
+	if usage.TotalTokens != 37 {
+		t.Errorf("total_tokens = %d, want 37", usage.TotalTokens)
+	}
+}
@@ -0,0 +1,153 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Context trimming (AUTO_TRIM_CONTEXT).
+//
+// When a conversation's estimated size exceeds the model's context window,
+// the oldest turns are removed until it fits. A turn is a user message with
+// the assistant replies and tool results that follow it, so the kept history
+// still starts with a user message. System and developer messages and the
+// turn holding the latest message are always kept. Strategies:
+//
+//	drop_oldest   remove the messages
+//	placeholder   remove them and insert a user note saying how many were removed
+
+const (
+	TrimDropOldest  = "drop_oldest"
+	TrimPlaceholder = "placeholder"
+)
+
+const (
+	// charsPerToken is the rough ratio used to estimate tokens from text
+	charsPerToken = 4
+	// mediaPartTokens is the estimate for one image, audio or file part,
+	// whose base64 size says little about its token cost
+	mediaPartTokens = 258
+	// messageOverheadTokens covers the role and turn markers of a message
+	messageOverheadTokens = 4
+)
+
+// EstimateTokens returns a rough token estimate for raw messages: text is
+// counted by length and every media part at a fixed cost
+func EstimateTokens(messages []json.RawMessage) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateMessageTokens(m)
+	}
+	return total
+}
+
+func estimateMessageTokens(m json.RawMessage) int {
+	var msg struct {
+		Content   any             `json:"content"`
+		ToolCalls json.RawMessage `json:"tool_calls"`
+	}
+	if err := json.Unmarshal(m, &msg); err != nil {
+		return len(m)/charsPerToken + 1
+	}
+
+	chars := len(msg.ToolCalls)
+	media := 0
+	switch content := msg.Content.(type) {
+	case string:
+		chars += utf8.RuneCountInString(content)
+	case []any:
+		for _, item := range content {
+			part, _ := item.(map[string]any)
+			switch part["type"] {
+			case "text":
+				text, _ := part["text"].(string)
+				chars += utf8.RuneCountInString(text)
+			case nil:
+			default:
+				media++
+			}
+		}
+	}
+	return messageOverheadTokens + chars/charsPerToken + media*mediaPartTokens
+}
+
+// TrimMessages removes the oldest non-system messages until the estimate fits
+// within limit tokens. It returns the messages and how many were removed;
+// if the kept messages alone exceed limit, it trims as far as it can.
+func TrimMessages(messages []json.RawMessage, limit int, strategy string) ([]json.RawMessage, int) {
+	total := EstimateTokens(messages)
+	if limit <= 0 || total <= limit {
+		return messages, 0
+	}
+
+	roles := make([]string, len(messages))
+	for i, m := range messages {
+		var msg struct {
+			Role string `json:"role"`
+		}
+		json.Unmarshal(m, &msg)
+		roles[i] = msg.Role
+	}
+
+	placeholderTokens := 0
+	if strategy == TrimPlaceholder {
+		placeholderTokens = estimateMessageTokens(trimPlaceholder(len(messages)))
+	}
+
+	removed := make([]bool, len(messages))
+	count := 0
+	last := len(messages) - 1
+	for i := 0; i < last && total+placeholderTokens > limit; {
+		if isSystemRole(roles[i]) {
+			i++
+			continue
+		}
+		// The turn runs up to the next user message
+		end := i + 1
+		for end <= last && roles[end] != "user" {
+			end++
+		}
+		if end > last {
+			break
+		}
+		for ; i < end; i++ {
+			if !isSystemRole(roles[i]) {
+				removed[i] = true
+				count++
+				total -= estimateMessageTokens(messages[i])
+			}
+		}
+	}
+	if count == 0 {
+		return messages, 0
+	}
+
+	result := make([]json.RawMessage, 0, len(messages)-count+1)
+	inserted := false
+	for i, m := range messages {
+		if removed[i] {
+			if strategy == TrimPlaceholder && !inserted {
+				result = append(result, trimPlaceholder(count))
+				inserted = true
+			}
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, count
+}
+
+// isSystemRole reports whether a message role is never trimmed
+func isSystemRole(role string) bool {
+	return role == "system" || role == "developer"
+}
+
+// trimPlaceholder is the note standing in for removed messages
+func trimPlaceholder(count int) json.RawMessage {
+	note, _ := json.Marshal(map[string]string{
+		"role":    "user",
+		"content": fmt.Sprintf("[%d earlier messages were removed to fit the context window]", count),
+	})
+	return note
+}
@@ -0,0 +1,106 @@
+package translate
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// rawMessages builds messages from "role:content" strings
+func rawMessages(t *testing.T, specs ...string) []json.RawMessage {
+	t.Helper()
+	messages := make([]json.RawMessage, len(specs))
+	for i, spec := range specs {
+		role, content, _ := strings.Cut(spec, ":")
+		raw, err := json.Marshal(map[string]string{"role": role, "content": content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[i] = raw
+	}
+	return messages
+}
+
+// messageRoles returns the role of each raw message
+func messageRoles(messages []json.RawMessage) []string {
+	roles := make([]string, len(messages))
+	for i, m := range messages {
+		var msg struct {
+			Role string `json:"role"`
+		}
+		json.Unmarshal(m, &msg)
+		roles[i] = msg.Role
+	}
+	return roles
+}
+
+func TestEstimateTokensCountsImagesAtFixedCost(t *testing.T) {
+	image := `{"role":"user","content":[{"type":"text","text":"describe this"},` +
+		`{"type":"image_url","image_url":{"url":"data:image/png;base64,` + strings.Repeat("A", 400000) + `"}}]}`
+	got := EstimateTokens([]json.RawMessage{json.RawMessage(image)})
+	want := messageOverheadTokens + len("describe this")/charsPerToken + mediaPartTokens
+	if got != want {
+		t.Errorf("EstimateTokens = %d, want %d", got, want)
+	}
+}
+
+func TestTrimMessagesDropsWholeTurns(t *testing.T) {
+	long := strings.Repeat("x", 400) // about 100 tokens
+
+	tests := []struct {
+		name        string
+		messages    []string
+		limit       int
+		wantRoles   []string
+		wantRemoved int
+	}{
+		{
+			name:        "fits",
+			messages:    []string{"system:s", "user:hi", "assistant:hello"},
+			limit:       1000,
+			wantRoles:   []string{"system", "user", "assistant"},
+			wantRemoved: 0,
+		},
+		{
+			name:        "drops the oldest pair",
+			messages:    []string{"system:s", "user:" + long, "assistant:" + long, "user:" + long, "assistant:" + long, "user:q"},
+			limit:       250,
+			wantRoles:   []string{"system", "user", "assistant", "user"},
+			wantRemoved: 2,
+		},
+		{
+			name:        "never leaves an assistant first",
+			messages:    []string{"user:a", "assistant:" + long, "assistant:" + long, "user:q"},
+			limit:       50,
+			wantRoles:   []string{"user"},
+			wantRemoved: 3,
+		},
+		{
+			name:        "tool results go with their turn",
+			messages:    []string{"user:" + long, "assistant:call", "tool:" + long, "user:" + long, "assistant:ok", "user:q"},
+			limit:       150,
+			wantRoles:   []string{"user", "assistant", "user"},
+			wantRemoved: 3,
+		},
+		{
+			name:        "keeps the turn with the latest message",
+			messages:    []string{"system:s", "user:" + long, "assistant:" + long},
+			limit:       10,
+			wantRoles:   []string{"system", "user", "assistant"},
+			wantRemoved: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trimmed, removed := TrimMessages(rawMessages(t, tt.messages...), tt.limit, TrimDropOldest)
+			if removed != tt.wantRemoved {
+				t.Errorf("removed = %d, want %d", removed, tt.wantRemoved)
+			}
+			if roles := messageRoles(trimmed); !slices.Equal(roles, tt.wantRoles) {
+				t.Errorf("roles = %v, want %v", roles, tt.wantRoles)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package translate
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// Estimated usage (ESTIMATE_USAGE).
+//
+// Some Vertex responses carry no usageMetadata. Clients that require usage
+// then get an approximation from the prompt and completion sizes, flagged
+// with "estimated": true so it is never mistaken for billed token counts.
+
+// EstimateTextTokens returns a rough token estimate for text
+func EstimateTextTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	return utf8.RuneCountInString(text)/charsPerToken + 1
+}
+
+// EstimateUsage returns an approximate usage marked as estimated
+func EstimateUsage(promptTokens, completionTokens int) *Usage {
+	return &Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+		Estimated:        true,
+	}
+}
+
+// EstimatePromptTokens returns a rough token estimate for request messages,
+// counted as EstimateTokens counts raw ones
+func EstimatePromptTokens(messages []Message) int {
+	raw := make([]json.RawMessage, 0, len(messages))
+	for _, m := range messages {
+		if data, err := json.Marshal(m); err == nil {
+			raw = append(raw, data)
+		}
+	}
+	return EstimateTokens(raw)
+}
+
+// FillEstimatedUsage sets an estimated usage on resp when upstream returned
+// none, for a prompt of promptTokens
+func FillEstimatedUsage(resp *ChatCompletionResponse, promptTokens int) {
+	if resp.Usage != nil {
+		return
+	}
+	completion := 0
+	for _, choice := range resp.Choices {
+		if choice.Message != nil {
+			completion += EstimateTextTokens(choice.Message.Content) + EstimateTextTokens(choice.Message.ReasoningContent)
+			if choice.Message.Reasoning != nil {
+				completion += EstimateTextTokens(choice.Message.Reasoning.Content)
+			}
+		}
+	}
+	resp.Usage = EstimateUsage(promptTokens, completion)
+}
+
+// RunningUsage accumulates a live completion estimate over a stream
+// (STREAM_USAGE_ESTIMATE, debug only). It only ever grows, so clients can
+// display it as a running cost; the final usage from upstream is authoritative.
+type RunningUsage struct {
+	prompt int
+	runes  int
+}
+
+// NewRunningUsage starts a running estimate for a prompt of promptTokens
+func NewRunningUsage(promptTokens int) *RunningUsage {
+	return &RunningUsage{prompt: promptTokens}
+}
+
+// Add counts generated content or reasoning text
+func (u *RunningUsage) Add(text string) {
+	u.runes += utf8.RuneCountInString(text)
+}
+
+// Usage returns the estimate so far, marked as estimated
+func (u *RunningUsage) Usage() *Usage {
+	completion := 0
+	if u.runes > 0 {
+		completion = u.runes/charsPerToken + 1
+	}
+	return EstimateUsage(u.prompt, completion)
+}
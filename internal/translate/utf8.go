@@ -0,0 +1,21 @@
+package translate
+
+import "unicode/utf8"
+
+// SplitIncompleteUTF8 splits s into the longest prefix ending on a rune
+// boundary and a trailing incomplete UTF-8 sequence (at most 3 bytes) that
+// should be held back until the next chunk completes it
+func SplitIncompleteUTF8(s string) (complete, tail string) {
+	// Walk back over continuation bytes to the start of the last rune
+	start := len(s)
+	for i := 1; i <= utf8.UTFMax && i <= len(s); i++ {
+		if utf8.RuneStart(s[len(s)-i]) {
+			start = len(s) - i
+			break
+		}
+	}
+	if start == len(s) || utf8.FullRuneInString(s[start:]) {
+		return s, ""
+	}
+	return s[:start], s[start:]
+}
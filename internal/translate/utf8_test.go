@@ -0,0 +1,42 @@
+package translate
+
+import "testing"
+
+func TestSplitIncompleteUTF8(t *testing.T) {
+	emoji := "😀" // 4 bytes
+	tests := []struct {
+		name     string
+		in       string
+		complete string
+		tail     string
+	}{
+		{"ascii", "hello", "hello", ""},
+		{"complete emoji", "hi " + emoji, "hi " + emoji, ""},
+		{"one byte of four", "hi " + emoji[:1], "hi ", emoji[:1]},
+		{"three bytes of four", "hi " + emoji[:3], "hi ", emoji[:3]},
+		{"two-byte rune cut", "caf" + "é"[:1], "caf", "é"[:1]},
+		{"only a partial rune", emoji[:2], "", emoji[:2]},
+		{"empty", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			complete, tail := SplitIncompleteUTF8(tt.in)
+			if complete != tt.complete || tail != tt.tail {
+				t.Errorf("SplitIncompleteUTF8(%q) = %q, %q; want %q, %q", tt.in, complete, tail, tt.complete, tt.tail)
+			}
+		})
+	}
+}
+
+func TestStreamStateSplitRune(t *testing.T) {
+	emoji := "😀"
+	state := NewStreamState()
+	first, _ := state.processText("hi " + emoji[:2])
+	second, _ := state.processText(emoji[2:] + "!")
+	if first != "hi " {
+		t.Errorf("first chunk content = %q, want the partial rune held back", first)
+	}
+	if second != emoji+"!" {
+		t.Errorf("second chunk content = %q, want %q", second, emoji+"!")
+	}
+}
@@ -9,20 +9,62 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
 	"vertex2api-golang/internal/keys"
+	"vertex2api-golang/internal/models"
 )
 
 // GeminiRequest represents a Gemini API request
 type GeminiRequest struct {
-	Contents          []Content          `json:"contents,omitempty"`
-	SystemInstruction *Content           `json:"systemInstruction,omitempty"`
-	GenerationConfig  *GenerationConfig  `json:"generationConfig,omitempty"`
-	Tools             []Tool             `json:"tools,omitempty"`
-	ToolConfig        *ToolConfig        `json:"toolConfig,omitempty"`
-	SafetySettings    []SafetySetting    `json:"safetySettings,omitempty"`
+	Contents          []Content         `json:"contents,omitempty"`
+	SystemInstruction *Content          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+	Tools             []Tool            `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig       `json:"toolConfig,omitempty"`
+	SafetySettings    []SafetySetting   `json:"safetySettings,omitempty"`
+	CachedContent     string            `json:"cachedContent,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+// labelKeyPattern and labelValuePattern follow GCP label rules: lowercase
+// letters, digits, underscores and dashes, keys starting with a letter
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// maxLabels is the GCP limit on labels per resource
+const maxLabels = 64
+
+// ValidateLabels checks label keys and values against GCP label rules
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("too many labels: %d (max %d)", len(labels), maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q: must start with a lowercase letter and contain only lowercase letters, digits, '_' or '-' (max 63 chars)", k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("invalid label value %q for key %q: only lowercase letters, digits, '_' or '-' allowed (max 63 chars)", v, k)
+		}
+	}
+	return nil
+}
+
+// cachedContentPattern matches "cachedContents/{id}" or the fully qualified
+// "projects/{project}/locations/{location}/cachedContents/{id}" resource name
+var cachedContentPattern = regexp.MustCompile(`^(projects/[^/]+/locations/[^/]+/)?cachedContents/[A-Za-z0-9_-]+$`)
+
+// ValidateCachedContentName checks that name is a well-formed cachedContents resource name
+func ValidateCachedContentName(name string) error {
+	if !cachedContentPattern.MatchString(name) {
+		return fmt.Errorf("invalid cached content name %q, expected cachedContents/{id} or projects/{project}/locations/{location}/cachedContents/{id}", name)
+	}
+	return nil
 }
 
 // Content represents message content
@@ -59,24 +101,44 @@ type FunctionResponse struct {
 
 // GenerationConfig contains generation parameters
 type GenerationConfig struct {
-	Temperature      *float64 `json:"temperature,omitempty"`
-	TopP             *float64 `json:"topP,omitempty"`
-	TopK             *int     `json:"topK,omitempty"`
-	MaxOutputTokens  *int     `json:"maxOutputTokens,omitempty"`
-	StopSequences    []string `json:"stopSequences,omitempty"`
-	CandidateCount   *int     `json:"candidateCount,omitempty"`
-	ResponseMimeType string   `json:"responseMimeType,omitempty"`
-	ThinkingConfig   *ThinkingConfig `json:"thinkingConfig,omitempty"`
+	Temperature        *float64        `json:"temperature,omitempty"`
+	TopP               *float64        `json:"topP,omitempty"`
+	TopK               *int            `json:"topK,omitempty"`
+	MaxOutputTokens    *int            `json:"maxOutputTokens,omitempty"`
+	StopSequences      []string        `json:"stopSequences,omitempty"`
+	CandidateCount     *int            `json:"candidateCount,omitempty"`
+	ResponseMimeType   string          `json:"responseMimeType,omitempty"`
+	ResponseLogprobs   bool            `json:"responseLogprobs,omitempty"`
+	ResponseModalities []string        `json:"responseModalities,omitempty"`
+	Logprobs           *int            `json:"logprobs,omitempty"`
+	ThinkingConfig     *ThinkingConfig `json:"thinkingConfig,omitempty"`
 }
 
-// ThinkingConfig for Gemini 3 thinking models
+// ThinkingConfig for Gemini 3 thinking models. ThinkingBudget is a pointer
+// so a budget of 0 (thinking off) is sent rather than omitted.
 type ThinkingConfig struct {
-	ThinkingBudget int `json:"thinkingBudget,omitempty"`
+	ThinkingBudget *int `json:"thinkingBudget,omitempty"`
 }
 
-// Tool represents a function tool
+// Tool represents a function or retrieval tool
 type Tool struct {
 	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+	Retrieval            *Retrieval            `json:"retrieval,omitempty"`
+}
+
+// Retrieval grounds generation in documents from a RAG Engine corpus
+type Retrieval struct {
+	VertexRAGStore *VertexRAGStore `json:"vertexRagStore,omitempty"`
+}
+
+// VertexRAGStore lists the RAG corpora to retrieve from
+type VertexRAGStore struct {
+	RAGResources []RAGResource `json:"ragResources"`
+}
+
+// RAGResource names one corpus, as projects/{p}/locations/{l}/ragCorpora/{id}
+type RAGResource struct {
+	RAGCorpus string `json:"ragCorpus"`
 }
 
 // FunctionDeclaration declares a function
@@ -113,10 +175,61 @@ type GeminiResponse struct {
 
 // Candidate represents a response candidate
 type Candidate struct {
-	Content       *Content        `json:"content,omitempty"`
-	FinishReason  string          `json:"finishReason,omitempty"`
-	Index         int             `json:"index"`
-	SafetyRatings []SafetyRating  `json:"safetyRatings,omitempty"`
+	Content           *Content           `json:"content,omitempty"`
+	FinishReason      string             `json:"finishReason,omitempty"`
+	Index             int                `json:"index"`
+	SafetyRatings     []SafetyRating     `json:"safetyRatings,omitempty"`
+	LogprobsResult    *LogprobsResult    `json:"logprobsResult,omitempty"`
+	GroundingMetadata *GroundingMetadata `json:"groundingMetadata,omitempty"`
+}
+
+// GroundingMetadata lists the sources a grounded answer is based on and
+// which text segments each source supports
+type GroundingMetadata struct {
+	GroundingChunks   []GroundingChunk   `json:"groundingChunks,omitempty"`
+	GroundingSupports []GroundingSupport `json:"groundingSupports,omitempty"`
+	WebSearchQueries  []string           `json:"webSearchQueries,omitempty"`
+}
+
+// GroundingChunk is one source; only web sources are mapped
+type GroundingChunk struct {
+	Web *GroundingWeb `json:"web,omitempty"`
+}
+
+// GroundingWeb is a web search result
+type GroundingWeb struct {
+	URI   string `json:"uri"`
+	Title string `json:"title,omitempty"`
+}
+
+// GroundingSupport ties a text segment to the chunks that support it
+type GroundingSupport struct {
+	Segment               GroundingSegment `json:"segment"`
+	GroundingChunkIndices []int            `json:"groundingChunkIndices,omitempty"`
+}
+
+// GroundingSegment is a byte range in the candidate text
+type GroundingSegment struct {
+	StartIndex int    `json:"startIndex"`
+	EndIndex   int    `json:"endIndex"`
+	Text       string `json:"text,omitempty"`
+}
+
+// LogprobsResult contains per-token log probabilities
+type LogprobsResult struct {
+	TopCandidates    []TopCandidates    `json:"topCandidates,omitempty"`
+	ChosenCandidates []LogprobCandidate `json:"chosenCandidates,omitempty"`
+}
+
+// TopCandidates lists the most likely tokens at one decoding step
+type TopCandidates struct {
+	Candidates []LogprobCandidate `json:"candidates,omitempty"`
+}
+
+// LogprobCandidate is a token with its log probability
+type LogprobCandidate struct {
+	Token          string  `json:"token"`
+	LogProbability float64 `json:"logProbability"`
 }
 
 // SafetyRating represents safety rating
@@ -124,6 +237,7 @@ type SafetyRating struct {
 	Category    string  `json:"category"`
 	Probability string  `json:"probability"`
 	Score       float64 `json:"score,omitempty"`
+	Blocked     bool    `json:"blocked,omitempty"`
 }
 
 // UsageMetadata contains token usage
@@ -161,22 +275,44 @@ func (c *Client) buildURL(auth *keys.AuthInfo, model string, stream bool) string
 	if stream {
 		action = "streamGenerateContent"
 	}
+	return modelURL(auth, model, action)
+}
 
-	// URL format: https://{location}-aiplatform.googleapis.com/v1beta1/projects/{project}/locations/{location}/publishers/google/models/{model}:{action}
+// modelURL constructs the URL of a model action, in the model's location
+// (MODEL_LOCATIONS, else the key's) and API version
+func modelURL(auth *keys.AuthInfo, model, action string) string {
+	// URL format: https://aiplatform.googleapis.com/{version}/projects/{project}/locations/{location}/publishers/google/models/{model}:{action}
 	return fmt.Sprintf(
-		"https://%s-aiplatform.googleapis.com/v1beta1/projects/%s/locations/%s/publishers/google/models/%s:%s?key=%s",
-		auth.Location,
+		"https://aiplatform.googleapis.com/%s/projects/%s/locations/%s/publishers/google/models/%s:%s?key=%s",
+		models.ResolveAPIVersion(model),
 		auth.ProjectID,
-		auth.Location,
+		models.ResolveLocation(model, auth.Location),
 		model,
 		action,
 		auth.APIKey,
 	)
 }
 
+// APIError is a non-200 answer from Vertex. Key health checks read its
+// status through keys.StatusError.
+type APIError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.Status, string(e.Body))
+}
+
+// StatusCode returns the upstream status, for keys.StatusError
+func (e *APIError) StatusCode() int {
+	return e.Status
+}
+
 // GenerateContent calls the non-streaming API
 func (c *Client) GenerateContent(ctx context.Context, model string, req *GeminiRequest) (*GeminiResponse, error) {
 	retryConfig := keys.GetRetryConfig()
+	retryStart := time.Now()
 	var lastErr error
 	var keyIndex int = -1
 
@@ -200,18 +336,27 @@ func (c *Client) GenerateContent(ctx context.Context, model string, req *GeminiR
 
 		if err == nil {
 			log.Printf("GenerateContent success: model=%s, key_index=%d, latency=%v", model, auth.KeyIndex, latency)
+			if resp.UsageMetadata != nil {
+				c.keyManager.RecordTokens(auth.KeyIndex, resp.UsageMetadata.TotalTokenCount)
+			}
 			return resp, nil
 		}
 
 		lastErr = err
 		log.Printf("GenerateContent attempt %d failed: model=%s, key_index=%d, error=%v", attempt+1, model, auth.KeyIndex, err)
 
+		c.keyManager.Penalize(auth.KeyIndex, err)
+
 		// Switch to next key for retry
 		if retryConfig.SwitchKey && c.keyManager.KeyCount() > 1 {
 			keyIndex = c.keyManager.NextKeyIndex(auth.KeyIndex)
 		}
 
 		if attempt < retryConfig.MaxRetries {
+			if retryConfig.BudgetExhausted(ctx, retryStart) {
+				log.Printf("Retry budget exhausted after %d attempts: model=%s", attempt+1, model)
+				break
+			}
 			time.Sleep(time.Duration(retryConfig.IntervalMS) * time.Millisecond)
 		}
 	}
@@ -222,9 +367,23 @@ func (c *Client) GenerateContent(ctx context.Context, model string, req *GeminiR
 // StreamGenerateContent calls the streaming API
 func (c *Client) StreamGenerateContent(ctx context.Context, model string, req *GeminiRequest, handler StreamHandler) error {
 	retryConfig := keys.GetRetryConfig()
+	retryStart := time.Now()
 	var lastErr error
 	var keyIndex int = -1
 
+	// Once a chunk has been handled the caller has sent output, and a retry
+	// would repeat it. Usage is cumulative, so the latest count is the
+	// attempt's total.
+	delivered := false
+	tokens := 0
+	track := func(chunk *GeminiResponse) error {
+		delivered = true
+		if chunk.UsageMetadata != nil {
+			tokens = chunk.UsageMetadata.TotalTokenCount
+		}
+		return handler(chunk)
+	}
+
 	for attempt := 0; attempt <= retryConfig.MaxRetries; attempt++ {
 		var auth *keys.AuthInfo
 		var err error
@@ -240,8 +399,10 @@ func (c *Client) StreamGenerateContent(ctx context.Context, model string, req *G
 		}
 
 		startTime := time.Now()
-		err = c.doStreamRequest(ctx, auth, model, req, handler)
+		tokens = 0
+		err = c.doStreamRequest(ctx, auth, model, req, track)
 		latency := time.Since(startTime)
+		c.keyManager.RecordTokens(auth.KeyIndex, tokens)
 
 		if err == nil {
 			log.Printf("StreamGenerateContent success: model=%s, key_index=%d, latency=%v", model, auth.KeyIndex, latency)
@@ -251,12 +412,21 @@ func (c *Client) StreamGenerateContent(ctx context.Context, model string, req *G
 		lastErr = err
 		log.Printf("StreamGenerateContent attempt %d failed: model=%s, key_index=%d, error=%v", attempt+1, model, auth.KeyIndex, err)
 
+		c.keyManager.Penalize(auth.KeyIndex, err)
+		if delivered {
+			return fmt.Errorf("stream failed after output: %w", err)
+		}
+
 		// Switch to next key for retry
 		if retryConfig.SwitchKey && c.keyManager.KeyCount() > 1 {
 			keyIndex = c.keyManager.NextKeyIndex(auth.KeyIndex)
 		}
 
 		if attempt < retryConfig.MaxRetries {
+			if retryConfig.BudgetExhausted(ctx, retryStart) {
+				log.Printf("Retry budget exhausted after %d attempts: model=%s", attempt+1, model)
+				break
+			}
 			time.Sleep(time.Duration(retryConfig.IntervalMS) * time.Millisecond)
 		}
 	}
@@ -291,7 +461,7 @@ func (c *Client) doRequest(ctx context.Context, auth *keys.AuthInfo, model strin
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(respBody))
+		return nil, &APIError{Status: resp.StatusCode, Body: respBody}
 	}
 
 	var geminiResp GeminiResponse
@@ -330,7 +500,7 @@ func (c *Client) doStreamRequest(ctx context.Context, auth *keys.AuthInfo, model
 	if resp.StatusCode != http.StatusOK {
 		// Read error response body for logging; ignore read errors on error path
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(respBody))
+		return &APIError{Status: resp.StatusCode, Body: respBody}
 	}
 
 	// Parse SSE stream
@@ -374,15 +544,7 @@ func (c *Client) ForwardRaw(ctx context.Context, model, action string, reqBody [
 		return nil, fmt.Errorf("failed to get auth: %w", err)
 	}
 
-	url := fmt.Sprintf(
-		"https://%s-aiplatform.googleapis.com/v1beta1/projects/%s/locations/%s/publishers/google/models/%s:%s?key=%s",
-		auth.Location,
-		auth.ProjectID,
-		auth.Location,
-		model,
-		action,
-		auth.APIKey,
-	)
+	url := modelURL(auth, model, action)
 
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
 	if err != nil {
@@ -0,0 +1,71 @@
+package vertex
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+	"vertex2api-golang/internal/keys"
+)
+
+func TestModelURL(t *testing.T) {
+	prev := config.Get()
+	next := *prev
+	next.ModelLocations = map[string]string{"gemini-2.5-flash": "europe-west4"}
+	next.ModelAPIVersions = map[string]string{}
+	next.VertexAPIVersion = "v1"
+	config.Override(&next)
+	t.Cleanup(func() { config.Override(prev) })
+
+	auth := &keys.AuthInfo{ProjectID: "p", APIKey: "k", Location: "us-central1"}
+	tests := []struct {
+		model, action, want string
+	}{
+		{
+			"gemini-2.0-flash", "generateContent",
+			"https://aiplatform.googleapis.com/v1/projects/p/locations/us-central1/publishers/google/models/gemini-2.0-flash:generateContent?key=k",
+		},
+		{
+			"gemini-2.5-pro", "generateContent",
+			"https://aiplatform.googleapis.com/v1/projects/p/locations/global/publishers/google/models/gemini-2.5-pro:generateContent?key=k",
+		},
+		{
+			"gemini-2.5-flash", "streamGenerateContent",
+			"https://aiplatform.googleapis.com/v1/projects/p/locations/europe-west4/publishers/google/models/gemini-2.5-flash:streamGenerateContent?key=k",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := modelURL(auth, tt.model, tt.action); got != tt.want {
+			t.Errorf("modelURL(%s, %s) = %s, want %s", tt.model, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := range maxLabels + 1 {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{"valid", map[string]string{"team": "search", "env": "prod-1", "cost_center": ""}, false},
+		{"uppercase key", map[string]string{"Team": "search"}, true},
+		{"key starting with a digit", map[string]string{"1team": "search"}, true},
+		{"uppercase value", map[string]string{"team": "Search"}, true},
+		{"value with a dot", map[string]string{"team": "a.b"}, true},
+		{"key too long", map[string]string{"k" + strings.Repeat("a", 63): "v"}, true},
+		{"too many labels", tooMany, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateLabels(tt.labels); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLabels = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package vertex
+
+import (
+	"sort"
+	"strings"
+
+	"vertex2api-golang/internal/config"
+)
+
+// Per-family safety settings.
+//
+// Gemini families differ in the harm categories they accept and the
+// thresholds that make sense, so the settings sent upstream are chosen by
+// model. Every model gets the four core categories with filtering disabled;
+// families that know the civic integrity category (gemini-2.0 onwards) get
+// it as well, since gemini-1.x rejects requests naming it. SAFETY_SETTINGS
+// overrides the built-in defaults with comma-separated
+// "family:CATEGORY=THRESHOLD" entries, where family is a model prefix ("*"
+// for every model; the longest matching prefix wins per category) and the
+// threshold OMIT leaves the category out:
+//
+//	SAFETY_SETTINGS=*:HARM_CATEGORY_HARASSMENT=BLOCK_ONLY_HIGH,gemini-2.0:HARM_CATEGORY_CIVIC_INTEGRITY=OMIT
+
+// omitThreshold removes a category from a family's settings
+const omitThreshold = "OMIT"
+
+// defaultSafetyThresholds disable content filtering for every model
+var defaultSafetyThresholds = map[string]string{
+	"HARM_CATEGORY_HARASSMENT":        "BLOCK_NONE",
+	"HARM_CATEGORY_HATE_SPEECH":       "BLOCK_NONE",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT": "BLOCK_NONE",
+	"HARM_CATEGORY_DANGEROUS_CONTENT": "BLOCK_NONE",
+}
+
+// familySafetyThresholds extend the defaults for model families, by prefix
+var familySafetyThresholds = map[string]map[string]string{
+	"gemini-2": {"HARM_CATEGORY_CIVIC_INTEGRITY": "BLOCK_NONE"},
+	"gemini-3": {"HARM_CATEGORY_CIVIC_INTEGRITY": "BLOCK_NONE"},
+}
+
+// SafetySettingsFor returns the safety settings to send for a model
+func SafetySettingsFor(model string) []SafetySetting {
+	thresholds := make(map[string]string, len(defaultSafetyThresholds))
+	for category, threshold := range defaultSafetyThresholds {
+		thresholds[category] = threshold
+	}
+
+	for family, defaults := range familySafetyThresholds {
+		if strings.HasPrefix(model, family) {
+			for category, threshold := range defaults {
+				thresholds[category] = threshold
+			}
+		}
+	}
+
+	// Apply overrides from the least to the most specific family
+	type override struct{ family, category, threshold string }
+	var overrides []override
+	for key, threshold := range config.Get().SafetySettings {
+		family, category, ok := strings.Cut(key, ":")
+		if !ok || category == "" {
+			continue
+		}
+		if family == "*" {
+			family = ""
+		}
+		if strings.HasPrefix(model, family) {
+			overrides = append(overrides, override{family, category, strings.ToUpper(threshold)})
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool { return len(overrides[i].family) < len(overrides[j].family) })
+	for _, o := range overrides {
+		thresholds[o.category] = o.threshold
+	}
+
+	categories := make([]string, 0, len(thresholds))
+	for category, threshold := range thresholds {
+		if threshold != omitThreshold {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+
+	settings := make([]SafetySetting, 0, len(categories))
+	for _, category := range categories {
+		settings = append(settings, SafetySetting{Category: category, Threshold: thresholds[category]})
+	}
+	return settings
+}
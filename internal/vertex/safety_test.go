@@ -0,0 +1,72 @@
+package vertex
+
+import (
+	"slices"
+	"testing"
+
+	"vertex2api-golang/internal/config"
+)
+
+func TestSafetySettingsFor(t *testing.T) {
+	core := []string{
+		"HARM_CATEGORY_DANGEROUS_CONTENT",
+		"HARM_CATEGORY_HARASSMENT",
+		"HARM_CATEGORY_HATE_SPEECH",
+		"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	}
+	withCivic := append([]string{"HARM_CATEGORY_CIVIC_INTEGRITY"}, core...)
+
+	tests := []struct {
+		name      string
+		model     string
+		overrides map[string]string
+		want      []string
+		threshold map[string]string
+	}{
+		{name: "gemini-1.5 lacks civic integrity", model: "gemini-1.5-pro", want: core},
+		{name: "gemini-2.0 has civic integrity", model: "gemini-2.0-flash", want: withCivic},
+		{name: "gemini-3 has civic integrity", model: "gemini-3-pro-preview", want: withCivic},
+		{
+			name:      "override omits a family default",
+			model:     "gemini-2.5-flash",
+			overrides: map[string]string{"gemini-2.5:HARM_CATEGORY_CIVIC_INTEGRITY": "omit"},
+			want:      core,
+		},
+		{
+			name:  "most specific override wins",
+			model: "gemini-2.5-flash",
+			overrides: map[string]string{
+				"*:HARM_CATEGORY_HARASSMENT":          "BLOCK_ONLY_HIGH",
+				"gemini-2.5:HARM_CATEGORY_HARASSMENT": "block_low_and_above",
+			},
+			want:      withCivic,
+			threshold: map[string]string{"HARM_CATEGORY_HARASSMENT": "BLOCK_LOW_AND_ABOVE"},
+		},
+	}
+
+	prev := config.Get()
+	t.Cleanup(func() { config.Override(prev) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := *prev
+			next.SafetySettings = tt.overrides
+			config.Override(&next)
+
+			settings := SafetySettingsFor(tt.model)
+			var categories []string
+			for _, s := range settings {
+				categories = append(categories, s.Category)
+				want, ok := tt.threshold[s.Category]
+				if !ok {
+					want = "BLOCK_NONE"
+				}
+				if s.Threshold != want {
+					t.Errorf("%s threshold = %s, want %s", s.Category, s.Threshold, want)
+				}
+			}
+			if !slices.Equal(categories, tt.want) {
+				t.Errorf("categories = %v, want %v", categories, tt.want)
+			}
+		})
+	}
+}